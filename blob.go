@@ -17,7 +17,8 @@ limitations under the License.
 package ell
 
 import (
-	"fmt"
+	"bytes"
+	"strconv"
 
 	. "github.com/boynton/ell/data"
 )
@@ -32,17 +33,28 @@ func (b *Blob) Type() Value {
 	return BlobType
 }
 
+// String - the blob in the syntax the reader accepts for it, i.e. #u8(1 2 3)
 func (b *Blob) String() string {
-	//notation.go can handle it as an instance: #<blob>"base64 string value"
-	//but here, we would return a nonreadable thing
-	return fmt.Sprintf("#[Blob %d bytes]", len(b.Value))
+	buf := []byte("#u8(")
+	for i, n := range b.Value {
+		if i > 0 {
+			buf = append(buf, ' ')
+		}
+		buf = strconv.AppendInt(buf, int64(n), 10)
+	}
+	return string(append(buf, ')'))
 }
+
 func (b *Blob) Equals(another Value) bool {
-	return false //FIXME
+	if b2, ok := another.(*Blob); ok {
+		return bytes.Equal(b.Value, b2.Value)
+	}
+	return false
 }
 
 // Blob - create a new blob, using the specified byte slice as the data. The data is not copied.
 func NewBlob(bytes []byte) *Blob {
+	blobAllocs.Add(len(bytes))
 	return &Blob{Value: bytes}
 }
 
@@ -70,7 +82,10 @@ func ToBlob(obj Value) (*Blob, error) {
 }
 
 func vectorToBlob(vec *Vector) (*Blob, error) {
-	el := vec.Elements
+	return valuesToBlob(vec.Elements)
+}
+
+func valuesToBlob(el []Value) (*Blob, error) {
 	n := len(el)
 	b := make([]byte, n, n)
 	for i := 0; i < n; i++ {
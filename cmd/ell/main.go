@@ -17,6 +17,7 @@ package main
 
 import (
 	"github.com/boynton/ell"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {
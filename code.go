@@ -19,6 +19,7 @@ package ell
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -43,6 +44,29 @@ const (
 	opcodeVector
 	opcodeStruct
 	opcodeUndefGlobal
+	opcodeCatch
+	opcodeUncatch
+	opcodeSetGlobal
+	opcodeDup
+	opcodeCallGlobal
+	opcodeTailCallGlobal
+	opcodeCallLiteral
+	opcodeTailCallLiteral
+	opcodeCar //the primops, which must come last: see primops.go
+	opcodeCdr
+	opcodeNullP
+	opcodeNot
+	opcodeIdenticalP
+	opcodeCons
+	opcodeAdd
+	opcodeSub
+	opcodeMul
+	opcodeInc
+	opcodeDec
+	opcodeNumLess
+	opcodeVectorRef
+	opcodeVectorSetBang
+	opcodeGet
 	opcodeCount
 )
 
@@ -63,8 +87,21 @@ var DefmacroSymbol = Intern("defmacro")
 var VectorSymbol = Intern("vector")
 var StructSymbol = Intern("struct")
 var UndefineSymbol = Intern("undefine")
+var CatchSymbol = Intern("catch")
+var UncatchSymbol = Intern("uncatch")
+var SetglobalSymbol = Intern("setglobal")
+var DupSymbol = Intern("dup")
+var CallglobalSymbol = Intern("callglobal")
+var TailcallglobalSymbol = Intern("tailcallglobal")
+var CallliteralSymbol = Intern("callliteral")
+var TailcallliteralSymbol = Intern("tailcallliteral")
 var FuncSymbol = Intern("func")
 
+// SourceSymbol and LocationSymbol - the pseudo-instructions that record where code came from, in code written
+// to be loaded again: the file:line of the code, and the file, line, and column of the instruction before
+var SourceSymbol = Intern("source")
+var LocationSymbol = Intern("location")
+
 var opsyms = initOpsyms()
 
 func initOpsyms() []Value {
@@ -86,6 +123,17 @@ func initOpsyms() []Value {
 	syms[opcodeVector] = VectorSymbol
 	syms[opcodeStruct] = StructSymbol
 	syms[opcodeUndefGlobal] = UndefineSymbol
+	syms[opcodeCatch] = CatchSymbol
+	syms[opcodeUncatch] = UncatchSymbol
+	syms[opcodeSetGlobal] = SetglobalSymbol
+	syms[opcodeDup] = DupSymbol
+	syms[opcodeCallGlobal] = CallglobalSymbol
+	syms[opcodeTailCallGlobal] = TailcallglobalSymbol
+	syms[opcodeCallLiteral] = CallliteralSymbol
+	syms[opcodeTailCallLiteral] = TailcallliteralSymbol
+	for op := opcodeCar; op < opcodeCount; op++ {
+		syms[op] = Intern(primops[op-opcodeCar].name)
+	}
 	return syms
 }
 
@@ -93,25 +141,80 @@ var CodeType Value = Intern("<code>")
 
 // Code - compiled Ell bytecode
 type Code struct {
-	name     string
-	ops      []int
-	argc     int
-	defaults []Value
-	keys     []Value
+	name      string
+	ops       []int
+	argc      int
+	locals    int //the size of its frame: the arguments, then the variables of any lets inlined into the code
+	defaults  []Value
+	keys      []Value
+	keyIndex  map[Value]int //the position of each key among the keyword arguments
+	constants []Value       //the literals, symbols, and function code referred to by the ops
+	source    string        //the file:line the code was loaded from, if known
+	locations []pcLocation  //the source locations of the calls in the code, in order
+	depth     int           //the stack depth at the end of the ops emitted so far
+	maxDepth  int           //an upper bound on the stack slots the code uses, not counting the functions it calls
+	loop      Value         //the name of the named let the code is the body of, whose calls are jumps back to the start
+	closes    bool          //true if the code makes closures, which share its frame, so a call must not reuse the frame
+	doc       string        //the documentation string of the function, if it has one
+	declared  *declaration  //the declared types of its arguments and result, if they were declared
+}
+
+// pcLocation - the source location of the instruction that ends at the pc, i.e. of a call, whose frame
+// returns to that pc
+type pcLocation struct {
+	pc  int
+	loc *Location
 }
 
 func MakeCode(argc int, defaults []Value, keys []Value, name string) *Code {
 	var ops []int
 	code := &Code{
-		name,
-		ops,
-		argc,
-		defaults, //nil for normal procs, empty for rest, and non-empty for optional/keyword
-		keys,
+		name:     name,
+		ops:      ops,
+		argc:     argc,
+		defaults: defaults, //nil for normal procs, empty for rest, and non-empty for optional/keyword
+		keys:     keys,
+	}
+	if keys != nil {
+		code.keyIndex = make(map[Value]int, len(keys))
+		for i, key := range keys {
+			code.keyIndex[key] = i
+		}
+	}
+	code.locals = argc + len(defaults)
+	if defaults != nil && len(defaults) == 0 {
+		code.locals++ //the rest argument
 	}
 	return code
 }
 
+// locate - record the source location, if known, of the instruction just emitted
+func (code *Code) locate(loc *Location) {
+	if loc != nil {
+		code.locations = append(code.locations, pcLocation{pc: len(code.ops), loc: loc})
+	}
+}
+
+// sourceLocation - the source location of the instruction that ends at the pc, or nil if it is not known
+func (code *Code) sourceLocation(pc int) *Location {
+	i := sort.Search(len(code.locations), func(i int) bool { return code.locations[i].pc >= pc })
+	if i < len(code.locations) && code.locations[i].pc == pc {
+		return code.locations[i].loc
+	}
+	return nil
+}
+
+// setSource - record the source location in the code, and in all the functions defined inside it
+func (code *Code) setSource(source string) {
+	code.source = source
+	for offset := 0; offset < len(code.ops); {
+		if code.ops[offset] == opcodeClosure {
+			(code.constants[code.ops[offset+1]].(*Code)).setSource(source)
+		}
+		offset += opSize(code.ops[offset])
+	}
+}
+
 func (code *Code) Type() Value {
 	return CodeType
 }
@@ -124,24 +227,8 @@ func (code1 *Code) Equals(another Value) bool {
 }
 
 func (code *Code) signature() string {
-	//
-	//experimental: external annotations on the functions: *declarations* is a map from symbol to string
-	//
-	//a macro to declare could be as follows:
-	// (defmacro declare (name args)
-	//   (or (symbol? name) (error "expected a <symbol> got " name))
-	//   (let ((sig (string args)))
-	//     `(put! *declarations* '~name '~sig)))
-	//used as:
-	// (declare cons (<any> <list>) <list>)
-	if code.name != "" {
-		val := GetGlobal(Intern("*declarations*")) //so if this this has not been defined, we'll just skip it
-		if val != nil && IsStruct(val) {
-			sig, _ := Get(val, Intern(code.name))
-			if sig != Null {
-				return sig.String()
-			}
-		}
+	if decl := code.declared; decl != nil {
+		return functionSignatureFromTypes(decl.result, decl.args, decl.rest)
 	}
 	//the following has no type info
 	tmp := ""
@@ -159,14 +246,15 @@ func (code *Code) signature() string {
 	return tmp
 }
 
-func (code *Code) decompile(pretty bool) string {
+// decompile - the code in its textual form, with its source locations if located is true
+func (code *Code) decompile(pretty bool, located bool) string {
 	var buf bytes.Buffer
-	code.decompileInto(&buf, "", pretty)
+	code.decompileInto(&buf, "", pretty, located)
 	s := buf.String()
-	return strings.Replace(s, "("+SymbolName(FuncSymbol)+" (\"\" 0 [] [])", "(code", 1)
+	return strings.Replace(s, "("+SymbolName(FuncSymbol)+" (\"\" 0 null null)", "(code", 1)
 }
 
-func (code *Code) decompileInto(buf *bytes.Buffer, indent string, pretty bool) {
+func (code *Code) decompileInto(buf *bytes.Buffer, indent string, pretty bool, located bool) {
 	indentAmount := "   "
 	offset := 0
 	max := len(code.ops)
@@ -176,37 +264,55 @@ func (code *Code) decompileInto(buf *bytes.Buffer, indent string, pretty bool) {
 	buf.WriteString(strconv.Itoa(code.argc))
 	if code.defaults != nil {
 		buf.WriteString(" ")
-		buf.WriteString(fmt.Sprintf("%v", code.defaults))
+		buf.WriteString(Write(NewVector(code.defaults...)))
 	} else {
-		buf.WriteString(" []")
+		buf.WriteString(" null") //no optional arguments, unlike [], which binds the rest of the arguments
 	}
 	if code.keys != nil {
 		buf.WriteString(" ")
-		buf.WriteString(fmt.Sprintf("%v", code.keys))
+		buf.WriteString(Write(NewVector(code.keys...)))
 	} else {
-		buf.WriteString(" []")
+		buf.WriteString(" null")
+	}
+	if code.doc != "" {
+		buf.WriteString(" ")
+		buf.WriteString(Write(NewString(code.doc)))
 	}
 	buf.WriteString(")")
 	if pretty {
 		indent = indent + indentAmount
 		prefix = "\n" + indent
 	}
+	if located && code.source != "" {
+		buf.WriteString(prefix + "(" + SymbolName(SourceSymbol) + " " + Write(NewString(code.source)) + ")")
+	}
 	for offset < max {
+		if located {
+			code.writeLocation(buf, prefix, offset)
+		}
 		op := code.ops[offset]
 		s := prefix + "(" + SymbolName(opsyms[op])
+		if isPrimop(op) {
+			buf.WriteString(s + ")")
+			offset++
+			continue
+		}
 		switch op {
-		case opcodePop, opcodeReturn:
+		case opcodePop, opcodeReturn, opcodeUncatch, opcodeDup:
 			buf.WriteString(s + ")")
 			offset++
-		case opcodeLiteral, opcodeDefGlobal, opcodeUse, opcodeGlobal, opcodeUndefGlobal, opcodeDefMacro:
-			buf.WriteString(s + " " + Write(constants[code.ops[offset+1]]) + ")")
+		case opcodeLiteral, opcodeDefGlobal, opcodeSetGlobal, opcodeUse, opcodeGlobal, opcodeUndefGlobal, opcodeDefMacro:
+			buf.WriteString(s + " " + Write(code.constants[code.ops[offset+1]]) + ")")
 			offset += 2
-		case opcodeCall, opcodeTailCall, opcodeJumpFalse, opcodeJump, opcodeVector, opcodeStruct:
+		case opcodeCall, opcodeTailCall, opcodeJumpFalse, opcodeJump, opcodeVector, opcodeStruct, opcodeCatch:
 			buf.WriteString(s + " " + strconv.Itoa(code.ops[offset+1]) + ")")
 			offset += 2
 		case opcodeLocal, opcodeSetLocal:
 			buf.WriteString(s + " " + strconv.Itoa(code.ops[offset+1]) + " " + strconv.Itoa(code.ops[offset+2]) + ")")
 			offset += 3
+		case opcodeCallGlobal, opcodeTailCallGlobal, opcodeCallLiteral, opcodeTailCallLiteral:
+			buf.WriteString(s + " " + strconv.Itoa(code.ops[offset+1]) + " " + Write(code.constants[code.ops[offset+2]]) + ")")
+			offset += 3
 		case opcodeClosure:
 			buf.WriteString(s)
 			if pretty {
@@ -218,18 +324,28 @@ func (code *Code) decompileInto(buf *bytes.Buffer, indent string, pretty bool) {
 			if pretty {
 				indent2 = indent + indentAmount
 			}
-			(constants[code.ops[offset+1]].(*Code)).decompileInto(buf, indent2, pretty)
+			(code.constants[code.ops[offset+1]].(*Code)).decompileInto(buf, indent2, pretty, located)
 			buf.WriteString(")")
 			offset += 2
 		default:
 			panic(fmt.Sprintf("Bad instruction: %d", code.ops[offset]))
 		}
 	}
+	if located {
+		code.writeLocation(buf, prefix, offset)
+	}
 	buf.WriteString(")")
 }
 
+// writeLocation - write the source location of the instruction that ends at the pc, if it is known
+func (code *Code) writeLocation(buf *bytes.Buffer, prefix string, pc int) {
+	if loc := code.sourceLocation(pc); loc != nil && pc > 0 {
+		buf.WriteString(fmt.Sprintf("%s(%s %s %d %d)", prefix, SymbolName(LocationSymbol), Write(NewString(loc.File)), loc.Line, loc.Column))
+	}
+}
+
 func (code *Code) String() string {
-	return code.decompile(true)
+	return code.decompile(true, false)
 	//	return fmt.Sprintf("(function (%d %v %s) %v)", code.argc, code.defaults, code.keys, code.ops)
 }
 
@@ -250,7 +366,8 @@ func (code *Code) loadOps(lst *List) error {
 			var defaults []Value
 			var keys []Value
 			var err error
-			if lst, ok := funcParams.(*List); ok && lst.Length() == 4 {
+			var doc string
+			if lst, ok := funcParams.(*List); ok && (lst.Length() == 4 || lst.Length() == 5) {
 				a := lst.Car
 				lst = lst.Cdr
 				name, err = AsStringValue(a)
@@ -267,17 +384,28 @@ func (code *Code) loadOps(lst *List) error {
 				a = lst.Car
 				lst = lst.Cdr
 				if v, ok := a.(*Vector); ok {
-					defaults = v.Elements
+					defaults = append(make([]Value, 0, len(v.Elements)), v.Elements...)
 				}
 				a = lst.Car
+				lst = lst.Cdr
 				if v, ok := a.(*Vector); ok {
-					keys = v.Elements
+					keys = append(make([]Value, 0, len(v.Elements)), v.Elements...)
+				}
+				if lst != EmptyList {
+					doc, err = AsStringValue(lst.Car)
+					if err != nil {
+						return NewError(SyntaxErrorKey, funcParams)
+					}
 				}
 			} else {
 				return NewError(SyntaxErrorKey, funcParams)
 			}
 			fun := MakeCode(argc, defaults, keys, name)
-			fun.loadOps(Cdr(lstFunc))
+			fun.doc = doc
+			err = fun.loadOps(Cdr(lstFunc))
+			if err != nil {
+				return err
+			}
 			code.emitClosure(fun)
 		case LiteralSymbol:
 			code.emitLiteral(Cadr(instr))
@@ -322,6 +450,14 @@ func (code *Code) loadOps(lst *List) error {
 				return err
 			}
 			code.emitJumpFalse(loc)
+		case CatchSymbol:
+			loc, err := AsIntValue(Cadr(instr))
+			if err != nil {
+				return err
+			}
+			code.emitCatch(loc)
+		case UncatchSymbol:
+			code.emitUncatch()
 		case CallSymbol:
 			argc, err := AsIntValue(Cadr(instr))
 			if err != nil {
@@ -338,70 +474,245 @@ func (code *Code) loadOps(lst *List) error {
 			code.emitReturn()
 		case PopSymbol:
 			code.emitPop()
+		case DupSymbol:
+			code.emitDup()
+		case CallglobalSymbol, TailcallglobalSymbol, CallliteralSymbol, TailcallliteralSymbol:
+			if ListLength(instr) != 3 {
+				return NewError(SyntaxErrorKey, instr)
+			}
+			argc, err := AsIntValue(Cadr(instr))
+			if err != nil {
+				return err
+			}
+			opcode := opcodeCallGlobal
+			switch op {
+			case TailcallglobalSymbol:
+				opcode = opcodeTailCallGlobal
+			case CallliteralSymbol:
+				opcode = opcodeCallLiteral
+			case TailcallliteralSymbol:
+				opcode = opcodeTailCallLiteral
+			}
+			code.emitCallConstant(opcode, argc, Caddr(instr))
 		case DefglobalSymbol:
 			code.emitDefGlobal(Cadr(instr))
+		case SetglobalSymbol:
+			code.emitSetGlobal(Cadr(instr))
 		case DefmacroSymbol:
 			code.emitDefMacro(Cadr(instr))
 		case UseSymbol:
 			code.emitUse(Cadr(instr))
+		case VectorSymbol:
+			n, err := AsIntValue(Cadr(instr))
+			if err != nil {
+				return err
+			}
+			code.emitVector(n)
+		case StructSymbol:
+			n, err := AsIntValue(Cadr(instr))
+			if err != nil {
+				return err
+			}
+			code.emitStruct(n)
+		case SourceSymbol:
+			source, err := AsStringValue(Cadr(instr))
+			if err != nil {
+				return err
+			}
+			code.source = source
+		case LocationSymbol:
+			if ListLength(instr) != 4 {
+				return NewError(SyntaxErrorKey, instr)
+			}
+			file, err := AsStringValue(Cadr(instr))
+			if err != nil {
+				return err
+			}
+			line, err := AsIntValue(Caddr(instr))
+			if err != nil {
+				return err
+			}
+			column, err := AsIntValue(Cadddr(instr))
+			if err != nil {
+				return err
+			}
+			code.locate(&Location{File: file, Line: line, Column: column})
 		default:
-			panic(fmt.Sprintf("Bad instruction: %v", op))
+			opcode, ok := primopsBySymbol[op]
+			if !ok {
+				return NewError(SyntaxErrorKey, "Bad instruction: ", instr)
+			}
+			code.emitPrimop(opcode)
 		}
 		lst = Cdr(lst)
 	}
 	return nil
 }
 
+// WriteCode - the code, as returned by Compile, in the textual form read by LoadCode. Loading it
+// again needs neither macro expansion nor compilation. The source locations of the code are kept, so errors in
+// the loaded code are located as they would be in the code compiled from source.
+func WriteCode(code *Code) ([]byte, error) {
+	return []byte(code.decompile(true, true) + "\n"), nil
+}
+
+// LoadCode - read code written by WriteCode. The data may hold several (code ...) forms, as in a
+// compiled module, in which case the result calls each of them in turn, returning the value of the last.
+func LoadCode(data []byte) (*Code, error) {
+	thunks, err := loadCodeForms(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(thunks) == 1 {
+		return thunks[0], nil
+	}
+	code := MakeCode(0, nil, nil, "")
+	if len(thunks) == 0 {
+		code.emitLiteral(Null)
+		code.emitReturn()
+		return code, nil
+	}
+	for i, thunk := range thunks {
+		code.emitClosure(thunk)
+		if i < len(thunks)-1 {
+			code.emitCall(0)
+			code.emitPop()
+		} else {
+			code.emitTailCall(0)
+		}
+	}
+	return code, nil
+}
+
+// loadCodeForms - read the (code ...) forms written by WriteCode, each as a separate thunk
+func loadCodeForms(data []byte) ([]*Code, error) {
+	forms, err := ReadAllFromString(string(data))
+	if err != nil {
+		return nil, err
+	}
+	var thunks []*Code
+	for forms != EmptyList {
+		form, ok := Car(forms).(*List)
+		if !ok || Car(form) != Intern("code") {
+			return nil, NewError(SyntaxErrorKey, "Not compiled code: ", Car(forms))
+		}
+		thunk := MakeCode(0, nil, nil, "")
+		err = thunk.loadOps(Cdr(form))
+		if err != nil {
+			return nil, err
+		}
+		thunks = append(thunks, thunk)
+		forms = Cdr(forms)
+	}
+	return thunks, nil
+}
+
+// putConstant - the index of the value in the code's constant pool, adding it if it is not already there
+func (code *Code) putConstant(val Value) int {
+	for i, c := range code.constants {
+		if c == val {
+			return i
+		}
+	}
+	code.constants = append(code.constants, val)
+	return len(code.constants) - 1
+}
+
+// push - track the stack depth as instructions are emitted. Code is scanned linearly, so a value that is
+// left on the stack by one branch of a conditional is counted again by the next, an overestimate.
+func (code *Code) push(n int) {
+	code.depth += n
+	if code.depth > code.maxDepth {
+		code.maxDepth = code.depth
+	}
+}
+
 func (code *Code) emitLiteral(val Value) {
+	code.push(1)
 	code.ops = append(code.ops, opcodeLiteral)
-	code.ops = append(code.ops, putConstant(val))
+	code.ops = append(code.ops, code.putConstant(val))
 }
 
 func (code *Code) emitGlobal(sym Value) {
+	code.push(1)
 	code.ops = append(code.ops, opcodeGlobal)
-	code.ops = append(code.ops, putConstant(sym))
+	code.ops = append(code.ops, code.putConstant(sym))
 }
 func (code *Code) emitCall(argc int) {
+	code.push(-argc)
 	code.ops = append(code.ops, opcodeCall)
 	code.ops = append(code.ops, argc)
 }
+
+// emitCallConstant - emit one of the call instructions that take the function as an operand: the value of a
+// global, or a literal
+func (code *Code) emitCallConstant(op int, argc int, fn Value) {
+	code.push(1)
+	code.push(-argc)
+	code.ops = append(code.ops, op)
+	code.ops = append(code.ops, argc)
+	code.ops = append(code.ops, code.putConstant(fn))
+}
+
+// emitPrimop - emit an instruction that applies a primitive to the arguments on the stack
+func (code *Code) emitPrimop(op int) {
+	code.push(1 - primops[op-opcodeCar].argc)
+	code.ops = append(code.ops, op)
+}
 func (code *Code) emitReturn() {
 	code.ops = append(code.ops, opcodeReturn)
 }
 func (code *Code) emitTailCall(argc int) {
+	code.push(-argc)
 	code.ops = append(code.ops, opcodeTailCall)
 	code.ops = append(code.ops, argc)
 }
 func (code *Code) emitPop() {
+	code.push(-1)
 	code.ops = append(code.ops, opcodePop)
 }
+func (code *Code) emitDup() {
+	code.push(1)
+	code.ops = append(code.ops, opcodeDup)
+}
 func (code *Code) emitLocal(i int, j int) {
+	code.push(1)
 	code.ops = append(code.ops, opcodeLocal)
 	code.ops = append(code.ops, i)
 	code.ops = append(code.ops, j)
 }
 func (code *Code) emitSetLocal(i int, j int) {
+	if i == 0 && j >= code.locals {
+		code.locals = j + 1 //a slot for an inlined variable
+	}
 	code.ops = append(code.ops, opcodeSetLocal)
 	code.ops = append(code.ops, i)
 	code.ops = append(code.ops, j)
 }
 func (code *Code) emitDefGlobal(sym Value) {
 	code.ops = append(code.ops, opcodeDefGlobal)
-	code.ops = append(code.ops, putConstant(sym))
+	code.ops = append(code.ops, code.putConstant(sym))
+}
+func (code *Code) emitSetGlobal(sym Value) {
+	code.ops = append(code.ops, opcodeSetGlobal)
+	code.ops = append(code.ops, code.putConstant(sym))
 }
 func (code *Code) emitUndefGlobal(sym Value) {
 	code.ops = append(code.ops, opcodeUndefGlobal)
-	code.ops = append(code.ops, putConstant(sym))
+	code.ops = append(code.ops, code.putConstant(sym))
 }
 func (code *Code) emitDefMacro(sym Value) {
 	code.ops = append(code.ops, opcodeDefMacro)
-	code.ops = append(code.ops, putConstant(sym))
+	code.ops = append(code.ops, code.putConstant(sym))
 }
 func (code *Code) emitClosure(newCode Value) {
+	code.closes = true
+	code.push(1)
 	code.ops = append(code.ops, opcodeClosure)
-	code.ops = append(code.ops, putConstant(newCode))
+	code.ops = append(code.ops, code.putConstant(newCode))
 }
 func (code *Code) emitJumpFalse(offset int) int {
+	code.push(-1)
 	code.ops = append(code.ops, opcodeJumpFalse)
 	loc := len(code.ops)
 	code.ops = append(code.ops, offset)
@@ -413,18 +724,36 @@ func (code *Code) emitJump(offset int) int {
 	code.ops = append(code.ops, offset)
 	return loc
 }
+
+// emitJumpTo - emit a jump back to an earlier location in the code
+func (code *Code) emitJumpTo(pc int) {
+	loc := code.emitJump(0)
+	code.ops[loc] = pc - loc + 1
+}
 func (code *Code) setJumpLocation(loc int) {
 	code.ops[loc] = len(code.ops) - loc + 1
 }
 func (code *Code) emitVector(alen int) {
+	code.push(1 - alen)
 	code.ops = append(code.ops, opcodeVector)
 	code.ops = append(code.ops, alen)
 }
 func (code *Code) emitStruct(slen int) {
+	code.push(1 - slen)
 	code.ops = append(code.ops, opcodeStruct)
 	code.ops = append(code.ops, slen)
 }
 func (code *Code) emitUse(sym Value) {
+	code.push(1)
 	code.ops = append(code.ops, opcodeUse)
-	code.ops = append(code.ops, putConstant(sym))
+	code.ops = append(code.ops, code.putConstant(sym))
+}
+func (code *Code) emitCatch(offset int) int {
+	code.ops = append(code.ops, opcodeCatch)
+	loc := len(code.ops)
+	code.ops = append(code.ops, offset)
+	return loc
+}
+func (code *Code) emitUncatch() {
+	code.ops = append(code.ops, opcodeUncatch)
 }
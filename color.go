@@ -0,0 +1,91 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	. "github.com/boynton/ell/data"
+)
+
+// colorTheme - the ANSI escape sequences written before REPL results, errors, the output of the expressions the
+// REPL evaluates, and the VM trace. A theme with none is no color at all.
+type colorTheme struct {
+	result string
+	err    string
+	output string
+	trace  string
+}
+
+const colorReset = "\033[0m"
+
+var colorThemes = map[string]*colorTheme{
+	"default": {result: "\033[0;32m", err: "\033[0;31m", output: "\033[0;34m", trace: "\033[0;90m"},
+	"dark":    {result: "\033[1;32m", err: "\033[1;31m", output: "\033[0;36m", trace: "\033[0;37m"},
+	"light":   {result: "\033[0;32m", err: "\033[0;31m", output: "\033[0;35m", trace: "\033[0;90m"},
+	"none":    {},
+}
+
+// colors - the theme in use, or nil until one is chosen
+var colors *colorTheme
+
+// SetColorTheme - use the named theme: default, dark, light, or none
+func SetColorTheme(name string) error {
+	theme, ok := colorThemes[name]
+	if !ok {
+		var names []string
+		for n := range colorThemes {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return NewError(ArgumentErrorKey, "Unknown color theme '", name, "', expected one of: ", strings.Join(names, ", "))
+	}
+	colors = theme
+	return nil
+}
+
+// currentColors - the theme in use. Unless one was set, it is the one named by the ELL_COLORS environment
+// variable, or the default theme, but there are no colors if the NO_COLOR environment variable is set or standard
+// output is not a terminal.
+func currentColors() *colorTheme {
+	if colors == nil {
+		if !colorTerminal() {
+			colors = colorThemes["none"]
+		} else if SetColorTheme(os.Getenv("ELL_COLORS")) != nil {
+			colors = colorThemes["default"]
+		}
+	}
+	return colors
+}
+
+func colorTerminal() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// colored - the string written in the color, if there is one
+func colored(color string, s string) string {
+	if color == "" {
+		return s
+	}
+	return color + s + colorReset
+}
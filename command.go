@@ -0,0 +1,407 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+
+	. "github.com/boynton/ell/data"
+)
+
+// The ell command runs one of its subcommands, i.e. "ell run foo.ell". Without one, it runs the files it is
+// given, or the REPL if there are none, as "ell foo.ell" always has.
+
+type subcommand struct {
+	name  string
+	args  string //the arguments it takes, for its usage
+	descr string
+	run   func(cmd *subcommand, args []string)
+}
+
+var subcommands = []*subcommand{
+	{"run", "file ... [-- arg ...]", "load and run the files, with the arguments of the script in *args*", runSubcommand},
+	{"compile", "file ... [-o file.lvm]", "compile the files, writing the code to the output file, or printing it", compileSubcommand},
+	{"dis", "file.lvm ...", "print the compiled code in the files", disSubcommand},
+	{"fmt", "[-w] file ...", "pretty print the source files, or rewrite them with -w", fmtSubcommand},
+	{"repl", "", "run the read-eval-print loop", replSubcommand},
+	{"test", "[dir ...]", "run the tests in the *_test.ell files of the directories", testSubcommand},
+}
+
+// mainOptions - the options of the subcommands that run Ell code
+type mainOptions struct {
+	flags       *flag.FlagSet
+	optimize    bool
+	verbose     bool
+	debug       bool
+	trace       bool
+	traceMacros bool
+	checkTypes  bool
+	noPeephole  bool
+	cache       bool
+	path        string
+	theme       string
+}
+
+func newMainOptions(name string, args string, descr string) *mainOptions {
+	opts := &mainOptions{flags: flag.NewFlagSet(name, flag.ExitOnError)}
+	fs := opts.flags
+	fs.BoolVar(&opts.optimize, "optimize", false, "optimize execution speed, should work for correct code, relax some checks")
+	fs.BoolVar(&opts.verbose, "verbose", false, "verbose mode, print extra information")
+	fs.BoolVar(&opts.debug, "debug", false, "debug mode, print extra information about compilation")
+	fs.BoolVar(&opts.trace, "trace", false, "trace VM instructions as they get executed")
+	fs.BoolVar(&opts.traceMacros, "trace-macros", false, "print each macro expansion, same as setting *trace-macros* to true")
+	fs.BoolVar(&opts.checkTypes, "check-types", false, "check the arguments of calls to functions with declared types, same as setting *check-types* to true")
+	fs.BoolVar(&opts.noPeephole, "nopeephole", false, "disable the peephole optimization of compiled code, for debugging")
+	fs.BoolVar(&opts.cache, "cache", false, "cache the compiled code of modules loaded from source, under the user's cache directory")
+	fs.StringVar(&opts.path, "path", "", "add directories to ell load path")
+	fs.StringVar(&opts.theme, "colors", "", "the color theme of the REPL and trace output: default, dark, light, or none")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [options] %s\n\n%s\n\noptions:\n", name, args, descr)
+		fs.PrintDefaults()
+	}
+	return opts
+}
+
+// options - the options of the command, with its usage
+func (cmd *subcommand) options() *mainOptions {
+	return newMainOptions("ell "+cmd.name, cmd.args, cmd.descr)
+}
+
+// init - initialize the runtime as the options specify
+func (opts *mainOptions) init(interactive bool) {
+	if opts.theme != "" {
+		if err := SetColorTheme(opts.theme); err != nil {
+			Fatal("*** ", err)
+		}
+	}
+	SetFlags(opts.optimize, opts.verbose, opts.debug, opts.trace, interactive)
+	peephole = !opts.noPeephole
+	cacheModules = opts.cache
+	Init(mainExtensions...)
+	if opts.traceMacros {
+		DefineGlobal(StringValue(traceMacrosSymbol), True)
+	}
+	if opts.checkTypes {
+		DefineGlobal(StringValue(checkTypesSymbol), True)
+	}
+	if opts.path != "" {
+		for _, p := range strings.Split(opts.path, ":") {
+			expandedPath := ExpandFilePath(p)
+			if IsDirectoryReadable(expandedPath) {
+				AddEllDirectory(expandedPath)
+				if opts.debug {
+					Println("[added directory to path: '", expandedPath, "']")
+				}
+			} else if opts.debug {
+				Println("[directory not readable, cannot add to path: '", expandedPath, "']")
+			}
+		}
+	}
+	//Init may have loaded code, so the flags are set again for what follows
+	SetFlags(opts.optimize, opts.verbose, opts.debug, opts.trace, interactive)
+}
+
+// parseArgs - parse the options in the arguments, wherever they are, returning the other arguments
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var params []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return params
+		}
+		params = append(params, args[0])
+		args = args[1:]
+	}
+}
+
+// argsSymbol - the global *args* is the list of the arguments given to the script being run, as strings
+var argsSymbol = Intern("*args*")
+
+// scriptArgs - parse the options in the arguments of a command that runs files, returning the files and the
+// arguments of the script. A file that starts with a #! line is a script, and the arguments after it are its own,
+// as are any after "--".
+func scriptArgs(fs *flag.FlagSet, args []string) ([]string, []string) {
+	var files []string
+	for {
+		fs.Parse(args)
+		if n := len(args) - fs.NArg(); n > 0 && args[n-1] == "--" {
+			return files, fs.Args()
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return files, nil
+		}
+		files = append(files, args[0])
+		if isScript(args[0]) {
+			return files, args[1:]
+		}
+		args = args[1:]
+	}
+}
+
+// isScript - true if the file starts with a #! line
+func isScript(file string) bool {
+	f, err := os.Open(ExpandFilePath(file))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var buf [2]byte
+	n, _ := f.Read(buf[:])
+	return n == 2 && string(buf[:]) == "#!"
+}
+
+// setScriptArgs - set *args* to the arguments
+func setScriptArgs(args []string) {
+	var lst []Value
+	for _, arg := range args {
+		lst = append(lst, NewString(arg))
+	}
+	DefineGlobal(StringValue(argsSymbol), ListFromValues(lst))
+}
+
+var mainExtensions []Extension
+
+// Main - run the ell command with the arguments of the process
+func Main(extns ...Extension) {
+	mainExtensions = extns
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if args[0] == "help" {
+			fmt.Println(mainUsage())
+			return
+		}
+		for _, cmd := range subcommands {
+			if cmd.name == args[0] {
+				cmd.run(cmd, args[1:])
+				Cleanup()
+				return
+			}
+		}
+	}
+	opts := newMainOptions("ell", "", "")
+	var compile, noInit bool
+	var prof string
+	opts.flags.BoolVar(&compile, "compile", false, "compile the file and output lap")
+	opts.flags.BoolVar(&noInit, "noinit", false, "disable initialization from the $HOME/.ell file")
+	opts.flags.StringVar(&prof, "profile", "", "profile the code to the specified file")
+	opts.flags.Usage = func() {
+		fmt.Fprintf(opts.flags.Output(), "%s\n\noptions:\n", mainUsage())
+		opts.flags.PrintDefaults()
+	}
+	params, scriptParams := scriptArgs(opts.flags, args)
+	switch {
+	case len(params) == 0:
+		replMain(opts, noInit)
+	case compile:
+		opts.init(false)
+		printCompiled(params)
+	default:
+		opts.init(false)
+		setScriptArgs(scriptParams)
+		runFiles(params, prof)
+	}
+	Cleanup()
+}
+
+func mainUsage() string {
+	var buf strings.Builder
+	buf.WriteString("usage: ell [options] [file ...]\n       ell <command> [options] [arguments]\n\n")
+	buf.WriteString("The Ell Language compiler, VM, and runtime. Without a command, ell runs the files, or the REPL if\n")
+	buf.WriteString("there are none. The arguments after a script, a file starting with #!, or after \"--\", are the\n")
+	buf.WriteString("script's own, in *args*. The commands are:\n\n")
+	for _, cmd := range subcommands {
+		buf.WriteString(fmt.Sprintf("    %-8s %s\n", cmd.name, cmd.descr))
+	}
+	buf.WriteString("\n\"ell <command> --help\" describes the command and its options.")
+	return buf.String()
+}
+
+func runSubcommand(cmd *subcommand, args []string) {
+	opts := cmd.options()
+	var prof string
+	opts.flags.StringVar(&prof, "profile", "", "profile the code to the specified file")
+	files, params := scriptArgs(opts.flags, args)
+	if len(files) == 0 {
+		opts.flags.Usage()
+		exit(2)
+	}
+	opts.init(false)
+	setScriptArgs(params)
+	runFiles(files, prof)
+}
+
+// runFiles - load the files. A script is loaded from its path, as it need not be named like a module.
+func runFiles(files []string, prof string) {
+	if prof != "" {
+		f, err := os.Create(prof)
+		if err != nil {
+			Fatal("*** ", err)
+		}
+		pprof.StartCPUProfile(f)
+		defer pprof.StopCPUProfile()
+	}
+	defer EnableInterrupts()()
+	for _, file := range files {
+		if !isScript(file) {
+			Run(file)
+		} else if err := LoadFile(ExpandFilePath(file)); err != nil {
+			Fatal("*** ", err.Error(), formatStackTrace(err))
+		}
+	}
+}
+
+func compileSubcommand(cmd *subcommand, args []string) {
+	opts := cmd.options()
+	var output string
+	opts.flags.StringVar(&output, "o", "", "the file to write the compiled code to, i.e. foo.lvm")
+	files := parseArgs(opts.flags, args)
+	if len(files) == 0 || (output != "" && len(files) > 1) {
+		opts.flags.Usage()
+		exit(2)
+	}
+	opts.init(false)
+	if output == "" {
+		printCompiled(files)
+		return
+	}
+	lap, err := CompileFile(files[0])
+	if err != nil {
+		Fatal("*** ", err.Error(), formatStackTrace(err))
+	}
+	if err := ioutil.WriteFile(output, []byte(StringValue(lap)), 0644); err != nil {
+		Fatal("*** ", err)
+	}
+}
+
+// printCompiled - compile the files, printing their code. Compiling a file evaluates its forms, as loading it does.
+func printCompiled(files []string) {
+	for _, filename := range files {
+		lap, err := CompileFile(filename)
+		if err != nil {
+			Fatal("*** ", err.Error(), formatStackTrace(err))
+		}
+		Println(lap)
+	}
+}
+
+func disSubcommand(cmd *subcommand, args []string) {
+	opts := cmd.options()
+	files := parseArgs(opts.flags, args)
+	if len(files) == 0 {
+		opts.flags.Usage()
+		exit(2)
+	}
+	opts.init(false)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(ExpandFilePath(file))
+		if err != nil {
+			Fatal("*** ", err)
+		}
+		thunks, err := loadCodeForms(data)
+		if err != nil {
+			Fatal("*** ", file, ": ", err)
+		}
+		fmt.Printf(";\n; code in %s\n;\n", file)
+		for _, thunk := range thunks {
+			fmt.Println(thunk.decompile(true, false))
+		}
+	}
+}
+
+func fmtSubcommand(cmd *subcommand, args []string) {
+	fs := flag.NewFlagSet("ell "+cmd.name, flag.ExitOnError)
+	var write bool
+	var width int
+	fs.BoolVar(&write, "w", false, "write the formatted source to the files, rather than printing it")
+	fs.IntVar(&width, "width", 100, "the width to fit the forms in")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ell %s [options] file ...\n\n%s. Forms with comments in them are left as they are.\n\noptions:\n", cmd.name, cmd.descr)
+		fs.PrintDefaults()
+	}
+	files := parseArgs(fs, args)
+	if len(files) == 0 {
+		fs.Usage()
+		exit(2)
+	}
+	Init(mainExtensions...)
+	for _, file := range files {
+		path := ExpandFilePath(file)
+		text, err := ioutil.ReadFile(path)
+		if err != nil {
+			Fatal("*** ", err)
+		}
+		formatted, err := FormatSource(file, string(text), width)
+		if err != nil {
+			Fatal("*** ", file, ": ", err)
+		}
+		if !write {
+			fmt.Print(formatted)
+		} else if formatted != string(text) {
+			if err := ioutil.WriteFile(path, []byte(formatted), 0644); err != nil {
+				Fatal("*** ", err)
+			}
+		}
+	}
+}
+
+func replSubcommand(cmd *subcommand, args []string) {
+	opts := cmd.options()
+	var noInit bool
+	opts.flags.BoolVar(&noInit, "noinit", false, "disable initialization from the $HOME/.ell file")
+	if params := parseArgs(opts.flags, args); len(params) > 0 {
+		opts.flags.Usage()
+		exit(2)
+	}
+	replMain(opts, noInit)
+}
+
+// replMain - load the $HOME/.ell file, unless noInit is set, and run the REPL
+func replMain(opts *mainOptions, noInit bool) {
+	opts.init(true)
+	if !noInit {
+		ellini := filepath.Join(os.Getenv("HOME"), ".ell")
+		if _, err := os.Stat(ellini); err == nil {
+			if err := Load(ellini); err != nil {
+				Fatal("*** ", err)
+			}
+		}
+	}
+	SetFlags(opts.optimize, opts.verbose, opts.debug, opts.trace, true)
+	ReadEvalPrintLoop()
+}
+
+func testSubcommand(cmd *subcommand, args []string) {
+	opts := cmd.options()
+	dirs := parseArgs(opts.flags, args)
+	opts.init(false)
+	_, failed, err := RunTestFiles(dirs...)
+	if err != nil {
+		Fatal("*** ", err)
+	}
+	if failed > 0 {
+		Cleanup()
+		exit(1)
+	}
+}
@@ -31,9 +31,44 @@ func Compile(expr Value) (*Code, error) {
 		return nil, err
 	}
 	target.emitReturn()
+	if peephole {
+		target.optimize()
+	}
 	return target, nil
 }
 
+// sourceLocations - the locations of the forms read from the file being loaded, and of their expansions
+var sourceLocations map[Value]*Location
+
+// locationOf - the location in the source of the form, if known
+func locationOf(expr Value) *Location {
+	if sourceLocations == nil {
+		return nil
+	}
+	return sourceLocations[expr]
+}
+
+// inheritLocation - the expansion of a form is located where the form is, if it has no location of its own
+func inheritLocation(expansion Value, form Value) {
+	if loc := locationOf(form); loc != nil && expansion != form {
+		switch expansion.(type) {
+		case *List, *Vector, *Struct:
+			if expansion != EmptyList && sourceLocations[expansion] == nil {
+				sourceLocations[expansion] = loc
+			}
+		}
+	}
+}
+
+// locateError - attach the location of the form to the error, unless the error already has one. Errors are
+// located as they are returned, so the location is that of the innermost form known.
+func locateError(err error, expr Value) error {
+	if errobj, ok := err.(*Error); ok && errobj.Location == nil {
+		errobj.Location = locationOf(expr)
+	}
+	return err
+}
+
 func calculateLocation(sym Value, env *List) (int, int, bool) {
 	i := 0
 	for env != EmptyList {
@@ -69,7 +104,7 @@ func compileSymbol(target *Code, env *List, expr Value, isTail bool, ignoreResul
 	if i, j, ok := calculateLocation(expr, env); ok {
 		target.emitLocal(i, j)
 	} else {
-		target.emitGlobal(expr)
+		target.emitGlobal(currentModule.resolve(expr.(*Symbol)))
 	}
 	if ignoreResult {
 		target.emitPop()
@@ -98,9 +133,18 @@ func compileDef(target *Code, env *List, lst Value, isTail bool, ignoreResult bo
 	}
 	sym := Cadr(lst)
 	val := Caddr(lst)
-	err := compileExpr(target, env, val, false, false, sym.String())
+	if !IsSymbol(sym) {
+		return NewError(SyntaxErrorKey, lst)
+	}
+	global := currentModule.define(sym.(*Symbol))
+	var err error
+	if fn, ok := val.(*List); ok && fn.Car == Intern("fn") && declarations[global] != nil && ListLength(fn) >= 3 {
+		err = compileFn(target, env, Cadr(fn), Cddr(fn), false, false, sym.String(), declarations[global])
+	} else {
+		err = compileExpr(target, env, val, false, false, sym.String())
+	}
 	if err == nil {
-		target.emitDefGlobal(sym)
+		target.emitDefGlobal(global)
 		if ignoreResult {
 			target.emitPop()
 		} else if isTail {
@@ -118,7 +162,7 @@ func compileUndef(target *Code, lst Value, isTail bool, ignoreResult bool, lstle
 	if !IsSymbol(sym) {
 		return NewError(SyntaxErrorKey, lst)
 	}
-	target.emitUndefGlobal(sym)
+	target.emitUndefGlobal(currentModule.resolve(sym.(*Symbol)))
 	if ignoreResult {
 	} else {
 		target.emitLiteral(sym)
@@ -167,7 +211,8 @@ func compileSet(target *Code, env *List, lst Value, isTail bool, ignoreResult bo
 	if i, j, ok := calculateLocation(sym, env); ok {
 		target.emitSetLocal(i, j)
 	} else {
-		target.emitDefGlobal(sym) //fix, should be SetGlobal
+		target.emitSetGlobal(currentModule.resolve(sym.(*Symbol)))
+		target.locate(locationOf(lst))
 	}
 	if ignoreResult {
 		target.emitPop()
@@ -207,12 +252,54 @@ func compileList(target *Code, env *List, expr Value, isTail bool, ignoreResult
 			return compileIfElse(target, env, Cadr(expr), Caddr(expr), Cdddr(expr), isTail, ignoreResult, context)
 		}
 		return NewError(SyntaxErrorKey, expr)
+	case Intern("and"):
+		// (and <expr> ...)
+		return compileAnd(target, env, Cdr(lst), isTail, ignoreResult, context)
+	case Intern("or"):
+		// (or <expr> ...)
+		return compileOr(target, env, Cdr(lst), isTail, ignoreResult, context)
+	case Intern("when"):
+		// (when pred <expr> ...)
+		if lstlen < 3 {
+			return NewError(SyntaxErrorKey, expr)
+		}
+		return compileIfElse(target, env, Cadr(expr), Cons(Intern("do"), Cddr(lst)), EmptyList, isTail, ignoreResult, context)
+	case Intern("unless"):
+		// (unless pred <expr> ...)
+		if lstlen < 3 {
+			return NewError(SyntaxErrorKey, expr)
+		}
+		return compileIfElse(target, env, Cadr(expr), Null, NewList(Cons(Intern("do"), Cddr(lst))), isTail, ignoreResult, context)
+	case Intern("case"):
+		// (case <key> ((<datum> ...) <expr> ...) ... (else <expr> ...))
+		if lstlen < 3 {
+			return NewError(SyntaxErrorKey, expr)
+		}
+		return compileCase(target, env, lst.(*List), isTail, ignoreResult, context)
+	case Intern("named-let"):
+		// (named-let <name> ((<sym> <val>) ...) <expr> ...) ;; a named let the expander found to be a loop
+		if lstlen < 4 || !IsSymbol(Cadr(lst)) {
+			return NewError(SyntaxErrorKey, expr)
+		}
+		return compileLoop(target, env, lst.(*List), isTail, ignoreResult, context)
+	case Intern("letrec*"):
+		// (letrec* ((<sym> <val>) ...) <expr> ...) ;; a letrec, or the internal defines of a function
+		if lstlen < 3 {
+			return NewError(SyntaxErrorKey, expr)
+		}
+		return compileLetrec(target, env, lst.(*List), isTail, ignoreResult, context)
+	case SpliceSymbol:
+		// @<expr> ;; only an argument of a call, which the expander has turned into an apply
+		return NewError(SyntaxErrorKey, "A splice can only be an argument of a call: ", expr)
 	case Intern("def"):
 		// (def <name> <val>)
 		return compileDef(target, env, expr, isTail, ignoreResult, lstlen)
 	case Intern("undef"):
 		// (undef <name>)
 		return compileUndef(target, expr, isTail, ignoreResult, lstlen)
+	case Intern("declare"):
+		// (declare <name> (<type> ...) <type>)
+		return compileDeclare(target, expr, isTail, ignoreResult, lstlen)
 	case Intern("defmacro"):
 		// (defmacro <name> (fn args & body))
 		return compileMacro(target, env, expr, isTail, ignoreResult, lstlen)
@@ -230,7 +317,7 @@ func compileList(target *Code, env *List, expr Value, isTail bool, ignoreResult
 		}
 		body := Cddr(lst)
 		args := Cadr(lst)
-		return compileFn(target, env, args, body, isTail, ignoreResult, context)
+		return compileFn(target, env, args, body, isTail, ignoreResult, context, nil)
 	case Intern("set!"):
 		// (set! <sym> <val>)
 		return compileSet(target, env, expr, isTail, ignoreResult, context, lstlen)
@@ -239,15 +326,42 @@ func compileList(target *Code, env *List, expr Value, isTail bool, ignoreResult
 		return target.loadOps(Cdr(expr))
 	case Intern("use"):
 		// (use module_name)
-		return compileUse(target, Cdr(lst))
+		err := compileUse(target, Cdr(lst))
+		if err == nil {
+			target.locate(locationOf(expr))
+		}
+		return err
+	case Intern("catch"):
+		// (catch <expr> ...)
+		if lstlen < 2 {
+			return NewError(SyntaxErrorKey, expr)
+		}
+		return compileCatch(target, env, Cdr(lst), isTail, ignoreResult, context)
+	case Intern("handler-case"):
+		// (handler-case <expr> (<keyword> (<sym>) <expr> ...) ... (else (<sym>) <expr> ...))
+		if lstlen < 2 {
+			return NewError(SyntaxErrorKey, expr)
+		}
+		return compileHandlerCase(target, env, expr, isTail, ignoreResult, context)
 	default: // a funcall
 		// (<fn>)
 		// (<fn> <arg> ...)
+		if fn == target.loop && isTail {
+			return compileLoopJump(target, env, Cdr(lst), context)
+		}
 		fn, args := fn, Cdr(lst)
+		warnLiteralArgs(fn, env, args)
+		warnKeywordArgs(fn, env, args)
 		if optimize {
+			if params, ok := inlinableParams(target, env, fn, ListLength(args)); ok {
+				return compileInline(target, env, params, Cddr(fn), args, isTail, ignoreResult, context)
+			}
 			fn, args = optimizeFuncall(fn, args)
+			if op, ok := primopFor(fn, env, ListLength(args)); ok {
+				return compilePrimopCall(target, env, op, args, isTail, ignoreResult, context, locationOf(expr))
+			}
 		}
-		return compileFuncall(target, env, fn, args, isTail, ignoreResult, context)
+		return compileFuncall(target, env, fn, args, isTail, ignoreResult, context, locationOf(expr))
 	}
 }
 
@@ -272,11 +386,11 @@ func compileVector(target *Code, env *List, vec *Vector, isTail bool, ignoreResu
 
 func compileStruct(target *Code, env *List, strct *Struct, isTail bool, ignoreResult bool, context string) error {
 	//struct literal: the elements are evaluated
-	vlen := len(strct.Bindings) * 2
+	vlen := strct.Length() * 2
 	vals := make([]Value, 0, vlen)
-	for k, v := range strct.Bindings {
-		vals = append(vals, k.ToValue())
-		vals = append(vals, v)
+	for _, e := range strct.Entries() {
+		vals = append(vals, e.Key)
+		vals = append(vals, e.Value)
 	}
 	for i := vlen - 1; i >= 0; i-- {
 		obj := vals[i]
@@ -303,7 +417,11 @@ func compileExpr(target *Code, env *List, expr Value, isTail bool, ignoreResult
 	case *Symbol:
 		return compileSymbol(target, env, p, isTail, ignoreResult)
 	case *List:
-		return compileList(target, env, p, isTail, ignoreResult, context)
+		err := compileList(target, env, p, isTail, ignoreResult, context)
+		if err != nil {
+			return locateError(err, p)
+		}
+		return nil
 	case *Vector:
 		return compileVector(target, env, p, isTail, ignoreResult, context)
 	case *Struct:
@@ -318,108 +436,134 @@ func compileExpr(target *Code, env *List, expr Value, isTail bool, ignoreResult
 	return nil
 }
 
-func compileFn(target *Code, env *List, args Value, body *List, isTail bool, ignoreResult bool, context string) error {
-	argc := 0
+// compileFn - compile a function, with the declared types of its arguments and result, if they were declared
+func compileFn(target *Code, env *List, args Value, body *List, isTail bool, ignoreResult bool, context string, decl *declaration) error {
+	argc, syms, defaults, keys, err := compileParams(args)
+	if err != nil {
+		return err
+	}
+	newEnv := Cons(ListFromValues(syms), env)
+	fnCode := MakeCode(argc, defaults, keys, context)
+	if doc, rest := docString(body); doc != nil {
+		fnCode.doc = doc.Value
+		body = rest
+	}
+	if decl != nil {
+		if err := decl.declare(fnCode, context); err != nil {
+			return err
+		}
+	}
+	err = compileSequence(fnCode, newEnv, body, true, false, context)
+	if err == nil {
+		if peephole {
+			fnCode.optimize()
+		}
+		if !ignoreResult {
+			target.emitClosure(fnCode)
+			if isTail {
+				target.emitReturn()
+			}
+		}
+	}
+	return err
+}
+
+// compileParams - the number of required parameters of a function, the names of all its parameters, and the
+// defaults and keys of the optional or keyword ones. The parameters are a symbol, bound to the list of all the
+// arguments, or a list of symbols for the required ones, which may end with one of:
+//
+//	& rest                   ;; the rest of the arguments, in a list
+//	[opt (opt default) ...]  ;; optional arguments, whose default is null unless given
+//	{key: default ...}       ;; keyword arguments. The keys may also be symbols, or quoted symbols.
+//
+// A vector of the parameters is the same as the list of them. The defaults are nil if there are only required
+// parameters, and empty if there is a rest parameter.
+func compileParams(params Value) (int, []Value, []Value, []Value, error) {
 	var syms []Value
 	var defaults []Value
 	var keys []Value
-	tmp := args
-	rest := false
-	if !IsSymbol(args) {
-		if IsVector(tmp) {
-			//clojure style. Should this be an error?
-			tmp, _ = ToList(tmp)
-		}
-		for tmp != EmptyList {
-			a := Car(tmp)
-			if vec, ok := a.(*Vector); ok {
-				//i.e. (x [y (z 23)]) is for optional y and z, but bound, z with default 23
-				if Cdr(tmp) != EmptyList {
-					return NewError(SyntaxErrorKey, tmp)
-				}
-				defaults = make([]Value, 0, len(vec.Elements))
-				for _, sym := range vec.Elements {
-					def := Null
-					if lst, ok := sym.(*List); ok {
-						def = Cadr(lst)
-						sym = lst.Car
-					}
-					if !IsSymbol(sym) {
-						return NewError(SyntaxErrorKey, tmp)
+	param := func(sym Value) error {
+		if !IsSymbol(sym) || sym == Intern("&") {
+			return NewError(SyntaxErrorKey, "Bad parameter in ", params, ": ", sym)
+		}
+		for _, s := range syms {
+			if s == sym {
+				return NewError(SyntaxErrorKey, "Duplicate parameter in ", params, ": ", sym)
+			}
+		}
+		syms = append(syms, sym)
+		return nil
+	}
+	if IsSymbol(params) {
+		return 0, []Value{params}, []Value{}, nil, nil
+	}
+	lst := params
+	if vec, ok := params.(*Vector); ok {
+		lst = ListFromValues(vec.Elements)
+	}
+	if !IsList(lst) {
+		return 0, nil, nil, nil, NewError(SyntaxErrorKey, "Bad parameters: ", params)
+	}
+	for tmp := lst.(*List); tmp != EmptyList; tmp = tmp.Cdr {
+		argc := len(syms)
+		switch p := tmp.Car.(type) {
+		case *Vector:
+			if tmp.Cdr != EmptyList {
+				return 0, nil, nil, nil, NewError(SyntaxErrorKey, "Optional parameters must come last: ", params)
+			}
+			defaults = make([]Value, 0, len(p.Elements))
+			for _, opt := range p.Elements {
+				def := Null
+				if binding, ok := opt.(*List); ok {
+					if ListLength(binding) != 2 {
+						return 0, nil, nil, nil, NewError(SyntaxErrorKey, "Bad optional parameter in ", params, ": ", opt)
 					}
-					syms = append(syms, sym)
-					defaults = append(defaults, def)
+					opt, def = binding.Car, Cadr(binding)
 				}
-				tmp = EmptyList
-				break
-			} else if strct, ok := a.(*Struct); ok {
-				//i.e. (x {y: 23, z: 57}]) is for optional y and z, keyword args, with defaults
-				if Cdr(tmp) != EmptyList {
-					return NewError(SyntaxErrorKey, tmp)
+				if err := param(opt); err != nil {
+					return 0, nil, nil, nil, err
 				}
-				slen := len(strct.Bindings)
-				defaults = make([]Value, 0, slen)
-				keys = make([]Value, 0, slen)
-				for k, defValue := range strct.Bindings {
-					sym := k.ToValue()
-					if IsList(sym) && Car(sym) == Intern("quote") && Cdr(sym) != EmptyList {
-						sym = Cadr(sym)
-					} else {
-						var err error
-						sym, err = Unkeyworded(sym) //returns sym itself if not a keyword, otherwise strips the colon
-						if err != nil {             //not a symbol or keyword
-							return NewError(SyntaxErrorKey, tmp)
-						}
-					}
-					if !IsSymbol(sym) {
-						return NewError(SyntaxErrorKey, tmp)
-					}
-					syms = append(syms, sym)
-					keys = append(keys, sym)
-					defaults = append(defaults, defValue)
+				defaults = append(defaults, def)
+			}
+			return argc, syms, defaults, nil, nil
+		case *Struct:
+			if tmp.Cdr != EmptyList {
+				return 0, nil, nil, nil, NewError(SyntaxErrorKey, "Keyword parameters must come last: ", params)
+			}
+			defaults = make([]Value, 0, p.Length())
+			keys = make([]Value, 0, p.Length())
+			for _, e := range p.Entries() {
+				sym := e.Key
+				if quoted, ok := sym.(*List); ok && quoted.Car == Intern("quote") && ListLength(quoted) == 2 {
+					sym = Cadr(quoted)
+				} else if k, err := Unkeyworded(sym); err == nil {
+					sym = k
+				}
+				if !IsSymbol(sym) {
+					return 0, nil, nil, nil, NewError(SyntaxErrorKey, "Bad keyword parameter in ", params, ": ", e.Key)
 				}
-				tmp = EmptyList
-				break
-			} else if !IsSymbol(a) {
-				return NewError(SyntaxErrorKey, tmp)
-			}
-			if a == Intern("&") { //the rest of the arglist is bound to a single variable
-				//note that the & annotation is optional if  what follows is a struct or vector
-				rest = true
-			} else {
-				if rest {
-					syms = append(syms, a) //note: added, but argv not incremented
-					defaults = make([]Value, 0)
-					tmp = EmptyList
-					break
+				if err := param(sym); err != nil {
+					return 0, nil, nil, nil, err
 				}
-				argc++
-				syms = append(syms, a)
+				keys = append(keys, sym)
+				defaults = append(defaults, e.Value)
 			}
-			tmp = Cdr(tmp)
-		}
-	}
-	if tmp != EmptyList { //remainder of the arglist bound to a single variable
-		if IsSymbol(tmp) {
-			syms = append(syms, tmp) //note: added, but argv not incremented
-			defaults = make([]Value, 0)
-		} else {
-			return NewError(SyntaxErrorKey, tmp)
+			return argc, syms, defaults, keys, nil
 		}
-	}
-	args = ListFromValues(syms) //why not just use the vector format in general?
-	newEnv := Cons(args, env)
-	fnCode := MakeCode(argc, defaults, keys, context)
-	err := compileSequence(fnCode, newEnv, body, true, false, context)
-	if err == nil {
-		if !ignoreResult {
-			target.emitClosure(fnCode)
-			if isTail {
-				target.emitReturn()
+		if tmp.Car == Intern("&") {
+			if ListLength(tmp) != 2 {
+				return 0, nil, nil, nil, NewError(SyntaxErrorKey, "& must be followed by one parameter: ", params)
+			}
+			if err := param(Cadr(tmp)); err != nil {
+				return 0, nil, nil, nil, err
 			}
+			return argc, syms, []Value{}, nil, nil
+		}
+		if err := param(tmp.Car); err != nil {
+			return 0, nil, nil, nil, err
 		}
 	}
-	return err
+	return len(syms), syms, nil, nil, nil
 }
 
 func compileSequence(target *Code, env *List, exprs *List, isTail bool, ignoreResult bool, context string) error {
@@ -455,7 +599,55 @@ func optimizeFuncall(fn Value, args *List) (Value, *List) {
 	return fn, args
 }
 
-func compileFuncall(target *Code, env *List, fn Value, args *List, isTail bool, ignoreResult bool, context string) error {
+// compileFuncall - the arguments are pushed in reverse order, then the function. The location of the call in
+// the source, if known, is recorded for the call instruction.
+// warnKeywordArgs - warn of a call to a global function with keyword arguments whose literal keywords are not
+// among its keys, or that has a keyword without a value
+func warnKeywordArgs(fn Value, env *List, args *List) {
+	sym, ok := fn.(*Symbol)
+	if !ok {
+		return
+	}
+	if _, _, local := calculateLocation(sym, env); local {
+		return
+	}
+	f, ok := currentModule.resolve(sym).Value.(*Function)
+	if !ok {
+		return
+	}
+	argc, _ := functionArity(f)
+	_, keys := functionDefaults(f)
+	if keys == nil {
+		return
+	}
+	n := ListLength(args)
+	if n < argc {
+		return
+	}
+	if (n-argc)%2 != 0 {
+		warn(fmt.Sprintf("%s is called with a keyword argument that has no value", sym))
+	}
+	for args, i := args, 0; args != EmptyList; args, i = args.Cdr, i+1 {
+		if i < argc || (i-argc)%2 != 0 {
+			continue
+		}
+		key, ok := args.Car.(*Keyword)
+		if !ok {
+			continue
+		}
+		known := false
+		for _, k := range keys {
+			if k == key || k == Intern(key.Name()) {
+				known = true
+			}
+		}
+		if !known {
+			warn(fmt.Sprintf("%s has no keyword argument %s", sym, key))
+		}
+	}
+}
+
+func compileFuncall(target *Code, env *List, fn Value, args *List, isTail bool, ignoreResult bool, context string, loc *Location) error {
 	argc := ListLength(args)
 	if argc < 0 {
 		return NewError(SyntaxErrorKey, Cons(fn, args))
@@ -470,8 +662,10 @@ func compileFuncall(target *Code, env *List, fn Value, args *List, isTail bool,
 	}
 	if isTail {
 		target.emitTailCall(argc)
+		target.locate(loc)
 	} else {
 		target.emitCall(argc)
+		target.locate(loc)
 		if ignoreResult {
 			target.emitPop()
 		}
@@ -479,6 +673,110 @@ func compileFuncall(target *Code, env *List, fn Value, args *List, isTail bool,
 	return nil
 }
 
+func compilePrimopCall(target *Code, env *List, op int, args *List, isTail bool, ignoreResult bool, context string, loc *Location) error {
+	err := compileArgs(target, env, args, context)
+	if err != nil {
+		return err
+	}
+	target.emitPrimop(op)
+	target.locate(loc)
+	if isTail {
+		target.emitReturn()
+	} else if ignoreResult {
+		target.emitPop()
+	}
+	return nil
+}
+
+// inlinableParams - the parameters of a function that is called as soon as it is made, as in the expansion of a
+// let, if its body can be compiled inline, in the frame of the function it is called from. Only functions with
+// the same number of plain parameters as there are arguments are inlined, and not at the top level, which has
+// no variables. The body must not make closures, which would share the frame: a loop assigns the inlined
+// variables again on each iteration, where each iteration of a let would otherwise have its own.
+func inlinableParams(target *Code, env *List, fn Value, argc int) ([]Value, bool) {
+	lambda, ok := fn.(*List)
+	if !ok || env == EmptyList || Car(lambda) != Intern("fn") || ListLength(lambda) < 3 {
+		return nil, false
+	}
+	lst, ok := Cadr(lambda).(*List)
+	if !ok || ListLength(lst) != argc {
+		return nil, false
+	}
+	var params []Value
+	for ; lst != EmptyList; lst = lst.Cdr {
+		if !IsSymbol(lst.Car) || lst.Car == Intern("&") || lst.Car == target.loop {
+			return nil, false
+		}
+		params = append(params, lst.Car)
+	}
+	if makesClosure(target, env, Cddr(lambda)) {
+		return nil, false
+	}
+	return params, true
+}
+
+// makesClosure - true if evaluating the expression might make a closure over the current frame. A function that
+// is itself inlined does not.
+func makesClosure(target *Code, env *List, expr Value) bool {
+	switch p := expr.(type) {
+	case *List:
+		if _, ok := inlinableParams(target, env, Car(p), ListLength(Cdr(p))); ok {
+			return makesClosure(target, env, Cdr(p))
+		}
+		switch Car(p) {
+		case Intern("quote"):
+			return false
+		case Intern("fn"), Intern("named-let"), Intern("letrec*"), Intern("handler-case"), Intern("code"):
+			return true
+		}
+		for ; p != EmptyList; p = p.Cdr {
+			if makesClosure(target, env, p.Car) {
+				return true
+			}
+		}
+	case *Vector:
+		for _, el := range p.Elements {
+			if makesClosure(target, env, el) {
+				return true
+			}
+		}
+	case *Struct:
+		for _, e := range p.Entries() {
+			if makesClosure(target, env, e.Key) || makesClosure(target, env, e.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compileInline - the arguments are assigned to new slots at the end of the current frame, and the body is
+// compiled with the parameters bound to those slots, instead of making a closure and calling it. A variable
+// of the frame with the same name as a parameter is hidden while the body is compiled.
+func compileInline(target *Code, env *List, params []Value, body *List, args *List, isTail bool, ignoreResult bool, context string) error {
+	err := compileArgs(target, env, args, context)
+	if err != nil {
+		return err
+	}
+	var names []Value
+	for rib := env.Car.(*List); rib != EmptyList; rib = rib.Cdr {
+		name := rib.Car
+		for _, param := range params {
+			if name == param {
+				name = Null
+			}
+		}
+		names = append(names, name)
+	}
+	base := len(names)
+	for j := range params {
+		target.emitSetLocal(0, base+j)
+		target.emitPop()
+	}
+	names = append(names, params...)
+	return compileSequence(target, Cons(ListFromValues(names), env.Cdr), body, isTail, ignoreResult, context)
+}
+
 func compileArgs(target *Code, env *List, args Value, context string) error {
 	if args != EmptyList {
 		err := compileArgs(target, env, Cdr(args), context)
@@ -518,16 +816,457 @@ func compileIfElse(target *Code, env *List, predicate Value, Consequent Value, a
 	return err
 }
 
+// compileLoop - a named let is compiled as a function of its variables, called with their initial values, in
+// which calls of the name are jumps back to the start. The expander only leaves a named let for the compiler if
+// all those calls are tail calls made directly by its body.
+func compileLoop(target *Code, env *List, expr *List, isTail bool, ignoreResult bool, context string) error {
+	var names []Value
+	var values []Value
+	for bindings := Caddr(expr); bindings != EmptyList; bindings = Cdr(bindings) {
+		binding := Car(bindings)
+		if ListLength(binding) != 2 || !IsSymbol(Car(binding)) {
+			return NewError(SyntaxErrorKey, expr)
+		}
+		names = append(names, Car(binding))
+		values = append(values, Cadr(binding))
+	}
+	loopCode := MakeCode(len(names), nil, nil, context)
+	loopCode.loop = Cadr(expr)
+	err := compileSequence(loopCode, Cons(ListFromValues(names), env), Cdddr(expr), true, false, context)
+	if err != nil {
+		return err
+	}
+	if peephole {
+		loopCode.optimize()
+	}
+	err = compileArgs(target, env, ListFromValues(values), context)
+	if err != nil {
+		return err
+	}
+	target.emitClosure(loopCode)
+	if isTail {
+		target.emitTailCall(len(names))
+	} else {
+		target.emitCall(len(names))
+		if ignoreResult {
+			target.emitPop()
+		}
+	}
+	return nil
+}
+
+// compileLetrec - the variables of a letrec get a frame of their own, allocated once, and are initialized in order
+// by code run in that frame, followed by the body. A value that refers to its own variable or a later one, other
+// than from within a function, would see it before it is initialized, so that is an error. A value that calls a
+// function might still reach an uninitialized variable, so in that case they are all first set to null.
+func compileLetrec(target *Code, env *List, expr *List, isTail bool, ignoreResult bool, context string) error {
+	var names []Value
+	var values []Value
+	for bindings := Cadr(expr); bindings != EmptyList; bindings = Cdr(bindings) {
+		binding := Car(bindings)
+		if ListLength(binding) != 2 || !IsSymbol(Car(binding)) {
+			return NewError(SyntaxErrorKey, expr)
+		}
+		names = append(names, Car(binding))
+		values = append(values, Cadr(binding))
+	}
+	letCode := MakeCode(0, nil, nil, context)
+	letEnv := Cons(ListFromValues(names), env)
+	for _, val := range values {
+		if lst, ok := val.(*List); ok && lst != EmptyList && lst.Car != Intern("fn") && lst.Car != Intern("quote") {
+			letCode.emitLiteral(Null)
+			for j := range names {
+				letCode.emitSetLocal(0, j)
+			}
+			letCode.emitPop()
+			break
+		}
+	}
+	for i, val := range values {
+		if name := usedBeforeInit(val, names[i:]); name != nil {
+			return NewError(SyntaxErrorKey, "letrec variable used before it is initialized: ", name)
+		}
+		err := compileExpr(letCode, letEnv, val, false, false, names[i].String())
+		if err != nil {
+			return err
+		}
+		letCode.emitSetLocal(0, i)
+		letCode.emitPop()
+	}
+	err := compileSequence(letCode, letEnv, Cddr(expr), true, false, context)
+	if err != nil {
+		return err
+	}
+	if peephole {
+		letCode.optimize()
+	}
+	target.emitClosure(letCode)
+	if isTail {
+		target.emitTailCall(0)
+	} else {
+		target.emitCall(0)
+		if ignoreResult {
+			target.emitPop()
+		}
+	}
+	return nil
+}
+
+// usedBeforeInit - the first of the names the expression refers to when it is evaluated, not counting references
+// from functions it makes, or nil if there are none
+func usedBeforeInit(expr Value, names []Value) Value {
+	switch p := expr.(type) {
+	case *Symbol:
+		for _, name := range names {
+			if p == name {
+				return p
+			}
+		}
+	case *List:
+		if p == EmptyList {
+			return nil
+		}
+		switch p.Car {
+		case Intern("quote"), Intern("fn"), Intern("code"), Intern("use"), Intern("declare"):
+			return nil
+		case Intern("set!"):
+			return usedBeforeInit(Caddr(p), names)
+		case Intern("handler-case"):
+			return usedBeforeInit(Cadr(p), names)
+		case Intern("named-let"):
+			//a loop, whose body is run at once with its variables hiding the names
+			bindings := Caddr(p)
+			if name := usedBeforeInit(bindingValues(bindings), names); name != nil {
+				return name
+			}
+			return usedBeforeInit(Cdddr(p), withoutNames(names, append(bindingNames(bindings), Cadr(p))))
+		case Intern("letrec*"):
+			bindings := Cadr(p)
+			inner := withoutNames(names, bindingNames(bindings))
+			if name := usedBeforeInit(bindingValues(bindings), inner); name != nil {
+				return name
+			}
+			return usedBeforeInit(Cddr(p), inner)
+		}
+		if fn, ok := p.Car.(*List); ok && fn != EmptyList && fn.Car == Intern("fn") {
+			//a let, whose body is run at once with its parameters hiding the names
+			if name := usedBeforeInit(p.Cdr, names); name != nil {
+				return name
+			}
+			inner := names
+			if params, ok := Cadr(fn).(*List); ok {
+				inner = withoutNames(names, listElements(params))
+			}
+			return usedBeforeInit(Cddr(fn), inner)
+		}
+		for ; p != EmptyList; p = p.Cdr {
+			if name := usedBeforeInit(p.Car, names); name != nil {
+				return name
+			}
+		}
+	case *Vector:
+		for _, el := range p.Elements {
+			if name := usedBeforeInit(el, names); name != nil {
+				return name
+			}
+		}
+	case *Struct:
+		for _, e := range p.Entries() {
+			if name := usedBeforeInit(e.Key, names); name != nil {
+				return name
+			}
+			if name := usedBeforeInit(e.Value, names); name != nil {
+				return name
+			}
+		}
+	}
+	return nil
+}
+
+func bindingNames(bindings Value) []Value {
+	var names []Value
+	for ; bindings != EmptyList; bindings = Cdr(bindings) {
+		names = append(names, Caar(bindings))
+	}
+	return names
+}
+
+func bindingValues(bindings Value) *List {
+	var values []Value
+	for ; bindings != EmptyList; bindings = Cdr(bindings) {
+		values = append(values, Cadar(bindings))
+	}
+	return ListFromValues(values)
+}
+
+// withoutNames - the names, less those that are hidden
+func withoutNames(names []Value, hidden []Value) []Value {
+	var result []Value
+	for _, name := range names {
+		if !ListContains(ListFromValues(hidden), name) {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// compileLoopJump - the next iteration of a loop: the arguments are assigned to the variables of the loop, and
+// execution continues from the start of its body
+func compileLoopJump(target *Code, env *List, args *List, context string) error {
+	err := compileArgs(target, env, args, context)
+	if err != nil {
+		return err
+	}
+	for j := 0; j < target.argc; j++ {
+		target.emitSetLocal(0, j)
+		target.emitPop()
+	}
+	target.emitJumpTo(0)
+	return nil
+}
+
+// compileAnd - each expression is evaluated in turn. The result is false as soon as one is false, otherwise
+// it is the value of the last expression.
+func compileAnd(target *Code, env *List, exprs *List, isTail bool, ignoreResult bool, context string) error {
+	if exprs == EmptyList {
+		return compileSelfEvalLiteral(target, True, isTail, ignoreResult)
+	}
+	var falseJumps []int
+	for ; Cdr(exprs) != EmptyList; exprs = Cdr(exprs) {
+		err := compileExpr(target, env, Car(exprs), false, false, context)
+		if err != nil {
+			return err
+		}
+		falseJumps = append(falseJumps, target.emitJumpFalse(0))
+	}
+	err := compileExpr(target, env, Car(exprs), isTail, ignoreResult, context)
+	if err != nil || len(falseJumps) == 0 {
+		return err
+	}
+	loc := 0
+	if !isTail {
+		loc = target.emitJump(0)
+	}
+	for _, falseJump := range falseJumps {
+		target.setJumpLocation(falseJump)
+	}
+	compileSelfEvalLiteral(target, False, isTail, ignoreResult)
+	if !isTail {
+		target.setJumpLocation(loc)
+	}
+	return nil
+}
+
+// compileOr - each expression is evaluated in turn, and the first value that is not false is the result.
+// The value is duplicated so that it is still on the stack after it is tested.
+func compileOr(target *Code, env *List, exprs *List, isTail bool, ignoreResult bool, context string) error {
+	if exprs == EmptyList {
+		return compileSelfEvalLiteral(target, False, isTail, ignoreResult)
+	}
+	var trueJumps []int
+	for ; Cdr(exprs) != EmptyList; exprs = Cdr(exprs) {
+		err := compileExpr(target, env, Car(exprs), false, false, context)
+		if err != nil {
+			return err
+		}
+		if ignoreResult {
+			next := target.emitJumpFalse(0)
+			trueJumps = append(trueJumps, target.emitJump(0))
+			target.setJumpLocation(next)
+			continue
+		}
+		target.emitDup()
+		next := target.emitJumpFalse(0)
+		if isTail {
+			target.emitReturn()
+		} else {
+			trueJumps = append(trueJumps, target.emitJump(0))
+		}
+		target.setJumpLocation(next)
+		target.emitPop()
+	}
+	err := compileExpr(target, env, Car(exprs), isTail, ignoreResult, context)
+	if err != nil {
+		return err
+	}
+	for _, trueJump := range trueJumps {
+		target.setJumpLocation(trueJump)
+	}
+	return nil
+}
+
+// compileCase - the key is evaluated once and kept on the stack while it is compared with the datums of each
+// clause in turn using equal?. The body of the first clause with a matching datum is the result, or that of
+// the else clause if none match, or null if there is no else clause.
+func compileCase(target *Code, env *List, expr *List, isTail bool, ignoreResult bool, context string) error {
+	err := compileExpr(target, env, Cadr(expr), false, false, context)
+	if err != nil {
+		return err
+	}
+	var endJumps []int
+	hasElse := false
+	for clauses := Cddr(expr); clauses != EmptyList; clauses = Cdr(clauses) {
+		clause, ok := Car(clauses).(*List)
+		if !ok || clause == EmptyList || clause.Cdr == EmptyList {
+			return NewError(SyntaxErrorKey, expr)
+		}
+		next := 0
+		if clause.Car == Intern("else") {
+			if Cdr(clauses) != EmptyList {
+				return NewError(SyntaxErrorKey, expr)
+			}
+			hasElse = true
+		} else {
+			datums, ok := clause.Car.(*List)
+			if !ok || datums == EmptyList {
+				return NewError(SyntaxErrorKey, expr)
+			}
+			var matchJumps []int
+			for ; datums != EmptyList; datums = datums.Cdr {
+				target.emitDup()
+				target.emitLiteral(datums.Car)
+				target.emitGlobal(Intern("equal?"))
+				target.emitCall(2)
+				if datums.Cdr == EmptyList {
+					next = target.emitJumpFalse(0)
+				} else {
+					skip := target.emitJumpFalse(0)
+					matchJumps = append(matchJumps, target.emitJump(0))
+					target.setJumpLocation(skip)
+				}
+			}
+			for _, matchJump := range matchJumps {
+				target.setJumpLocation(matchJump)
+			}
+		}
+		depth := target.depth //the next clause is reached with the key still on the stack
+		target.emitPop()
+		err = compileSequence(target, env, clause.Cdr, isTail, ignoreResult, context)
+		if err != nil {
+			return err
+		}
+		if hasElse {
+			break
+		}
+		target.depth = depth
+		if !isTail {
+			endJumps = append(endJumps, target.emitJump(0))
+		}
+		target.setJumpLocation(next)
+	}
+	if !hasElse {
+		target.emitPop()
+		compileSelfEvalLiteral(target, Null, isTail, ignoreResult)
+	}
+	for _, endJump := range endJumps {
+		target.setJumpLocation(endJump)
+	}
+	return nil
+}
+
+// compileCatch - the body is evaluated with a handler active. If an error is raised, the handler
+// unwinds the stack and the error object becomes the value of the catch.
+func compileCatch(target *Code, env *List, body *List, isTail bool, ignoreResult bool, context string) error {
+	loc := target.emitCatch(0)
+	err := compileSequence(target, env, body, false, false, context) //never a tail call: the handler must be removed
+	if err != nil {
+		return err
+	}
+	target.emitUncatch()
+	target.setJumpLocation(loc)
+	if ignoreResult {
+		target.emitPop()
+	} else if isTail {
+		target.emitReturn()
+	}
+	return nil
+}
+
+// compileHandlerCase - like catch, but the error is dispatched on its kind to the first matching clause.
+// If no clause matches, the error is raised again. The handler is compiled as a call to a function:
+//
+//	(handler-case expr (io-error: (e) body ...) (else (e) body ...))
+//
+//	->
+//
+//	(fn (__err__)
+//	  (if (identical? (error-kind __err__) 'io-error:)
+//	    ((fn (e) body ...) __err__)
+//	    ((fn (e) body ...) __err__)))
+func compileHandlerCase(target *Code, env *List, expr Value, isTail bool, ignoreResult bool, context string) error {
+	errsym := Intern("__err__")
+	var dispatch Value = NewList(Intern("raise"), errsym)
+	var clauses []Value
+	for lst := Cddr(expr); lst != EmptyList; lst = Cdr(lst) {
+		clauses = append(clauses, Car(lst))
+	}
+	for i := len(clauses) - 1; i >= 0; i-- {
+		clause := clauses[i]
+		if ListLength(clause) < 3 || !IsList(Cadr(clause)) || ListLength(Cadr(clause)) > 1 {
+			return NewError(SyntaxErrorKey, expr)
+		}
+		kind := Car(clause)
+		params := Cadr(clause).(*List)
+		body := Cons(Intern("fn"), Cons(params, Cddr(clause)))
+		var action Value
+		if params == EmptyList {
+			action = NewList(body)
+		} else {
+			action = NewList(body, errsym)
+		}
+		if kind == Intern("else") {
+			dispatch = action
+		} else if kind.Type() == KeywordType {
+			test := NewList(Intern("identical?"), NewList(Intern("error-kind"), errsym), NewList(Intern("quote"), kind))
+			dispatch = NewList(Intern("if"), test, action, dispatch)
+		} else {
+			return NewError(SyntaxErrorKey, expr)
+		}
+	}
+	loc := target.emitCatch(0)
+	err := compileExpr(target, env, Cadr(expr), false, false, context)
+	if err != nil {
+		return err
+	}
+	target.emitUncatch()
+	loc2 := target.emitJump(0)
+	target.setJumpLocation(loc)
+	err = compileExpr(target, env, NewList(Intern("fn"), NewList(errsym), dispatch), false, false, context)
+	if err != nil {
+		return err
+	}
+	target.emitCall(1)
+	target.setJumpLocation(loc2)
+	if ignoreResult {
+		target.emitPop()
+	} else if isTail {
+		target.emitReturn()
+	}
+	return nil
+}
+
+// compileUse - (use name [only: (name ...)] [rename: ((name new-name) ...)] [prefix: pre-]). The operand of the
+// use instruction is the module name, or the whole list if there are options.
 func compileUse(target *Code, rest *List) error {
 	lstlen := ListLength(rest)
-	if lstlen != 1 {
-		//to do: other options for use.
+	if lstlen%2 != 1 {
 		return NewError(SyntaxErrorKey, Cons(Intern("use"), rest))
 	}
 	sym := Car(rest)
 	if !IsSymbol(sym) {
 		return NewError(SyntaxErrorKey, rest)
 	}
-	target.emitUse(sym)
+	for options := Cdr(rest); options != EmptyList; options = Cddr(options) {
+		switch Car(options) {
+		case onlyKeyword, renameKeyword, prefixKeyword:
+		default:
+			return NewError(SyntaxErrorKey, "Unknown option to use: ", Car(options))
+		}
+	}
+	if lstlen == 1 {
+		target.emitUse(sym)
+	} else {
+		target.emitUse(rest)
+	}
 	return nil
 }
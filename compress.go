@@ -0,0 +1,214 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/boynton/ell/data"
+)
+
+// Gzip - the bytes compressed in the gzip format
+func Gzip(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, ioError(err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, ioError(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Gunzip - the bytes of gzip compressed data, uncompressed
+func Gunzip(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, ioError(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, ioError(err)
+	}
+	return data, nil
+}
+
+// closers - closes each of its closers in turn, i.e. a compressor and then the file it writes
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var first error
+	for _, c := range cs {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// OpenGzipInputFile - open a port that reads the uncompressed contents of the gzip file, as bytes if binary is
+// true, otherwise as characters
+func OpenGzipInputFile(path string, binary bool) (*Port, error) {
+	f, err := os.Open(ExpandFilePath(path))
+	if err != nil {
+		return nil, ioError(err)
+	}
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, ioError(err)
+	}
+	port := NewInputPort(r, path)
+	port.binary = binary
+	port.closer = closers{r, f}
+	closeWhenCollected(port)
+	return port, nil
+}
+
+// OpenGzipOutputFile - open a port that compresses what is written to it into the gzip file, as bytes if binary
+// is true, otherwise as characters. Appending adds another gzip member to the file, which reads back as the
+// concatenation of the members. The compressed data is only complete once the port is closed.
+func OpenGzipOutputFile(path string, binary bool, append bool) (*Port, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if append {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(ExpandFilePath(path), flags, 0644)
+	if err != nil {
+		return nil, ioError(err)
+	}
+	w := gzip.NewWriter(f)
+	port := &Port{name: path, writer: w, binary: binary, closer: closers{w, f}}
+	closeWhenCollected(port)
+	return port, nil
+}
+
+// ZipEntries - the entries of the zip archive, each a struct with the name:, size:, and directory: of the entry
+func ZipEntries(path string) (*List, error) {
+	r, err := zip.OpenReader(ExpandFilePath(path))
+	if err != nil {
+		return nil, ioError(err)
+	}
+	defer r.Close()
+	entries := make([]Value, 0, len(r.File))
+	for _, f := range r.File {
+		entry := NewStruct()
+		entry.Put(Intern("name:"), NewString(f.Name))
+		entry.Put(Intern("size:"), Int(int64(f.UncompressedSize64)))
+		entry.Put(Intern("directory:"), False)
+		if f.FileInfo().IsDir() {
+			entry.Put(Intern("directory:"), True)
+		}
+		entries = append(entries, entry)
+	}
+	return ListFromValues(entries), nil
+}
+
+// ZipExtract - extract the entries of the zip archive into the directory, creating it if necessary, and return
+// the names of the files extracted. An entry whose name would put it outside the directory is an error.
+func ZipExtract(path string, dir string) (*List, error) {
+	r, err := zip.OpenReader(ExpandFilePath(path))
+	if err != nil {
+		return nil, ioError(err)
+	}
+	defer r.Close()
+	dir = filepath.Clean(ExpandFilePath(dir))
+	var names []Value
+	for _, f := range r.File {
+		target := filepath.Join(dir, f.Name)
+		if target != dir && !strings.HasPrefix(target, dir+string(os.PathSeparator)) {
+			return nil, NewError(IOErrorKey, "Zip entry is outside the directory: ", NewString(f.Name))
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return nil, ioError(err)
+			}
+			continue
+		}
+		if err := extractZipFile(f, target); err != nil {
+			return nil, err
+		}
+		names = append(names, NewString(f.Name))
+	}
+	return ListFromValues(names), nil
+}
+
+func extractZipFile(f *zip.File, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return ioError(err)
+	}
+	in, err := f.Open()
+	if err != nil {
+		return ioError(err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return ioError(err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return ioError(err)
+	}
+	return ioError(out.Close())
+}
+
+// compressArg - the bytes of the blob or string argument
+func compressArg(name string, arg Value) ([]byte, error) {
+	switch p := arg.(type) {
+	case *Blob:
+		return p.Value, nil
+	case *String:
+		return []byte(p.Value), nil
+	}
+	return nil, argTypeError(name, "<blob> or <string>", 1, arg)
+}
+
+func ellGzip(argv []Value) (Value, error) {
+	b, err := compressArg("gzip", argv[0])
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := Gzip(b)
+	if err != nil {
+		return nil, err
+	}
+	return NewBlob(compressed), nil
+}
+
+func ellGunzip(argv []Value) (Value, error) {
+	b, err := Gunzip(argv[0].(*Blob).Value)
+	if err != nil {
+		return nil, err
+	}
+	return NewBlob(b), nil
+}
+
+func ellZipEntries(argv []Value) (Value, error) {
+	return ZipEntries(StringValue(argv[0]))
+}
+
+func ellZipExtract(argv []Value) (Value, error) {
+	return ZipExtract(StringValue(argv[0]), StringValue(argv[1]))
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	. "github.com/boynton/ell/data"
+)
+
+// Copy - a new container with the same elements as the list, vector, struct, set, hashmap, blob, or instance of
+// one of them. The copy is not frozen. Other values are immutable, and are returned as is.
+func Copy(obj Value) Value {
+	switch p := obj.(type) {
+	case *List:
+		return ListFromValues(ListToVector(p).Elements)
+	case *Vector:
+		return NewVector(p.Elements...)
+	case *Struct:
+		return p.Copy()
+	case *Set:
+		return NewSet(p.Members()...)
+	case *HashMap:
+		return &HashMap{table: p.table.Copy()}
+	case *Blob:
+		return NewBlob(append([]byte(nil), p.Value...))
+	case *Instance:
+		CountInstance()
+		return &Instance{TypeTag: p.TypeTag, Value: Copy(p.Value)}
+	}
+	return obj
+}
+
+// DeepCopy - a copy of the value, like Copy, in which the elements of containers are also copied, all the way
+// down. Values shared within the original are shared within the copy, so cycles are copied as cycles. The keys
+// of structs, sets, and hashmaps are not copied.
+func DeepCopy(obj Value) Value {
+	return deepCopy(obj, make(map[Value]Value))
+}
+
+func deepCopy(obj Value, copies map[Value]Value) Value {
+	if cp, ok := copies[obj]; ok {
+		return cp
+	}
+	switch p := obj.(type) {
+	case *List:
+		if p == EmptyList {
+			return p
+		}
+		head := Cons(nil, EmptyList)
+		copies[p] = head
+		for tail := head; ; tail = tail.Cdr {
+			tail.Car = deepCopy(p.Car, copies)
+			if p = p.Cdr; p == EmptyList {
+				break
+			}
+			if cp, ok := copies[p]; ok {
+				tail.Cdr = cp.(*List)
+				break
+			}
+			tail.Cdr = Cons(nil, EmptyList)
+			copies[p] = tail.Cdr
+		}
+		return head
+	case *Vector:
+		cp := MakeVector(len(p.Elements), Null)
+		copies[p] = cp
+		for i, e := range p.Elements {
+			cp.Elements[i] = deepCopy(e, copies)
+		}
+		return cp
+	case *Struct:
+		cp := NewStruct()
+		copies[p] = cp
+		for _, e := range p.Entries() {
+			cp.Put(e.Key, deepCopy(e.Value, copies))
+		}
+		return cp
+	case *HashMap:
+		cp := &HashMap{table: deepCopy(p.table, copies).(*Struct)}
+		copies[p] = cp
+		return cp
+	case *Instance:
+		CountInstance()
+		cp := &Instance{TypeTag: p.TypeTag}
+		copies[p] = cp
+		cp.Value = deepCopy(p.Value, copies)
+		return cp
+	}
+	return Copy(obj)
+}
+
+// Freeze - make every vector and struct in the value immutable, including the value itself and those within
+// lists, vectors, structs, and instances, all the way down. The value is returned.
+func Freeze(obj Value) Value {
+	freeze(obj, make(map[Value]bool))
+	return obj
+}
+
+func freeze(obj Value, seen map[Value]bool) {
+	if seen[obj] {
+		return
+	}
+	switch p := obj.(type) {
+	case *List:
+		for ; p != EmptyList && !seen[p]; p = p.Cdr {
+			seen[p] = true
+			freeze(p.Car, seen)
+		}
+	case *Vector:
+		seen[p] = true
+		p.Freeze()
+		for _, e := range p.Elements {
+			freeze(e, seen)
+		}
+	case *Struct:
+		seen[p] = true
+		p.Freeze()
+		for _, e := range p.Entries() {
+			freeze(e.Key, seen)
+			freeze(e.Value, seen)
+		}
+	case *Instance:
+		seen[p] = true
+		freeze(p.Value, seen)
+	}
+}
+
+// IsFrozen - true if the value is a frozen vector or struct, or an instance of one
+func IsFrozen(obj Value) bool {
+	switch p := obj.(type) {
+	case *Vector:
+		return p.IsFrozen()
+	case *Struct:
+		return p.IsFrozen()
+	case *Instance:
+		return IsFrozen(p.Value)
+	}
+	return false
+}
+
+// checkMutable - an error if the value is frozen, for the function that would change it
+func checkMutable(obj Value, name string) error {
+	if IsFrozen(obj) {
+		return NewError(ArgumentErrorKey, name, " cannot change a frozen ", obj.Type())
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2021 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// The values allocated are counted by type, with an estimate of the memory they take. The counts are global, so
+// they include the allocations of all goroutines. Values that are preallocated, such as small integers, and the
+// growth of containers after they are made are not counted. Nothing is counted until the counts are wanted, so
+// that goroutines allocating values don't contend for the shared counters when nobody reads them.
+
+// AllocStat - the number of values of a type allocated so far, and the bytes they took
+type AllocStat struct {
+	Type  string //the name of the type, i.e. "<list>"
+	Count int64
+	Bytes int64
+}
+
+// AllocCounter - counts the allocations of values of one type
+type AllocCounter struct {
+	typ   string
+	size  int64 //the size of each value
+	count int64
+	extra int64 //the bytes of the values' variable sized parts, such as the elements of vectors
+}
+
+var allocMutex sync.Mutex
+var allocCounters []*AllocCounter
+
+// counting - true once allocations are counted
+var counting atomic.Bool
+
+// CountAllocations - start counting allocations, if they are not counted already. The counts are of the
+// allocations made since the first call.
+func CountAllocations() {
+	counting.Store(true)
+}
+
+// NewAllocCounter - a counter of the allocations of values of the named type, each of the given size
+func NewAllocCounter(typ string, size uintptr) *AllocCounter {
+	allocMutex.Lock()
+	defer allocMutex.Unlock()
+	c := &AllocCounter{typ: typ, size: int64(size)}
+	allocCounters = append(allocCounters, c)
+	return c
+}
+
+// Add - count an allocation, whose variable sized part, if any, took the extra bytes
+func (c *AllocCounter) Add(extra int) {
+	if !counting.Load() {
+		return
+	}
+	atomic.AddInt64(&c.count, 1)
+	if extra > 0 {
+		atomic.AddInt64(&c.extra, int64(extra))
+	}
+}
+
+// Count - the number of values allocated so far
+func (c *AllocCounter) Count() int64 {
+	return atomic.LoadInt64(&c.count)
+}
+
+// AllocStats - the allocations so far, by type, in the order the counters were made
+func AllocStats() []AllocStat {
+	allocMutex.Lock()
+	defer allocMutex.Unlock()
+	stats := make([]AllocStat, 0, len(allocCounters))
+	for _, c := range allocCounters {
+		count := atomic.LoadInt64(&c.count)
+		stats = append(stats, AllocStat{Type: c.typ, Count: count, Bytes: count*c.size + atomic.LoadInt64(&c.extra)})
+	}
+	return stats
+}
+
+const valueSize = unsafe.Sizeof(Value(nil))
+const structEntrySize = unsafe.Sizeof(StructEntry{})
+
+var listAllocs = NewAllocCounter("<list>", unsafe.Sizeof(List{}))
+var numberAllocs = NewAllocCounter("<number>", unsafe.Sizeof(Number{}))
+var stringAllocs = NewAllocCounter("<string>", unsafe.Sizeof(String{}))
+var vectorAllocs = NewAllocCounter("<vector>", unsafe.Sizeof(Vector{}))
+var structAllocs = NewAllocCounter("<struct>", unsafe.Sizeof(Struct{}))
+var instanceAllocs = NewAllocCounter("<instance>", unsafe.Sizeof(Instance{}))
+
+// CountInstance - count the allocation of an instance made without NewInstance
+func CountInstance() {
+	instanceAllocs.Add(0)
+}
@@ -18,8 +18,13 @@ package data
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 type ReaderExtension interface {
@@ -27,10 +32,56 @@ type ReaderExtension interface {
 	HandleReaderMacro(c byte) (Value, error, bool)
 }
 
+// KeywordStyle - how keywords are written in the input of a Reader
+type KeywordStyle int
+
+const (
+	KeywordsTrailing KeywordStyle = iota //name:, as Ell writes them
+	KeywordsLeading                      //:name, as in EDN. A colon at the end of a name is dropped, so {a: 1} has the key a
+)
+
+// ReaderOptions - the dialect of the notation a Reader accepts. The zero value is EllDN, which also reads JSON,
+// since the colon after a key in braces is optional, and commas are whitespace.
+type ReaderOptions struct {
+	Maps     func(kv []Value) (Value, error) //if not nil, braces are read as what it makes of their keys and values, rather than as a struct
+	Keywords KeywordStyle
+	JSON     bool //if true, only JSON is accepted, with its colons and commas, and no comments, symbols, or reader macros
+}
+
 type Reader struct {
-	Input     *bufio.Reader
-	Position  int
-	Extension ReaderExtension
+	ReaderOptions
+	Input       *bufio.Reader
+	Position    int
+	Extension   ReaderExtension
+	File        string              //the name of the input, for the locations of what is read from it
+	Locations   map[Value]*Location //if not nil, the location of each list, vector, and struct read is recorded in it
+	Incremental bool                //if true, input that ends in the middle of a value is NeedMoreInput, not io.EOF
+	line        int                 //the number of newlines read so far
+	column      int                 //the number of bytes read so far on the current line
+	prevChar    byte
+	prevEnd     int //the column of the end of the previous line, in case its newline is unread
+	startLine   int //the line the last value read started on
+	startColumn int
+	startPos    int //the position in the input of the start of the last value read
+}
+
+// NeedMoreInput - the error an incremental Reader returns when its input ends before the value it is reading
+// does, i.e. "(foo (bar", so that the caller can add to the input and read it again. The input is not a
+// syntax error so far, unlike "(foo))".
+var NeedMoreInput = errors.New("need more input")
+
+// Location - the position in its input of a value read by a Reader. Lines and columns start at 1.
+type Location struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (loc *Location) String() string {
+	if loc.File == "" {
+		return fmt.Sprintf("%d:%d", loc.Line, loc.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", loc.File, loc.Line, loc.Column)
 }
 
 func (reader *Reader) Read() (Value, error) {
@@ -77,6 +128,14 @@ func (dr *Reader) GetChar() (byte, error) {
 	b, e := dr.Input.ReadByte()
 	if e == nil {
 		dr.Position++
+		dr.prevChar = b
+		if b == '\n' {
+			dr.line++
+			dr.prevEnd = dr.column
+			dr.column = 0
+		} else {
+			dr.column++
+		}
 	}
 	return b, e
 }
@@ -85,10 +144,50 @@ func (dr *Reader) UngetChar() error {
 	e := dr.Input.UnreadByte()
 	if e == nil {
 		dr.Position--
+		if dr.prevChar == '\n' {
+			dr.line--
+			dr.column = dr.prevEnd
+		} else {
+			dr.column--
+		}
 	}
 	return e
 }
 
+// StartLine - the line the last value read started on, starting at 1
+func (dr *Reader) StartLine() int {
+	return dr.startLine
+}
+
+// StartPosition - the position in the input of the first character of the last value read
+func (dr *Reader) StartPosition() int {
+	return dr.startPos
+}
+
+// StartLocation - the location of the first character of the last value read
+func (dr *Reader) StartLocation() *Location {
+	return &Location{File: dr.File, Line: dr.startLine, Column: dr.startColumn}
+}
+
+// Location - the current position in the input, just after the last character read
+func (dr *Reader) Location() *Location {
+	return &Location{File: dr.File, Line: dr.line + 1, Column: dr.column}
+}
+
+// locate - record the location of the value, which started at the given line and column, if it is a list,
+// vector, or struct. Other values, such as symbols, are shared, so their location cannot be recorded.
+func (dr *Reader) locate(val Value, line int, column int) {
+	if dr.Locations == nil {
+		return
+	}
+	switch val.(type) {
+	case *List, *Vector, *Struct:
+		if val != EmptyList && dr.Locations[val] == nil {
+			dr.Locations[val] = &Location{File: dr.File, Line: line + 1, Column: column}
+		}
+	}
+}
+
 func (dr *Reader) ReadValue() (Value, error) {
 	c, e := dr.GetChar()
 	for e == nil {
@@ -96,38 +195,69 @@ func (dr *Reader) ReadValue() (Value, error) {
 			c, e = dr.GetChar()
 			continue
 		}
-		switch c {
-		case ';':
-			e = dr.DecodeComment()
-			if e != nil {
-				break
-			} else {
-				c, e = dr.GetChar()
-			}
-		case '#':
-			return dr.DecodeReaderMacro()
-		case '(':
-			return dr.DecodeList()
-		case '[':
-			return dr.DecodeVector()
-		case '{':
-			return dr.DecodeStruct()
-		case '"':
-			return dr.DecodeString()
-		case ')', ']', '}':
-			return nil, NewError(SyntaxErrorKey, "Unexpected '", string(c), "'")
-		default:
-			if dr.Extension != nil {
-				o, err, done := dr.Extension.HandleChar(c)
-				if done || err != nil {
-					return o, err
-				}
+		skipped, err := dr.SkipComment(c)
+		if err != nil || !skipped {
+			e = err
+			break
+		}
+		c, e = dr.GetChar()
+	}
+	if e != nil {
+		return Null, e
+	}
+	return dr.readFrom(c)
+}
+
+// incomplete - the error to return for err, found in the middle of a value
+func (dr *Reader) incomplete(err error) error {
+	if err == io.EOF && dr.Incremental {
+		return NeedMoreInput
+	}
+	return err
+}
+
+// readFrom - read the value that starts with the character just read, recording its location
+func (dr *Reader) readFrom(c byte) (Value, error) {
+	line, column, pos := dr.line, dr.column, dr.Position-1
+	val, err := dr.decodeValue(c)
+	if err == nil {
+		dr.locate(val, line, column)
+	} else {
+		err = dr.incomplete(err)
+	}
+	dr.startLine = line + 1 //set after any values nested in this one
+	dr.startColumn = column
+	dr.startPos = pos
+	return val, err
+}
+
+// decodeValue - decode the value that starts with the character
+func (dr *Reader) decodeValue(c byte) (Value, error) {
+	if dr.JSON {
+		return dr.decodeJSONValue(c)
+	}
+	switch c {
+	case '#':
+		return dr.DecodeReaderMacro()
+	case '(':
+		return dr.DecodeList()
+	case '[':
+		return dr.DecodeVector()
+	case '{':
+		return dr.DecodeStruct()
+	case '"':
+		return dr.DecodeString()
+	case ')', ']', '}':
+		return nil, NewError(SyntaxErrorKey, "Unexpected '", string(c), "'")
+	default:
+		if dr.Extension != nil {
+			o, err, done := dr.Extension.HandleChar(c)
+			if done || err != nil {
+				return o, err
 			}
-			atom, err := dr.DecodeAtom(c)
-			return atom, err
 		}
+		return dr.DecodeAtom(c)
 	}
-	return Null, e
 }
 
 func (dr *Reader) DecodeComment() error {
@@ -141,6 +271,57 @@ func (dr *Reader) DecodeComment() error {
 	return e
 }
 
+// SkipComment - skip the comment that starts with the character just read, if it starts one: a line comment
+// starting with ;, a block comment between #| and |#, which may be nested, or a datum comment, where #; comments
+// out the value that follows it. A #! line at the very start of the input is a comment too, so that scripts can
+// be run directly.
+func (dr *Reader) SkipComment(c byte) (bool, error) {
+	if dr.JSON {
+		return false, nil
+	}
+	if c == ';' {
+		return true, dr.DecodeComment()
+	}
+	if c != '#' {
+		return false, nil
+	}
+	next, err := dr.Input.Peek(1)
+	if err == nil && next[0] == '!' && dr.Position == 1 {
+		return true, dr.DecodeComment()
+	}
+	if err != nil || (next[0] != '|' && next[0] != ';') {
+		return false, nil
+	}
+	dr.GetChar()
+	if next[0] == ';' {
+		_, err = dr.ReadValue()
+		return true, dr.incomplete(err)
+	}
+	return true, dr.incomplete(dr.DecodeBlockComment())
+}
+
+// DecodeBlockComment - skip to the end of a block comment, after its opening #| has been read
+func (dr *Reader) DecodeBlockComment() error {
+	depth := 1
+	prev := byte(0)
+	c, e := dr.GetChar()
+	for e == nil {
+		if prev == '|' && c == '#' {
+			depth--
+			if depth == 0 {
+				return nil
+			}
+			c = 0
+		} else if prev == '#' && c == '|' {
+			depth++
+			c = 0
+		}
+		prev = c
+		c, e = dr.GetChar()
+	}
+	return e
+}
+
 func (dr *Reader) DecodeString() (Value, error) {
 	var buf []byte
 	c, e := dr.GetChar()
@@ -160,25 +341,20 @@ func (dr *Reader) DecodeString() (Value, error) {
 			case 'r':
 				buf = append(buf, '\r')
 			case 'u', 'U':
-				c, e = dr.GetChar()
-				if e != nil {
-					return nil, e
+				var hex []byte
+				for i := 0; i < 4; i++ {
+					c, e = dr.GetChar()
+					if e != nil {
+						return nil, e
+					}
+					hex = append(hex, c)
 				}
-				buf = append(buf, c)
-				c, e = dr.GetChar()
-				if e != nil {
-					return nil, e
-				}
-				buf = append(buf, c)
-				c, e = dr.GetChar()
-				if e != nil {
-					return nil, e
-				}
-				buf = append(buf, c)
-				c, e = dr.GetChar()
-				if e != nil {
-					return nil, e
+				r, err := strconv.ParseUint(string(hex), 16, 32)
+				if err != nil {
+					return nil, NewError(SyntaxErrorKey, "Bad unicode escape in string: \\u", string(hex))
 				}
+				buf = utf8.AppendRune(buf, rune(r))
+			default: //i.e. '"', '\\', and '/'
 				buf = append(buf, c)
 			}
 		} else if c == '"' {
@@ -217,11 +393,12 @@ func (dr *Reader) SkipToData(skipColon bool) (byte, error) {
 			c, err = dr.GetChar()
 			continue
 		}
-		if c == ';' {
-			err = dr.DecodeComment()
-			if err == nil {
-				c, err = dr.GetChar()
-			}
+		skipped, er := dr.SkipComment(c)
+		if er != nil {
+			return 0, er
+		}
+		if skipped {
+			c, err = dr.GetChar()
 			continue
 		}
 		return c, nil
@@ -238,14 +415,13 @@ func (dr *Reader) DecodeStruct() (Value, error) {
 		if err != nil {
 			return nil, err
 		}
-		if c == ':' {
+		if c == ':' && dr.Keywords != KeywordsLeading {
 			return nil, NewError(SyntaxErrorKey, "Unexpected ':' in struct")
 		}
 		if c == '}' {
-			return MakeStruct(items)
+			return dr.makeStruct(items)
 		}
-		dr.UngetChar()
-		element, err := dr.ReadValue()
+		element, err := dr.readFrom(c)
 		if err != nil {
 			return nil, err
 		}
@@ -257,8 +433,7 @@ func (dr *Reader) DecodeStruct() (Value, error) {
 		if c == '}' {
 			return nil, NewError(SyntaxErrorKey, "mismatched key/value in struct")
 		}
-		dr.UngetChar()
-		element, err = dr.ReadValue()
+		element, err = dr.readFrom(c)
 		if err != nil {
 			return nil, err
 		}
@@ -267,6 +442,18 @@ func (dr *Reader) DecodeStruct() (Value, error) {
 	return nil, err
 }
 
+// makeStruct - the value of braces with the keys and values, which is a struct unless there is a Maps option
+func (dr *Reader) makeStruct(kv []Value) (Value, error) {
+	if dr.Maps != nil {
+		return dr.Maps(kv)
+	}
+	strct, err := StructFromPairs(kv)
+	if err != nil {
+		return nil, err
+	}
+	return strct, nil
+}
+
 func (dr *Reader) DecodeSequence(endChar byte) ([]Value, error) {
 	c, err := dr.GetChar()
 	var items []Value
@@ -275,18 +462,18 @@ func (dr *Reader) DecodeSequence(endChar byte) ([]Value, error) {
 			c, err = dr.GetChar()
 			continue
 		}
-		if c == ';' {
-			err = dr.DecodeComment()
-			if err == nil {
-				c, err = dr.GetChar()
-			}
+		skipped, er := dr.SkipComment(c)
+		if er != nil {
+			return nil, er
+		}
+		if skipped {
+			c, err = dr.GetChar()
 			continue
 		}
 		if c == endChar {
 			return items, nil
 		}
-		dr.UngetChar()
-		element, er := dr.ReadValue()
+		element, er := dr.readFrom(c)
 		if er != nil {
 			return nil, er
 		}
@@ -297,6 +484,9 @@ func (dr *Reader) DecodeSequence(endChar byte) ([]Value, error) {
 }
 
 func (dr *Reader) DecodeAtom(firstChar byte) (Value, error) {
+	if dr.Keywords == KeywordsLeading {
+		return dr.decodeLeadingKeywordAtom(firstChar)
+	}
 	s, err := dr.DecodeAtomString(firstChar)
 	if err != nil {
 		return nil, err
@@ -317,12 +507,11 @@ func (dr *Reader) DecodeAtom(firstChar byte) (Value, error) {
 			return False, nil
 		}
 	}
-	f, err := strconv.ParseFloat(s, 64)
-	if err == nil {
+	if n, ok := ParseNumber(s); ok {
 		if keyword {
 			return nil, NewError(SyntaxErrorKey, "Keyword cannot have a name that looks like a number: ", s, ":")
 		}
-		return Float(f), nil
+		return n, nil
 	}
 	if keyword {
 		s += ":"
@@ -331,6 +520,43 @@ func (dr *Reader) DecodeAtom(firstChar byte) (Value, error) {
 	return sym, nil
 }
 
+// decodeLeadingKeywordAtom - decode an atom where keywords are written :name. They are the same keywords as name:
+// in Ell, and a colon at the end of a name is dropped.
+func (dr *Reader) decodeLeadingKeywordAtom(firstChar byte) (Value, error) {
+	keyword := firstChar == ':'
+	if keyword {
+		firstChar = 0
+	}
+	s, err := dr.DecodeAtomString(firstChar)
+	if err != nil {
+		return nil, err
+	}
+	if len(s) > 0 && s[len(s)-1] == ':' {
+		s = s[:len(s)-1]
+	}
+	if s == "" {
+		return nil, NewError(SyntaxErrorKey, "Invalid keyword: ':' without a name")
+	}
+	if keyword {
+		if _, ok := ParseNumber(s); ok {
+			return nil, NewError(SyntaxErrorKey, "Keyword cannot have a name that looks like a number: :", s)
+		}
+		return Intern(s + ":"), nil
+	}
+	switch s {
+	case "null":
+		return Null, nil
+	case "true":
+		return True, nil
+	case "false":
+		return False, nil
+	}
+	if n, ok := ParseNumber(s); ok {
+		return n, nil
+	}
+	return Intern(s), nil
+}
+
 func (dr *Reader) DecodeAtomString(firstChar byte) (string, error) {
 	var buf []byte
 	if firstChar != 0 {
@@ -346,7 +572,16 @@ func (dr *Reader) DecodeAtomString(firstChar byte) (string, error) {
 		}
 		if c == ':' {
 			buf = append(buf, c)
-			break
+			//a colon followed by a name is a qualified symbol, i.e. mod:name, rather than the end of a keyword
+			c, e = dr.GetChar()
+			if e != nil {
+				break
+			}
+			if IsWhitespace(c) || IsDelimiter(c) || (c >= '0' && c <= '9') {
+				dr.UngetChar()
+				break
+			}
+			continue
 		}
 		if IsDelimiter(c) {
 			dr.UngetChar()
@@ -392,6 +627,145 @@ func (dr *Reader) DecodeType(firstChar byte) (string, error) {
 	return s, nil
 }
 
+// decodeJSONValue - decode the JSON value that starts with the character
+func (dr *Reader) decodeJSONValue(c byte) (Value, error) {
+	switch c {
+	case '[':
+		items, err := dr.decodeJSONSequence(']', false)
+		if err != nil {
+			return nil, err
+		}
+		return NewVector(items...), nil
+	case '{':
+		items, err := dr.decodeJSONSequence('}', true)
+		if err != nil {
+			return nil, err
+		}
+		return dr.makeStruct(items)
+	case '"':
+		return dr.DecodeString()
+	}
+	if IsDelimiter(c) || IsWhitespace(c) {
+		return nil, NewError(SyntaxErrorKey, "Unexpected '", string(c), "' in JSON")
+	}
+	buf := []byte{c}
+	c, err := dr.GetChar()
+	for err == nil && !IsDelimiter(c) && !IsWhitespace(c) {
+		buf = append(buf, c)
+		c, err = dr.GetChar()
+	}
+	if err == nil {
+		dr.UngetChar()
+	} else if err != io.EOF {
+		return nil, err
+	}
+	s := string(buf)
+	switch s {
+	case "null":
+		return Null, nil
+	case "true":
+		return True, nil
+	case "false":
+		return False, nil
+	}
+	if isJSONNumber(s) {
+		if n, ok := ParseNumber(s); ok {
+			return n, nil
+		}
+	}
+	return nil, NewError(SyntaxErrorKey, "Not JSON: ", s)
+}
+
+// decodeJSONSequence - decode the elements of a JSON array, or the keys and values of an object, up to the end
+// character, after the opening one has been read
+func (dr *Reader) decodeJSONSequence(endChar byte, object bool) ([]Value, error) {
+	var items []Value
+	c, err := dr.skipJSONWhitespace()
+	if err == nil && c == endChar {
+		return items, nil
+	}
+	for err == nil {
+		if object && c != '"' {
+			return nil, NewError(SyntaxErrorKey, "JSON object keys must be strings, got '", string(c), "'")
+		}
+		val, er := dr.readFrom(c)
+		if er != nil {
+			return nil, er
+		}
+		items = append(items, val)
+		if object {
+			if c, err = dr.skipJSONWhitespace(); err != nil {
+				break
+			}
+			if c != ':' {
+				return nil, NewError(SyntaxErrorKey, "Expected ':' after a JSON object key, got '", string(c), "'")
+			}
+			if c, err = dr.skipJSONWhitespace(); err != nil {
+				break
+			}
+			if val, err = dr.readFrom(c); err != nil {
+				return nil, err
+			}
+			items = append(items, val)
+		}
+		if c, err = dr.skipJSONWhitespace(); err != nil {
+			break
+		}
+		if c == endChar {
+			return items, nil
+		}
+		if c != ',' {
+			return nil, NewError(SyntaxErrorKey, "Expected ',' or '", string(endChar), "' in JSON, got '", string(c), "'")
+		}
+		c, err = dr.skipJSONWhitespace()
+	}
+	return nil, err
+}
+
+// skipJSONWhitespace - the next character that is not whitespace. Commas are not whitespace in JSON.
+func (dr *Reader) skipJSONWhitespace() (byte, error) {
+	c, err := dr.GetChar()
+	for err == nil && (c == ' ' || c == '\n' || c == '\t' || c == '\r') {
+		c, err = dr.GetChar()
+	}
+	return c, err
+}
+
+// isJSONNumber - true if the text is a number as JSON writes them: an optional minus sign, an integer part with no
+// leading zeros, then an optional fraction and exponent
+func isJSONNumber(s string) bool {
+	i := 0
+	digits := func() int {
+		start := i
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		return i - start
+	}
+	if i < len(s) && s[i] == '-' {
+		i++
+	}
+	if n := digits(); n == 0 || (n > 1 && s[i-n] == '0') {
+		return false
+	}
+	if i < len(s) && s[i] == '.' {
+		i++
+		if digits() == 0 {
+			return false
+		}
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		if digits() == 0 {
+			return false
+		}
+	}
+	return i == len(s)
+}
+
 func (dr *Reader) DecodeReaderMacro() (Value, error) {
 	c, e := dr.GetChar()
 	if e != nil {
@@ -411,6 +785,9 @@ func (dr *Reader) DecodeReaderMacro() (Value, error) {
 				return o, err
 			}
 		}
+		if c != '<' {
+			return dr.DecodeTagged(c)
+		}
 		atom, err := dr.DecodeType(c)
 		if err != nil {
 			return nil, err
@@ -426,14 +803,39 @@ func (dr *Reader) DecodeReaderMacro() (Value, error) {
 	}
 }
 
+// DecodeTagged - decode a tagged literal, i.e. #point{x: 1 y: 2}, whose tag starts with the character after the #
+func (dr *Reader) DecodeTagged(firstChar byte) (Value, error) {
+	s, err := dr.DecodeAtomString(firstChar)
+	if err != nil {
+		return nil, err
+	}
+	tag, ok := Intern(s).(*Symbol)
+	if !ok || !((firstChar >= 'a' && firstChar <= 'z') || (firstChar >= 'A' && firstChar <= 'Z')) {
+		return nil, NewError(SyntaxErrorKey, "Bad reader macro: #", s, " ...")
+	}
+	val, err := dr.ReadValue()
+	if err != nil {
+		if err == io.EOF && !dr.Incremental {
+			return nil, NewError(SyntaxErrorKey, "Missing value for tagged literal: #", s)
+		}
+		return nil, err
+	}
+	return MakeTagged(tag, val)
+}
+
 type WriterExtension interface {
 	HandleValue(v Value) (string, error, bool)
 }
 
 type Writer struct {
-	Json      bool
-	Indent    string
-	Extension WriterExtension
+	Json           bool
+	Indent         string
+	SortKeys       bool //write the fields of structs in the order of their keys, rather than in no particular order
+	EscapeNonASCII bool //in JSON, write the characters outside of ASCII as \u escapes
+	MaxLength      int  //if not zero, the elements of lists, vectors, and structs after this many are written as ...
+	MaxDepth       int  //if not zero, lists, vectors, and structs nested more than this deep are written as ...
+	Extension      WriterExtension
+	depth          int //the number of lists, vectors, and structs being written that contain the current value
 }
 
 func (writer *Writer) Write(val Value) (string, error) {
@@ -455,6 +857,19 @@ func (writer *Writer) WriteAll(lst *List) (string, error) {
 	return buf.String(), nil
 }
 
+// WriteStream - write the value to the output, as Write would return it, but without building the text in memory
+func (writer *Writer) WriteStream(w io.Writer, val Value) error {
+	out := bufio.NewWriter(w)
+	err := writer.encode(out, val, writer.Json, "", writer.Indent)
+	if err == nil && writer.Indent != "" {
+		out.WriteString("\n")
+	}
+	if err2 := out.Flush(); err2 != nil && err == nil {
+		err = NewError(IOErrorKey, err2.Error())
+	}
+	return err
+}
+
 /*
 func (writer *Writer) WriteAllIndent(lst *List, indent string) string {
 	var buf bytes.Buffer
@@ -506,63 +921,138 @@ func (writer *Writer) writeToString(obj Value) (string, error) {
 }
 
 func (writer *Writer) WriteData(o Value, json bool, indent string, indentSize string) (string, error) {
-	//an error is never returned for non-json
+	var buf bytes.Buffer
+	err := writer.encode(&buf, o, json, indent, indentSize)
+	return buf.String(), err
+}
+
+func (writer *Writer) WriteVector(vec *Vector, json bool, indent string, indentSize string) (string, error) {
+	var buf bytes.Buffer
+	err := writer.encodeVector(&buf, vec, json, indent, indentSize)
+	return buf.String(), err
+}
+
+func (writer *Writer) WriteStruct(strct *Struct, json bool, indent string, indentSize string) (string, error) {
+	var buf bytes.Buffer
+	err := writer.encodeStruct(&buf, strct, json, indent, indentSize)
+	return buf.String(), err
+}
+
+func (writer *Writer) WriteList(lst *List, indent string, indentSize string) string {
+	var buf bytes.Buffer
+	writer.encodeList(&buf, lst, indent, indentSize)
+	return buf.String()
+}
+
+// encode - write the value to the output. Errors writing to the output are left for the caller to find, i.e.
+// when it flushes a bufio.Writer, so an error is never returned for non-json.
+func (writer *Writer) encode(out io.StringWriter, o Value, json bool, indent string, indentSize string) error {
 	if writer.Extension != nil {
 		s, err, done := writer.Extension.HandleValue(o)
 		if done || err != nil {
-			return s, err
+			out.WriteString(s)
+			return err
 		}
 	}
 	if o == Null {
-		return "null", nil
+		out.WriteString("null")
+		return nil
+	}
+	if !json {
+		if s, ok := PrintWithMethod(o); ok {
+			out.WriteString(s)
+			return nil
+		}
+		if writer.encodeTagged(out, o, indent, indentSize) {
+			return nil
+		}
+	}
+	if !json {
+		switch o.(type) {
+		case *List, *Vector, *Struct:
+			if writer.MaxDepth > 0 && writer.depth >= writer.MaxDepth {
+				out.WriteString("...")
+				return nil
+			}
+			writer.depth++
+			defer func() { writer.depth-- }()
+		}
 	}
 	switch p := o.(type) {
 	case *Boolean:
-		return p.String(), nil
+		out.WriteString(p.String())
 	case *Number:
-		return p.String(), nil
+		if json {
+			s, err := jsonNumber(p)
+			if err != nil {
+				return err
+			}
+			out.WriteString(s)
+		} else {
+			out.WriteString(p.String())
+		}
 	case *List:
 		if json {
-			return writer.WriteVector(ListToVector(p), json, indent, indentSize)
+			return writer.encodeVector(out, ListToVector(p), json, indent, indentSize)
 		}
-		return writer.WriteList(p, indent, indentSize), nil
+		writer.encodeList(out, p, indent, indentSize)
 	case *Keyword:
 		if json {
-			return EncodeString(p.Name()), nil
+			writer.encodeString(out, p.Name(), json)
+		} else {
+			out.WriteString(p.String())
 		}
-		return p.String(), nil
 	case *Symbol:
 		if json {
-			return EncodeString(p.Name()), nil
+			writer.encodeString(out, p.Name(), json)
+		} else {
+			out.WriteString(o.String())
 		}
-		return o.String(), nil
 	case *Type:
 		if json {
-			return EncodeString(p.Name()), nil
+			writer.encodeString(out, p.Name(), json)
+		} else {
+			out.WriteString(o.String())
 		}
-		return o.String(), nil
 	case *String:
-		return EncodeString(p.Value), nil
+		writer.encodeString(out, p.Value, json)
 	case *Vector:
-		return writer.WriteVector(p, json, indent, indentSize)
+		return writer.encodeVector(out, p, json, indent, indentSize)
 	case *Struct:
-		return writer.WriteStruct(p, json, indent, indentSize)
+		return writer.encodeStruct(out, p, json, indent, indentSize)
 	case *Instance:
 		if json {
-			return p.Value.String(), nil
+			return writer.encode(out, p.Value, json, indent, indentSize)
 		}
-		return o.String(), nil
+		out.WriteString("#" + p.TypeTag.String())
+		writer.encode(out, p.Value, json, indent, indentSize)
 	default:
 		if json {
-			return "", NewError(ArgumentErrorKey, "Data cannot be described in JSON: ", o)
+			return NewError(ArgumentErrorKey, "Data cannot be described in JSON: ", o)
 		}
-		return o.String(), nil
+		out.WriteString(o.String())
 	}
+	return nil
 }
 
-func (writer *Writer) WriteVector(vec *Vector, json bool, indent string, indentSize string) (string, error) {
-	var buf bytes.Buffer
-	buf.WriteString("[")
+// encodeTagged - write the value as a tagged literal, if a tag writer is defined for its type. If the tag
+// writer fails, or returns another value of the same type, the value is written as it would be otherwise.
+func (writer *Writer) encodeTagged(out io.StringWriter, o Value, indent string, indentSize string) bool {
+	tw := taggedWriter(o.Type())
+	if tw == nil {
+		return false
+	}
+	val, err := tw.write(o)
+	if err != nil || val == nil || val.Type() == o.Type() {
+		return false
+	}
+	out.WriteString("#" + tw.tag.Text + " ")
+	writer.encode(out, val, false, indent, indentSize)
+	return true
+}
+
+func (writer *Writer) encodeVector(out io.StringWriter, vec *Vector, json bool, indent string, indentSize string) error {
+	out.WriteString("[")
 	vlen := len(vec.Elements)
 	if vlen > 0 {
 		delim := ""
@@ -573,35 +1063,33 @@ func (writer *Writer) WriteVector(vec *Vector, json bool, indent string, indentS
 		if indentSize != "" {
 			nextIndent = indent + indentSize
 			delim = delim + "\n" + nextIndent
-			buf.WriteString("\n" + nextIndent)
+			out.WriteString("\n" + nextIndent)
 		} else {
 			delim = delim + " "
 		}
-		s, err := writer.WriteData(vec.Elements[0], json, nextIndent, indentSize)
-		if err != nil {
-			return "", err
-		}
-		buf.WriteString(s)
-		for i := 1; i < vlen; i++ {
-			s, err := writer.WriteData(vec.Elements[i], json, nextIndent, indentSize)
-			if err != nil {
-				return "", err
+		for i, el := range vec.Elements {
+			if i > 0 {
+				out.WriteString(delim)
+			}
+			if writer.elided(i, json) {
+				out.WriteString("...")
+				break
+			}
+			if err := writer.encode(out, el, json, nextIndent, indentSize); err != nil {
+				return err
 			}
-			buf.WriteString(delim)
-			buf.WriteString(s)
+		}
+		if indentSize != "" {
+			out.WriteString("\n" + indent)
 		}
 	}
-	if indentSize != "" {
-		buf.WriteString("\n" + indent)
-	}
-	buf.WriteString("]")
-	return buf.String(), nil
+	out.WriteString("]")
+	return nil
 }
 
-func (writer *Writer) WriteStruct(strct *Struct, json bool, indent string, indentSize string) (string, error) {
-	var buf bytes.Buffer
-	buf.WriteString("{")
-	size := len(strct.Bindings)
+func (writer *Writer) encodeStruct(out io.StringWriter, strct *Struct, json bool, indent string, indentSize string) error {
+	out.WriteString("{")
+	size := strct.Length()
 	delim := ""
 	sep := " "
 	if json {
@@ -613,64 +1101,135 @@ func (writer *Writer) WriteStruct(strct *Struct, json bool, indent string, inden
 		if indentSize != "" {
 			nextIndent = indent + indentSize
 			delim = delim + "\n" + nextIndent
-			buf.WriteString("\n" + nextIndent)
+			out.WriteString("\n" + nextIndent)
 		} else {
 			delim = delim + " "
 		}
 	}
-	first := true
-	for k, v := range strct.Bindings {
-		if first {
-			first = false
-		} else {
-			buf.WriteString(delim)
+	entries := strct.Entries()
+	if writer.SortKeys {
+		entries = SortedEntries(strct)
+	}
+	for i, e := range entries {
+		if i > 0 {
+			out.WriteString(delim)
 		}
-		s, err := writer.WriteData(k.ToValue(), json, nextIndent, indentSize)
-		if err != nil {
-			return "", err
+		if writer.elided(i, json) {
+			out.WriteString("...")
+			break
 		}
-		buf.WriteString(s)
-		buf.WriteString(sep)
-		s, err = writer.WriteData(v, json, nextIndent, indentSize)
-		if err != nil {
-			return "", err
+		if json {
+			writer.encodeString(out, jsonKey(e.Key), json)
+		} else if err := writer.encode(out, e.Key, json, nextIndent, indentSize); err != nil {
+			return err
+		}
+		out.WriteString(sep)
+		if err := writer.encode(out, e.Value, json, nextIndent, indentSize); err != nil {
+			return err
 		}
-		buf.WriteString(s)
 	}
-	if indentSize != "" {
-		buf.WriteString("\n" + indent)
+	if size > 0 && indentSize != "" {
+		out.WriteString("\n" + indent)
 	}
-	buf.WriteString("}")
-	return buf.String(), nil
+	out.WriteString("}")
+	return nil
 }
 
-func (writer *Writer) WriteList(lst *List, indent string, indentSize string) string {
+func (writer *Writer) encodeList(out io.StringWriter, lst *List, indent string, indentSize string) {
 	if lst == EmptyList {
-		return "()"
+		out.WriteString("()")
+		return
 	}
-	var buf bytes.Buffer
-	buf.WriteString("(")
+	out.WriteString("(")
 	delim := " "
 	nextIndent := ""
 	if indentSize != "" {
 		nextIndent = indent + indentSize
 		delim = "\n" + nextIndent
-		buf.WriteString("\n" + nextIndent)
+		out.WriteString("\n" + nextIndent)
 	}
-	s, _ := writer.WriteData(lst.Car, false, nextIndent, indentSize)
-	buf.WriteString(s)
-	lst = lst.Cdr
-	for lst != EmptyList {
-		buf.WriteString(delim)
-		s, _ := writer.WriteData(lst.Car, false, nextIndent, indentSize)
-		buf.WriteString(s)
+	for i := 0; lst != EmptyList; i++ {
+		if i > 0 {
+			out.WriteString(delim)
+		}
+		if writer.elided(i, false) {
+			out.WriteString("...")
+			break
+		}
+		writer.encode(out, lst.Car, false, nextIndent, indentSize)
 		lst = lst.Cdr
 	}
 	if indentSize != "" {
-		buf.WriteString("\n" + indent)
+		out.WriteString("\n" + indent)
 	}
-	buf.WriteString(")")
-	return buf.String()
+	out.WriteString(")")
+}
+
+// elided - true if the element at the index of a list, vector, or struct is beyond MaxLength, so that it and
+// the elements after it are written as ...
+func (writer *Writer) elided(i int, json bool) bool {
+	return !json && writer.MaxLength > 0 && i >= writer.MaxLength
+}
+
+// jsonKey - the struct key as a JSON object key, which is a string, whatever kind of key the struct has
+func jsonKey(k Value) string {
+	switch p := k.(type) {
+	case *String:
+		return p.Value
+	case *Symbol:
+		return p.Name()
+	case *Keyword:
+		return p.Name()
+	case *Type:
+		return p.Name()
+	}
+	return k.String()
+}
+
+// encodeString - write the string in quotes, with escapes. JSON has escapes for all the control characters,
+// and optionally for all the characters outside of ASCII.
+func (writer *Writer) encodeString(out io.StringWriter, s string, json bool) {
+	if !json {
+		out.WriteString(EncodeString(s))
+		return
+	}
+	var buf []byte
+	buf = append(buf, '"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', byte(c))
+		case c == '\n':
+			buf = append(buf, '\\', 'n')
+		case c == '\t':
+			buf = append(buf, '\\', 't')
+		case c == '\r':
+			buf = append(buf, '\\', 'r')
+		case c < 0x20 || c == 0x7f:
+			buf = append(buf, fmt.Sprintf("\\u%04x", c)...)
+		case c > 0x7f && writer.EscapeNonASCII:
+			if r1, r2 := utf16.EncodeRune(c); r1 != utf8.RuneError {
+				buf = append(buf, fmt.Sprintf("\\u%04x\\u%04x", r1, r2)...)
+			} else {
+				buf = append(buf, fmt.Sprintf("\\u%04x", c)...)
+			}
+		default:
+			buf = utf8.AppendRune(buf, c)
+		}
+	}
+	buf = append(buf, '"')
+	out.WriteString(string(buf))
+}
+
+// jsonNumber - the number in JSON, which has no rationals, infinities, or NaN
+func jsonNumber(n *Number) (string, error) {
+	if math.IsInf(n.Value, 0) || math.IsNaN(n.Value) {
+		return "", NewError(ArgumentErrorKey, "Number cannot be described in JSON: ", n)
+	}
+	if n.IsExact() && !n.IsExactInteger() {
+		return strconv.FormatFloat(n.Value, 'g', -1, 64), nil
+	}
+	return n.String(), nil
 }
 
 // EncodeString - return the encoded form of a string value
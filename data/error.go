@@ -21,7 +21,9 @@ import (
 )
 
 type Error struct {
-	Data Value
+	Data     Value
+	Trace    *List     //the VM's call stack where the error was raised, innermost first. Not part of the error's value.
+	Location *Location //where in the source the error was found by the compiler, if known. Not part of the error's value.
 }
 
 // Q: do I really need this? It is not part of EllDN. It has Instance syntax anyway. So...like UUID/Timestamp, right?
@@ -56,6 +58,16 @@ func MakeError(elements ...Value) *Error {
 	return &Error{Data: data}
 }
 
+// Kind - the keyword that classifies the error, i.e. io-error:. Errors without one are generic errors.
+func (err *Error) Kind() Value {
+	if v, ok := err.Data.(*Vector); ok && len(v.Elements) > 0 {
+		if v.Elements[0].Type() == KeywordType {
+			return v.Elements[0]
+		}
+	}
+	return ErrorKey
+}
+
 func (err *Error) Type() Value {
 	return ErrorType
 }
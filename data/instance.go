@@ -17,6 +17,7 @@ package data
 
 import (
 	"fmt"
+	"sync"
 )
 
 // Instance - a type/data value pair, i.e. `#<point>{x: 23 y: 57}` which is a struct tagged with the <point> type
@@ -32,6 +33,9 @@ func (data *Instance) Type() Value {
 }
 
 func (data *Instance) String() string {
+	if s, ok := PrintWithMethod(data); ok {
+		return s
+	}
 	return fmt.Sprintf("#%s%v", data.TypeTag, data.Value.String())
 }
 
@@ -53,8 +57,38 @@ func NewInstance(tag Value, value Value) (Value, error) {
 	case NullType, BooleanType, NumberType, SymbolType, KeywordType, StringType, VectorType, StructType, ListType, TypeType:
 		return nil, NewError(ArgumentErrorKey, tag, NewString("Cannot tag instance as a builtin type"))
 	}
+	instanceAllocs.Add(0)
 	return &Instance{
 		TypeTag: tag,
 		Value:   value,
 	}, nil
 }
+
+// PrintMethod - returns the textual form of a value of the type it is defined for, in place of the default one
+type PrintMethod func(val Value) (string, error)
+
+var printMethods sync.Map //from type to PrintMethod
+
+// DefinePrintMethod - use the method to write the values of the type, and for their String. A nil method
+// removes the type's print method.
+func DefinePrintMethod(typ Value, method PrintMethod) {
+	if method == nil {
+		printMethods.Delete(typ)
+	} else {
+		printMethods.Store(typ, method)
+	}
+}
+
+// PrintWithMethod - the textual form of the value from the print method defined for its type, if there is one.
+// If the method fails, the value has its default textual form.
+func PrintWithMethod(val Value) (string, bool) {
+	method, ok := printMethods.Load(val.Type())
+	if !ok {
+		return "", false
+	}
+	s, err := method.(PrintMethod)(val)
+	if err != nil {
+		return "", false
+	}
+	return s, true
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2021 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// ParseJSON - parse the JSON text, which must hold exactly one value. Objects become structs with string
+// keys, arrays become vectors, and integers stay exact.
+func ParseJSON(s string) (Value, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, NewError(SyntaxErrorKey, "Bad JSON: ", err.Error())
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, NewError(SyntaxErrorKey, "Bad JSON: extra data after the value")
+	}
+	return fromJSON(v)
+}
+
+func fromJSON(v interface{}) (Value, error) {
+	switch p := v.(type) {
+	case nil:
+		return Null, nil
+	case bool:
+		if p {
+			return True, nil
+		}
+		return False, nil
+	case json.Number:
+		if n, ok := ParseNumber(string(p)); ok {
+			return n, nil
+		}
+		return nil, NewError(SyntaxErrorKey, "Bad JSON number: ", string(p))
+	case string:
+		return NewString(p), nil
+	case []interface{}:
+		elements := make([]Value, len(p))
+		for i, el := range p {
+			val, err := fromJSON(el)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = val
+		}
+		return NewVector(elements...), nil
+	case map[string]interface{}:
+		strct := NewStruct()
+		for k, el := range p {
+			val, err := fromJSON(el)
+			if err != nil {
+				return nil, err
+			}
+			strct.Put(NewString(k), val)
+		}
+		return strct, nil
+	}
+	return nil, NewError(SyntaxErrorKey, "Bad JSON value: ", v)
+}
@@ -101,8 +101,14 @@ func (lst *List) Length() int {
 	return count
 }
 
+// ConsCount - the number of list cells allocated so far, by all goroutines, since allocations were first counted
+func ConsCount() int64 {
+	return listAllocs.Count()
+}
+
 // Cons - create a new list consisting of the first object and the rest of the list
 func Cons(car Value, cdr *List) *List {
+	listAllocs.Add(0)
 	return &List{
 		Car: car,
 		Cdr: cdr,
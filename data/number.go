@@ -17,19 +17,95 @@ package data
 
 import (
 	"math"
+	"math/big"
 	"strconv"
+	"strings"
 )
 
+// Number - an Ell number. Exact numbers are integers, held in an int64 if they fit, and rationals, held in
+// a big.Rat, as are the integers that do not fit. Everything else is inexact, a float64.
 type Number struct {
-	Value float64
+	Value float64  //the value of an inexact number, or the closest float to the value of an exact one
+	exact bool     //true for integers and rationals
+	i     int64    //the value of an exact integer that fits in an int64
+	rat   *big.Rat //the value of any other exact number
 }
 
 func Float(f float64) *Number {
+	numberAllocs.Add(0)
 	return &Number{Value: f}
 }
 
 func Integer(i int) *Number {
-	return &Number{Value: float64(i)}
+	return Int64(int64(i))
+}
+
+// the small integers are preallocated, so that loops counting and indexing with them do not allocate
+const (
+	minCachedInteger = -128
+	maxCachedInteger = 1023
+)
+
+var integerCache = initIntegerCache()
+
+func initIntegerCache() []*Number {
+	cache := make([]*Number, maxCachedInteger-minCachedInteger+1)
+	for i := range cache {
+		n := int64(i + minCachedInteger)
+		cache[i] = &Number{Value: float64(n), exact: true, i: n}
+	}
+	return cache
+}
+
+// Int64 - an exact integer
+func Int64(i int64) *Number {
+	if i >= minCachedInteger && i <= maxCachedInteger {
+		return integerCache[i-minCachedInteger]
+	}
+	numberAllocs.Add(0)
+	return &Number{Value: float64(i), exact: true, i: i}
+}
+
+// BigInteger - an exact integer, of any size
+func BigInteger(i *big.Int) *Number {
+	return Rational(new(big.Rat).SetInt(i))
+}
+
+// Rational - an exact number. The rational is not copied, and must not be modified afterwards.
+func Rational(r *big.Rat) *Number {
+	if r.IsInt() && r.Num().IsInt64() {
+		return Int64(r.Num().Int64())
+	}
+	f, _ := r.Float64()
+	numberAllocs.Add(0)
+	return &Number{Value: f, exact: true, rat: r}
+}
+
+// ParseNumber - the number the string represents: an integer, a rational like 1/3, or a float. The
+// ok result is false if the string is not a number.
+func ParseNumber(s string) (*Number, bool) {
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		return Int64(i), true
+	}
+	if err.(*strconv.NumError).Err == strconv.ErrRange {
+		if b, ok := new(big.Int).SetString(s, 10); ok {
+			return BigInteger(b), true
+		}
+	}
+	if slash := strings.Index(s, "/"); slash > 0 {
+		num, ok1 := new(big.Int).SetString(s[:slash], 10)
+		denom, ok2 := new(big.Int).SetString(s[slash+1:], 10)
+		if ok1 && ok2 && denom.Sign() > 0 && s[slash+1] != '+' {
+			return Rational(new(big.Rat).SetFrac(num, denom)), true
+		}
+		return nil, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err == nil {
+		return Float(f), true
+	}
+	return nil, false
 }
 
 const epsilon = 0.000000001
@@ -49,20 +125,61 @@ func (n *Number) Type() Value {
 }
 
 func (n *Number) String() string {
-	return strconv.FormatFloat(n.Value, 'f', -1, 64)
+	if n.exact {
+		if n.rat != nil {
+			return n.rat.RatString()
+		}
+		return strconv.FormatInt(n.i, 10)
+	}
+	s := strconv.FormatFloat(n.Value, 'f', -1, 64)
+	if math.Trunc(n.Value) == n.Value && !math.IsInf(n.Value, 0) {
+		s += ".0" //so that it reads back as an inexact number
+	}
+	return s
 }
 
 func (n *Number) Equals(another Value) bool {
 	if another != nil {
 		if n2, ok := another.(*Number); ok {
+			if n.exact && n2.exact {
+				return NumberCompare(n, n2) == 0
+			}
 			return NumberEqual(n.Value, n2.Value)
 		}
 	}
 	return false
 }
 
+// IsExact - true if the number is an integer or a rational, false if it is a float
+func (n *Number) IsExact() bool {
+	return n.exact
+}
+
+// IsExactInteger - true if the number is an exact integer, of any size
+func (n *Number) IsExactInteger() bool {
+	return n.exact && (n.rat == nil || n.rat.IsInt())
+}
+
+// Rat - the value of an exact number as a rational, or nil if the number is inexact. The result must not be modified.
+func (n *Number) Rat() *big.Rat {
+	if !n.exact {
+		return nil
+	}
+	if n.rat != nil {
+		return n.rat
+	}
+	return new(big.Rat).SetInt64(n.i)
+}
+
 func (n *Number) IntValue() int {
-	return int(n.Value)
+	return int(n.Int64Value())
+}
+
+func (n *Number) Int64Value() int64 {
+	if n.exact && n.rat == nil {
+		return n.i
+	}
+	return int64(n.Value)
 }
 
 func (n *Number) Float64Value() float64 {
@@ -70,5 +187,162 @@ func (n *Number) Float64Value() float64 {
 }
 
 func (n *Number) RuneValue() rune {
-	return rune(n.Value)
+	return rune(n.Int64Value())
+}
+
+// NumberCompare - -1, 0, or 1 as n1 is less than, equal to, or greater than n2. The comparison is exact
+// unless one of the numbers is inexact.
+func NumberCompare(n1 *Number, n2 *Number) int {
+	if n1.exact && n2.exact {
+		if n1.rat == nil && n2.rat == nil {
+			if n1.i < n2.i {
+				return -1
+			} else if n1.i > n2.i {
+				return 1
+			}
+			return 0
+		}
+		return n1.Rat().Cmp(n2.Rat())
+	}
+	if n1.Value < n2.Value {
+		return -1
+	} else if n1.Value > n2.Value {
+		return 1
+	}
+	return 0
+}
+
+// NumberAdd - the sum of the numbers, exact if both of them are
+func NumberAdd(n1 *Number, n2 *Number) *Number {
+	if n1.exact && n2.exact {
+		if n1.rat == nil && n2.rat == nil {
+			sum := n1.i + n2.i
+			if (sum > n1.i) == (n2.i > 0) {
+				return Int64(sum)
+			}
+		}
+		return Rational(new(big.Rat).Add(n1.Rat(), n2.Rat()))
+	}
+	return Float(n1.Value + n2.Value)
+}
+
+// NumberSub - the difference of the numbers, exact if both of them are
+func NumberSub(n1 *Number, n2 *Number) *Number {
+	if n1.exact && n2.exact {
+		if n1.rat == nil && n2.rat == nil {
+			diff := n1.i - n2.i
+			if (diff < n1.i) == (n2.i > 0) {
+				return Int64(diff)
+			}
+		}
+		return Rational(new(big.Rat).Sub(n1.Rat(), n2.Rat()))
+	}
+	return Float(n1.Value - n2.Value)
+}
+
+// NumberMul - the product of the numbers, exact if both of them are
+func NumberMul(n1 *Number, n2 *Number) *Number {
+	if n1.exact && n2.exact {
+		if n1.rat == nil && n2.rat == nil {
+			a, b := n1.i, n2.i
+			if a == 0 || b == 0 {
+				return Int64(0)
+			}
+			p := a * b
+			if p/b == a && !(a == -1 && b == math.MinInt64) && !(b == -1 && a == math.MinInt64) {
+				return Int64(p)
+			}
+		}
+		return Rational(new(big.Rat).Mul(n1.Rat(), n2.Rat()))
+	}
+	return Float(n1.Value * n2.Value)
+}
+
+// NumberDiv - the quotient of the numbers, exact if both of them are. Exact division by zero is an error.
+func NumberDiv(n1 *Number, n2 *Number) (*Number, error) {
+	if n1.exact && n2.exact {
+		if n1.rat == nil && n2.rat == nil {
+			a, b := n1.i, n2.i
+			if b == 0 {
+				return nil, NewError(ArgumentErrorKey, "Division by zero")
+			}
+			if a%b == 0 && !(a == math.MinInt64 && b == -1) {
+				return Int64(a / b), nil
+			}
+		}
+		return Rational(new(big.Rat).Quo(n1.Rat(), n2.Rat())), nil
+	}
+	return Float(n1.Value / n2.Value), nil
+}
+
+// NumberQuotient - the quotient of the integers, truncated towards zero
+func NumberQuotient(n1 *Number, n2 *Number) (*Number, error) {
+	return integerDivide(n1, n2, 'q')
+}
+
+// NumberRemainder - the remainder of the integer division, with the sign of the dividend
+func NumberRemainder(n1 *Number, n2 *Number) (*Number, error) {
+	return integerDivide(n1, n2, 'r')
+}
+
+// NumberModulo - the remainder of the integer division, with the sign of the divisor
+func NumberModulo(n1 *Number, n2 *Number) (*Number, error) {
+	return integerDivide(n1, n2, 'm')
+}
+
+func integerDivide(n1 *Number, n2 *Number, op byte) (*Number, error) {
+	if n1.exact && n2.exact {
+		if !n1.IsExactInteger() || !n2.IsExactInteger() {
+			return nil, NewError(ArgumentErrorKey, "Expected integers, got ", n1, " and ", n2)
+		}
+		if n1.rat == nil && n2.rat == nil {
+			a, b := n1.i, n2.i
+			if b == 0 {
+				return nil, NewError(ArgumentErrorKey, "Division by zero")
+			}
+			if !(a == math.MinInt64 && b == -1) {
+				switch op {
+				case 'q':
+					return Int64(a / b), nil
+				case 'r':
+					return Int64(a % b), nil
+				default:
+					m := a % b
+					if m != 0 && (m < 0) != (b < 0) {
+						m += b
+					}
+					return Int64(m), nil
+				}
+			}
+		}
+		a, b := n1.Rat().Num(), n2.Rat().Num()
+		if b.Sign() == 0 {
+			return nil, NewError(ArgumentErrorKey, "Division by zero")
+		}
+		q, r := new(big.Int).QuoRem(a, b, new(big.Int))
+		switch op {
+		case 'q':
+			return BigInteger(q), nil
+		case 'r':
+			return BigInteger(r), nil
+		default:
+			if r.Sign() != 0 && r.Sign() != b.Sign() {
+				r.Add(r, b)
+			}
+			return BigInteger(r), nil
+		}
+	}
+	a, b := n1.Value, n2.Value
+	switch op {
+	case 'q':
+		return Float(math.Trunc(a / b)), nil
+	case 'r':
+		return Float(math.Mod(a, b)), nil
+	default:
+		m := math.Mod(a, b)
+		if m != 0 && (m < 0) != (b < 0) {
+			m += b
+		}
+		return Float(m), nil
+	}
 }
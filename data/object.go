@@ -0,0 +1,69 @@
+/*
+Copyright 2021 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Object - a Go value wrapped as a value of a type, so that programs embedding ell can pass their own values to
+// it, and define generic function methods and print methods for them. Its type is determined by the tag, as
+// for an Instance.
+type Object struct {
+	TypeTag Value
+	Value   interface{}
+}
+
+func (obj *Object) Type() Value {
+	return obj.TypeTag
+}
+
+func (obj *Object) String() string {
+	if s, ok := PrintWithMethod(obj); ok {
+		return s
+	}
+	return fmt.Sprintf("#%s[%v]", obj.TypeTag, obj.Value)
+}
+
+// Equals - objects are equal if they have the same type and their Go values are ==, if they are comparable
+func (obj *Object) Equals(another Value) bool {
+	if obj2, ok := another.(*Object); ok {
+		if obj.TypeTag != obj2.TypeTag {
+			return false
+		}
+		if obj.Value == nil || obj2.Value == nil {
+			return obj.Value == obj2.Value
+		}
+		if reflect.TypeOf(obj.Value).Comparable() && reflect.TypeOf(obj2.Value).Comparable() {
+			return obj.Value == obj2.Value
+		}
+		return obj == obj2
+	}
+	return false
+}
+
+// NewObject - wrap the Go value as a value of the type, which must not be a builtin type
+func NewObject(tag Value, value interface{}) (*Object, error) {
+	if !IsType(tag) {
+		return nil, NewError(ArgumentErrorKey, TypeType.String(), tag)
+	}
+	switch tag {
+	case NullType, BooleanType, NumberType, SymbolType, KeywordType, StringType, VectorType, StructType, ListType, TypeType:
+		return nil, NewError(ArgumentErrorKey, tag, NewString("Cannot tag object as a builtin type"))
+	}
+	return &Object{TypeTag: tag, Value: value}, nil
+}
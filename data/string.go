@@ -24,6 +24,7 @@ type String struct {
 }
 
 func NewString(s string) *String {
+	stringAllocs.Add(len(s))
 	return &String{Value: s}
 }
 
@@ -50,7 +51,21 @@ type Character struct {
 	Value rune
 }
 
+// the Latin-1 characters are preallocated, so that taking strings apart does not allocate
+var characterCache = initCharacterCache()
+
+func initCharacterCache() []*Character {
+	cache := make([]*Character, 256)
+	for i := range cache {
+		cache[i] = &Character{Value: rune(i)}
+	}
+	return cache
+}
+
 func NewCharacter(c rune) *Character {
+	if c >= 0 && int(c) < len(characterCache) {
+		return characterCache[c]
+	}
 	return &Character{Value: c}
 }
 
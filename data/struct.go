@@ -17,59 +17,79 @@ package data
 
 import (
 	"bytes"
+	"sort"
 )
 
+// Struct - a map from keys, which may be any values, to values. Keys are compared with Equal, and the fields are
+// kept in the order their keys were first put.
 type Struct struct {
-	Bindings map[StructKey]Value
-	Error    error
+	entries []StructEntry
+	index   *structIndex
+	frozen  bool
+	Error   error
 }
 
+// structIndex - the indices of the entries of a struct by the hashes of their keys. Copies of a struct share its
+// index until they add keys to it, so only the struct that owns the index changes it, and then only by adding to
+// it, so the indices a copy finds are still right, and it ignores the ones beyond its entries.
+type structIndex struct {
+	owner   *Struct
+	buckets map[uint64][]int
+}
+
+// StructEntry - a field of a struct
+type StructEntry struct {
+	Key   Value
+	Value Value
+}
+
+// structIndexThreshold - structs with more entries than this have an index of them by the hashes of their keys.
+// Smaller ones, as most are, are searched in order.
+const structIndexThreshold = 8
+
 var EmptyStruct *Struct = NewStruct()
 
 func NewStruct() *Struct {
-	return &Struct{Bindings: make(map[StructKey]Value)}
+	structAllocs.Add(0)
+	return &Struct{}
 }
 
-// MakeStruct - create a new <struct> object from the arguments, which can be other structs, or key/value pairs
-func MakeStruct(fieldvals []Value) (*Struct, error) {
-	strct := &Struct{
-		Bindings: make(map[StructKey]Value),
+// StructFromPairs - create a new <struct> object from the keys and values, which alternate in the slice
+func StructFromPairs(kv []Value) (*Struct, error) {
+	if len(kv)%2 != 0 {
+		return nil, NewError(ArgumentErrorKey, "Mismatched key/value in struct: ", kv[len(kv)-1])
+	}
+	structAllocs.Add(len(kv) / 2 * int(structEntrySize))
+	strct := &Struct{entries: make([]StructEntry, 0, len(kv)/2)}
+	for i := 0; i < len(kv); i += 2 {
+		strct.Put(kv[i], kv[i+1])
 	}
+	return strct, nil
+}
+
+// MakeStruct - create a new <struct> object from the arguments, which can be other structs, whose fields are
+// copied, or key/value pairs
+func MakeStruct(fieldvals []Value) (*Struct, error) {
+	strct := NewStruct()
 	count := len(fieldvals)
 	i := 0
-	var bindings map[StructKey]Value
 	for i < count {
 		o := fieldvals[i]
-		if p, ok := o.(*Instance); ok {
+		if p, ok := o.(*Instance); ok && p.Value.Type() == StructType {
 			o = p.Value
 		}
 		i++
-		switch o.Type() {
-		case StructType: // not a valid key, just copy bindings from it
-			p := o.(*Struct)
-			if bindings == nil {
-				bindings = make(map[StructKey]Value, len(p.Bindings))
-			}
-			for k, v := range p.Bindings {
-				bindings[k] = v
-			}
-		case StringType, SymbolType, KeywordType, TypeType:
-			if i == count {
-				return nil, NewError(ArgumentErrorKey, "Mismatched keyword/value in arglist: ", o)
-			}
-			if bindings == nil {
-				bindings = make(map[StructKey]Value)
+		if p, ok := o.(*Struct); ok {
+			for _, e := range p.entries {
+				strct.Put(e.Key, e.Value)
 			}
-			bindings[newStructKey(o)] = fieldvals[i]
-			i++
-		default:
-			return nil, NewError(ArgumentErrorKey, "Bad struct key: ", o)
+			continue
 		}
-	}
-	if bindings == nil {
-		strct.Bindings = make(map[StructKey]Value)
-	} else {
-		strct.Bindings = bindings
+		if i == count {
+			return nil, NewError(ArgumentErrorKey, "Mismatched keyword/value in arglist: ", o)
+		}
+		strct.Put(o, fieldvals[i])
+		i++
 	}
 	return strct, nil
 }
@@ -77,21 +97,16 @@ func MakeStruct(fieldvals []Value) (*Struct, error) {
 // Equal returns true if the object is equal to the argument
 func (s1 *Struct) Equals(another Value) bool {
 	if s2, ok := another.(*Struct); ok {
-		bindings1 := s1.Bindings
-		size := len(bindings1)
-		bindings2 := s2.Bindings
-		if size == len(bindings2) {
-			for k, v := range bindings1 {
-				v2, ok := bindings2[k]
-				if !ok {
-					return false
-				}
-				if !Equal(v, v2) {
-					return false
-				}
+		if s1.Length() != s2.Length() {
+			return false
+		}
+		for _, e := range s1.entries {
+			i := s2.find(e.Key)
+			if i < 0 || !Equal(e.Value, s2.entries[i].Value) {
+				return false
 			}
-			return true
 		}
+		return true
 	}
 	return false
 }
@@ -103,85 +118,153 @@ func (d *Struct) Type() Value {
 func (d *Struct) String() string {
 	var buf bytes.Buffer
 	buf.WriteString("{")
-	first := true
-	for k, v := range d.Bindings {
-		if first {
-			first = false
-		} else {
+	for i, e := range d.entries {
+		if i > 0 {
 			buf.WriteString(" ")
 		}
-		buf.WriteString(k.Value)
+		buf.WriteString(e.Key.String())
 		buf.WriteString(" ")
-		buf.WriteString(v.String())
+		buf.WriteString(e.Value.String())
 	}
 	buf.WriteString("}")
 	return buf.String()
 }
 
-type StructKey struct {
-	Value string
-	Type  string
+func (d *Struct) Value() Value {
+	return d
 }
 
-func newStructKey(key Value) StructKey {
-	if IsValidStructKey(key) {
-		return StructKey{key.String(), key.Type().String()}
+func (data *Struct) Length() int {
+	return len(data.entries)
+}
+
+// Entries - the fields of the struct, in the order their keys were first put. The slice must not be modified.
+func (strct *Struct) Entries() []StructEntry {
+	return strct.entries
+}
+
+// Keys - the keys of the struct, in order
+func (strct *Struct) Keys() []Value {
+	keys := make([]Value, len(strct.entries))
+	for i, e := range strct.entries {
+		keys[i] = e.Key
 	}
-	return StructKey{}
+	return keys
 }
 
-func IsValidStructKey(d Value) bool {
-	switch d.Type() {
-	case StringType, SymbolType, KeywordType, TypeType:
-		return true
+// find - the index of the entry with the key, or -1 if there is none
+func (strct *Struct) find(key Value) int {
+	if strct.index == nil {
+		for i, e := range strct.entries {
+			if Equal(key, e.Key) {
+				return i
+			}
+		}
+		return -1
 	}
-	return false
+	for _, i := range strct.index.buckets[Hash(key)] {
+		if i < len(strct.entries) && Equal(key, strct.entries[i].Key) {
+			return i
+		}
+	}
+	return -1
 }
 
-func (k StructKey) ToValue() Value {
-	if k.Type == "<string>" {
-		return NewString(k.Value)
+// reindex - build the index of the entries if there are enough of them to need one
+func (strct *Struct) reindex() {
+	strct.index = nil
+	if len(strct.entries) > structIndexThreshold {
+		strct.index = &structIndex{owner: strct, buckets: make(map[uint64][]int, len(strct.entries))}
+		for i, e := range strct.entries {
+			strct.index.add(Hash(e.Key), i)
+		}
 	}
-	return Intern(k.Value)
 }
 
-func (d *Struct) Value() Value {
-	return d
+// add - add the index of an entry. The slices of indices are never appended to in place, as copies of the index
+// share them.
+func (index *structIndex) add(h uint64, i int) {
+	bucket := index.buckets[h]
+	index.buckets[h] = append(bucket[:len(bucket):len(bucket)], i)
 }
 
-func (data *Struct) Length() int {
-	return len(data.Bindings)
+// ownIndex - make the index the struct's own, to change, copying it if it is shared with the struct it was
+// copied from
+func (strct *Struct) ownIndex() {
+	if strct.index.owner != strct {
+		buckets := make(map[uint64][]int, len(strct.index.buckets)+1)
+		for h, bucket := range strct.index.buckets {
+			buckets[h] = bucket
+		}
+		strct.index = &structIndex{owner: strct, buckets: buckets}
+	}
 }
 
 func (strct *Struct) Get(key Value) Value {
-	if IsValidStructKey(key) {
-		k := newStructKey(key)
-		result, ok := strct.Bindings[k]
-		if ok {
-			return result
-		}
+	if i := strct.find(key); i >= 0 {
+		return strct.entries[i].Value
 	}
 	return Null
 }
 
+// Has - true if the struct has a field with the key, even if its value is null
 func (strct *Struct) Has(key Value) bool {
-	tmp := strct.Get(key)
-	return tmp != Null
+	return strct.find(key) >= 0
 }
 
 func (strct *Struct) Put(key Value, val Value) *Struct {
-	k := newStructKey(key)
-	if k.Value == "" {
-		//strct.Error = fmt.Errorf("Bad key for struct: %v", key)
-		//I'd like to return an Error, but then the Put method cannot be chained. Unless Value had all methods. Maybe?
-	} else {
-		strct.Bindings[k] = val
+	if i := strct.find(key); i >= 0 {
+		strct.entries[i].Value = val
+		return strct
+	}
+	strct.entries = append(strct.entries, StructEntry{Key: key, Value: val})
+	if strct.index != nil {
+		strct.ownIndex()
+		strct.index.add(Hash(key), len(strct.entries)-1)
+	} else if len(strct.entries) > structIndexThreshold {
+		strct.reindex()
 	}
 	return strct
 }
 
 func (strct *Struct) Unput(key Value) *Struct {
-	k := newStructKey(key)
-	delete(strct.Bindings, k)
+	if i := strct.find(key); i >= 0 {
+		strct.entries = append(strct.entries[:i], strct.entries[i+1:]...)
+		strct.reindex()
+	}
 	return strct
 }
+
+// Freeze - mark the struct as immutable. Ell's functions that change structs refuse to change a frozen one.
+func (strct *Struct) Freeze() {
+	strct.frozen = true
+}
+
+// IsFrozen - true if the struct has been frozen. Copies of it are not frozen.
+func (strct *Struct) IsFrozen() bool {
+	return strct.frozen
+}
+
+// Copy - a new struct with the same fields. The keys and values are not copied, and the index of the keys is
+// shared until one of the structs adds a key.
+func (strct *Struct) Copy() *Struct {
+	structAllocs.Add(len(strct.entries) * int(structEntrySize))
+	return &Struct{entries: append([]StructEntry(nil), strct.entries...), index: strct.index}
+}
+
+// Assoc - a copy of the struct, with the value for the key. The struct is not changed.
+func (strct *Struct) Assoc(key Value, val Value) *Struct {
+	return strct.Copy().Put(key, val)
+}
+
+// Dissoc - a copy of the struct, without the field for the key. The struct is not changed.
+func (strct *Struct) Dissoc(key Value) *Struct {
+	return strct.Copy().Unput(key)
+}
+
+// SortedEntries - the fields of the struct, in the order of the text of their keys
+func SortedEntries(strct *Struct) []StructEntry {
+	entries := append([]StructEntry{}, strct.entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Key.String() < entries[j].Key.String() })
+	return entries
+}
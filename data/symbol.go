@@ -16,7 +16,9 @@ limitations under the License.
 package data
 
 import (
+	"strconv"
 	"sync"
+	"sync/atomic"
 )
 
 // Symbols are symbolic identifiers, i.e. Intern("foo") == Intern("foo"), the same objects.
@@ -158,3 +160,19 @@ func Intern(name string) Value {
 	}
 	return sym
 }
+
+var gensymCount int64
+
+// Gensym - a new uninterned symbol. Its name is the prefix followed by a number, but it is not the same
+// symbol as one read or interned with that name, so it cannot be captured by the code a macro expands into.
+func Gensym(prefix string) *Symbol {
+	n := atomic.AddInt64(&gensymCount, 1)
+	return &Symbol{Text: prefix + "__" + strconv.FormatInt(n, 10)}
+}
+
+// IsInterned - true if the symbol is the one Intern returns for its name, false for a gensym
+func IsInterned(sym *Symbol) bool {
+	symtabMutex.Lock()
+	defer symtabMutex.Unlock()
+	return symtab[sym.Text] == sym
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2021 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"sync"
+)
+
+// Tagged literals, i.e. `#point{x: 23 y: 57}`, are a tag symbol followed by the value the tagged value is made
+// from. The constructor defined for the tag makes it. A tag without a constructor makes an instance of the type
+// named by the tag, so the literal above reads the same as `#<point>{x: 23 y: 57}`.
+
+// TagConstructor - makes the value of a tagged literal from the value that follows the tag
+type TagConstructor func(val Value) (Value, error)
+
+// TagWriter - returns the value to write after the tag, for a value of a type with tagged literals
+type TagWriter func(val Value) (Value, error)
+
+type tagWriter struct {
+	tag   *Symbol
+	write TagWriter
+}
+
+var tagMutex sync.RWMutex
+var tagConstructors = make(map[*Symbol]TagConstructor)
+var tagWriters = make(map[Value]*tagWriter)
+
+// DefineTagConstructor - read the literals with the tag using the constructor. A nil constructor removes
+// the tag's constructor.
+func DefineTagConstructor(tag *Symbol, constructor TagConstructor) {
+	tagMutex.Lock()
+	defer tagMutex.Unlock()
+	if constructor == nil {
+		delete(tagConstructors, tag)
+	} else {
+		tagConstructors[tag] = constructor
+	}
+}
+
+// DefineTagWriter - write the values of the type as literals with the tag, followed by what the writer returns
+// for them. A nil writer removes the type's writer.
+func DefineTagWriter(typ Value, tag *Symbol, writer TagWriter) {
+	tagMutex.Lock()
+	defer tagMutex.Unlock()
+	if writer == nil {
+		delete(tagWriters, typ)
+	} else {
+		tagWriters[typ] = &tagWriter{tag: tag, write: writer}
+	}
+}
+
+// MakeTagged - the value of the tagged literal
+func MakeTagged(tag *Symbol, val Value) (Value, error) {
+	tagMutex.RLock()
+	constructor := tagConstructors[tag]
+	tagMutex.RUnlock()
+	if constructor != nil {
+		return constructor(val)
+	}
+	return NewInstance(Intern("<"+tag.Text+">"), val)
+}
+
+// taggedWriter - the tag and writer for the values of the type, if it has them
+func taggedWriter(typ Value) *tagWriter {
+	tagMutex.RLock()
+	defer tagMutex.RUnlock()
+	return tagWriters[typ]
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2021 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// ParseTOML - parse the TOML document. As with JSON, tables become structs, with their keys sorted, arrays become
+// vectors, and integers stay exact. Dates and times are kept as strings, in the form TOML writes them.
+func ParseTOML(s string) (Value, error) {
+	var doc map[string]interface{}
+	if err := toml.Unmarshal([]byte(s), &doc); err != nil {
+		return nil, NewError(SyntaxErrorKey, "Bad TOML: ", err.Error())
+	}
+	return fromTOML(doc)
+}
+
+func fromTOML(v interface{}) (Value, error) {
+	switch p := v.(type) {
+	case bool:
+		if p {
+			return True, nil
+		}
+		return False, nil
+	case int64:
+		return Int64(p), nil
+	case float64:
+		return Float(p), nil
+	case string:
+		return NewString(p), nil
+	case time.Time:
+		return NewString(p.Format(time.RFC3339Nano)), nil
+	case []interface{}:
+		elements := make([]Value, len(p))
+		for i, el := range p {
+			val, err := fromTOML(el)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = val
+		}
+		return NewVector(elements...), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(p))
+		for k := range p {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		strct := NewStruct()
+		for _, k := range keys {
+			val, err := fromTOML(p[k])
+			if err != nil {
+				return nil, err
+			}
+			strct.Put(NewString(k), val)
+		}
+		return strct, nil
+	case fmt.Stringer: //the local dates and times
+		return NewString(p.String()), nil
+	}
+	return nil, NewError(SyntaxErrorKey, "Bad TOML value: ", v)
+}
@@ -15,12 +15,88 @@ limitations under the License.
 */
 package data
 
+import (
+	"math"
+)
+
 type Value interface {
 	Type() Value
 	String() string
 	Equals(another Value) bool
 }
 
+// Hasher - a value whose hash is not just that of its type. Values that are Equal must have the same Hash.
+type Hasher interface {
+	Hash() uint64
+}
+
+const fnvOffset = 14695981039346656037
+const fnvPrime = 1099511628211
+
+func hashString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h = (h ^ uint64(s[i])) * fnvPrime
+	}
+	return h
+}
+
+func hashCombine(h uint64, h2 uint64) uint64 {
+	return (h ^ h2) * fnvPrime
+}
+
+// Hash - a hash of the value consistent with Equal, so that values that are Equal have the same hash. Values
+// of types Hash does not know, that do not implement Hasher, hash to their type.
+func Hash(v Value) uint64 {
+	if v == nil {
+		return fnvOffset
+	}
+	switch p := v.(type) {
+	case *String:
+		return hashString(fnvOffset, p.Value)
+	case *Symbol:
+		return hashString(fnvOffset, p.Text)
+	case *Keyword:
+		return hashString(fnvOffset, p.Text)
+	case *Type:
+		return hashString(fnvOffset, p.Text)
+	case *Character:
+		return hashCombine(fnvOffset, uint64(p.Value))
+	case *Number:
+		//numbers within epsilon of each other are Equal, so all that round to the same integer hash the same.
+		//Ones that round to different integers, but are within epsilon of the half between them, are not found
+		//by each other.
+		r := math.Round(p.Value)
+		if r == 0 {
+			r = 0 //not -0
+		}
+		return hashCombine(fnvOffset, math.Float64bits(r))
+	case *List:
+		h := uint64(fnvOffset)
+		for ; p != EmptyList; p = p.Cdr {
+			h = hashCombine(h, Hash(p.Car))
+		}
+		return h
+	case *Vector:
+		h := uint64(fnvOffset)
+		for _, el := range p.Elements {
+			h = hashCombine(h, Hash(el))
+		}
+		return h
+	case *Struct:
+		//the order of the fields does not matter to Equal, so their hashes are combined without it
+		var h uint64
+		for _, e := range p.Entries() {
+			h += hashCombine(Hash(e.Key), Hash(e.Value))
+		}
+		return hashCombine(fnvOffset, h)
+	case *Instance:
+		return hashCombine(Hash(p.TypeTag), Hash(p.Value))
+	case Hasher:
+		return p.Hash()
+	}
+	return hashString(fnvOffset, v.Type().String())
+}
+
 func Equal(o1 Value, o2 Value) bool {
 	if o1 == o2 {
 		return true
@@ -21,6 +21,7 @@ import (
 
 type Vector struct {
 	Elements []Value
+	frozen   bool
 }
 
 var EmptyVector *Vector = VectorFromElementsNoCopy(nil) //NewVector()
@@ -38,6 +39,7 @@ func MakeVector(size int, init Value) *Vector {
 }
 
 func VectorFromElementsNoCopy(elements []Value) *Vector {
+	vectorAllocs.Add(len(elements) * int(valueSize))
 	return &Vector{Elements: elements}
 }
 
@@ -48,6 +50,16 @@ func VectorFromElements(elements []Value, count int) *Vector {
 	return VectorFromElementsNoCopy(el)
 }
 
+// Freeze - mark the vector as immutable. Ell's functions that change vectors refuse to change a frozen one.
+func (v *Vector) Freeze() {
+	v.frozen = true
+}
+
+// IsFrozen - true if the vector has been frozen
+func (v *Vector) IsFrozen() bool {
+	return v.frozen
+}
+
 func (v *Vector) Type() Value {
 	return VectorType
 }
@@ -0,0 +1,200 @@
+/*
+Copyright 2021 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// XML elements are structs of their tag, their attributes, as a struct with string keys, and their children,
+// as a vector of elements and strings of text:
+//
+//	{tag: "a" attrs: {"href" "/"} children: ["home"]}
+//
+// Names keep the namespace prefixes they are written with, i.e. "atom:link".
+
+var xmlTagKey = Intern("tag:")
+var xmlAttrsKey = Intern("attrs:")
+var xmlChildrenKey = Intern("children:")
+
+// ParseXML - parse the XML document into its root element. Comments and processing instructions are dropped,
+// as is the text between elements that is only whitespace.
+func ParseXML(s string) (Value, error) {
+	dec := xml.NewDecoder(strings.NewReader(s))
+	var stack []*Struct
+	var children [][]Value
+	var root Value
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, NewError(SyntaxErrorKey, "Bad XML: ", err.Error())
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if root != nil {
+				return nil, NewError(SyntaxErrorKey, "Bad XML: more than one root element")
+			}
+			attrs := NewStruct()
+			for _, attr := range t.Attr {
+				attrs.Put(NewString(xmlName(attr.Name)), NewString(attr.Value))
+			}
+			elem := NewStruct()
+			elem.Put(xmlTagKey, NewString(xmlName(t.Name)))
+			elem.Put(xmlAttrsKey, attrs)
+			stack = append(stack, elem)
+			children = append(children, nil)
+		case xml.EndElement:
+			n := len(stack) - 1
+			if n < 0 || xmlText(stack[n].Get(xmlTagKey)) != xmlName(t.Name) {
+				return nil, NewError(SyntaxErrorKey, "Bad XML: unexpected end element </", xmlName(t.Name), ">")
+			}
+			elem := stack[n]
+			elem.Put(xmlChildrenKey, NewVector(children[n]...))
+			stack, children = stack[:n], children[:n]
+			if n == 0 {
+				root = elem
+			} else {
+				children[n-1] = append(children[n-1], elem)
+			}
+		case xml.CharData:
+			text := string(t)
+			if strings.TrimSpace(text) == "" {
+				continue
+			}
+			if len(stack) == 0 {
+				return nil, NewError(SyntaxErrorKey, "Bad XML: text outside of the root element")
+			}
+			n := len(children) - 1
+			if k := len(children[n]) - 1; k >= 0 {
+				if prev, ok := children[n][k].(*String); ok { //text split by a comment or CDATA section
+					children[n][k] = NewString(prev.Value + text)
+					continue
+				}
+			}
+			children[n] = append(children[n], NewString(text))
+		}
+	}
+	if len(stack) > 0 {
+		return nil, NewError(SyntaxErrorKey, "Bad XML: missing end element </", xmlText(stack[len(stack)-1].Get(xmlTagKey)), ">")
+	}
+	if root == nil {
+		return nil, NewError(SyntaxErrorKey, "Bad XML: no root element")
+	}
+	return root, nil
+}
+
+// xmlText - the text of a string, or the name of a symbol or keyword, so that attributes can be keyed by keywords,
+// or else the value as display shows it
+func xmlText(val Value) string {
+	switch p := val.(type) {
+	case *String:
+		return p.Value
+	case *Symbol:
+		return p.Name()
+	case *Keyword:
+		return p.Name()
+	}
+	return val.String()
+}
+
+func xmlName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+// EmitXML - the element in XML. If indent is not empty, elements whose children are all elements are broken
+// across lines, indenting each level by it. Attribute values and text that are not strings are written as
+// display shows them.
+func EmitXML(val Value, indent string) (string, error) {
+	var buf strings.Builder
+	if err := emitXMLElement(&buf, val, indent, ""); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func emitXMLElement(buf *strings.Builder, val Value, indent string, prefix string) error {
+	elem, ok := val.(*Struct)
+	if !ok || !elem.Has(xmlTagKey) {
+		return NewError(ArgumentErrorKey, "Expected an XML element struct, got ", val)
+	}
+	tag := xmlText(elem.Get(xmlTagKey))
+	if tag == "" {
+		return NewError(ArgumentErrorKey, "XML element has no tag: ", val)
+	}
+	buf.WriteString("<" + tag)
+	if attrs, ok := elem.Get(xmlAttrsKey).(*Struct); ok {
+		for _, entry := range attrs.Entries() {
+			buf.WriteString(" " + xmlText(entry.Key) + "=\"")
+			xml.EscapeText(buf, []byte(xmlText(entry.Value)))
+			buf.WriteString("\"")
+		}
+	} else if elem.Get(xmlAttrsKey) != Null {
+		return NewError(ArgumentErrorKey, "XML attrs: must be a struct, got ", elem.Get(xmlAttrsKey))
+	}
+	var children []Value
+	switch p := elem.Get(xmlChildrenKey).(type) {
+	case *Vector:
+		children = p.Elements
+	case *List:
+		for ; p != EmptyList; p = p.Cdr {
+			children = append(children, p.Car)
+		}
+	default:
+		if p != Null {
+			return NewError(ArgumentErrorKey, "XML children: must be a vector or list, got ", p)
+		}
+	}
+	if len(children) == 0 {
+		buf.WriteString("/>")
+		return nil
+	}
+	buf.WriteString(">")
+	broken := indent != ""
+	for _, child := range children {
+		switch child.(type) {
+		case *Struct:
+		case *Vector, *List:
+			return NewError(ArgumentErrorKey, "XML children must be elements or text, got ", child)
+		default:
+			broken = false
+		}
+	}
+	for _, child := range children {
+		if _, ok := child.(*Struct); ok {
+			if broken {
+				buf.WriteString("\n" + prefix + indent)
+			}
+			if err := emitXMLElement(buf, child, indent, prefix+indent); err != nil {
+				return err
+			}
+		} else {
+			xml.EscapeText(buf, []byte(xmlText(child)))
+		}
+	}
+	if broken {
+		buf.WriteString("\n" + prefix)
+	}
+	buf.WriteString("</" + tag + ">")
+	return nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2021 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"io"
+	"math/big"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ParseYAML - parse the YAML text, which must hold at most one document. As with JSON, mappings become structs,
+// with their keys in the order of the document, sequences become vectors, and integers stay exact. Timestamps
+// are kept as strings, and an empty document is null.
+func ParseYAML(s string) (Value, error) {
+	dec := yaml.NewDecoder(strings.NewReader(s))
+	var doc yaml.Node
+	if err := dec.Decode(&doc); err != nil {
+		if err == io.EOF {
+			return Null, nil
+		}
+		return nil, NewError(SyntaxErrorKey, "Bad YAML: ", err.Error())
+	}
+	var extra yaml.Node
+	if err := dec.Decode(&extra); err != io.EOF {
+		return nil, NewError(SyntaxErrorKey, "Bad YAML: more than one document")
+	}
+	return fromYAML(&doc)
+}
+
+func fromYAML(node *yaml.Node) (Value, error) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return Null, nil
+		}
+		return fromYAML(node.Content[0])
+	case yaml.AliasNode:
+		return fromYAML(node.Alias)
+	case yaml.SequenceNode:
+		elements := make([]Value, len(node.Content))
+		for i, el := range node.Content {
+			val, err := fromYAML(el)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = val
+		}
+		return NewVector(elements...), nil
+	case yaml.MappingNode:
+		strct := NewStruct()
+		if err := putYAMLEntries(strct, node); err != nil {
+			return nil, err
+		}
+		return strct, nil
+	}
+	return yamlScalar(node)
+}
+
+// putYAMLEntries - put the entries of the mapping into the struct. The entries of the mappings merged into it
+// with << come first, so that its own entries override them.
+func putYAMLEntries(strct *Struct, node *yaml.Node) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].ShortTag() != "!!merge" {
+			continue
+		}
+		merged := resolveYAMLAlias(node.Content[i+1])
+		sources := []*yaml.Node{merged}
+		if merged.Kind == yaml.SequenceNode {
+			sources = merged.Content
+		}
+		for j := len(sources) - 1; j >= 0; j-- {
+			source := resolveYAMLAlias(sources[j])
+			if source.Kind != yaml.MappingNode {
+				return NewError(SyntaxErrorKey, "Bad YAML: a merge must be of mappings, at line ", node.Content[i].Line)
+			}
+			if err := putYAMLEntries(strct, source); err != nil {
+				return err
+			}
+		}
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].ShortTag() == "!!merge" {
+			continue
+		}
+		key, err := fromYAML(node.Content[i])
+		if err != nil {
+			return err
+		}
+		val, err := fromYAML(node.Content[i+1])
+		if err != nil {
+			return err
+		}
+		strct.Put(key, val)
+	}
+	return nil
+}
+
+func resolveYAMLAlias(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+func yamlScalar(node *yaml.Node) (Value, error) {
+	var v interface{}
+	if err := node.Decode(&v); err != nil {
+		return nil, NewError(SyntaxErrorKey, "Bad YAML: ", err.Error())
+	}
+	switch p := v.(type) {
+	case nil:
+		return Null, nil
+	case bool:
+		if p {
+			return True, nil
+		}
+		return False, nil
+	case int:
+		return Int64(int64(p)), nil
+	case int64:
+		return Int64(p), nil
+	case uint64:
+		return BigInteger(new(big.Int).SetUint64(p)), nil
+	case float64:
+		return Float(p), nil
+	case string:
+		return NewString(p), nil
+	}
+	return NewString(node.Value), nil
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	. "github.com/boynton/ell/data"
+)
+
+// Databases are reached through database/sql, so any driver registered with it can be used. The ell command
+// registers the sqlite3 driver; a program embedding Ell imports the drivers it wants.
+
+// DBType - the type of Ell's database object
+var DBType Value = Intern("<db>")
+
+// DatabaseErrorKey - the kind of error raised when a database operation fails
+var DatabaseErrorKey = Intern("database-error:")
+
+var rowsAffectedKey = Intern("rows-affected:")
+var lastInsertIDKey = Intern("last-insert-id:")
+
+type DB struct {
+	driver string
+	db     *sql.DB // nil once closed
+}
+
+func (db *DB) Type() Value {
+	return DBType
+}
+
+func (db *DB) String() string {
+	s := "#[db " + db.driver
+	if db.db == nil {
+		s += " CLOSED"
+	}
+	return s + "]"
+}
+
+func (db1 *DB) Equals(another Value) bool {
+	if db2, ok := another.(*DB); ok {
+		return db1 == db2
+	}
+	return false
+}
+
+func databaseError(err error) error {
+	return NewError(DatabaseErrorKey, err.Error())
+}
+
+// OpenDB - open the database named by the source, with the driver registered under that name, i.e. "sqlite3"
+// and the path of a database file. The connection is made before returning, so a bad source is an error here.
+func OpenDB(driver string, source string) (*DB, error) {
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		if strings.Contains(err.Error(), "unknown driver") {
+			return nil, NewError(DatabaseErrorKey, "Unknown database driver ", NewString(driver),
+				", the drivers are ", NewString(strings.Join(sql.Drivers(), " ")))
+		}
+		return nil, databaseError(err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, databaseError(err)
+	}
+	return &DB{driver: driver, db: db}, nil
+}
+
+// CloseDB - close the database, after which it cannot be used
+func CloseDB(db *DB) error {
+	if db.db == nil {
+		return nil
+	}
+	err := db.db.Close()
+	db.db = nil
+	if err != nil {
+		return databaseError(err)
+	}
+	return nil
+}
+
+func (db *DB) open() (*sql.DB, error) {
+	if db.db == nil {
+		return nil, NewError(DatabaseErrorKey, "Database is closed: ", db)
+	}
+	return db.db, nil
+}
+
+// Query - the rows the query selects, as a vector of structs whose keys are the column names as keywords. The
+// args fill the query's placeholders.
+func (db *DB) Query(query string, args []Value) (*Vector, error) {
+	conn, err := db.open()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(query, sqlArgs(args)...)
+	if err != nil {
+		return nil, databaseError(err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, databaseError(err)
+	}
+	keys := make([]Value, len(columns))
+	for i, col := range columns {
+		keys[i] = Intern(col + ":")
+	}
+	var result []Value
+	vals := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, databaseError(err)
+		}
+		row := NewStruct()
+		for i, key := range keys {
+			row.Put(key, fromSQL(vals[i]))
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, databaseError(err)
+	}
+	return NewVector(result...), nil
+}
+
+// Exec - execute the statement, returning a struct of the rows-affected: and the last-insert-id:, where the
+// driver reports them. The args fill the statement's placeholders.
+func (db *DB) Exec(stmt string, args []Value) (*Struct, error) {
+	conn, err := db.open()
+	if err != nil {
+		return nil, err
+	}
+	res, err := conn.Exec(stmt, sqlArgs(args)...)
+	if err != nil {
+		return nil, databaseError(err)
+	}
+	result := NewStruct()
+	if n, err := res.RowsAffected(); err == nil {
+		result.Put(rowsAffectedKey, Int(n))
+	}
+	if id, err := res.LastInsertId(); err == nil {
+		result.Put(lastInsertIDKey, Int(id))
+	}
+	return result, nil
+}
+
+// sqlArgs - the values as arguments for database/sql. Numbers are integers if they are exact integers, and
+// values with no SQL equivalent are passed as their text.
+func sqlArgs(args []Value) []interface{} {
+	result := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch p := arg.(type) {
+		case *Number:
+			if p.IsExactInteger() && math.Abs(p.Value) < math.MaxInt64 {
+				result[i] = p.Int64Value()
+			} else {
+				result[i] = p.Value
+			}
+		case *String:
+			result[i] = p.Value
+		case *Blob:
+			result[i] = p.Value
+		default:
+			switch arg {
+			case Null:
+				result[i] = nil
+			case True:
+				result[i] = true
+			case False:
+				result[i] = false
+			default:
+				result[i] = arg.String()
+			}
+		}
+	}
+	return result
+}
+
+// fromSQL - the value of a column as scanned by database/sql. Times are kept as strings.
+func fromSQL(v interface{}) Value {
+	switch p := v.(type) {
+	case nil:
+		return Null
+	case bool:
+		if p {
+			return True
+		}
+		return False
+	case int64:
+		return Int(p)
+	case float64:
+		return Float(p)
+	case string:
+		return NewString(p)
+	case []byte:
+		return NewBlob(append([]byte{}, p...))
+	case time.Time:
+		return NewString(p.Format(time.RFC3339Nano))
+	}
+	return NewString(fmt.Sprint(v))
+}
+
+func ellDBOpen(argv []Value) (Value, error) {
+	return OpenDB(StringValue(argv[0]), StringValue(argv[1]))
+}
+
+func ellDBP(argv []Value) (Value, error) {
+	if _, ok := argv[0].(*DB); ok {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellDBQuery(argv []Value) (Value, error) {
+	return argv[0].(*DB).Query(StringValue(argv[1]), argv[2:])
+}
+
+func ellDBExec(argv []Value) (Value, error) {
+	return argv[0].(*DB).Exec(StringValue(argv[1]), argv[2:])
+}
@@ -0,0 +1,57 @@
+//go:build cgo
+
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ell
+
+// the sqlite3 driver needs cgo, so these tests are only built with it
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestDatabase(t *testing.T) {
+	Init()
+	src := fmt.Sprintf(`(let ((db (db-open "sqlite3" %q)))
+	          (db-exec db "create table people (id integer primary key, name text, age integer, score real, photo blob)")
+	          (let ((a (db-exec db "insert into people (name, age, score) values (?, ?, ?)" "ann" 31 2.5)))
+	            (let ((b (db-exec db "insert into people (name, age, photo) values (?, ?, ?)" "bob" null #u8(1 2))))
+	              (let ((rows (db-query db "select name, age, score, photo from people order by id"))
+	                    (adults (db-query db "select name from people where age > ?" 30)))
+	                (let ((updated (db-exec db "update people set age = age + 1")))
+	                  (close db)
+	                  (list (get a rows-affected:) (get b last-insert-id:) rows adults (get updated rows-affected:)
+	                        (db? db) (string db)))))))`, filepath.Join(t.TempDir(), "test.db"))
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `(1 2 [{name: "ann" age: 31 score: 2.5 photo: null} {name: "bob" age: null score: null photo: #u8(1 2)}] [{name: "ann"}] 2 true "#[db sqlite3 CLOSED]")`
+	if s := Write(result); s != expected {
+		t.Error("database primitives returned the wrong value: ", s)
+	}
+	for _, bad := range []string{`(db-open "nodriver" "x")`, `(db-query (db-open "sqlite3" ":memory:") "select * from missing")`,
+		`(let ((db (db-open "sqlite3" ":memory:"))) (close db) (db-exec db "select 1"))`} {
+		_, err := exec(compileString(t, bad), nil)
+		if err == nil || errorKind(err) != DatabaseErrorKey {
+			t.Error("expected a database error: ", bad, " got ", err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	. "github.com/boynton/ell/data"
+)
+
+// The debugger pauses execution when (break) is called, when a function with a breakpoint is entered, and after
+// each step, and reads commands to inspect the paused frame and to continue. It runs in the instrumented VM, so it
+// is not available with --optimize unless a breakpoint was set before the code was run.
+
+// debugging - true if the VM must check for pauses before each instruction
+var debugging bool
+
+// breakpoints - the names of the functions execution pauses in when they are entered
+var breakpoints = map[string]bool{}
+
+const (
+	runToBreakpoint = iota
+	stepInstruction
+	stepOver
+)
+
+// debugMode - how the debugger continues: to the next breakpoint, the next instruction, or the next instruction in
+// the paused frame or a caller of it, stepping over calls
+var debugMode = runToBreakpoint
+
+// debugFrame - the frame paused in when stepping over calls
+var debugFrame *Frame
+
+// breakRequested - true when (break) has been called, so execution pauses at the next instruction
+var breakRequested bool
+
+// debugReadLine - read a debugger command. The REPL replaces it to read through its line editor.
+var debugReadLine = func() (string, error) {
+	return stdinReader.ReadString('\n')
+}
+
+// debugOut - where the debugger writes
+var debugOut io.Writer = os.Stdout
+
+// stdinReader - standard input, shared by the debugger and the plain REPL so neither loses input the other buffered
+var stdinReader = bufio.NewReader(os.Stdin)
+
+func updateDebugging() {
+	debugging = len(breakpoints) > 0 || breakRequested || debugMode != runToBreakpoint
+}
+
+// SetBreakpoint - pause when the named function is entered
+func SetBreakpoint(name string) {
+	breakpoints[name] = true
+	updateDebugging()
+}
+
+// ClearBreakpoint - remove the breakpoint on the named function, or all of them if the name is empty
+func ClearBreakpoint(name string) {
+	if name == "" {
+		breakpoints = map[string]bool{}
+	} else {
+		delete(breakpoints, name)
+	}
+	updateDebugging()
+}
+
+// Breakpoints - the names of the functions with breakpoints, sorted
+func Breakpoints() []string {
+	names := make([]string, 0, len(breakpoints))
+	for name := range breakpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isCallerOf - true if the frame is one of the frames that the other returns to
+func isCallerOf(frame *Frame, other *Frame) bool {
+	for f := other.previous; f != nil; f = f.previous {
+		if f == frame {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldPause - true if execution is to pause before the instruction at the pc of the frame
+func shouldPause(env *Frame, pc int) bool {
+	switch {
+	case breakRequested:
+		return true
+	case debugMode == stepInstruction:
+		return true
+	case debugMode == stepOver && (env == debugFrame || isCallerOf(env, debugFrame)):
+		return true
+	}
+	return pc == 0 && env.code.name != "" && breakpoints[env.code.name]
+}
+
+// debugPause - pause before the instruction at the pc, if the debugger should, and read commands until one
+// continues execution. Quitting the debugger aborts execution with an interrupt: error.
+func (vm *vm) debugPause(env *Frame, pc int, stack []Value, sp int) error {
+	if !shouldPause(env, pc) {
+		return nil
+	}
+	breakRequested = false
+	fmt.Fprintf(debugOut, "[paused at %s: %s]\n", env.code.location(pc), opsyms[env.code.ops[pc]])
+	inspected := env
+	for {
+		fmt.Fprint(debugOut, "debug> ")
+		line, err := debugReadLine()
+		if err != nil && line == "" {
+			line = "quit"
+		}
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+		switch words[0] {
+		case "s", "step":
+			debugMode = stepInstruction
+		case "n", "next":
+			debugMode, debugFrame = stepOver, env
+		case "c", "continue":
+			debugMode, debugFrame = runToBreakpoint, nil
+		case "q", "quit":
+			debugMode, debugFrame = runToBreakpoint, nil
+			updateDebugging()
+			return NewError(InterruptKey, "debugger quit")
+		case "bt", "where":
+			for lst := stackTrace(env, pc); lst != EmptyList; lst = lst.Cdr {
+				fmt.Fprintln(debugOut, "    at", StringValue(lst.Car))
+			}
+			continue
+		case "f", "frame":
+			inspected = env
+			if len(words) > 1 {
+				n, err := strconv.Atoi(words[1])
+				for ; err == nil && n > 0 && inspected.previous != nil && inspected.previous.code != nil; n-- {
+					inspected = inspected.previous
+				}
+			}
+			fmt.Fprintln(debugOut, inspected.code.location(-1))
+			continue
+		case "l", "locals":
+			for i, val := range inspected.elements {
+				fmt.Fprintf(debugOut, "    %d: %s\n", i, Write(val))
+			}
+			continue
+		case "stack":
+			for i := sp; i < len(stack); i++ {
+				fmt.Fprintf(debugOut, "    %d: %s\n", i-sp, Write(stack[i]))
+			}
+			continue
+		case "p", "print":
+			debugging = false //the expression runs without pausing
+			if val, err := debugEval(strings.TrimSpace(line[len(words[0]):])); err != nil {
+				fmt.Fprintln(debugOut, "***", err)
+			} else {
+				fmt.Fprintln(debugOut, "=", Write(val))
+			}
+			updateDebugging()
+			continue
+		default:
+			fmt.Fprintln(debugOut, "commands: step (s), next (n), continue (c), quit (q), where (bt), frame (f) [n], locals (l), stack, print (p) <expr>")
+			continue
+		}
+		updateDebugging()
+		return nil
+	}
+}
+
+// debugEval - the value of the expression in the source, which is evaluated in the global environment
+func debugEval(src string) (Value, error) {
+	expr, err := ReadFromString(src)
+	if err != nil {
+		return nil, err
+	}
+	return evalSource(expr, "")
+}
+
+func ellBreak(argv []Value) (Value, error) {
+	breakRequested = true
+	updateDebugging()
+	return Null, nil
+}
+
+func ellBreakOn(argv []Value) (Value, error) {
+	SetBreakpoint(functionNameArg(argv[0]))
+	return Null, nil
+}
+
+func ellUnbreak(argv []Value) (Value, error) {
+	if len(argv) == 0 {
+		ClearBreakpoint("")
+	} else {
+		for _, arg := range argv {
+			ClearBreakpoint(functionNameArg(arg))
+		}
+	}
+	return Null, nil
+}
+
+func ellBreakpoints(argv []Value) (Value, error) {
+	var names []Value
+	for _, name := range Breakpoints() {
+		names = append(names, Intern(name))
+	}
+	return ListFromValues(names), nil
+}
+
+// functionNameArg - the name of the function, which may be given as its symbol or as the function itself
+func functionNameArg(arg Value) string {
+	if fn, ok := arg.(*Function); ok {
+		return functionName(fn)
+	}
+	return arg.String()
+}
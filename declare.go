@@ -0,0 +1,173 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"fmt"
+
+	. "github.com/boynton/ell/data"
+)
+
+// A type declaration gives the types of the arguments and the result of a global function defined after it:
+//
+//	(declare square (<number>) <number>)
+//	(declare greet (<string> & <string>) <string>) ;the rest of the arguments are all strings
+//
+// The types of optional and keyword arguments follow those of the required ones, in order. The declaration is
+// recorded in the function's code, where it makes its signature. The compiler warns of calls whose literal
+// arguments contradict it, and when the global *check-types* is true, calls check their arguments against it.
+
+// checkTypesSymbol - when the global *check-types* is true, the arguments of calls to functions with declared
+// types are checked
+var checkTypesSymbol = Intern("*check-types*")
+
+type declaration struct {
+	args       []Value
+	rest       Value //the type of each of the rest of the arguments, or nil if there are no more
+	result     Value
+	positional int //the number of arguments that are not keyword arguments or the rest, once it is known
+}
+
+// declarations - the declared types of the global functions, by the symbols they are defined to
+var declarations = make(map[Value]*declaration)
+
+// warn - log a warning about the code being compiled
+var warn = func(msg string) {
+	logMessage(LogWarn, msg)
+}
+
+// compileDeclare - record the declaration of (declare <name> (<type> ...) <type>). It is a value of the name.
+func compileDeclare(target *Code, expr Value, isTail bool, ignoreResult bool, lstlen int) error {
+	sym, ok := Cadr(expr).(*Symbol)
+	if !ok || (lstlen != 3 && lstlen != 4) {
+		return NewError(SyntaxErrorKey, expr)
+	}
+	decl := &declaration{result: AnyType}
+	if lstlen == 4 {
+		decl.result = Cadddr(expr)
+	}
+	types, ok := Caddr(expr).(*List)
+	if !ok || !IsType(decl.result) {
+		return NewError(SyntaxErrorKey, expr)
+	}
+	for ; types != EmptyList; types = types.Cdr {
+		if types.Car == Intern("&") && types.Cdr != EmptyList && types.Cdr.Cdr == EmptyList {
+			decl.rest = types.Cdr.Car
+			types = types.Cdr
+		} else {
+			decl.args = append(decl.args, types.Car)
+		}
+		if !IsType(types.Car) {
+			return NewError(SyntaxErrorKey, expr)
+		}
+	}
+	decl.positional = len(decl.args)
+	declarations[currentModule.define(sym)] = decl
+	if !ignoreResult {
+		target.emitLiteral(sym)
+		if isTail {
+			target.emitReturn()
+		}
+	}
+	return nil
+}
+
+// declare - check that the declaration fits the arguments of the function's code, and record it there
+func (decl *declaration) declare(code *Code, name string) error {
+	count := code.argc + len(code.defaults)
+	rest := code.defaults != nil && len(code.defaults) == 0
+	if len(decl.args) != count || (decl.rest != nil && !rest) {
+		return NewError(SyntaxErrorKey, "the declared types of ", name, " do not match its arguments")
+	}
+	decl.positional = count
+	if code.keys != nil || rest {
+		decl.positional = code.argc
+	}
+	code.declared = decl
+	return nil
+}
+
+// typeAt - the declared type of the argument at the position, or nil if it is not known
+func (decl *declaration) typeAt(i int) Value {
+	if i < decl.positional {
+		return decl.args[i]
+	}
+	if decl.positional == len(decl.args) {
+		return decl.rest
+	}
+	return nil
+}
+
+// warnLiteralArgs - warn of the literal arguments of a call to a declared global that are not of the declared types
+func warnLiteralArgs(fn Value, env *List, args *List) {
+	sym, ok := fn.(*Symbol)
+	if !ok {
+		return
+	}
+	if _, _, local := calculateLocation(sym, env); local {
+		return
+	}
+	decl := declarations[currentModule.resolve(sym)]
+	if decl == nil {
+		return
+	}
+	for i := 0; args != EmptyList; i, args = i+1, args.Cdr {
+		t := decl.typeAt(i)
+		if lt := literalType(args.Car); t != nil && t != AnyType && lt != nil && lt != t {
+			warn(fmt.Sprintf("%s is declared to take a %s for argument %d, not %s", sym, t, i+1, Write(args.Car)))
+		}
+	}
+}
+
+// literalType - the type of the value of the expression, if it is a literal, or nil
+func literalType(expr Value) Value {
+	switch p := expr.(type) {
+	case *Symbol:
+		return nil
+	case *List:
+		if p.Car == Intern("quote") && p.Cdr != EmptyList {
+			return Cadr(p).Type()
+		}
+		return nil
+	}
+	return expr.Type()
+}
+
+// checkArgs - check the arguments of a call to the function with the declared types, in the frame built for it.
+// Optional and keyword arguments that were not provided have their default values, which are not checked.
+func (decl *declaration) checkArgs(fun *Function, args []Value) error {
+	code := fun.code
+	for i, t := range decl.args {
+		if i >= code.argc && args[i] == code.defaults[i-code.argc] {
+			continue
+		}
+		if t != AnyType && args[i].Type() != t {
+			return argTypeError(callName(fun), t.String(), i+1, args[i])
+		}
+	}
+	if decl.rest == nil || decl.rest == AnyType || len(args) <= len(decl.args) {
+		return nil
+	}
+	if rest, ok := args[len(decl.args)].(*List); ok {
+		for i := len(decl.args); rest != EmptyList; i, rest = i+1, rest.Cdr {
+			if rest.Car.Type() != decl.rest {
+				return argTypeError(callName(fun), decl.rest.String(), i+1, rest.Car)
+			}
+		}
+	}
+	return nil
+}
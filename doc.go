@@ -0,0 +1,93 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"sort"
+	"strings"
+
+	. "github.com/boynton/ell/data"
+)
+
+// Functions are documented with a string before the arguments in defn and defmacro, or at the start of the body
+// of fn when more expressions follow it:
+//
+//	(defn square "the square of the number" (n) (* n n))
+
+// documented - the function a symbol names, as a macro or a global, or nil if it names neither
+func documented(sym *Symbol) *Function {
+	if mac := GetMacro(sym); mac != nil {
+		return mac.expander
+	}
+	if fn, ok := GetGlobal(sym).(*Function); ok {
+		return fn
+	}
+	return nil
+}
+
+// Doc - the documentation string of the function, or of the function or macro the symbol names, or "" if it has
+// none
+func Doc(obj Value) string {
+	fn, ok := obj.(*Function)
+	if sym, isSym := obj.(*Symbol); isSym {
+		fn, ok = documented(sym), true
+	}
+	if ok && fn != nil && fn.code != nil {
+		return fn.code.doc
+	}
+	return ""
+}
+
+// Apropos - the defined globals and macros whose names contain the text, in order
+func Apropos(text string) []Value {
+	seen := make(map[Value]bool)
+	var names []string
+	add := func(sym Value) {
+		if !seen[sym] && strings.Contains(sym.(*Symbol).Text, text) {
+			seen[sym] = true
+			names = append(names, sym.(*Symbol).Text)
+		}
+	}
+	for _, sym := range Globals() {
+		add(sym)
+	}
+	for _, sym := range Macros() {
+		add(sym)
+	}
+	sort.Strings(names)
+	syms := make([]Value, len(names))
+	for i, name := range names {
+		syms[i] = Intern(name)
+	}
+	return syms
+}
+
+// describe - the signature and documentation of the function or macro the symbol names, as the REPL shows them
+func describe(sym *Symbol) string {
+	fn := documented(sym)
+	if fn == nil {
+		return sym.Text + " is not defined"
+	}
+	s := sym.Text + " " + functionSignature(fn)
+	if GetMacro(sym) != nil {
+		s = sym.Text + " is a macro"
+	}
+	if doc := Doc(fn); doc != "" {
+		s += "\n  " + strings.Replace(doc, "\n", "\n  ", -1)
+	}
+	return s
+}
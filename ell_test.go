@@ -16,7 +16,22 @@ limitations under the License.
 package ell
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	. "github.com/boynton/ell/data"
 )
@@ -61,3 +76,2591 @@ func TestBooleans(t *testing.T) {
 	testType(t, "<boolean>", b1.Type())
 	testType(t, "<boolean>", b2.Type())
 }
+
+func compileString(t *testing.T, src string) *Code {
+	expr, err := ReadFromString(src)
+	if err == nil {
+		expr, err = Macroexpand(expr)
+	}
+	if err != nil {
+		t.Fatal("cannot read ", src, ": ", err)
+	}
+	code, err := Compile(expr)
+	if err != nil {
+		t.Fatal("cannot compile ", src, ": ", err)
+	}
+	return code
+}
+
+func testLimitError(t *testing.T, limits Limits, src string) {
+	_, err := ExecWithLimits(limits, compileString(t, src))
+	if e, ok := err.(*Error); !ok || e.Kind() != LimitErrorKey {
+		t.Error("expected a limit-error: for ", src, ", got ", err)
+	}
+}
+
+func TestExecWithLimits(t *testing.T) {
+	Init()
+	testLimitError(t, Limits{MaxInstructions: 10000}, "(let loop ((i 0)) (loop (+ i 1)))")
+	testLimitError(t, Limits{MaxInstructions: 10000}, "(catch (let loop () (loop)))")
+	testLimitError(t, Limits{MaxConses: 1000}, "(let loop ((l '())) (loop (cons 1 l)))")
+	//only the conses made after the limit is set count against it
+	CountAllocations()
+	for lst, i := EmptyList, 0; i < 2000; i++ {
+		lst = Cons(One, lst)
+	}
+	if _, err := ExecWithLimits(Limits{MaxConses: 1000}, compileString(t, "(list 1 2 3)")); err != nil {
+		t.Error("conses made before execution began counted against its limit: ", err)
+	}
+	testLimitError(t, Limits{MaxStack: 100}, "(do (defn deep (n) (if (= n 0) 0 (+ (deep (- n 1)) 1))) (deep 1000))")
+	//functions called back from primitives run under the same limits
+	testLimitError(t, Limits{MaxInstructions: 10000}, "(map (fn (x) (let loop () (loop))) '(1))")
+	testLimitError(t, Limits{MaxInstructions: 10000}, "(sort '(2 1) (fn (a b) (let loop () (loop))))")
+	testLimitError(t, Limits{MaxInstructions: 10000}, "(swap! (atom 1) (fn (x) (let loop () (loop))))")
+	testLimitError(t, Limits{MaxInstructions: 10000}, "(force (future (let loop () (loop))))")
+	result, err := ExecWithLimits(Limits{MaxInstructions: 10000, MaxStack: 100}, compileString(t, "(+ 1 2)"))
+	if err != nil || !Equal(result, Integer(3)) {
+		t.Error("expected 3 within the limits, got ", result, err)
+	}
+}
+
+func TestExecWithContext(t *testing.T) {
+	Init()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := ExecWithContext(ctx, compileString(t, "(catch (let loop () (loop)))"))
+	if e, ok := err.(*Error); !ok || e.Kind() != InterruptKey {
+		t.Error("expected an interrupt: error when the context times out, got ", err)
+	}
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel2()
+	_, err = ExecWithContext(ctx2, compileString(t, "(filter (fn (x) (let loop () (loop))) '(1))"))
+	if e, ok := err.(*Error); !ok || e.Kind() != InterruptKey {
+		t.Error("expected an interrupt: error when the context times out in a callback, got ", err)
+	}
+	_, err = ExecWithContext(ctx2, compileString(t, "(force (future (let loop () (loop))))"))
+	if e, ok := err.(*Error); !ok || e.Kind() != InterruptKey {
+		t.Error("expected an interrupt: error when the context times out in a future, got ", err)
+	}
+	result, err := ExecWithContext(context.Background(), compileString(t, "(+ 1 2)"))
+	if err != nil || !Equal(result, Integer(3)) {
+		t.Error("expected 3, got ", result, err)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	Init()
+	src := `(do
+	          (def log '())
+	          (defn spin () (let loop ((i 0)) (loop (+ i 1))))
+	          (let ((result (handler-case (unwind-protect (spin) (set! log (cons 'cleanup log))) (interrupt: (e) 'caught))))
+	            (list result log)))`
+	code := compileString(t, src)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		interrupts <- os.Interrupt
+	}()
+	result, err := exec(code, nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != "(caught (cleanup))" {
+		t.Error("the interrupt was not caught after unwinding: ", s)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		interrupts <- os.Interrupt
+	}()
+	if _, err := exec(compileString(t, "(spin)"), nil); err == nil || err.(*Error).Kind() != InterruptKey {
+		t.Error("expected an interrupt: error, got ", err)
+	}
+	//interrupts while the REPL waits for input are cleared when it gets it, and don't end the process
+	defer EnableInterrupts()()
+	initReplVariables()
+	awaitInput()
+	defer awaitingInput.Store(false)
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal("cannot find the test process: ", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := self.Signal(os.Interrupt); err != nil {
+			t.Skip("cannot send an interrupt: ", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	handler := &ellHandler{}
+	if result, _, err := handler.Eval("(+ 1 2)"); err != nil || result != "= 3" {
+		t.Error("interrupts while waiting for input were not cleared: ", result, err)
+	}
+}
+
+func TestWriteCode(t *testing.T) {
+	src := `((fn (x [(y "default")]) (list x y [x y] {a: x})) 23)`
+	data, err := WriteCode(compileString(t, src))
+	if err != nil {
+		t.Fatal("cannot write code: ", err)
+	}
+	more, _ := WriteCode(compileString(t, "(def *write-code-test* ((fn args args) 57))"))
+	data = append(more, data...)
+	code, err := LoadCode(data)
+	if err != nil {
+		t.Fatal("cannot load code: ", err, "\n", string(data))
+	}
+	result, err := exec(code, nil)
+	if err != nil {
+		t.Fatal("loaded code failed: ", err)
+	}
+	if s := Write(result); s != `(23 "default" [23 "default"] {a: 23})` {
+		t.Error("loaded code returned the wrong value: ", s)
+	}
+	if val := GetGlobal(Intern("*write-code-test*")); val == nil || Write(val) != "(57)" {
+		t.Error("loaded code did not run all of its forms: ", val)
+	}
+}
+
+func TestWriteCodeGensyms(t *testing.T) {
+	Init()
+	g := Gensym("tmp")
+	named := Intern(g.Text)
+	expr := NewList(Intern("list"), NewList(QuoteSymbol, g), NewList(QuoteSymbol, g), NewList(QuoteSymbol, named))
+	compiled, err := Compile(expr)
+	if err != nil {
+		t.Fatal("cannot compile: ", err)
+	}
+	data, err := WriteCode(compiled)
+	if err != nil {
+		t.Fatal("cannot write code: ", err)
+	}
+	code, err := LoadCode(data)
+	if err != nil {
+		t.Fatal("cannot load code: ", err, "\n", string(data))
+	}
+	result, err := exec(code, nil)
+	if err != nil {
+		t.Fatal("loaded code failed: ", err)
+	}
+	syms := result.(*List)
+	first, second, third := syms.Car, Cadr(syms), Caddr(syms)
+	if first == named || first == Value(g) {
+		t.Error("a gensym was interned when the code was loaded: ", string(data))
+	}
+	if first != second {
+		t.Error("the occurrences of a gensym were loaded as different symbols: ", string(data))
+	}
+	if third != named {
+		t.Error("the symbol with the name of a gensym was not loaded as itself: ", string(data))
+	}
+	if _, err := ReadFromString("#:tmp:"); err == nil {
+		t.Error("a keyword was read as an uninterned symbol")
+	}
+}
+
+func TestModuleDeclarations(t *testing.T) {
+	Init()
+	dir := t.TempDir()
+	defer SetLoadPath(LoadPath()...)
+	SetLoadPath(dir)
+	//the accessors of the record are defined by a macro, after the function that refers to them
+	src := "(export span-width)\n(defn span-width (s) (- (span-high s) (span-low s)))\n(defrecord span (low high))\n(def wide (span 2 9))\n"
+	if err := os.WriteFile(filepath.Join(dir, "spans.ell"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exec(compileString(t, "(use spans)"), nil); err != nil {
+		t.Fatal("cannot use the module: ", err)
+	}
+	result, err := exec(compileString(t, "(span-width spans:wide)"), nil)
+	if err != nil || !Equal(result, Integer(7)) {
+		t.Error("expected 7 from a function using names a macro defines later in its module, got ", result, err)
+	}
+}
+
+func TestModuleCache(t *testing.T) {
+	Init()
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+	t.Setenv("HOME", dir)
+	defer SetLoadPath(LoadPath()...)
+	SetLoadPath(dir)
+	write := func(name string, text string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	answer := func() string {
+		delete(modules, "cachemain")
+		delete(modules, "cacheuser")
+		if _, err := exec(compileString(t, "(use cachemain)"), nil); err != nil {
+			t.Fatal("cannot use the module: ", err)
+		}
+		result, err := exec(compileString(t, "(get-answer)"), nil)
+		if err != nil {
+			t.Fatal("cannot call the module's function: ", err)
+		}
+		return Write(result)
+	}
+	write("cacheuser.ell", "(defmacro answer () 1)\n")
+	write("cachemain.ell", "(use cacheuser)\n(defn get-answer () (answer))\n")
+	if s := answer(); s != "1" {
+		t.Error("the module returned ", s)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cache")); err == nil {
+		t.Error("modules were cached without --cache")
+	}
+	cacheModules = true
+	defer func() { cacheModules = false }()
+	for _, expected := range []string{"1", "1"} {
+		if s := answer(); s != expected {
+			t.Error("the cached module returned ", s, " instead of ", expected)
+		}
+	}
+	if cached, _ := filepath.Glob(filepath.Join(dir, "cache", "ell", "*.lvm")); len(cached) != 2 {
+		t.Error("expected the two modules to be cached, got ", cached)
+	}
+	//a change to a macro the module used invalidates its cached code
+	write("cacheuser.ell", "(defmacro answer () 42)\n")
+	for _, expected := range []string{"42", "42"} {
+		if s := answer(); s != expected {
+			t.Error("the cached module returned ", s, " instead of ", expected)
+		}
+	}
+}
+
+func TestCallFunction(t *testing.T) {
+	Init()
+	DefineFunctionRestArgs("call-through", func(argv []Value) (Value, error) {
+		return TailCallFunction(argv[0], argv[1:])
+	}, AnyType, AnyType, AnyType)
+	DefineFunctionRestArgs("call-twice", nil, AnyType, AnyType, AnyType)
+	defineCallback("call-twice", func(vm *vm, argv []Value) (Value, error) {
+		val, err := CallFunction(vm, argv[0], argv[1:])
+		if err != nil {
+			return nil, err
+		}
+		return CallFunction(vm, argv[0], []Value{val})
+	})
+	defer func() { optimize = false }()
+	for _, optimize = range []bool{false, true} {
+		result, err := exec(compileString(t, "(list (call-through + 1 2) (call-through (fn (x) (* x 2)) 21))"), nil)
+		if err != nil || Write(result) != "(3 42)" {
+			t.Error("expected (3 42) from calls through a primitive, got ", result, err)
+		}
+		//a loop through the primitive is a tail call, so it runs in constant stack space
+		src := "(do (defn count-down (n) (if (= n 0) 'done (call-through count-down (- n 1)))) (count-down 10000))"
+		result, err = ExecWithLimits(Limits{MaxStack: 100}, compileString(t, src))
+		if err != nil || result != Intern("done") {
+			t.Error("expected a loop through a primitive to finish, got ", result, err)
+		}
+	}
+	result, err := exec(compileString(t, "(list (call-twice inc 1) (call-twice (fn (x) (* x 2)) 3))"), nil)
+	if err != nil || Write(result) != "(3 12)" {
+		t.Error("expected (3 12) from calls returning to a primitive, got ", result, err)
+	}
+	//the calls run under the limits of the VM that calls the primitive
+	_, err = ExecWithLimits(Limits{MaxInstructions: 10000}, compileString(t, "(call-twice (fn (x) (let loop () (loop))) 1)"))
+	if errorKind(err) != LimitErrorKey {
+		t.Error("expected a limit error from a loop called from a primitive, got ", err)
+	}
+}
+
+func TestCaller(t *testing.T) {
+	Init()
+	fn, err := exec(compileString(t, "(fn (x) (list x (+ x 1)))"), nil)
+	if err != nil {
+		t.Fatal("cannot make the function: ", err)
+	}
+	call := caller(VM(defaultStackSize), fn.(*Function), 1, "test")
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 1000; i++ {
+		if result, err := call(Integer(3)); err != nil || Write(result) != "(3 4)" {
+			t.Fatal("expected (3 4) from the caller, got ", result, err)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	//a stack for each call would be a thousand of them
+	if n := after.TotalAlloc - before.TotalAlloc; n > 100*defaultStackSize*uint64(valueSize) {
+		t.Error("the caller's VM does not reuse its stack: ", n, " bytes allocated")
+	}
+}
+
+// execOptimized - the result of the source compiled with the optimization flag off and with it on, which must be
+// the same. The flag is left on, for the caller to look at the code compiled with it, until the test ends.
+func execOptimized(t *testing.T, flag *bool, src string) string {
+	saved := *flag
+	t.Cleanup(func() { *flag = saved })
+	results := make([]string, 0, 2)
+	for _, *flag = range []bool{false, true} {
+		code := compileString(t, src)
+		result, err := exec(code, nil)
+		if err != nil {
+			t.Fatal("cannot execute ", code, ": ", err)
+		}
+		results = append(results, Write(result))
+	}
+	if results[0] != results[1] {
+		t.Error("optimized code returned ", results[1], " instead of ", results[0])
+	}
+	return results[0]
+}
+
+func TestPeephole(t *testing.T) {
+	Init()
+	src := "((fn (x) (do 1 (if (and (> x 0) (name: {name: true})) (list x 'positive) (do 2 (list x))))) 1)"
+	execOptimized(t, &peephole, src)
+	lap := compileString(t, src).String()
+	if !strings.Contains(lap, "(callglobal 2 >)") || !strings.Contains(lap, "(callliteral 1 name:)") || strings.Contains(lap, "(pop)") {
+		t.Error("code was not optimized: ", lap)
+	}
+}
+
+func TestPrimops(t *testing.T) {
+	Init()
+	src := "((fn (v n) (vector-set! v 0 (cons (- n 1) (cdr '(1 2)))) (if (< n 3) (get {a: (car (vector-ref v 0))} a:) (not n))) [0] 2)"
+	execOptimized(t, &optimize, src)
+	lap := compileString(t, src).String()
+	if !strings.Contains(lap, "(vector-set!)") || !strings.Contains(lap, "(dec)") || strings.Contains(lap, "callglobal") {
+		t.Error("primitives were not compiled as primops: ", lap)
+	}
+	_, err := exec(compileString(t, "(car 1)"), nil)
+	if err == nil || !strings.Contains(err.Error(), "car expected a <list>") {
+		t.Error("primop did not check its argument type: ", err)
+	}
+}
+
+func TestInline(t *testing.T) {
+	Init()
+	src := `((fn (n) (let ((a (* n 2)) (b (let ((n 1)) n)))
+	                (let ((a (+ a b)) (n (cons n '())))
+	                  (list a b n (let loop ((i 0) (fs '()))
+	                                (if (< i 3) (loop (inc i) (let ((j i)) (cons (fn () j) fs))) (map (fn (f) (f)) fs))))))) 3)`
+	if result := execOptimized(t, &optimize, src); result != "(7 1 (3) (2 1 0))" {
+		t.Error("inlined code returned ", result, " instead of (7 1 (3) (2 1 0))")
+	}
+	lap := compileString(t, "((fn (n) (let ((a (* n 2))) (let ((a (inc a)) (b n)) (list a b)))) 3)").String()
+	if strings.Count(lap, "(closure") != 1 || !strings.Contains(lap, "(setlocal 0 2)") {
+		t.Error("lets were not inlined: ", lap)
+	}
+}
+
+func TestSourceLocations(t *testing.T) {
+	Init()
+	file := filepath.Join(t.TempDir(), "locations.ell")
+	loadSource := func(src string) error {
+		if err := os.WriteFile(file, []byte(src), 0644); err != nil {
+			t.Fatal("cannot write ", file, ": ", err)
+		}
+		return LoadFile(file)
+	}
+	defer func() { optimize = false }()
+	for _, optimize = range []bool{false, true} {
+		err := loadSource("(defn location-test (x)\n  (let ((y (inc x)))\n    (car y)))\n\n(location-test 1)\n")
+		trace := formatStackTrace(err)
+		if !strings.Contains(trace, "location-test [pc ") || !strings.Contains(trace, "("+file+":3:5)") || !strings.Contains(trace, "("+file+":5:1)") {
+			t.Error("runtime error was not located: ", err, trace)
+		}
+	}
+	if err := os.WriteFile(file, []byte("(defn location-test (x)\n  (let ((y (inc x)))\n    (car y)))\n"), 0644); err != nil {
+		t.Fatal("cannot write ", file, ": ", err)
+	}
+	var compiled bytes.Buffer
+	if err := loadFile(file, &compiled); err != nil {
+		t.Fatal("cannot load ", file, ": ", err)
+	}
+	undefGlobal(Intern("location-test").(*Symbol))
+	code, err := LoadCode(compiled.Bytes())
+	if err == nil {
+		_, err = importCode(code)
+	}
+	if err != nil {
+		t.Fatal("cannot load the compiled code ", compiled.String(), ": ", err)
+	}
+	_, err = Eval(NewList(Intern("location-test"), One))
+	if trace := formatStackTrace(err); !strings.Contains(trace, "("+file+":3:5)") {
+		t.Error("runtime error in loaded code was not located: ", err, trace)
+	}
+	err = loadSource("(def location-test\n  (fn (x)\n\t(if)))\n")
+	if errobj, ok := err.(*Error); !ok || errobj.Location == nil || errobj.Location.String() != file+":3:2" {
+		t.Error("syntax error was not located: ", err, formatStackTrace(err))
+	}
+}
+
+func TestRaiseSharedError(t *testing.T) {
+	Init()
+	file := filepath.Join(t.TempDir(), "shared.ell")
+	src := "(def shared-error (make-error test-error: \"shared\"))\n(defn raise-here () (raise shared-error))\n(defn raise-there () (raise shared-error))\n"
+	if err := os.WriteFile(file, []byte(src), 0644); err != nil {
+		t.Fatal("cannot write ", file, ": ", err)
+	}
+	defer func() { optimize = false }()
+	for _, optimize = range []bool{false, true} {
+		if err := LoadFile(file); err != nil {
+			t.Fatal("cannot load ", file, ": ", err)
+		}
+		traces := []string{"(raise-here)", "(raise-there)", "(raise (catch (raise-here)))", "shared-error"}
+		for i, src := range traces {
+			val, err := exec(compileString(t, "(stack-trace (catch "+src+"))"), nil)
+			if err != nil {
+				t.Fatal("cannot get the trace of ", src, ": ", err)
+			}
+			traces[i] = Write(val)
+		}
+		if !strings.Contains(traces[0], file+":2:") || !strings.Contains(traces[1], file+":3:") {
+			t.Error("an error raised from two places did not get the trace of each: ", traces[0], traces[1])
+		}
+		if !strings.Contains(traces[2], file+":2:") {
+			t.Error("an error raised again did not keep its trace: ", traces[2])
+		}
+		if traces[3] != "()" {
+			t.Error("raising an error changed the value the program holds: ", traces[3])
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	src := `(1 #| a block comment #| nested |# (not read) |# 2
+	  #;(3 4) 5 #;
+	  6 [7 #;8] {a: #| |# 9 #;b: #;10} ; to the end of the line
+	  #|#|x|#|#)`
+	expr, err := ReadFromString(src)
+	if err != nil {
+		t.Fatal("cannot read ", src, ": ", err)
+	}
+	if s := Write(expr); s != "(1 2 5 [7] {a: 9})" {
+		t.Error("comments were not skipped: ", s)
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	Init()
+	src := `(let ((b #u8(104 105 0 255)) (c (make-blob 2 7)))
+	          (blob-set! b 2 33)
+	          (blob-set! c 1 8)
+	          (list b (blob-length b) (blob-ref b 3) (blob->string (subblob b 0 3)) (string->blob "hi") c
+	                (equal? (subblob b 0 2) (string->blob "hi")) (subblob b 3 10)))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != `(#u8(104 105 33 255) 4 255 "hi!" #u8(104 105) #u8(7 8) true #u8(255))` {
+		t.Error("blob primitives returned the wrong value: ", s)
+	}
+	for _, bad := range []string{"#u8(1 256)", "#u8(a)", "#u(1)"} {
+		if _, err := ReadFromString(bad); err == nil {
+			t.Error("bad blob literal was read: ", bad)
+		}
+	}
+	if _, err := exec(compileString(t, "(blob-set! (make-blob 1) 1 0)"), nil); err == nil {
+		t.Error("blob-set! did not check the index")
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	Init()
+	defer func() { optimize = false }()
+	src := `(list (* 99999999999 99999999999) (+ 9223372036854775807 1) (- -9223372036854775808 1) (/ 6 3) (/ 1 3)
+	              (+ 1/3 2/3) (* 1.5 2) (quotient -7 2) (remainder -7 2) (modulo -7 2) (floor -7/2) (ceiling -7/2)
+	              (int 5/2) (exact 0.5) (inexact 1/4) (exact? 1/2) (inexact? 1.0) (= 1/2 0.5) (< 1/3 0.34) (inc 1/2))`
+	for _, optimize = range []bool{false, true} {
+		result, err := exec(compileString(t, src), nil)
+		if err != nil {
+			t.Fatal("cannot execute ", src, ": ", err)
+		}
+		expected := "(9999999999800000000001 9223372036854775808 -9223372036854775809 2 1/3 1 3.0 -3 -1 1 -4 -3 3 1/2 0.25 true true true true 3/2)"
+		if s := Write(result); s != expected {
+			t.Error("optimize ", optimize, ": numeric operations returned the wrong value: ", s)
+		}
+	}
+	for _, bad := range []string{"(/ 1 0)", "(quotient 1/2 1)", "(exact (/ 1.0 0))"} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("no error for ", bad)
+		}
+	}
+	for _, s := range []string{"12345678901234567890123", "-2/3", "1.5", "2.0", "+Inf"} {
+		val, err := ReadFromString(s)
+		if err != nil || Write(val) != s {
+			t.Error("number did not read back the same: ", s, " => ", val, err)
+		}
+	}
+}
+
+func TestSmallValueCache(t *testing.T) {
+	Init()
+	src := `(list (identical? (+ 1 2) 3) (identical? (to-character "b") #\b) (identical? (* 1000 1000) 1000000))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != "(true true false)" {
+		t.Error("small values were not shared: ", s)
+	}
+	n1, n2 := Integer(100), Integer(200)
+	if allocs := testing.AllocsPerRun(100, func() { NumberAdd(n1, n2) }); allocs != 0 {
+		t.Error("small integer arithmetic allocated: ", allocs)
+	}
+}
+
+func TestPorts(t *testing.T) {
+	Init()
+	src := `(let ((out (open-output-string)) (in (open-input-string "ab\ncd\n(1 2) x")))
+	          (display "x=" out)
+	          (write "hi" port: out)
+	          (print out 1 " " 'foo)
+	          (println out "!")
+	          (newline out)
+	          (let ((result (list (get-output-string out))))
+	            (let loop ((fns (list read-char peek-char read-line read-line read read read read-line)))
+	              (if (empty? fns) (reverse (cons (port? in) (cons (input-port? out) (cons (output-port? out) result))))
+	                (do (set! result (cons ((car fns) in) result))
+	                    (loop (cdr fns)))))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != `("x=\"hi\"1 foo!\n\n" #\a #\b "b" "cd" (1 2) x null null true false true)` {
+		t.Error("ports returned the wrong value: ", s)
+	}
+	if _, err := exec(compileString(t, `(let ((out (open-output-string))) (close out) (display 1 out))`), nil); err == nil {
+		t.Error("writing to a closed port did not fail")
+	}
+}
+
+func TestBinaryPorts(t *testing.T) {
+	Init()
+	src := `(let ((out (open-output-blob)) (in (open-input-blob #u8(1 2 3 4 5))))
+	          (write-byte 255 out)
+	          (write-bytes #u8(7 8) out)
+	          (let ((b (read-byte in)))
+	            (let ((p (peek-byte in)))
+	              (let ((bs (read-bytes 3 in)))
+	                (let ((rest (read-bytes 3 in)))
+	                  (list (get-output-blob out) b p bs rest (read-bytes 1 in) (read-byte in) (binary-port? in) (binary-port? (open-output-string))))))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != "(#u8(255 7 8) 1 2 #u8(2 3 4) #u8(5) null null true false)" {
+		t.Error("binary ports returned the wrong value: ", s)
+	}
+	for _, bad := range []string{`(read-char (open-input-blob #u8(1)))`, `(read-byte (open-input-string "a"))`, `(write-byte 256 (open-output-blob))`, `(display 1 (open-output-blob))`} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("no error for ", bad)
+		}
+	}
+}
+
+func TestStandardPorts(t *testing.T) {
+	Init()
+	defer DefineGlobal("*stdout*", stdoutPort)
+	src := `(let ((out (open-output-string)) (saved *stdout*))
+	          (set! *stdout* out)
+	          (print "a" 1)
+	          (println " b")
+	          (printf "~d~%" 2)
+	          (display 'c)
+	          (newline)
+	          (set! *stdout* saved)
+	          (list (get-output-string out) (input-port? *stdin*) (output-port? *stdout*) (output-port? *stderr*)
+	                (string *stdin*) (string *stderr*)))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != `("a1 b\n2\nc\n" true true true "#[input-port stdin]" "#[output-port stderr]")` {
+		t.Error("standard ports returned the wrong value: ", s)
+	}
+	if _, err := exec(compileString(t, `(do (set! *stdout* 1) (print "x"))`), nil); err == nil {
+		t.Error("printing to a *stdout* that is not a port did not fail")
+	}
+}
+
+func TestLog(t *testing.T) {
+	Init()
+	defer func(level LogLevel, timestamps bool, json bool, port *Port) {
+		logLevel, logTimestamps, logJSON, logPort = level, timestamps, json, port
+	}(logLevel, logTimestamps, logJSON, logPort)
+	src := `(let ((out (open-output-string)))
+	          (log-config port: out level: info: json: false timestamps: false)
+	          (log-debug "dropped")
+	          (log-info "started" user: "ann" n: 3)
+	          (log-config json: true)
+	          (log-warn "disk low" free: 1024)
+	          (let ((config (log-config level: error: port: false)))
+	            (log-warn "dropped")
+	            (list (get-output-string out) (get config level:) (get config json:) (get config port:))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `("INFO started user=\"ann\" n=3\n{\"level\": \"warn\", \"msg\": \"disk low\", \"free\": 1024}\n" error: true null)`
+	if s := Write(result); s != expected {
+		t.Error("log entries were wrong: ", s)
+	}
+	for _, src := range []string{`(log-info "x" key:)`, `(log-config level: loud:)`, `(log-config port: 1)`} {
+		if _, err := exec(compileString(t, src), nil); err == nil {
+			t.Error("no error from ", src)
+		}
+	}
+}
+
+func TestReadText(t *testing.T) {
+	Init()
+	src := `(let ((in (open-input-string "héllo\nwörld")) (result '()))
+	          (let loop ((fns (list (fn () (read-string 3 in)) (fn () (peek-char in)) (fn () (read-line in))
+	                                (fn () (read-string 0 in)) (fn () (read-string 10 in)) (fn () (read-string 1 in))
+	                                (fn () (eof-object? (read-line in))) (fn () (eof-object? (read-char in)))
+	                                (fn () (eof-object? #\a)))))
+	            (if (empty? fns) (reverse result)
+	              (do (set! result (cons ((car fns)) result))
+	                  (loop (cdr fns))))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != `("hél" #\l "lo" "" "wörld" null true true false)` {
+		t.Error("text reading primitives returned the wrong value: ", s)
+	}
+	for _, bad := range []string{`(read-string -1 (open-input-string "a"))`, `(read-string 1 (open-input-blob #u8(1)))`} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("expected an error: ", bad)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	Init()
+	dir := t.TempDir()
+	src := fmt.Sprintf(`(let ((dir %q))
+	          (make-directory (string dir "/sub"))
+	          (write-file (string dir "/a.txt") "hello")
+	          (append-file (string dir "/a.txt") #u8(33 10))
+	          (let ((out (open-output-file (string dir "/b.txt") append: true)))
+	            (write '(1 "two") port: out)
+	            (close out))
+	          (rename-file (string dir "/b.txt") (string dir "/c.txt"))
+	          (let ((in (open-input-file (string dir "/c.txt"))))
+	            (let ((val (read in)))
+	              (close in)
+	              (let ((info (file-info (string dir "/a.txt"))) (bytes (read-file (string dir "/a.txt") binary: true)))
+	                (delete-file (string dir "/c.txt"))
+	                (list (read-file (string dir "/a.txt")) bytes val (get info size:) (get info directory:)
+	                      (get (file-info (string dir "/sub")) directory:) (list-directory dir)
+	                      (file-exists? (string dir "/c.txt")))))))`, dir)
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != `("hello!\n" #u8(104 101 108 108 111 33 10) (1 "two") 7 false true ("a.txt" "sub") false)` {
+		t.Error("file primitives returned the wrong value: ", s)
+	}
+	if _, err := exec(compileString(t, fmt.Sprintf(`(read-file "%s/missing")`, dir)), nil); err == nil {
+		t.Error("reading a missing file did not fail")
+	}
+}
+
+func TestWithOpenFile(t *testing.T) {
+	Init()
+	path := filepath.Join(t.TempDir(), "a.txt")
+	src := fmt.Sprintf(`(let ((path %q) (ports '()))
+	          (with-open-output-file (out path) (set! ports (cons out ports)) (write '(1 2) port: out))
+	          (with-open-output-file (out path append: true) (set! ports (cons out ports)) (write 3 port: out))
+	          (let ((val (with-open-input-file (in path) (set! ports (cons in ports)) (let ((a (read in))) (list a (read in))))))
+	            (let ((err (catch (with-open-input-file (in path) (set! ports (cons in ports)) (error "oops")))))
+	              (list val (error? err) (map (fn (p) (string-ends-with? (string p) "CLOSED]")) ports)))))`, path)
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != `(((1 2) 3) true (true true true true))` {
+		t.Error("with-open-file forms returned the wrong value: ", s)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	Init()
+	dir := t.TempDir()
+	archive, err := os.Create(filepath.Join(dir, "a.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(archive)
+	for _, name := range []string{"top.txt", "sub/", "sub/inner.txt"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(name, "/") {
+			io.WriteString(w, "in "+name)
+		}
+	}
+	zw.Close()
+	archive.Close()
+	src := fmt.Sprintf(`(let ((dir %q))
+	          (with-open-output-file (out (string dir "/log.gz") gzip: true) (println out "one"))
+	          (with-open-output-file (out (string dir "/log.gz") gzip: true append: true) (println out "two"))
+	          (let ((lines (with-open-input-file (in (string dir "/log.gz") gzip: true)
+	                         (let ((a (read-line in))) (let ((b (read-line in))) (list a b (read-line in))))))
+	                (extracted (zip-extract (string dir "/a.zip") (string dir "/out"))))
+	            (list (blob->string (gunzip (gzip "hello"))) (equal? (gunzip (gzip #u8(1 2 3))) #u8(1 2 3)) lines
+	                  (blob->string (gunzip (read-file (string dir "/log.gz") binary: true)))
+	                  (map (fn (e) (list (get e name:) (get e size:) (get e directory:))) (zip-entries (string dir "/a.zip")))
+	                  extracted (read-file (string dir "/out/sub/inner.txt")))))`, dir)
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `("hello" true ("one" "two" null) "one\ntwo\n" (("top.txt" 10 false) ("sub/" 0 true) ("sub/inner.txt" 16 false)) ("top.txt" "sub/inner.txt") "in sub/inner.txt")`
+	if s := Write(result); s != expected {
+		t.Error("compression primitives returned the wrong value: ", s)
+	}
+	archive, _ = os.Create(filepath.Join(dir, "bad.zip"))
+	zw = zip.NewWriter(archive)
+	zw.Create("../escaped.txt")
+	zw.Close()
+	archive.Close()
+	for _, bad := range []string{`(gunzip #u8(1 2 3))`, fmt.Sprintf(`(zip-extract "%s/bad.zip" "%s/out")`, dir, dir)} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("expected an error: ", bad)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.txt")); err == nil {
+		t.Error("zip-extract wrote a file outside the directory")
+	}
+}
+
+func TestLoopClosures(t *testing.T) {
+	Init()
+	src := `(do
+	          (def thunks '())
+	          (dorange (i 3) (set! thunks (cons (fn () i) thunks)))
+	          (let loop ((i 0))
+	            (when (< i 3)
+	              (set! thunks (cons (fn () (set! i (* i 10)) i) thunks))
+	              (loop (+ i 1))))
+	          (defn count-down (n acc)
+	            (if (= n 0) acc (count-down (- n 1) (cons (fn () n) acc))))
+	          (list (map (fn (f) (f)) thunks) (map (fn (f) (f)) (count-down 3 '()))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != "((20 10 0 2 1 0) (1 2 3))" {
+		t.Error("closures made in a loop do not have their own variables: ", s)
+	}
+	//a nested loop's binding shadows the outer loop only in its body, not in the init expressions after it
+	src = `(let outer ((n 3))
+	         (if (= n 0) 0
+	           (let inner ((outer 1) (m (outer (- n 1))))
+	             (+ m outer))))`
+	result, err = exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != "3" {
+		t.Error("a call in a nested loop's init expression was compiled as a jump: ", s)
+	}
+}
+
+func TestApply(t *testing.T) {
+	Init()
+	src := `(do
+	          (defn count-down (n) (if (= n 0) 'done (apply count-down (list (- n 1)))))
+	          (list (apply list 1 2 '(3 4)) (apply list '()) (funcall list 1 2) (identity 'x)
+	                ((complement zero?) 3) ((partial list 1 2) 3) (apply name: (list {name: 23}))
+	                (count-down 100000) (callcc (fn (k) (apply k '(5)) 6))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != "((1 2 3 4) () (1 2) x true (1 2 3) 23 done 5)" {
+		t.Error("apply returned the wrong value: ", s)
+	}
+	for _, src := range []string{`(apply list)`, `(apply list 1 2)`, `(apply 1 '())`, `(funcall "x")`} {
+		if _, err := exec(compileString(t, src), nil); err == nil {
+			t.Error("expected an error from ", src)
+		}
+	}
+}
+
+func TestEvalAndCompile(t *testing.T) {
+	Init()
+	src := `(do
+	          (eval '(def eval-test-value 21))
+	          (def compiled (compile '(* eval-test-value 2)))
+	          (list (eval (list '+ 1 2)) (type compiled) (compiled) (apply compiled '())
+	                (callcc (fn (k) (eval (list k 5)) 6))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != "(3 <code> 42 42 5)" {
+		t.Error("eval and compile returned the wrong value: ", s)
+	}
+	if _, err := exec(compileString(t, `((compile '(+ 1 2)) 3)`), nil); err == nil {
+		t.Error("calling compiled code with an argument did not fail")
+	}
+	if _, err := exec(compileString(t, `(eval '(if))`), nil); err == nil {
+		t.Error("evaluating a malformed expression did not fail")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	Init()
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.ell":      "(def loaded-value 1)\n(load \"sub/part.ell\")\n",
+		"sub/part.ell":  "(load \"other.ell\")\n",
+		"sub/other.ell": "(def loaded-value (+ loaded-value 1))\n",
+		"self.ell":      "(load \"self.ell\")\n",
+		"open.ell":      "(def x 1)\n\n(list (list 2)\n",
+		"close.ell":     "(def x 1)\n  (list 2))\n",
+	}
+	for name, text := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := LoadFile(filepath.Join(dir, "main.ell")); err != nil {
+		t.Fatal("cannot load a file that loads files relative to it: ", err)
+	}
+	if val := GetGlobal(Intern("loaded-value")); !Equal(val, Integer(2)) {
+		t.Error("the loaded files were not evaluated: ", val)
+	}
+	if err := LoadFile(filepath.Join(dir, "self.ell")); err == nil || !strings.Contains(err.Error(), "Recursive load") {
+		t.Error("expected an error loading a file that loads itself, got ", err)
+	}
+	for name, location := range map[string]string{"open.ell": ":3:1", "close.ell": ":2:11"} {
+		err := LoadFile(filepath.Join(dir, name))
+		if e, ok := err.(*Error); !ok || e.Kind() != SyntaxErrorKey || !strings.HasSuffix(e.Location.String(), name+location) {
+			t.Errorf("expected a syntax error at %s%s, got %v%s", name, location, err, formatStackTrace(err))
+		}
+	}
+	src := `(let ((port (open-input-string "(def loaded-from-port 23) (* loaded-from-port 2)")))
+	          (load port)
+	          loaded-from-port)`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil || !Equal(result, Integer(23)) {
+		t.Error("loading a string port returned ", result, err)
+	}
+	if _, err := exec(compileString(t, `(load (open-input-string "(list 1"))`), nil); err == nil {
+		t.Error("loading a port whose input ends in the middle of a form did not fail")
+	}
+}
+
+func TestCompileFile(t *testing.T) {
+	Init()
+	file := filepath.Join(t.TempDir(), "swapper.ell")
+	src := "(defmacro swap2 (a b) `(list ~b ~a))\n(defn swapped () (swap2 1 2))\n(swapped)\n"
+	if err := os.WriteFile(file, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	//the macro is defined while the file is compiled, so its uses after it are expanded
+	lvm, err := CompileFile(file)
+	if err != nil {
+		t.Fatal("cannot compile ", file, ": ", err)
+	}
+	code, err := LoadCode([]byte(StringValue(lvm)))
+	if err != nil {
+		t.Fatal("cannot load the compiled code: ", err)
+	}
+	if result, err := exec(code, nil); err != nil || Write(result) != "(2 1)" {
+		t.Error("expected (2 1) from the compiled code, got ", result, err)
+	}
+}
+
+func TestProcess(t *testing.T) {
+	Init()
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	src := fmt.Sprintf(`(let ((dir %q))
+	          (setenv "ELL_TEST_VAR" "hello")
+	          (chdir dir)
+	          (list (getenv "ELL_TEST_VAR") (current-directory)
+	                (system "echo $ELL_TEST_VAR; echo oops >&2; exit 3")
+	                (exec-command "cat" '() input: "piped")
+	                (get (exec-command "pwd" '() dir: "/") stdout:)))`, dir)
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := fmt.Sprintf(`("hello" %q {stdout: "hello\n" stderr: "oops\n" exit-code: 3} {stdout: "piped" stderr: "" exit-code: 0} "/\n")`, dir)
+	if s := Write(result); s != expected {
+		t.Error("process primitives returned the wrong value: ", s)
+	}
+	if _, err := exec(compileString(t, `(exec-command "no-such-command-for-ell" '())`), nil); err == nil {
+		t.Error("running a missing command did not fail")
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	Init()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Test", r.Header.Get("X-Test"))
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(404)
+		}
+		fmt.Fprintf(w, "%s %s", r.Method, body)
+	}))
+	defer server.Close()
+	src := fmt.Sprintf(`(let ((url %q))
+	          (let ((res1 (http-get (string url "/x") headers: {X-Test: "yes"})) (res2 (http-post url "data")))
+	            (list (get res1 status:) (blob->string (get res1 body:)) (get (get res1 headers:) "X-Test")
+	                  (blob->string (get res2 body:)) (get (http-get (string url "/missing")) status:)
+	                  (blob->string (get (http url method: "PUT" body: #u8(65)) body:)))))`, server.URL)
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != `(200 "GET " ("yes") "POST data" 404 "PUT A")` {
+		t.Error("http primitives returned the wrong value: ", s)
+	}
+	_, err = exec(compileString(t, `(http-get "http://localhost:0/")`), nil)
+	if e, ok := err.(*Error); !ok || e.Kind() != HTTPErrorKey {
+		t.Error("expected an http-error, got ", err)
+	}
+}
+
+func TestHTTPServer(t *testing.T) {
+	Init()
+	src := `(let ((count 0))
+	          (fn (req)
+	            (set! count (inc count))
+	            (if (equal? (get req path:) "/text") "plain"
+	              (if (equal? (get req path:) "/fail") (error "failed")
+	                {status: 201 headers: {X-Count: (string count)}
+	                 body: (string (get req method:) " " (get req query:) " " (blob->string (get req body:)))}))))`
+	handler, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	server := httptest.NewServer(newHTTPHandler(handler.(*Function)))
+	defer server.Close()
+	res, err := http.Post(server.URL+"/x?a=1", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 201 || string(body) != "POST a=1 hello" || res.Header.Get("X-Count") != "1" {
+		t.Error("wrong response: ", res.StatusCode, " ", string(body), " ", res.Header)
+	}
+	for path, expected := range map[string]int{"/text": 200, "/fail": 500} {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != expected || (path == "/text" && string(body) != "plain") {
+			t.Error("wrong response for ", path, ": ", res.StatusCode, " ", string(body))
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	Init()
+	src := `(let ((val (json-parse "{\"b\": [1, 2.5, 12345678901234567890, true, null], \"a\": {\"s\": \"\\u00e9\\n\"}}")))
+	          (list (json-emit val sort-keys: true) (equal? val (json-parse (json-emit val)))
+	                (json-emit {z: 1/2 y: (vector 'x)} sort-keys: true indent: " ")))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `("{\"a\": {\"s\": \"é\\n\"}, \"b\": [1, 2.5, 12345678901234567890, true, null]}" true "{\n \"y\": [\n  \"x\"\n ],\n \"z\": 0.5\n}\n")`
+	if s := Write(result); s != expected {
+		t.Error("json primitives returned the wrong value: ", s)
+	}
+	for _, bad := range []string{`(json-parse "{\"a\": 1,}")`, `(json-parse "[1] 2")`, `(json-parse "{a: 1}")`} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("no error for ", bad)
+		}
+	}
+}
+
+func TestYAMLAndTOML(t *testing.T) {
+	Init()
+	yamlDoc := `
+name: demo
+ports: [80, 443]
+big: 18446744073709551615
+ratio: 0.5
+enabled: yes
+missing: ~
+when: 2001-12-14
+defaults: &defaults
+  retries: 3
+  timeout: 10
+server:
+  <<: *defaults
+  timeout: 30
+  hosts:
+    - a.example.com
+    - b.example.com
+`
+	val, err := ParseYAML(yamlDoc)
+	if err != nil {
+		t.Fatal("cannot parse YAML: ", err)
+	}
+	expected := `{"name" "demo" "ports" [80 443] "big" 18446744073709551615 "ratio" 0.5 "enabled" "yes" "missing" null "when" "2001-12-14" "defaults" {"retries" 3 "timeout" 10} "server" {"retries" 3 "timeout" 30 "hosts" ["a.example.com" "b.example.com"]}}`
+	if s := Write(val); s != expected {
+		t.Error("YAML parsed to the wrong value: ", s)
+	}
+	tomlDoc := `
+title = "demo"
+ports = [80, 443]
+ratio = 0.5
+enabled = true
+updated = 1979-05-27T07:32:00Z
+birthday = 1979-05-27
+
+[server]
+host = "a.example.com"
+[[server.routes]]
+path = "/"
+[[server.routes]]
+path = "/api"
+`
+	val, err = ParseTOML(tomlDoc)
+	if err != nil {
+		t.Fatal("cannot parse TOML: ", err)
+	}
+	expected = `{"birthday" "1979-05-27" "enabled" true "ports" [80 443] "ratio" 0.5 "server" {"host" "a.example.com" "routes" [{"path" "/"} {"path" "/api"}]} "title" "demo" "updated" "1979-05-27T07:32:00Z"}`
+	if s := Write(val); s != expected {
+		t.Error("TOML parsed to the wrong value: ", s)
+	}
+	result, err := exec(compileString(t, `(list (yaml-parse "") (yaml-parse "- 1\n- two") (toml-parse "a = 1"))`), nil)
+	if err != nil {
+		t.Fatal("cannot execute yaml-parse and toml-parse: ", err)
+	}
+	if s := Write(result); s != `(null [1 "two"] {"a" 1})` {
+		t.Error("yaml-parse and toml-parse returned the wrong value: ", s)
+	}
+	for _, bad := range []string{"a: [1", "a: 1\n---\nb: 2", "a: 1\nb: *nope"} {
+		if _, err := ParseYAML(bad); err == nil {
+			t.Error("no error parsing YAML ", bad)
+		}
+	}
+	for _, bad := range []string{"a = ", "a = 1\na = 2", "[t\nx = 1"} {
+		if _, err := ParseTOML(bad); err == nil {
+			t.Error("no error parsing TOML ", bad)
+		}
+	}
+}
+
+func TestXML(t *testing.T) {
+	Init()
+	doc := `<?xml version="1.0"?>
+<feed xmlns:atom="http://www.w3.org/2005/Atom" lang="en">
+  <!-- a comment -->
+  <title>News &amp; <![CDATA[<more>]]></title>
+  <atom:link href="/feed?a=1&amp;b=2"/>
+  <entry id="1"><p>one <b>bold</b> word</p></entry>
+</feed>`
+	val, err := ParseXML(doc)
+	if err != nil {
+		t.Fatal("cannot parse XML: ", err)
+	}
+	expected := `{tag: "feed" attrs: {"xmlns:atom" "http://www.w3.org/2005/Atom" "lang" "en"} children: [` +
+		`{tag: "title" attrs: {} children: ["News & <more>"]} {tag: "atom:link" attrs: {"href" "/feed?a=1&b=2"} children: []} ` +
+		`{tag: "entry" attrs: {"id" "1"} children: [{tag: "p" attrs: {} children: ["one " {tag: "b" attrs: {} children: ["bold"]} " word"]}]}]}`
+	if s := Write(val); s != expected {
+		t.Error("XML parsed to the wrong value: ", s)
+	}
+	src := `(let ((feed (xml-parse "<a x='1'><b>x &lt; y</b><c/></a>")))
+	          (list (xml-emit feed) (xml-emit feed indent: "  ") (equal? feed (xml-parse (xml-emit feed)))
+	                (xml-emit {tag: "p" attrs: {class: "note" n: 2} children: ["a \"quote\"" {tag: "br"}]})))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected = `("<a x=\"1\"><b>x &lt; y</b><c/></a>" "<a x=\"1\">\n  <b>x &lt; y</b>\n  <c/>\n</a>" true "<p class=\"note\" n=\"2\">a &#34;quote&#34;<br/></p>")`
+	if s := Write(result); s != expected {
+		t.Error("xml primitives returned the wrong value: ", s)
+	}
+	for _, bad := range []string{"<a><b></a>", "<a>", "<a/><b/>", "text", "", "<a>&nope;</a>"} {
+		if _, err := ParseXML(bad); err == nil {
+			t.Error("no error parsing XML ", bad)
+		}
+	}
+	for _, bad := range []string{`(xml-emit {attrs: {}})`, `(xml-emit {tag: "a" children: [1 [2]]})`, `(xml-emit {tag: "a" attrs: 1})`} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("no error for ", bad)
+		}
+	}
+}
+
+func TestJSONOptions(t *testing.T) {
+	Init()
+	src := `(let ((port (open-output-string)))
+	          (json-emit {s: "é" k: 'sym} sort-keys: true escape-unicode: true port: port)
+	          (list (get-output-string port) (json-emit ["😀"] escape-unicode: true) (json-emit {"a" 1 b: []} indent: "  " sort-keys: true)))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `("{\"k\": \"sym\", \"s\": \"\\u00e9\"}" "[\"\\ud83d\\ude00\"]" "{\n  \"a\": 1,\n  \"b\": []\n}\n")`
+	if s := Write(result); s != expected {
+		t.Error("json-emit with options returned the wrong value: ", s)
+	}
+	var buf strings.Builder
+	big := MakeVector(1000, NewString("x\x01"))
+	if err := JsonEmitTo(&buf, big, JsonOptions{}); err != nil {
+		t.Fatal("cannot emit to a writer: ", err)
+	}
+	if s, _ := JsonEmit(big, JsonOptions{}); buf.String() != s || !strings.HasPrefix(s, `["x\u0001", `) {
+		t.Error("JsonEmitTo wrote different JSON than JsonEmit: ", buf.String()[:20])
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	Init()
+	big := NewVector(MakeVector(1000, NewString("x\ty")), NewStruct().Put(Intern("k:"), NewSet(Intern("a"))), NewList(QuoteSymbol, Intern("q")))
+	var buf strings.Builder
+	if err := WriteTo(&buf, big); err != nil {
+		t.Fatal("cannot write to a writer: ", err)
+	}
+	if buf.String() != Write(big) || !strings.HasSuffix(buf.String(), ` {k: #{a}} 'q]`) {
+		t.Error("WriteTo wrote different text than Write: ", buf.String()[:20])
+	}
+	buf.Reset()
+	if err := JsonTo(&buf, big, "  "); err != nil {
+		t.Fatal("cannot write JSON to a writer: ", err)
+	}
+	if s, _ := Json(big, "  "); buf.String() != s {
+		t.Error("JsonTo wrote different JSON than Json: ", buf.String()[:20])
+	}
+	if err := JsonTo(&buf, NewStringOutputPort(), ""); err == nil {
+		t.Error("no error from JsonTo for a value with no JSON equivalent")
+	}
+}
+
+func TestReaderOptions(t *testing.T) {
+	Init()
+	tests := []struct {
+		opts     ReaderOptions
+		src      string
+		expected string
+	}{
+		{ReaderOptions{}, `{a: 1 "b": [2, 3]}`, `{a: 1 "b" [2 3]}`},
+		{ReaderOptions{Maps: HashMapBraces}, `{[1 2] "x" a: {}}`, `#hashmap {[1 2] "x" a: #hashmap {}}`},
+		{ReaderOptions{Keywords: KeywordsLeading}, `{:name "x" tags: [:a :b] n: 1}`, `{name: "x" tags [a: b:] n 1}`},
+		{ReaderOptions{JSON: true}, ` {"a": [1, -2.5e3, true, null], "b": {}, "c": []}`, `{"a" [1 -2500.0 true null] "b" {} "c" []}`},
+	}
+	for _, test := range tests {
+		val, err := Decode(test.src, test.opts)
+		if err != nil {
+			t.Error("cannot decode ", test.src, ": ", err)
+		} else if s := Write(val); s != test.expected {
+			t.Error("decoding ", test.src, " returned the wrong value: ", s)
+		}
+	}
+	for _, src := range []string{`{a: 1}`, `[1 2]`, `[1, 2,]`, `{"a" 1}`, `{"a": 1,}`, `[01]`, `[1.]`, `; x
+1`, `(1)`, `#uuid "x"`, `[nan]`} {
+		if val, err := Decode(src, ReaderOptions{JSON: true}); err == nil {
+			t.Error("no error decoding ", src, " as JSON, got ", val)
+		}
+	}
+	if _, err := Decode(`: x`, ReaderOptions{Keywords: KeywordsLeading}); err == nil {
+		t.Error("no error decoding a colon without a name")
+	}
+	reader := NewDataReader(strings.NewReader(`[1, 2] {"x": "y"}`), ReaderOptions{JSON: true})
+	all, err := reader.ReadAll()
+	if err != nil || Write(all) != `([1 2] {"x" "y"})` {
+		t.Error("reading a stream of JSON values returned the wrong value: ", all, err)
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	Init()
+	src := `(let ((s {name: "ann" age: null}))
+	          (defn tail-name (s) (name: s "none"))
+	          (list (name: s) (name: s "none") (age: s 0) (size: s) (size: s "none") (tail-name {}) (apply name: (list {} 1))
+	                (keyword? name:) (keyword? 'name) (keyword->symbol name:) (string->keyword "name")
+	                (string->keyword "name:")))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != `("ann" "ann" 0 null "none" "none" 1 true false name name: name:)` {
+		t.Error("keyword primitives returned the wrong value: ", s)
+	}
+	for _, src := range []string{`(name: {} 1 2)`, `(name:)`, `(string->keyword "")`, `(name: 3 "x")`} {
+		if _, err := exec(compileString(t, src), nil); err == nil {
+			t.Error("no error from ", src)
+		}
+	}
+}
+
+func TestStringBuilder(t *testing.T) {
+	Init()
+	src := `(let ((sb (string-builder "a" 1)))
+	          (dorange (i 0 3) (append! sb #\- i))
+	          (append! sb " " '(x "y") 2.5)
+	          (list (string-builder? sb) (string-builder? "a") (string-builder->string sb)
+	                (string "<" sb ">" #\c null) (string-builder->string (append! (string-builder) sb))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != `(true false "a1-0-1-2 (x y)2.5" "<a1-0-1-2 (x y)2.5>cnull" "a1-0-1-2 (x y)2.5")` {
+		t.Error("string builder returned the wrong value: ", s)
+	}
+	for _, src := range []string{`(append! "a" "b")`, `(string-builder->string "a")`} {
+		if _, err := exec(compileString(t, src), nil); errorKind(err) != ArgumentErrorKey {
+			t.Error("no argument error from ", src, ": ", err)
+		}
+	}
+}
+
+func TestReadIncremental(t *testing.T) {
+	Init()
+	for _, s := range []string{`(foo (bar`, `[1 2`, `{a: 1`, `"abc`, `'`, `#\`, `#| comment`, `#;`, `(a ; comment`, `#u8`} {
+		if _, err := ReadIncremental(s); err != NeedMoreInput {
+			t.Errorf("expected NeedMoreInput for %q, got %v", s, err)
+		}
+	}
+	for _, s := range []string{`(foo]`, `{a: 1]`, `)`} {
+		if _, err := ReadIncremental(s); err == nil || err == NeedMoreInput {
+			t.Errorf("expected a syntax error for %q, got %v", s, err)
+		}
+	}
+	input := ""
+	for _, line := range []string{"(define (f x)", "  ; the result", "  (+ x 1))"} {
+		input += line + "\n"
+		val, err := ReadIncremental(input)
+		if err == NeedMoreInput {
+			continue
+		}
+		if err != nil {
+			t.Fatal("cannot read ", input, ": ", err)
+		}
+		if s := Write(val); s != "(define (f x) (+ x 1))" {
+			t.Error("read the wrong value: ", s)
+		}
+		return
+	}
+	t.Error("never read a complete value from ", input)
+}
+
+func TestUUID(t *testing.T) {
+	Init()
+	src := `(let ((a (uuid)) (b (uuid)) (u #uuid "F47AC10B-58CC-4372-A567-0E02B2C3D479"))
+	          (list (uuid? a) (equal? a b) (equal? a (read (write a))) (length (uuid->string a))
+	                (string-ref (uuid->string a) 14) (write u) (uuid->string u)
+	                (equal? u (string->uuid "urn:uuid:f47ac10b-58cc-4372-a567-0e02b2c3d479"))
+	                (equal? (uuid "x") (uuid "x")) (equal? (uuid u "x") (uuid (uuid->string u) "x"))
+	                (uuid->string (uuid "http://example.com/"))
+	                (get (struct u 1) (string->uuid "f47ac10b-58cc-4372-a567-0e02b2c3d479"))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `(true false true 36 #\4 "#uuid \"f47ac10b-58cc-4372-a567-0e02b2c3d479\"" "f47ac10b-58cc-4372-a567-0e02b2c3d479" true true true "773536a8-4b7b-383d-9106-697d4d366254" 1)`
+	if s := Write(result); s != expected {
+		t.Error("uuids returned the wrong value: ", s)
+	}
+	for _, bad := range []string{`(string->uuid "nope")`, `(read "#uuid \"nope\"")`, `(read "#uuid 1")`, `(uuid 1)`} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("expected an error: ", bad)
+		}
+	}
+}
+
+func TestTaggedLiterals(t *testing.T) {
+	Init()
+	defer DefineTagConstructor(Intern("twice").(*Symbol), nil)
+	defer DefineTagWriter(Intern("<pt>"), nil, nil)
+	src := `(do
+	          (define-tag 'twice (fn (n) (* 2 n)))
+	          (define-tag 'pt (fn (v) (instance <pt> v)) type: <pt> writer: (fn (p) (value p)))
+	          (let ((p (read "#pt [1 #twice 2]")))
+	            (list (read "#twice 21") (type p) (write p) (equal? p (read (write p)))
+	                  (write (read "#foo{a: 1}")) (write (read "#widget \"x\"")) (write (read "#u8(1 2)")))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `(42 <pt> "#pt [1 4]" true "#<foo>{a: 1}" "#<widget>\"x\"" "#u8(1 2)")`
+	if s := Write(result); s != expected {
+		t.Error("tagged literals returned the wrong value: ", s)
+	}
+	for _, bad := range []string{`#pt`, `#9 [1]`, `#foo: 1`} {
+		if _, err := ReadFromString(bad); err == nil {
+			t.Error("no error reading ", bad)
+		}
+	}
+}
+
+func TestPretty(t *testing.T) {
+	Init()
+	val, err := ReadFromString(`(defn f (x) (let ((y [1 2 3 4 5 6])) (list 'quote-me {a: 1 bb: "two"} y)))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := Pretty(val, 100); strings.Contains(s, "\n") {
+		t.Error("pretty printed a value that fits on one line across lines: ", s)
+	}
+	expected := `(defn f
+  (x)
+  (let ((y [1 2 3 4 5 6]))
+    (list 'quote-me
+      {a: 1 bb: "two"}
+      y)))`
+	if s := Pretty(val, 30); s != expected {
+		t.Errorf("pretty printed the wrong text:\n%s", s)
+	}
+	result, err := exec(compileString(t, `(let ((port (open-output-string))) (pprint [1 2 3] width: 4 port: port) (get-output-string port))`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := StringValue(result); s != "[1\n 2\n 3]\n" {
+		t.Errorf("pprint wrote the wrong text: %q", s)
+	}
+}
+
+func TestPrintLimits(t *testing.T) {
+	Init()
+	defer DefineGlobal("*print-length*", Null)
+	defer DefineGlobal("*print-depth*", Null)
+	src := `(do (set! *print-length* 3) (set! *print-depth* 2)
+	          (let ((val '(1 [2 [3 4] {a: [5]}] 6 7 8)))
+	            (list (write val) (json val) (write '(a b c d) indent: " "))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `("(1 [2 ... ...] 6 ...)" "[1, [2, [3, 4], {\"a\": [5]}], 6, 7, 8]" "(\n a\n b\n c\n ...\n)\n")`
+	if s := Write(result); s != expected {
+		t.Error("writing with print limits returned the wrong value: ", s)
+	}
+	val, _ := ReadFromString(`(defn f (x) (list [1 2 3 4] [[5]] (g x y z)))`)
+	expected = "(defn f\n  (x)\n  ...)"
+	if s := Pretty(val, 10); s != expected {
+		t.Errorf("pretty printing with print limits returned the wrong text:\n%s", s)
+	}
+	DefineGlobal("*print-length*", Null)
+	DefineGlobal("*print-depth*", Integer(3))
+	expected = "(defn f\n  (x)\n  (list [1 2 3 4]\n    [...]\n    (g x y z)))"
+	if s := Pretty(val, 20); s != expected {
+		t.Errorf("pretty printing with print depth returned the wrong text:\n%s", s)
+	}
+}
+
+func TestPrintSorted(t *testing.T) {
+	Init()
+	defer DefineGlobal("*print-sorted*", False)
+	src := `(let ((val {z: 1 a: #{3 1 2} m: (hashmap "y" 1 "b" 2)}))
+	          (let ((unsorted (write val)))
+	            (set! *print-sorted* true)
+	            (list unsorted (write val) (json {z: 1 a: 2}) (json-emit {z: 1 a: 2} sort-keys: false))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `("{z: 1 a: #{3 1 2} m: #hashmap {\"y\" 1 \"b\" 2}}" "{a: #{1 2 3} m: #hashmap {\"b\" 2 \"y\" 1} z: 1}" "{\"a\": 2, \"z\": 1}" "{\"z\": 1, \"a\": 2}")`
+	if s := Write(result); s != expected {
+		t.Error("sorted printing returned the wrong value: ", s)
+	}
+}
+
+func TestPrintMethods(t *testing.T) {
+	Init()
+	defer DefinePrintMethod(Intern("<money>"), nil)
+	src := `(do
+	          (define-print-method <money> (fn (m) (string "$" (value m))))
+	          (let ((m (instance <money> 5)) (port (open-output-string)))
+	            (let ((written (list (write m) (write [m {a: m}]) (string m) (do (pprint [m m] width: 6 port: port) (get-output-string port)))))
+	              (define-print-method <money> null)
+	              (list written (write m)))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `(("$5" "[$5 {a: $5}]" "$5" "[$5\n $5]\n") "#<money>5")`
+	if s := Write(result); s != expected {
+		t.Error("print methods returned the wrong value: ", s)
+	}
+	DefinePrintMethod(Intern("<money>"), func(val Value) (string, error) {
+		return "", NewError(ErrorKey, "failed")
+	})
+	if s := Write(NewVector(Intern("x"))); s != "[x]" {
+		t.Error("print method changed the value of another type: ", s)
+	}
+	m, _ := NewInstance(Intern("<money>"), Integer(5))
+	if s := m.String(); s != "#<money>5" {
+		t.Error("failed print method did not fall back to the default form: ", s)
+	}
+}
+
+func TestStructKeys(t *testing.T) {
+	Init()
+	src := `(let ((s (struct 'b 2 "a" 1 [1 2] 'vec 3 'three c: null)))
+	          (put! s 'b 20)
+	          (put! s 3.0 'three-point-oh)
+	          (list (write s) (keys s) (values s) (get s [1 2]) (get s 3) (has-key? s c:) (has? s c:) (has-key? s 'd)
+	                (write (dissoc s "a")) (struct-length s) (equal? s (read (write s)))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `("{b 20 \"a\" 1 [1 2] vec 3 three-point-oh c: null}" (b "a" [1 2] 3 c:) (20 1 vec three-point-oh null) vec three-point-oh true false false "{b 20 [1 2] vec 3 three-point-oh c: null}" 5 true)`
+	if s := Write(result); s != expected {
+		t.Error("struct with arbitrary keys returned the wrong value: ", s)
+	}
+	big := NewStruct()
+	for i := 0; i < 100; i++ {
+		big.Put(NewVector(Integer(i), NewString("k")), Integer(i))
+	}
+	for i := 0; i < 100; i += 3 {
+		big.Unput(NewVector(Integer(i), NewString("k")))
+	}
+	for i := 0; i < 100; i++ {
+		got := big.Get(NewVector(Integer(i), NewString("k")))
+		if (i%3 == 0) != (got == Null) || (got != Null && !Equal(got, Integer(i))) {
+			t.Fatal("large struct returned the wrong value for key ", i, ": ", got)
+		}
+	}
+	if k := big.Keys()[0]; !Equal(k, NewVector(Integer(1), NewString("k"))) {
+		t.Error("large struct did not keep the order of its keys: ", k)
+	}
+}
+
+func TestPersistentUpdates(t *testing.T) {
+	Init()
+	src := `(let ((s {a: 1 b: 2}) (v [1 2 3]) (p (instance <pt> {x: 1 y: 2})))
+	          (let ((s2 (assoc s b: 20 c: 30)) (s3 (dissoc s a:)) (v2 (vector-assoc v 1 'two)) (v3 (vector-assoc v 3 4)))
+	            (list s s2 s3 v v2 v3 (assoc p x: 10) p)))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `({a: 1 b: 2} {a: 1 b: 20 c: 30} {b: 2} [1 2 3] [1 two 3] [1 2 3 4] #<pt>{x: 10 y: 2} #<pt>{x: 1 y: 2})`
+	if s := Write(result); s != expected {
+		t.Error("persistent updates returned the wrong value: ", s)
+	}
+	//copies share the index of a large struct until they add keys, and each finds only its own
+	key := func(i int) Value { return NewString(fmt.Sprint("k", i)) }
+	base := NewStruct()
+	for i := 0; i < 20; i++ {
+		base.Put(key(i), Integer(i))
+	}
+	replaced := base.Assoc(key(5), Integer(500))
+	added := base.Assoc(key(20), Integer(20))
+	base.Put(key(21), Integer(21))
+	other := added.Assoc(key(22), Integer(22))
+	removed := base.Dissoc(key(0))
+	checks := []struct {
+		s        *Struct
+		k        int
+		expected Value
+	}{
+		{base, 5, Integer(5)}, {replaced, 5, Integer(500)}, {base, 20, Null}, {added, 20, Integer(20)},
+		{added, 21, Null}, {base, 21, Integer(21)}, {replaced, 21, Null}, {other, 22, Integer(22)},
+		{added, 22, Null}, {other, 21, Null}, {removed, 0, Null}, {removed, 19, Integer(19)}, {base, 0, Integer(0)},
+	}
+	for i, c := range checks {
+		if v := c.s.Get(key(c.k)); !Equal(v, c.expected) {
+			t.Errorf("check %d: got %v for key %d, expected %v", i, v, c.k, c.expected)
+		}
+	}
+}
+
+func TestSets(t *testing.T) {
+	Init()
+	src := `(let ((a #{1 2 3 2}) (b (to-set [3 4 1])))
+	          (list a (set-union a b) (set-intersection a b) (set-difference a b) (set-contains? a 2) (set-contains? b 2)
+	                (equal? a #{3 2 1}) (equal? a b) (to-list b) (to-vector a) (set-length a) (set #\a "b")))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `(#{1 2 3} #{1 2 3 4} #{1 3} #{2} true false true false (3 4 1) [1 2 3] 3 #{#\a "b"})`
+	if s := Write(result); s != expected {
+		t.Error("sets returned the wrong value: ", s)
+	}
+	if s, err := Json(NewSet(Integer(1), NewString("x")), ""); err != nil || s != `[1, "x"]` {
+		t.Error("set written as JSON incorrectly: ", s, err)
+	}
+	if Hash(NewSet(Integer(1), Integer(2))) != Hash(NewSet(Integer(2), Integer(1))) {
+		t.Error("equal sets have different hashes")
+	}
+}
+
+func TestHashMaps(t *testing.T) {
+	Init()
+	src := `(let ((h (hashmap [1 2] "a" '(x y) "b" {k: 1} "c")))
+	          (hashmap-put! h [1 2] "A")
+	          (hashmap-remove! h '(x y))
+	          (list h (hashmap-get h [1 2]) (hashmap-get h {k: 1}) (hashmap-get h '(x y) 'none) (hashmap-has? h [1 2])
+	                (hashmap-length h) (hashmap-keys h) (hashmap-values h) (equal? h #hashmap {{k: 1} "c" [1 2] "A"})
+	                (= (hash [1 {a: 2 b: 3}]) (hash [1 {b: 3 a: 2}])) (to-struct h)))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `(#hashmap {[1 2] "A" {k: 1} "c"} "A" "c" none true 2 ([1 2] {k: 1}) ("A" "c") true true {[1 2] "A" {k: 1} "c"})`
+	if s := Write(result); s != expected {
+		t.Error("hashmaps returned the wrong value: ", s)
+	}
+	h, _ := NewHashMap([]Value{NewString("a"), Integer(1)})
+	if s, err := Json(h, ""); err != nil || s != `{"a": 1}` {
+		t.Error("hashmap written as JSON incorrectly: ", s, err)
+	}
+}
+
+func TestGenericSignatures(t *testing.T) {
+	Init()
+	obj, err := NewObject(Intern("<gothing>"), []int{1, 2})
+	if err != nil {
+		t.Fatal("cannot make an object: ", err)
+	}
+	if obj.Type() != Intern("<gothing>") || !Equal(obj, obj) || Equal(obj, &Object{TypeTag: obj.TypeTag, Value: []int{1, 2}}) {
+		t.Error("object has the wrong type, or is compared incorrectly")
+	}
+	formals, _ := ReadFromString("((o <gothing>) x)")
+	sig, err := methodSignature(formals.(*List))
+	if err != nil {
+		t.Fatal("cannot make a method signature: ", err)
+	}
+	for _, s := range arglistSignatures([]Value{obj, NewString("x")}) {
+		if s == sig {
+			return
+		}
+	}
+	t.Error("the signature of the method ", sig, " is not one of the signatures of its arguments")
+}
+
+func TestPromises(t *testing.T) {
+	Init()
+	src := `(let ((n 0))
+	          (let ((p (delay (do (set! n (+ n 1)) (* n 10)))))
+	            (let ((before n))
+	              (let ((first (force p)))
+	                (list before first (force p) n (promise? p) (force (make-promise 3)) (force 4)
+	                      (lazy-first (lazy-rest (make-lazy-seq 1 (delay (make-lazy-seq 2 '()))))))))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `(0 10 10 1 true 3 4 2)`
+	if s := Write(result); s != expected {
+		t.Error("promises returned the wrong value: ", s)
+	}
+	//threads forcing the same promise all get the value of the force that finished first
+	p := NewPromise(Closure(compileString(t, "(list 1)"), nil))
+	results := make([]Value, 8)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = Force(VM(defaultStackSize), p)
+		}(i)
+	}
+	wg.Wait()
+	for _, val := range results {
+		if val != results[0] || Write(val) != "(1)" {
+			t.Error("threads forcing a promise got different values: ", val, results[0])
+		}
+	}
+	testLimitError(t, Limits{MaxInstructions: 10000}, "(force (delay (let loop () (loop))))")
+}
+
+func TestStrings(t *testing.T) {
+	s := NewString("Hello, 世界")
+	if n := StringLength(s); n != 9 {
+		t.Error("the length of the string is wrong: ", n)
+	}
+	if c, err := StringRef(s, 8); err != nil || !Equal(c, NewCharacter('界')) {
+		t.Error("string-ref returned the wrong character: ", c, err)
+	}
+	if _, err := StringRef(s, 9); err == nil {
+		t.Error("string-ref beyond the end of the string did not fail")
+	}
+	if sub := Substring(s, 5, 100); sub.Value != ", 世界" {
+		t.Error("substring returned the wrong string: ", sub)
+	}
+	if i := StringIndex(s, NewString("界"), 0); i != 8 {
+		t.Error("string-index returned the wrong index: ", i)
+	}
+	if trimmed := StringTrim(NewString(" \t x "), Null, true, false); trimmed.Value != "x " {
+		t.Error("string-trim-left returned the wrong string: ", trimmed)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	Init()
+	src := `(let ((port (open-output-string)))
+	          (printf port "~a+~a=~d~%" 1 2 3)
+	          (list (format "~a|~s|~5a|~-5a|" "x" "x" 'ab 'cd) (format "~05d ~x ~b ~o ~.2f ~f ~~" -42 255 5 8 3.14159 2.5)
+	                (format "~6.1f|~3a" 2.25 "世界") (format "~d" 123456789012345678901234567890) (get-output-string port)))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `("x|\"x\"|   ab|cd   |" "-0042 ff 101 10 3.14 2.5 ~" "   2.2| 世界" "123456789012345678901234567890" "1+2=3\n")`
+	if s := Write(result); s != expected {
+		t.Error("format returned the wrong value: ", s)
+	}
+	for _, bad := range []string{`(format "~a")`, `(format "~a" 1 2)`, `(format "~d" "x")`, `(format "~q" 1)`, `(format "~5")`} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("format did not fail: ", bad)
+		}
+	}
+}
+
+func TestCharacters(t *testing.T) {
+	Init()
+	src := `(list (char-alphabetic? #\a) (char-alphabetic? #\x4E16) (char-alphabetic? #\1) (char-numeric? #\7)
+	              (char-whitespace? #\tab) (char-whitespace? #\a) (char-upper-case? #\A) (char-lower-case? #\A)
+	              (char-upcase #\a) (char-downcase #\xC9) (char->integer #\A) (integer->char 955))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `(true true false true true false true false #\A #\x00E9 65 #\x03BB)`
+	if s := Write(result); s != expected {
+		t.Error("character functions returned the wrong value: ", s)
+	}
+	for _, bad := range []string{`(integer->char -1)`, `(integer->char 55296)`, `(integer->char 1.5)`} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("integer->char did not fail: ", bad)
+		}
+	}
+}
+
+func TestMath(t *testing.T) {
+	Init()
+	src := `(list (sqrt 16) (sqrt 9/4) (sqrt 2) (sqrt 4.0) (expt 2 100) (expt 2/3 -2) (expt -2 -3) (expt 2 0.5) (expt 0 0)
+	              (truncate -7/2) (truncate -3.7) (round 5/2) (round -2.5) (round 7) (min 3 1 2) (max 1 2.0) (max 1/2 1/3)
+	              (gcd 12 -18) (gcd) (lcm 4 6) (lcm) (gcd 4.0 6) (floor -7/2) (ceiling 3.2))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `(4 3/2 1.4142135623730951 2.0 1267650600228229401496703205376 9/4 -1/8 1.4142135623730951 1 -3 -3.0 3 -3.0 7 1 2.0 1/2 6 0 12 1 2.0 -4 4.0)`
+	if s := Write(result); s != expected {
+		t.Error("math functions returned the wrong values: ", s)
+	}
+	for _, bad := range []string{`(sqrt -1)`, `(expt 0 -1)`, `(gcd 1.5)`, `(min)`} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("math function did not fail: ", bad)
+		}
+	}
+}
+
+func TestBitwise(t *testing.T) {
+	Init()
+	src := `(list (bit-and 12 10) (bit-or 12 10) (bit-xor 12 10) (bit-and) (bit-not 5) (bit-and -1 255)
+	              (arithmetic-shift 1 70) (arithmetic-shift -5 -1) (arithmetic-shift 1024 -3) (logical-shift-right -1 60)
+	              (logical-shift-right 256 4) (bit-count 255) (bit-count -1) (bit-xor (arithmetic-shift 1 64) 1))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `(8 14 6 -1 -6 255 1180591620717411303424 -3 128 15 16 8 0 18446744073709551617)`
+	if s := Write(result); s != expected {
+		t.Error("bitwise functions returned the wrong values: ", s)
+	}
+	for _, bad := range []string{`(bit-and 1.5 1)`, `(bit-not 1/2)`, `(logical-shift-right 1 -1)`} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("bitwise function did not fail: ", bad)
+		}
+	}
+}
+
+func TestRandom(t *testing.T) {
+	Init()
+	src := `(let ((g1 (make-random-generator 42)) (g2 (make-random-generator 42)))
+	          (let ((a (list (random g1 100) (random g1 5 10) (random g1 1.0)))
+	                (b (list (random g2 100) (random g2 5 10) (random g2 1.0))))
+	            (random-seed! g1 42)
+	            (list (equal? a b) (equal? a (list (random g1 100) (random g1 5 10) (random g1 1.0))) (blob-length (random-bytes 16)))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != "(true true 16)" {
+		t.Error("random generators returned the wrong values: ", s)
+	}
+	gen := NewRandomGenerator(7)
+	for i := 0; i < 100; i++ {
+		n, err := gen.Random(Integer(-3), Integer(3))
+		if err != nil || !n.IsExactInteger() || n.IntValue() < -3 || n.IntValue() >= 3 {
+			t.Fatal("random integer out of range: ", n, err)
+		}
+		f := gen.Float(2, 4)
+		if f.IsExact() || f.Value < 2 || f.Value >= 4 {
+			t.Fatal("random float out of range: ", f)
+		}
+	}
+	if _, err := gen.Random(Integer(3), Integer(3)); err == nil {
+		t.Error("random with an empty range did not fail")
+	}
+}
+
+func TestSort(t *testing.T) {
+	Init()
+	src := `(let ((v [3 1 2]) (pairs '((b 2) (a 1) (c 2) (d 1))))
+	          (sort! v)
+	          (list (sort '(5 3 9 1)) (sort [5 3 9 1] >) (sort '("pear" "apple" "fig")) v
+	                (sort-by pairs (fn (p) (car (cdr p)))) (sort-by pairs (fn (p) (car (cdr p))) >)))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `((1 3 5 9) [9 5 3 1] ("apple" "fig" "pear") [1 2 3] ((a 1) (d 1) (b 2) (c 2)) ((b 2) (c 2) (a 1) (d 1)))`
+	if s := Write(result); s != expected {
+		t.Error("sort returned the wrong value: ", s)
+	}
+	for _, bad := range []string{`(sort '(1 "a"))`, `(sort '(2 1) (fn (a b) (error 'oops)))`, `(sort 1)`} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("sort did not fail: ", bad)
+		}
+	}
+}
+
+func TestSequences(t *testing.T) {
+	Init()
+	src := `(let ((count 0) (odd? (fn (n) (= 1 (modulo n 2)))))
+	          (for-each (fn (x y) (set! count (+ count (* x y)))) '(1 2 3) [10 20])
+	          (list (map inc '(1 2 3)) (map + [1 2 3] '(10 20)) (map char-upcase "abc")
+	                (filter odd? [1 2 3 4 5]) (filter (fn (c) (not (equal? c #\b))) "abc")
+	                (reduce + 0 '(1 2 3 4)) (reduce (fn (acc x) (cons x acc)) '() [1 2])
+	                (every? odd? '(1 3)) (every? odd? [1 2]) (any? zero? '(1 3)) (any? zero? '(1 0))
+	                (zip '(1 2 3) '[a b]) count))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `((2 3 4) [11 22] "ABC" [1 3 5] "ac" 10 (2 1) true false false true ((1 a) (2 b)) 50)`
+	if s := Write(result); s != expected {
+		t.Error("sequence functions returned the wrong value: ", s)
+	}
+	for _, bad := range []string{`(map inc 1)`, `(map inc "abc")`, `(any? zero? "abc")`, `(filter zero? {})`} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("sequence function did not fail: ", bad)
+		}
+	}
+	//a traversal calls the function on one VM, in a frame of its own for each element, and nothing more
+	code := compileString(t, "(reduce (fn (acc x) (+ acc x)) 0 (map inc v))")
+	v := make([]Value, 10000)
+	for i := range v {
+		v[i] = Integer(i)
+	}
+	DefineGlobal("v", NewVector(v...))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	result, err = exec(code, nil)
+	runtime.ReadMemStats(&after)
+	if err != nil || Write(result) != "50005000" {
+		t.Fatal("expected 50005000 from the traversals, got ", result, err)
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 2000*uint64(len(v)) {
+		t.Error("traversals allocate too much for each element: ", n, " bytes")
+	}
+}
+
+func TestListUtilities(t *testing.T) {
+	Init()
+	src := `(let ((alist '(("a" 1) (b 2))) (lst (list 1 2 3)))
+	          (list (assoc "a" alist) (assoc "z" alist) (assq 'b alist) (assq "a" alist)
+	                (member "x" '(1 "x" 2)) (memq 3 '(1 2)) (append '(1) '() '(2 3)) (reverse! lst) lst
+	                (last '(1 2 3)) (flatten '(1 (2 () [3 (4)]) ())) (take 2 '(1 2 3)) (take 5 [1 2]) (take 2 "abc")
+	                (drop 2 '(1 2 3)) (drop 1 [1 2]) (drop 5 "abc") (range 3) (range 1 3) (range 5 0 -2) (range 0 1 0.5)
+	                (list-tabulate 3 (fn (i) (* i i))) (assoc {a: 1} b: 2)))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `(("a" 1) false (b 2) false ("x" 2) false (1 2 3) (3 2 1) (1) 3 (1 2 3 4) (1 2) [1 2] "ab" (3) [2] "" (0 1 2) (1 2) (5 3 1) (0 0.5) (0 1 4) {a: 1 b: 2})`
+	if s := Write(result); s != expected {
+		t.Error("list utilities returned the wrong value: ", s)
+	}
+	for _, bad := range []string{`(last '())`, `(assoc 1 '(1 2))`, `(range 1 2 0)`, `(range 1 2 3 4)`, `(take 1 {})`} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("list utility did not fail: ", bad)
+		}
+	}
+}
+
+func TestVectorOperations(t *testing.T) {
+	Init()
+	src := `(let ((v (vector 1 2 3 4 5)) (w (make-vector 3 0)) (x (vector 1 2 3 4)))
+	          (vector-fill! w 7 1)
+	          (vector-copy! x 1 x 0 3)
+	          (vector-copy! v 3 '[a b])
+	          (list (subvector [1 2 3 4] 1 3) (subvector [1 2 3] 1) w x v
+	                (vector-append [1] [] [2 3]) (vector-append) (vector-map + [1 2 3] [10 20])))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `([2 3] [2 3] [0 7 7] [1 1 2 3] [1 2 3 a b] [1 2 3] [] [11 22])`
+	if s := Write(result); s != expected {
+		t.Error("vector operations returned the wrong value: ", s)
+	}
+	for _, bad := range []string{`(subvector [1 2] 1 3)`, `(subvector [1 2] 2 1)`, `(vector-fill! [1] 0 -1)`,
+		`(vector-copy! [1 2] 1 [1 2])`, `(vector-copy! [1 2] 0 [1 2] 1 3)`, `(vector-map inc '(1 2))`} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("vector operation did not fail: ", bad)
+		}
+	}
+}
+
+func TestCopyAndFreeze(t *testing.T) {
+	Init()
+	src := `(let ((v (vector 1 (vector 2) {a: (vector 3)})) (l (list (vector 1))) (s {k: (vector 1)}))
+	          (let ((shallow (copy v)) (deep (deep-copy v)) (ls (copy l)) (ss (copy s)))
+	            (vector-set! (vector-ref v 1) 0 20)
+	            (vector-set! v 0 10)
+	            (freeze! v)
+	            (list shallow deep (identical? (car ls) (car l)) (identical? (get ss k:) (get s k:))
+	                  (frozen? v) (frozen? (vector-ref v 1)) (frozen? (get (vector-ref v 2) a:))
+	                  (frozen? (copy v)) (frozen? (deep-copy v)) (frozen? 1)
+	                  (assoc (vector-ref v 2) b: 1))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `([1 [20] {a: [3]}] [1 [2] {a: [3]}] true true true true true false false false {a: [3] b: 1})`
+	if s := Write(result); s != expected {
+		t.Error("copy and freeze! returned the wrong value: ", s)
+	}
+	cyclic := NewVector(Null)
+	cyclic.Elements[0] = cyclic
+	if cp := DeepCopy(cyclic).(*Vector); cp == cyclic || cp.Elements[0] != cp {
+		t.Error("deep-copy did not copy a cycle as a cycle")
+	}
+	for _, bad := range []string{`(vector-set! (freeze! (vector 1)) 0 2)`, `(put! (freeze! {a: 1}) a: 2)`,
+		`(unput! (freeze! {a: 1}) a:)`, `(vector-fill! (freeze! (vector 1)) 0)`, `(sort! (freeze! (vector 2 1)))`,
+		`(vector-copy! (freeze! (vector 1 2)) 0 [3])`, `(let ((v (freeze! [[1]]))) (vector-set! (vector-ref v 0) 0 2))`} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("changing a frozen value did not fail: ", bad)
+		}
+	}
+}
+
+func TestFunctionIntrospection(t *testing.T) {
+	Init()
+	src := `(let ((opt (fn (x [(y 23) z]) x)) (keys (fn (x {y: 1 z: 2}) x)) (rest (fn (x & more) x)))
+	          (list (function-name car) (function-name opt) (function-name apply)
+	                (function-arity car) (function-arity opt) (function-arity keys) (function-arity rest)
+	                (function-arity list) (function-arity substring) (function-arity apply)
+	                (function-defaults opt) (function-keys opt) (function-defaults keys) (function-keys keys)
+	                (function-defaults substring) (function-keys car)))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `("car" null "apply" (1 1) (1 3) (1 5) (1 null) (0 null) (2 3) (2 null) (23 null) () (1 2) (y z) (-1) ())`
+	if s := Write(result); s != expected {
+		t.Error("function introspection returned the wrong value: ", s)
+	}
+}
+
+func TestDocStrings(t *testing.T) {
+	Init()
+	for _, def := range []string{`(defn square "the square of the number" (n) (* n n))`,
+		`(defmacro unless-true "the else expression, unless the condition is true" (c e) (list 'if c null e))`,
+		`(def half "half of the number" (fn (n) (/ n 2)))`} {
+		if _, err := exec(compileString(t, def), nil); err != nil {
+			t.Fatal("cannot execute ", def, ": ", err)
+		}
+	}
+	src := `(list (doc square) (doc 'square) (doc 'unless-true) (doc half) (doc (fn (x) "inner" (def y x) y))
+	              (doc (fn () "not documentation")) ((fn () "not documentation")) (doc car) (doc 'undefined-thing)
+	              (square 3) (apropos "quar") (apropos "unless-tr"))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `("the square of the number" "the square of the number" "the else expression, unless the condition is true" "half of the number" "inner" null "not documentation" null null 9 (square) (unless-true))`
+	if s := Write(result); s != expected {
+		t.Error("documentation strings returned the wrong value: ", s)
+	}
+	code := compileString(t, `(fn (x) "the argument" x)`)
+	reloaded, err := exec(compileString(t, code.String()), nil)
+	if err != nil {
+		t.Fatal("cannot load the decompiled code: ", err)
+	}
+	if Doc(reloaded) != "the argument" {
+		t.Error("the documentation string did not survive decompiling: ", code)
+	}
+	if s := describe(Intern("square").(*Symbol)); s != "square (<any>)\n  the square of the number" {
+		t.Error("describe returned the wrong text: ", s)
+	}
+}
+
+func TestDeclarations(t *testing.T) {
+	Init()
+	var warnings []string
+	saved := warn
+	warn = func(msg string) { warnings = append(warnings, msg) }
+	defer func() {
+		warn = saved
+		DefineGlobal(StringValue(checkTypesSymbol), False)
+	}()
+	for _, src := range []string{`(declare twice (<number>) <number>)`, `(defn twice (n) (* 2 n))`,
+		`(declare join (<string> & <string>) <string>)`, `(defn join (s & more) s)`,
+		`(declare opt (<number> <string>))`, `(defn opt (n [s]) n)`} {
+		if _, err := exec(compileString(t, src), nil); err != nil {
+			t.Fatal("cannot execute ", src, ": ", err)
+		}
+	}
+	src := `(list (function-signature twice) (function-signature join) (function-signature opt) (twice "x"))`
+	code := compileString(t, src)
+	if len(warnings) != 1 || warnings[0] != `twice is declared to take a <number> for argument 1, not "x"` {
+		t.Error("the compiler did not warn of the literal argument: ", warnings)
+	}
+	warnings = nil
+	compileString(t, `(list (join "a" 'b) (join "a" "b") (opt 1 2) (let ((twice (fn (x) x))) (twice "x")))`)
+	if len(warnings) != 2 || warnings[1] != `join is declared to take a <string> for argument 2, not 'b` {
+		t.Error("the compiler warned of the wrong arguments: ", warnings)
+	}
+	if _, err := exec(code, nil); err == nil {
+		t.Error("multiplying a string did not fail")
+	}
+	result, err := exec(compileString(t, `(list (function-signature twice) (function-signature join) (function-signature opt))`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := Write(result); s != `("(<number>) <number>" "(<string> <string>*) <string>" "(<number> <string>) <any>")` {
+		t.Error("the declared signatures are wrong: ", s)
+	}
+	if _, err := exec(compileString(t, `(join 1)`), nil); err != nil {
+		t.Error("the arguments were checked without *check-types*: ", err)
+	}
+	DefineGlobal(StringValue(checkTypesSymbol), True)
+	for _, bad := range []string{`(join 1)`, `(join "a" "b" 3)`, `(opt 1 'x)`} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("the arguments were not checked: ", bad)
+		}
+	}
+	if result, err := exec(compileString(t, `(list (join "a" "b") (opt 1) (twice 2))`), nil); err != nil || Write(result) != `("a" 1 4)` {
+		t.Error("checking the arguments failed correct calls: ", result, err)
+	}
+	for _, bad := range []string{`(declare f (<number>) 3)`, `(declare f (x))`, `(declare f (<any> &))`} {
+		expr, _ := ReadFromString(bad)
+		if _, err := Compile(expr); err == nil {
+			t.Error("a bad declaration did not fail: ", bad)
+		}
+	}
+	expr, _ := ReadFromString(`(do (declare mismatched (<number>)) (def mismatched (fn (a b) a)))`)
+	if _, err := Compile(expr); err == nil {
+		t.Error("a declaration that does not match the function did not fail")
+	}
+}
+
+func TestInterp(t *testing.T) {
+	interp := NewInterp(InterpOptions{Limits: Limits{MaxInstructions: 100000}})
+	interp.Define("greeting", NewString("hello"))
+	val, err := interp.EvalString(`(defn greet (name) (string greeting ", " name)) (greet "there")`)
+	if err != nil {
+		t.Fatal("cannot evaluate: ", err)
+	}
+	if s := Write(val); s != `"hello, there"` {
+		t.Error("EvalString returned the wrong value: ", s)
+	}
+	val, err = interp.Call("greet", NewString("world"))
+	if err != nil {
+		t.Fatal("cannot call greet: ", err)
+	}
+	if s := Write(val); s != `"hello, world"` {
+		t.Error("Call returned the wrong value: ", s)
+	}
+	if val, err = interp.EvalString(""); err != nil || val != Null {
+		t.Error("EvalString of nothing should be null, got ", val, err)
+	}
+	if _, err = interp.Call("no-such-function-anywhere"); err == nil {
+		t.Error("Call of an undefined function should fail")
+	}
+	if _, err = interp.Call("greeting"); err == nil {
+		t.Error("Call of a non-function should fail")
+	}
+	if _, err = interp.EvalString(`(defn spin () (spin)) (spin)`); err == nil {
+		t.Error("EvalString should enforce the interpreter's limits")
+	}
+}
+
+type testPoint struct {
+	X, Y  int
+	Label string
+	tags  []string
+}
+
+func (p *testPoint) Move(dx, dy int) *testPoint {
+	p.X += dx
+	p.Y += dy
+	return p
+}
+
+func (p *testPoint) Sum(ns ...float64) (float64, error) {
+	if len(ns) == 0 {
+		return 0, fmt.Errorf("nothing to sum")
+	}
+	total := float64(p.X + p.Y)
+	for _, n := range ns {
+		total += n
+	}
+	return total, nil
+}
+
+func (p testPoint) Split() (int, int) {
+	return p.X, p.Y
+}
+
+func TestGenericAccessors(t *testing.T) {
+	Init()
+	counts := map[string]int{"a": 1}
+	m, _ := NewObject(Intern("<counts>"), counts)
+	DefineGlobal("test-counts", m)
+	defer DefineGlobal("test-counts", Null)
+	names := []string{"x", "y"}
+	sl, _ := NewObject(Intern("<names>"), names)
+	DefineGlobal("test-names", sl)
+	defer DefineGlobal("test-names", Null)
+	src := `(let ((v [1 2 3]) (h (hashmap [1] "one")))
+	          (put! v 0 'x)
+	          (put! h [2] "two")
+	          (put! test-counts b: 2)
+	          (put! test-names 1 "z")
+	          (list (get v 1) (get "héllo" 1) (get h [2]) (get {a: 1} a:) (get test-counts a:) (get test-counts "c")
+	                (get test-names 1) v (has? v 2) (has? v 3) (has? "ab" -1) (has? #{1} 1) (has? h [1])
+	                (has? test-counts "b") (has? test-counts c:)
+	                (map length (list '(1 2) v "héllo" {a: 1} #{1} h #u8(1) test-counts test-names))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `(2 #\x00E9 "two" 1 1 null "z" [x 2 3] true false false true true true false (2 3 5 1 1 2 1 2 2))`
+	if s := Write(result); s != expected {
+		t.Error("generic accessors returned the wrong value: ", s)
+	}
+	if counts["b"] != 2 || names[1] != "z" {
+		t.Error("put! did not change the Go values: ", counts, names)
+	}
+	for _, src := range []string{`(get [1 2] 2)`, `(get [1 2] -1)`, `(get "ab" 'a)`, `(put! "ab" 0 #\x)`, `(put! (freeze! [1]) 0 2)`,
+		`(get 3 0)`, `(length 3)`, `(get test-names 5)`} {
+		_, err := exec(compileString(t, src), nil)
+		if err == nil {
+			t.Error("no error from ", src)
+		} else if errorKind(err) != ArgumentErrorKey {
+			t.Error("wrong kind of error from ", src, ": ", err)
+		}
+	}
+}
+
+func TestGoObjects(t *testing.T) {
+	Init()
+	obj, _ := NewObject(Intern("<test-point>"), &testPoint{X: 1, Y: 2, Label: "p"})
+	DefineGlobal("test-point", obj)
+	src := `(do (def gx (.X test-point)) (def glabel (get test-point label:)) (def gkx (x: test-point))
+	            (put! test-point y: 10) (def gy (.Y test-point)) (def gmoved (.X (.Move test-point 5 5)))
+	            (def gsum (.Sum test-point 0.5 1)) (def gsplit (.Split test-point)) (def gp (invoke test-point 'move 1 1))
+	            (list gx glabel gkx gy gmoved gsum gsplit gp (type gp)))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	expected := `(1 "p" 1 10 6 22.5 (6 15) #<go-object>[&{7 16 p []}] <go-object>)`
+	if s := Write(result); s != expected {
+		t.Error("Go object access returned the wrong value: ", s)
+	}
+	if _, err := Macroexpand(NewList(Intern(".X"))); err == nil {
+		t.Error("expected an error from expanding (.X)")
+	}
+	for _, bad := range []string{`(.Sum test-point)`, `(.Missing test-point)`, `(get test-point tags:)`,
+		`(.Move test-point "a" 1)`, `(.Move test-point 1)`, `(put! test-point x: "a")`} {
+		if _, err := exec(compileString(t, bad), nil); err == nil {
+			t.Error("expected an error from ", bad)
+		}
+	}
+}
+
+func TestArgumentErrors(t *testing.T) {
+	Init()
+	defer func() { optimize = false }()
+	for src, expected := range map[string]string{
+		`(car 1 2)`:               "car expected 1 argument, got 2",
+		`(vector-ref [1] "a")`:    "vector-ref expected a <number> for argument 2, got a string",
+		`(substring "abc" 1 "x")`: "substring expected a <number> for argument 3, got a string",
+		`(range 1 2 3 4)`:         "range expected 1 to 3 arguments, got 4",
+		`(random-list)`:           "random-list expected 1 to 3 arguments, got 0",
+		`(raise 23)`:              "raise expected a <error> or <keyword> for argument 1, got a number",
+		`(getfn "a")`:             "getfn expected a <symbol> for argument 1, got a string",
+		`((fn (x) x))`:            "#[function] expected 1 argument, got 0",
+		`((fn (x & more) x) )`:    "#[function] expected 1 or more arguments, got 0",
+		`(printf 2)`:              "printf expected a <string> for argument 1, got a number",
+		`(error-kind 5)`:          "error-kind expected a <error> for argument 1, got a number",
+		`(error-kind)`:            "error-kind expected 1 argument, got 0",
+		`(error-data 5)`:          "error-data expected a <error> for argument 1, got a number",
+		`(write-all [1])`:         "write-all expected a <list> for argument 1, got a vector",
+		`(write-file "x" 5)`:      "write-file expected a <string> or <blob> for argument 2, got a number",
+		`(close 5)`:               "close expected a <channel>, <connection>, <port>, or <db> for argument 1, got a number",
+		`(select 5)`:              "select expected a <vector> or <list> for argument 1, got a number",
+		`(random 1 2 3)`:          "random expected 0 to 2 arguments, got 3",
+		`(random-seed! "x")`:      "random-seed! expected a <number> for argument 1, got a string",
+	} {
+		//the optimized VM checks the arguments of primitives too
+		for _, optimize = range []bool{false, true} {
+			_, err := exec(compileString(t, src), nil)
+			if err == nil {
+				t.Error("expected an error from ", src)
+			} else if e, ok := err.(*Error); !ok || e.Kind() != ArgumentErrorKey || !strings.Contains(err.Error(), expected) {
+				t.Error("wrong error from ", src, ": ", err)
+			}
+		}
+	}
+	for _, optimize = range []bool{false, true} {
+		if _, err := exec(compileString(t, "(car argument-errors-undefined)"), nil); err == nil || !strings.Contains(err.Error(), "Undefined symbol") {
+			t.Error("expected an undefined symbol error, got ", err)
+		}
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	Init()
+	Intern("completion-test-key:")
+	DefineGlobal("completion-test-value", Integer(1))
+	DefineGlobal("completion-test-fn", GetGlobal(Intern("car")))
+	handler := &ellHandler{}
+	if add, matches := handler.Complete("(completion-te"); add != "st-fn" || len(matches) != 1 {
+		t.Error("function position completed incorrectly: ", add, matches)
+	}
+	if add, matches := handler.Complete("(get s completion-test-"); add != "" || strings.Join(matches, " ") != "completion-test-fn completion-test-key: completion-test-value" {
+		t.Error("argument position completed incorrectly: ", add, matches)
+	}
+	if add, matches := handler.Complete(`(load "tests/dynamic_wind_te`); add != "st.ell" || len(matches) != 1 {
+		t.Error("load path completed incorrectly: ", add, matches)
+	}
+	if add, matches := handler.Complete(`(println "tests/dynamic_wind_te`); add != "" || len(matches) != 0 {
+		t.Error("string completed incorrectly: ", add, matches)
+	}
+	if add, _ := handler.Complete(`(load "te`); add != "sts/" {
+		t.Error("load path completed incorrectly: ", add)
+	}
+}
+
+func TestReplVariables(t *testing.T) {
+	Init()
+	initReplVariables()
+	handler := &ellHandler{}
+	for _, src := range []string{"(+ 1 2)", "(* *1 10)", "(list *1 *2)"} {
+		if _, _, err := handler.Eval(src); err != nil {
+			t.Fatal("cannot evaluate ", src, ": ", err)
+		}
+	}
+	if _, _, err := handler.Eval("(car 1)"); err == nil {
+		t.Fatal("expected an error from (car 1)")
+	}
+	result, _, err := handler.Eval("(list *1 *2 *3 (error-kind *e*))")
+	if err != nil {
+		t.Fatal("cannot evaluate: ", err)
+	}
+	if result != "= ((30 3) 30 3 argument-error:)" {
+		t.Error("REPL variables have the wrong values: ", result)
+	}
+}
+
+func TestColorThemes(t *testing.T) {
+	Init()
+	defer func() { colors = nil }()
+	if err := SetColorTheme("plaid"); err == nil {
+		t.Error("expected an error for an unknown color theme")
+	}
+	if err := SetColorTheme("dark"); err != nil {
+		t.Fatal("cannot set the color theme: ", err)
+	}
+	handler := &ellHandler{theme: currentColors()}
+	if result, _, _ := handler.Eval("(+ 1 2)"); result != colors.result+"= 3" {
+		t.Errorf("result written in the wrong color: %q", result)
+	}
+	if _, _, err := handler.Eval("(car 1)"); err == nil || !strings.HasPrefix(err.Error(), colors.err) {
+		t.Error("error written in the wrong color: ", err)
+	}
+	if s := colored(colorThemes["none"].trace, "x"); s != "x" {
+		t.Errorf("no color theme wrote colors: %q", s)
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	Init()
+	var out bytes.Buffer
+	commands := []string{"locals", "where", "frame 1", "locals", "p (+ 1 2)", "n", "c"}
+	defer func(readLine func() (string, error), w io.Writer) { debugReadLine, debugOut = readLine, w }(debugReadLine, debugOut)
+	debugReadLine = func() (string, error) {
+		if len(commands) == 0 {
+			return "", io.EOF
+		}
+		cmd := commands[0]
+		commands = commands[1:]
+		return cmd, nil
+	}
+	debugOut = &out
+	src := `(do (defn debug-add (a b) (+ a b)) (defn debug-outer (x) (* 2 (debug-add x 1)))
+	            (break-on 'debug-add) (def bps (breakpoints)) (def result (debug-outer 10)) (unbreak debug-add)
+	            (list bps result (breakpoints) (debug-outer 1)))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != "((debug-add) 22 () 4)" {
+		t.Error("debugging returned the wrong value: ", s)
+	}
+	transcript := out.String()
+	for _, expected := range []string{"[paused at debug-add [pc 0]", "    0: 10\n    1: 1\n", "    at debug-outer", "= 3\n", "[paused at debug-add [pc 3]"} {
+		if !strings.Contains(transcript, expected) {
+			t.Errorf("debugger transcript does not contain %q:\n%s", expected, transcript)
+		}
+	}
+	commands = []string{"quit"}
+	if _, err := exec(compileString(t, `(do (break) 1)`), nil); err == nil || err.(*Error).Kind() != InterruptKey {
+		t.Error("quitting the debugger should interrupt execution, got ", err)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	Init()
+	var out bytes.Buffer
+	defer func(w io.Writer) { traceOut = w }(traceOut)
+	traceOut = &out
+	src := `(do (defn trace-fact (n) (if (< n 2) 1 (* n (trace-fact (- n 1)))))
+	            (trace trace-fact) (def traced-names (trace)) (def result (trace-fact 3))
+	            (untrace trace-fact) (trace-fact 4)
+	            (list traced-names result (trace)))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != "((trace-fact) 6 ())" {
+		t.Error("tracing returned the wrong value: ", s)
+	}
+	expected := `(trace-fact 3)
+  (trace-fact 2)
+    (trace-fact 1)
+    trace-fact => 1
+  trace-fact => 2
+trace-fact => 6
+`
+	if out.String() != expected {
+		t.Errorf("wrong trace output:\n%s", out.String())
+	}
+	if _, err := exec(compileString(t, `(trace 23)`), nil); err == nil {
+		t.Error("expected an error tracing a non-function")
+	}
+}
+
+func TestProfile(t *testing.T) {
+	Init()
+	ResetProfile()
+	src := `(do (defn profile-fib (n) (if (< n 2) n (+ (profile-fib (- n 1)) (profile-fib (- n 2)))))
+	            (profile-start) (def result (profile-fib 15)) (profile-stop) result)`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != "610" {
+		t.Error("profiling returned the wrong value: ", s)
+	}
+	report := ProfileReport()
+	if !strings.Contains(report, " 1973 ") || !strings.Contains(report, "profile-fib") {
+		t.Errorf("wrong profile report:\n%s", report)
+	}
+	var buf bytes.Buffer
+	if err := WriteProfile(&buf); err != nil {
+		t.Fatal("cannot write the profile: ", err)
+	}
+	if _, err := gzip.NewReader(&buf); err != nil {
+		t.Error("the profile is not gzipped: ", err)
+	}
+	ResetProfile()
+	if strings.Contains(ProfileReport(), "profile-fib") {
+		t.Error("resetting the profile did not discard it")
+	}
+}
+
+func TestVMStats(t *testing.T) {
+	Init()
+	before := VMStats(nil)
+	list := NewList(NewString("one"), Float(2.5), NewVector(Zero, One))
+	after := VMStats(before)
+	for typ, count := range map[string]int64{"<list>": 3, "<string>": 1, "<number>": 1, "<vector>": 1} {
+		if n := statsValue(after, statsTypesKey, Intern(typ), statsCountKey); n < count {
+			t.Errorf("expected at least %d allocations of %s, got %d", count, typ, n)
+		}
+	}
+	if n := statsValue(after, statsTypesKey, Intern("<string>"), statsBytesKey); n < 3 {
+		t.Error("the bytes of the string allocated were not counted: ", n)
+	}
+	if statsValue(after, statsCountKey) >= statsValue(VMStats(nil), statsCountKey) {
+		t.Error("the allocations since the earlier stats are not fewer than all of them")
+	}
+	if list.Length() != 3 {
+		t.Error("wrong list: ", list)
+	}
+	if _, err := exec(compileString(t, `(vm-stats 23)`), nil); err == nil {
+		t.Error("expected an error getting the stats since a non-struct")
+	}
+}
+
+func TestTimeAndBench(t *testing.T) {
+	Init()
+	var out bytes.Buffer
+	defer func(w io.Writer) { timeOut = w }(timeOut)
+	timeOut = &out
+	src := `(do (def bench-count 0) (def result (time (list 1 2 3)))
+	            (bench (set! bench-count (+ bench-count 1)) iterations: 10)
+	            (list result bench-count))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != "((1 2 3) 10)" {
+		t.Error("time and bench returned the wrong value: ", s)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "; elapsed ") || !strings.HasPrefix(lines[1], "; 10 iterations, min ") {
+		t.Errorf("wrong report from time and bench:\n%s", out.String())
+	}
+	if _, err := exec(compileString(t, `(bench (error "oops"))`), nil); err == nil {
+		t.Error("expected the error raised by the benchmarked expression")
+	}
+}
+
+func TestDeftest(t *testing.T) {
+	Init()
+	ClearTests()
+	defer ClearTests()
+	var out bytes.Buffer
+	defer func(w io.Writer) { testOut = w }(testOut)
+	testOut = &out
+	src := `(do (deftest unit-passing (assert-equal 4 (+ 2 2)) (assert-error (car 5) argument-error:))
+	            (deftest unit-failing (assert-equal [1 {x: 2}] [1 {x: 3}] "the " 'maps " differ"))
+	            (run-tests "unit-"))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if result != False {
+		t.Error("run-tests should return false when a test fails, not ", result)
+	}
+	expected := `--- FAIL: unit-failing
+    the maps differ
+    expected: [1 {x: 2}]
+      actual: [1 {x: 3}]
+    first difference at [1].x:, expected 2, got 3
+1 passed, 1 failed
+`
+	if out.String() != expected {
+		t.Errorf("wrong test report:\n%s", out.String())
+	}
+	out.Reset()
+	if passed, failed, err := RunTests(VM(defaultStackSize), "passing"); passed != 1 || failed != 0 || err != nil {
+		t.Error("wrong results running the passing test: ", passed, failed, err)
+	}
+}
+
+func TestFormatSource(t *testing.T) {
+	Init()
+	src := `; leading comment
+
+
+(defn   f (x)   (+ x 1)) ; trailing comment
+(def v [1
+        2])
+(defn g (x)
+  ;; inner comment
+  x)
+(defmacro m (a) ` + "`" + `(list ~a ~@(list 1 2)))
+(let loop ((i 0)) (if (< i 10) (loop (+ i 1)) i))
+(def s "a;b")
+`
+	expected := `; leading comment
+
+(defn f (x) (+ x 1)) ; trailing comment
+(def v [1 2])
+(defn g (x)
+  ;; inner comment
+  x)
+(defmacro m (a) ` + "`" + `(list ~a ~@(list 1 2)))
+(let loop ((i 0))
+  (if (< i 10) (loop (+ i 1)) i))
+(def s "a;b")
+`
+	formatted, err := FormatSource("", src, 40)
+	if err != nil {
+		t.Fatal("cannot format the source: ", err)
+	}
+	if formatted != expected {
+		t.Errorf("wrong formatted source:\n%s", formatted)
+	}
+	if again, _ := FormatSource("", formatted, 40); again != formatted {
+		t.Errorf("formatting the formatted source changed it:\n%s", again)
+	}
+	if _, err := FormatSource("", "(foo", 40); err == nil {
+		t.Error("expected an error formatting incomplete source")
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	output := fs.String("o", "", "output")
+	verbose := fs.Bool("verbose", false, "verbose")
+	params := parseArgs(fs, []string{"foo.ell", "-o", "foo.lvm", "bar.ell", "--verbose"})
+	if strings.Join(params, " ") != "foo.ell bar.ell" || *output != "foo.lvm" || !*verbose {
+		t.Error("wrong arguments parsed: ", params, *output, *verbose)
+	}
+}
+
+func TestScriptArgs(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script")
+	if err := os.WriteFile(script, []byte("#!/usr/bin/env ell\n(def x 23)\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	verbose := fs.Bool("verbose", false, "verbose")
+	files, args := scriptArgs(fs, []string{"--verbose", "foo.ell", script, "-x", "--", "bar"})
+	if strings.Join(files, " ") != "foo.ell "+script || strings.Join(args, " ") != "-x -- bar" || !*verbose {
+		t.Error("wrong script arguments parsed: ", files, args)
+	}
+	files, args = scriptArgs(fs, []string{"foo.ell", "--", "-x", "bar"})
+	if strings.Join(files, " ") != "foo.ell" || strings.Join(args, " ") != "-x bar" {
+		t.Error("wrong arguments after -- parsed: ", files, args)
+	}
+	vals, err := ReadAllFromString("#!/usr/bin/env ell\n(def x 23)\n")
+	if err != nil || vals.Length() != 1 || Write(vals.Car) != "(def x 23)" {
+		t.Error("the #! line was not skipped: ", vals, err)
+	}
+	if _, err := ReadAllFromString("(list 1)\n#!foo\n"); err == nil {
+		t.Error("a #! line after the start should not be a comment")
+	}
+}
+
+func TestLetrec(t *testing.T) {
+	Init()
+	src := `(do
+	          (defn parity (n)
+	            (defn ev? (n) (if (zero? n) true (od? (- n 1))))
+	            (defn od? (n) (if (zero? n) false (ev? (- n 1))))
+	            (list (ev? n) (od? n)))
+	          (list (parity 7) (letrec ((a 1) (b (list a 2))) b) (letrec ((f (fn () x)) (y (f)) (x 3)) (list y x))))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != "((false true) (1 2) (null 3))" {
+		t.Error("letrec did not initialize its variables in order: ", s)
+	}
+	for _, src := range []string{"(letrec ((a b) (b 1)) a)", "(fn () (def a (list b)) (def b 1) a)", "(letrec ((a a)) a)"} {
+		expr, err := ReadFromString(src)
+		if err == nil {
+			expr, err = Macroexpand(expr)
+		}
+		if err == nil {
+			_, err = Compile(expr)
+		}
+		if err == nil || !strings.Contains(err.Error(), "used before it is initialized") {
+			t.Error("use of a letrec variable before it is initialized was not an error: ", src, ": ", err)
+		}
+	}
+}
+
+func TestDestructuring(t *testing.T) {
+	Init()
+	src := `(do
+	          (defn f (p)
+	            (def (a {x: x y: (y1 y2)}) p)
+	            (list a x y1 y2))
+	          (def (g1 g2 . gs) '(1 2 3 4))
+	          (list (let (((a b . rest) '(1 2 3 4)) (c 5)) (list a b rest c))
+	                (let (((a & rest) '(1)) ({name: n "k": k} {name: "ann" "k": 2})) (list a rest n k))
+	                (f (list 0 {x: 1 y: '(2 3)}))
+	                (list g1 g2 gs)))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != `((1 2 (3 4) 5) (1 () "ann" 2) (0 1 2 3) (1 2 (3 4)))` {
+		t.Error("destructuring bound the wrong values: ", s)
+	}
+	for _, src := range []string{"(let (((a 1) x)) a)", "(let (((a .) x)) a)", "(let (((a . b c) x)) a)", "(def {x: 2} x)"} {
+		expr, err := ReadFromString(src)
+		if err == nil {
+			_, err = Macroexpand(expr)
+		}
+		if errorKind(err) != SyntaxErrorKey {
+			t.Error("bad destructuring pattern was not a syntax error: ", src, ": ", err)
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	Init()
+	var warnings []string
+	saved := warn
+	warn = func(msg string) { warnings = append(warnings, msg) }
+	defer func() { warn = saved }()
+	src := `(do
+	          (defn kf (a {size: 10 'color "red"}) (list a size color))
+	          (list (kf 1) (kf 1 color: 'blue size: 2) ((fn (a [b (c 5)]) (list a b c)) 1) ((fn [a & r] (list a r)) 1 2)))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != `((1 10 "red") (1 2 blue) (1 null 5) (1 (2)))` {
+		t.Error("the optional or keyword arguments were bound wrongly: ", s)
+	}
+	compileString(t, `(list (kf 1 colour: 'blue) (kf 1 size:) (kf 1 size: 2))`)
+	if len(warnings) != 2 || !strings.Contains(strings.Join(warnings, "\n"), "kf has no keyword argument colour:") {
+		t.Error("the compiler did not warn of the bad keyword arguments: ", warnings)
+	}
+	if _, err := exec(compileString(t, `((fn (a [b]) a) 1 2 3)`), nil); err == nil {
+		t.Error("too many optional arguments were not an error")
+	}
+	for src, msg := range map[string]string{
+		"(fn (a [b b]) a)": "Duplicate parameter", "(fn (a [(b)]) a)": "Bad optional parameter",
+		"(fn (a {b: 1} c) a)": "Keyword parameters must come last", "(fn (a & b c) a)": "& must be followed",
+		"(fn (a 2) a)": "Bad parameter"} {
+		expr, err := ReadFromString(src)
+		if err == nil {
+			expr, err = Macroexpand(expr)
+		}
+		if err == nil {
+			_, err = Compile(expr)
+		}
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Error("the wrong error for the parameters of ", src, ": ", err)
+		}
+	}
+}
+
+func TestSplice(t *testing.T) {
+	Init()
+	src := `(do
+	          (def xs '(3 4))
+	          (defn count-down (n) (if (= n 0) 'done (count-down @(list (- n 1)))))
+	          (list (list 1 2 @xs) (list @xs) (list 1 @xs 5 @xs 6) (list @'()) (count-down 100000) '(f @x)))`
+	result, err := exec(compileString(t, src), nil)
+	if err != nil {
+		t.Fatal("cannot execute ", src, ": ", err)
+	}
+	if s := Write(result); s != "((1 2 3 4) (3 4) (1 3 4 5 3 4 6) () done (f @x))" {
+		t.Error("the spliced arguments were passed wrongly: ", s)
+	}
+	expr, err := ReadFromString("(def y @xs)")
+	if err == nil {
+		expr, err = Macroexpand(expr)
+	}
+	if err == nil {
+		_, err = Compile(expr)
+	}
+	if err == nil {
+		t.Error("a splice that is not an argument of a call was not an error")
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	. "github.com/boynton/ell/data"
+)
+
+// sourceHeadArgs - the number of arguments after the first that a call keeps on its first line when formatted, so
+// that the name and the parameters of a definition, and the name and bindings of a named let, stay together
+func sourceHeadArgs(lst *List) int {
+	switch lst.Car {
+	case Intern("defn"), DefmacroSymbol, Intern("defmethod"), Intern("defgeneric"):
+		return 1
+	case Intern("let"):
+		if _, ok := Cadr(lst).(*Symbol); ok {
+			return 1
+		}
+	}
+	return 0
+}
+
+// FormatSource - the source text with each top level form pretty printed to fit in the width. The comments between
+// the forms are kept, and blank lines between them are reduced to one. A form with comments in it is left as it is,
+// as is one that would not read back the same when pretty printed.
+func FormatSource(file string, text string, width int) (string, error) {
+	//incremental, so that a form cut off by the end of the file is an error, rather than the end of the forms
+	reader := &Reader{Input: bufio.NewReader(strings.NewReader(text)), File: file, Incremental: true}
+	reader.Extension = &EllReaderExtension{r: reader}
+	var buf strings.Builder
+	end := 0
+	for {
+		val, err := reader.ReadValue()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", readError(reader, err)
+		}
+		start := reader.StartPosition()
+		writeGap(&buf, text[end:start], false)
+		buf.WriteString(formatForm(val, text[start:reader.Position], width))
+		end = reader.Position
+	}
+	writeGap(&buf, text[end:], true)
+	return buf.String(), nil
+}
+
+// writeGap - write the comments between two forms, or after the last one. A comment on the line a form ends on
+// stays there.
+func writeGap(buf *strings.Builder, gap string, atEnd bool) {
+	lines := strings.Split(gap, "\n")
+	blank := 0
+	for i, line := range lines {
+		text := strings.TrimRight(line, " \t\r")
+		if strings.TrimSpace(text) == "" {
+			if i > 0 && i < len(lines)-1 {
+				blank++
+			}
+			continue
+		}
+		if i == 0 && buf.Len() > 0 {
+			buf.WriteString(" " + strings.TrimSpace(text))
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString("\n")
+			if blank > 0 {
+				buf.WriteString("\n")
+			}
+		}
+		buf.WriteString(text)
+		blank = 0
+	}
+	if buf.Len() > 0 {
+		buf.WriteString("\n")
+		if blank > 0 && !atEnd {
+			buf.WriteString("\n")
+		}
+	}
+}
+
+// formatForm - the form pretty printed, or its source if it has comments in it or does not read back the same
+func formatForm(val Value, source string, width int) string {
+	if hasComment(source) {
+		return source
+	}
+	ext := newWriter("", false)
+	ext.writer.MaxLength = 0
+	ext.writer.MaxDepth = 0
+	p := &prettyPrinter{ext: ext, width: width, headArgs: sourceHeadArgs}
+	p.print(val, 0, 0)
+	formatted := p.buf.String()
+	vals, err := ReadAllFromString(formatted)
+	if err != nil || vals.Length() != 1 || !Equal(vals.Car, val) || ext.write(vals.Car) != ext.write(val) {
+		return source
+	}
+	return formatted
+}
+
+// hasComment - true if the source of a form has a comment in it
+func hasComment(source string) bool {
+	inString := false
+	for i := 0; i < len(source); i++ {
+		c := source[i]
+		switch {
+		case inString:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == ';':
+			return true
+		case c == '#' && i+1 < len(source):
+			switch source[i+1] {
+			case '|', ';':
+				return true
+			case '\\':
+				i += 2 //a character literal, which may be #\; or #\"
+			}
+		}
+	}
+	return false
+}
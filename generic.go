@@ -33,7 +33,7 @@ func methodSignature(formalArgs *List) (Value, error) {
 				return nil, NewError(SyntaxErrorKey, "Specialized argument must be of the form <symbol> or (<symbol> <type>), got ", s)
 			}
 		} else if s.Type() == SymbolType { //unspecialized
-			tname = "<any>"
+			tname = TypeNameString(AnyType)
 		} else {
 			return nil, NewError(SyntaxErrorKey, "Specialized argument must be of the form <symbol> or (<symbol> <type>), got ", s)
 		}
@@ -46,7 +46,7 @@ func methodSignature(formalArgs *List) (Value, error) {
 func arglistSignature(args []Value) string {
 	sig := ""
 	for _, arg := range args {
-		sig += (arg.Type().(*Type)).Name()
+		sig += TypeNameString(arg.Type())
 	}
 	return sig
 }
@@ -3,9 +3,11 @@ module github.com/boynton/ell
 go 1.19
 
 require (
-	github.com/boynton/cli v0.0.0-20170122194616-c91dc790ccff
 	github.com/boynton/repl v0.0.0-20170116235056-348863958e3e
+	github.com/mattn/go-sqlite3 v1.14.33
 	github.com/pborman/uuid v1.2.0
+	github.com/pelletier/go-toml/v2 v2.0.9
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require github.com/google/uuid v1.0.0 // indirect
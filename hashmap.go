@@ -0,0 +1,145 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	. "github.com/boynton/ell/data"
+)
+
+var HashMapType Value = Intern("<hashmap>")
+
+var hashmapTag = Intern("hashmap").(*Symbol)
+
+// HashMap - a mutable table from keys, which may be any values, including lists, vectors, and structs, to values.
+// Keys are compared with Equal and found by their Hash, so a key must not be modified while it is in the table.
+// It is written as a tagged literal, i.e. #hashmap {[1 2] "a" [3 4] "b"}.
+type HashMap struct {
+	table *Struct
+}
+
+func (h *HashMap) Type() Value {
+	return HashMapType
+}
+
+func (h *HashMap) String() string {
+	return "#" + hashmapTag.Text + " " + h.table.String()
+}
+
+// Equals - hashmaps are equal if they have equal values for the same keys
+func (h *HashMap) Equals(another Value) bool {
+	if h2, ok := another.(*HashMap); ok {
+		return h.table.Equals(h2.table)
+	}
+	return false
+}
+
+func (h *HashMap) Hash() uint64 {
+	return Hash(h.table)
+}
+
+// NewHashMap - create a new hashmap with the keys and values, which alternate in the slice
+func NewHashMap(kv []Value) (*HashMap, error) {
+	if len(kv)%2 != 0 {
+		return nil, NewError(ArgumentErrorKey, "hashmap expected an even number of keys and values, got ", len(kv))
+	}
+	h := &HashMap{table: NewStruct()}
+	for i := 0; i < len(kv); i += 2 {
+		h.Put(kv[i], kv[i+1])
+	}
+	return h, nil
+}
+
+func IsHashMap(obj Value) bool {
+	_, ok := obj.(*HashMap)
+	return ok
+}
+
+// ToHashMap - a new hashmap with the fields of the struct, or of the struct the object converts to
+func ToHashMap(obj Value) (*HashMap, error) {
+	if h, ok := obj.(*HashMap); ok {
+		return &HashMap{table: h.table.Copy()}, nil
+	}
+	strct, err := ToStruct(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &HashMap{table: strct.(*Struct).Copy()}, nil
+}
+
+// ToStruct - a new struct with the entries of the hashmap
+func (h *HashMap) ToStruct() *Struct {
+	return h.table.Copy()
+}
+
+func (h *HashMap) Length() int {
+	return h.table.Length()
+}
+
+// Get - the value for the key, or null if there is none
+func (h *HashMap) Get(key Value) Value {
+	return h.table.Get(key)
+}
+
+// Has - true if the hashmap has an entry for the key, even if its value is null
+func (h *HashMap) Has(key Value) bool {
+	return h.table.Has(key)
+}
+
+func (h *HashMap) Put(key Value, val Value) {
+	h.table.Put(key, val)
+}
+
+func (h *HashMap) Remove(key Value) {
+	h.table.Unput(key)
+}
+
+// Keys - the keys of the hashmap, in the order they were first put
+func (h *HashMap) Keys() []Value {
+	return h.table.Keys()
+}
+
+// Values - the values of the hashmap, in the order of their keys
+func (h *HashMap) Values() []Value {
+	entries := h.table.Entries()
+	values := make([]Value, len(entries))
+	for i, e := range entries {
+		values[i] = e.Value
+	}
+	return values
+}
+
+// HashMapBraces - a Maps reader option that reads braces as hashmaps, i.e. ReaderOptions{Maps: HashMapBraces}
+func HashMapBraces(kv []Value) (Value, error) {
+	h, err := NewHashMap(kv)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// defineHashMapTag - read #hashmap tagged literals as hashmaps, and write hashmaps as them
+func defineHashMapTag() {
+	DefineTagConstructor(hashmapTag, func(val Value) (Value, error) {
+		if p, ok := val.(*Struct); ok {
+			return &HashMap{table: p}, nil
+		}
+		return nil, NewError(SyntaxErrorKey, "#hashmap expected a <struct>, got a ", val.Type())
+	})
+	DefineTagWriter(HashMapType, hashmapTag, func(val Value) (Value, error) {
+		return val.(*HashMap).table, nil
+	})
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"context"
+	"sync"
+
+	. "github.com/boynton/ell/data"
+)
+
+// InterpOptions - how NewInterp sets up the runtime, and the limits on the code an interpreter runs
+type InterpOptions struct {
+	Optimize   bool        //optimize execution speed, relaxing some checks, as the -optimize flag does
+	Verbose    bool        //print extra information
+	Debug      bool        //print extra information about compilation
+	LoadPath   []string    //directories to search for modules, after the default ones
+	Extensions []Extension //extensions to initialize, the first time the runtime is set up
+	Limits     Limits      //resource limits for each evaluation or call. Zero fields mean no limit
+}
+
+// Interp - an interpreter, for Go programs that embed Ell:
+//
+//	interp := ell.NewInterp(ell.InterpOptions{})
+//	interp.Define("greeting", data.NewString("hello"))
+//	val, err := interp.EvalString(`(defn greet (name) (string greeting ", " name))`)
+//	val, err = interp.Call("greet", data.NewString("world"))
+//
+// The global environment belongs to the process, so all interpreters share the globals, macros, and modules
+// they define. Each interpreter has its own limits and context for the code it runs.
+type Interp struct {
+	limits Limits
+	ctx    context.Context
+}
+
+var initMutex sync.Mutex
+var initialized bool
+
+// NewInterp - an interpreter with the options. The runtime is initialized, with the primitives and the ell
+// library, the first time an interpreter is made, unless Init has already been called.
+func NewInterp(options InterpOptions) *Interp {
+	initMutex.Lock()
+	defer initMutex.Unlock()
+	SetFlags(options.Optimize, options.Verbose, options.Debug, false, false)
+	if !initialized {
+		Init(options.Extensions...)
+	}
+	for _, dir := range options.LoadPath {
+		AddEllDirectory(dir)
+	}
+	return &Interp{limits: options.Limits}
+}
+
+// WithContext - an interpreter like this one whose evaluations and calls are aborted, with an interrupt: error,
+// when the context is done
+func (interp *Interp) WithContext(ctx context.Context) *Interp {
+	return &Interp{limits: interp.limits, ctx: ctx}
+}
+
+// exec - run the code with the interpreter's limits and context
+func (interp *Interp) exec(code *Code, args ...Value) (Value, error) {
+	vm := VM(defaultStackSize)
+	if interp.limits.MaxStack > 0 {
+		vm.stackSize = interp.limits.MaxStack
+	}
+	vm.acct = newAccounting(interp.limits)
+	vm.ctx = interp.ctx
+	return vm.execArgs(code, args)
+}
+
+// Eval - evaluate the expression, expanding its macros and compiling it first
+func (interp *Interp) Eval(expr Value) (Value, error) {
+	code, err := compileSource(expr, "")
+	if err != nil {
+		return nil, err
+	}
+	return interp.exec(code)
+}
+
+// EvalString - read the expressions in the source and evaluate them in order, returning the value of the last
+// one, or null if there are none
+func (interp *Interp) EvalString(src string) (Value, error) {
+	exprs, err := ReadAllFromString(src)
+	if err != nil {
+		return nil, err
+	}
+	var result Value = Null
+	for ; exprs != EmptyList; exprs = exprs.Cdr {
+		result, err = interp.Eval(exprs.Car)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Define - bind the value to the global name
+func (interp *Interp) Define(name string, val Value) {
+	DefineGlobal(name, val)
+}
+
+// Global - the value of the global name, or nil if it is not defined
+func (interp *Interp) Global(name string) Value {
+	return GetGlobal(Intern(name))
+}
+
+// Call - call the function that is the value of the global name with the arguments
+func (interp *Interp) Call(name string, args ...Value) (Value, error) {
+	sym := Intern(name)
+	val := GetGlobal(sym)
+	if val == nil {
+		return nil, NewError(ErrorKey, "Undefined symbol: ", sym)
+	}
+	fn, ok := val.(*Function)
+	if !ok {
+		return nil, NewError(ArgumentErrorKey, "Not a function: ", sym)
+	}
+	return interp.exec(trampoline(fn, len(args), name), args...)
+}
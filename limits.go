@@ -0,0 +1,101 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"context"
+
+	. "github.com/boynton/ell/data"
+)
+
+// LimitErrorKey - the kind of error raised when execution exceeds its limits. Unlike interrupts, these
+// errors cannot be caught by Ell code, the VM exits and the error is returned to the host.
+var LimitErrorKey = Intern("limit-error:")
+
+// Limits - resource limits for running untrusted code. A zero field means no limit. List cells do not record the
+// VM that made them, so the conses counted against MaxConses are all those made since execution began, by any
+// goroutine, and a thread spawned by the code counts those made since it was spawned.
+type Limits struct {
+	MaxInstructions int   //VM instructions executed, including those of callbacks such as dynamic-wind thunks
+	MaxConses       int64 //list cells allocated since execution began
+	MaxStack        int   //the size of the value stack, in slots. The default is 1000
+}
+
+// accounting - the resources used by a VM, shared with the VMs it starts to run callbacks
+type accounting struct {
+	limits       Limits
+	instructions int
+	conses       int64 //the global cons count when execution began
+}
+
+func newAccounting(limits Limits) *accounting {
+	if limits.MaxConses > 0 {
+		CountAllocations()
+	}
+	return &accounting{limits: limits, conses: ConsCount()}
+}
+
+func (acct *accounting) step() error {
+	acct.instructions++
+	if acct.limits.MaxInstructions > 0 && acct.instructions > acct.limits.MaxInstructions {
+		return NewError(LimitErrorKey, "instruction limit exceeded: ", acct.limits.MaxInstructions)
+	}
+	return nil
+}
+
+// check - poll for cancellation, and account for the resources used so far. It is called at function calls, so
+// every loop is checked, since loops in Ell are tail calls. Interrupts are polled for at the same points, but are
+// raised as errors that can be caught.
+func (vm *vm) check() error {
+	if vm.ctx != nil {
+		select {
+		case <-vm.ctx.Done():
+			return NewError(InterruptKey, vm.ctx.Err())
+		default:
+		}
+	}
+	if vm.acct != nil && vm.acct.limits.MaxConses > 0 {
+		if ConsCount()-vm.acct.conses > vm.acct.limits.MaxConses {
+			return NewError(LimitErrorKey, "allocation limit exceeded: ", vm.acct.limits.MaxConses, " conses")
+		}
+	}
+	return nil
+}
+
+func stackOverflow() error {
+	return NewError(LimitErrorKey, "stack overflow")
+}
+
+// ExecWithLimits - execute the code, as returned by Compile, with the given arguments. If it exceeds
+// the limits, execution is aborted and a limit-error: is returned.
+func ExecWithLimits(limits Limits, code *Code, args ...Value) (Value, error) {
+	vm := VM(defaultStackSize)
+	if limits.MaxStack > 0 {
+		vm.stackSize = limits.MaxStack
+	}
+	vm.acct = newAccounting(limits)
+	return vm.execArgs(code, args)
+}
+
+// ExecWithContext - execute the code, as returned by Compile, with the given arguments. If the context is
+// cancelled or times out, execution is aborted with an interrupt: error. Threads spawned by the code are
+// aborted, too. A primitive that blocks, such as a channel receive, is not interrupted.
+func ExecWithContext(ctx context.Context, code *Code, args ...Value) (Value, error) {
+	vm := VM(defaultStackSize)
+	vm.ctx = ctx
+	return vm.execArgs(code, args)
+}
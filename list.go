@@ -101,6 +101,16 @@ func ListLength(o Value) int {
 	return -1
 }
 
+// ListContains - return true if the object is an element of the list, compared by identity
+func ListContains(lst *List, val Value) bool {
+	for ; lst != EmptyList; lst = lst.Cdr {
+		if lst.Car == val {
+			return true
+		}
+	}
+	return false
+}
+
 func MakeList(count int, val Value) *List {
 	result := EmptyList
 	for i := 0; i < count; i++ {
@@ -120,6 +130,8 @@ func ToList(obj Value) (*List, error) {
 		return StructToList(p)
 	case *String:
 		return StringToList(p), nil
+	case *Set:
+		return ListFromValues(p.Members()), nil
 	}
 	return nil, NewError(ArgumentErrorKey, "to-list cannot accept ", obj.Type())
 }
@@ -148,6 +160,10 @@ func Flatten(lst *List) *List {
 		default:
 			lstItem = NewList(item)
 		}
+		if lstItem == EmptyList {
+			lst = lst.Cdr
+			continue
+		}
 		if tail == EmptyList {
 			result = lstItem
 			tail = result
@@ -162,6 +178,83 @@ func Flatten(lst *List) *List {
 	return result
 }
 
+// ReverseBang - reverse the list in place, by changing the cdr of each of its cells, and return the new head
+func ReverseBang(lst *List) *List {
+	rev := EmptyList
+	for lst != EmptyList {
+		next := lst.Cdr
+		lst.Cdr = rev
+		rev = lst
+		lst = next
+	}
+	return rev
+}
+
+// Last - the last element of the list, which must not be empty
+func Last(lst *List) (Value, error) {
+	if lst == EmptyList {
+		return nil, NewError(ArgumentErrorKey, "last expected a non-empty <list>")
+	}
+	for lst.Cdr != EmptyList {
+		lst = lst.Cdr
+	}
+	return lst.Car, nil
+}
+
+// Member - the rest of the list starting with the first element equal to the value, or nil if there is none.
+// If identity is true, elements are compared by identity rather than with Equal.
+func Member(val Value, lst *List, identity bool) *List {
+	for ; lst != EmptyList; lst = lst.Cdr {
+		if lst.Car == val || (!identity && Equal(lst.Car, val)) {
+			return lst
+		}
+	}
+	return nil
+}
+
+// AssocList - the first element of the association list, a list of lists, whose car is equal to the key, or nil
+// if there is none. If identity is true, keys are compared by identity rather than with Equal.
+func AssocList(key Value, alist *List, identity bool, name string) (*List, error) {
+	for ; alist != EmptyList; alist = alist.Cdr {
+		entry, ok := alist.Car.(*List)
+		if !ok || entry == EmptyList {
+			return nil, NewError(ArgumentErrorKey, name, " expected a list of non-empty <list>, found ", alist.Car)
+		}
+		if entry.Car == key || (!identity && Equal(entry.Car, key)) {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// Range - the list of numbers from start up to, but not including, end, incrementing by step. A negative step
+// counts down to end instead.
+func Range(start *Number, end *Number, step *Number) (*List, error) {
+	dir := NumberCompare(step, Zero)
+	if dir == 0 {
+		return nil, NewError(ArgumentErrorKey, "range step cannot be zero")
+	}
+	var values []Value
+	for n := start; NumberCompare(n, end) == -dir; n = NumberAdd(n, step) {
+		values = append(values, n)
+	}
+	return ListFromValues(values), nil
+}
+
+// ListTabulate - the list of the results of calling the function with each index from 0 up to count
+func ListTabulate(vm *vm, count int, fn *Function) (*List, error) {
+	call := caller(vm, fn, 1, "list-tabulate")
+	values := make([]Value, 0, count)
+	for i := 0; i < count; i++ {
+		val, err := call(Integer(i))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, val)
+	}
+	return ListFromValues(values), nil
+}
+
 func Concat(seq1 *List, seq2 *List) (*List, error) {
 	rev := Reverse(seq1)
 	if rev == EmptyList {
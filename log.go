@@ -0,0 +1,220 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/boynton/ell/data"
+)
+
+// The log takes entries of a level, a message, and fields of keys and values. In text, an entry is a line of
+// the level, the message, and key=value for each field, after the time if timestamps are on:
+//
+//	2024-05-01T12:00:00.000Z WARN disk low free=1024 path="/tmp"
+//
+// In JSON, it is an object of the time, level, and msg, with the fields. The runtime's own verbose, debug, and
+// trace output are entries of the debug level.
+
+// LogLevel - the severity of a log entry. Entries below the level of the log are dropped.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelKeys = []Value{Intern("debug:"), Intern("info:"), Intern("warn:"), Intern("error:")}
+var logLevelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+var logLevelKey = Intern("level:")
+var logTimestampsKey = Intern("timestamps:")
+var logJSONKey = Intern("json:")
+var logPortKey = Intern("port:")
+
+var logMutex sync.Mutex
+var logLevel = LogInfo
+var logTimestamps bool
+var logJSON bool
+var logPort *Port // nil means the value of *stderr*
+
+// SetLogLevel - drop log entries below the level
+func SetLogLevel(level LogLevel) {
+	logMutex.Lock()
+	logLevel = level
+	logMutex.Unlock()
+}
+
+func logLevelFromKey(val Value) (LogLevel, error) {
+	for i, key := range logLevelKeys {
+		if val == key {
+			return LogLevel(i), nil
+		}
+	}
+	return LogInfo, NewError(ArgumentErrorKey, "Bad log level, expected debug:, info:, warn:, or error:, got ", val)
+}
+
+// Log - write an entry to the log, if its level is not below the log's. The fields alternate keys, usually
+// keywords, and their values.
+func Log(level LogLevel, msg string, fields ...Value) error {
+	if len(fields)%2 != 0 {
+		return NewError(ArgumentErrorKey, "Log fields must be pairs of keys and values, got ", NewVector(fields...))
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	if level < logLevel {
+		return nil
+	}
+	port := logPort
+	if port == nil {
+		if p, ok := GetGlobal(stderrSymbol).(*Port); ok {
+			port = p
+		} else {
+			port = stderrPort
+		}
+	}
+	var now string
+	if logTimestamps {
+		now = time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	}
+	if logJSON {
+		entry := NewStruct()
+		if now != "" {
+			entry.Put(Intern("time:"), NewString(now))
+		}
+		entry.Put(logLevelKey, NewString(strings.ToLower(logLevelNames[level])))
+		entry.Put(Intern("msg:"), NewString(msg))
+		for i := 0; i < len(fields); i += 2 {
+			entry.Put(fields[i], fields[i+1])
+		}
+		s, err := JsonEmit(entry, JsonOptions{}) //keeping the time, level, and msg first
+		if err != nil {
+			return err
+		}
+		return port.WriteString(s + "\n")
+	}
+	var buf strings.Builder
+	if now != "" {
+		buf.WriteString(now + " ")
+	}
+	buf.WriteString(logLevelNames[level] + " " + msg)
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteString(" " + logFieldName(fields[i]) + "=" + Write(fields[i+1]))
+	}
+	line := buf.String()
+	if level == LogDebug && port == stderrPort {
+		line = colored(currentColors().trace, line)
+	}
+	return port.WriteString(line + "\n")
+}
+
+func logFieldName(key Value) string {
+	switch p := key.(type) {
+	case *String:
+		return p.Value
+	case *Keyword:
+		return p.Name()
+	case *Symbol:
+		return p.Name()
+	}
+	return key.String()
+}
+
+// logMessage - log the args, concatenated as Println does, for the runtime's own entries. A failure to write
+// them is ignored.
+func logMessage(level LogLevel, args ...interface{}) {
+	var buf strings.Builder
+	for _, arg := range args {
+		buf.WriteString(str(arg))
+	}
+	Log(level, buf.String())
+}
+
+// logConfig - the settings of the log, as a struct
+func logConfig() *Struct {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	config := NewStruct()
+	config.Put(logLevelKey, logLevelKeys[logLevel])
+	config.Put(logTimestampsKey, False)
+	if logTimestamps {
+		config.Put(logTimestampsKey, True)
+	}
+	config.Put(logJSONKey, False)
+	if logJSON {
+		config.Put(logJSONKey, True)
+	}
+	if logPort != nil {
+		config.Put(logPortKey, logPort)
+	} else {
+		config.Put(logPortKey, Null)
+	}
+	return config
+}
+
+// logFunction - the primitive that logs entries of the level, from a message and its fields
+func logFunction(level LogLevel) PrimitiveFunction {
+	return func(argv []Value) (Value, error) {
+		msg := argv[0]
+		if s, ok := msg.(*String); ok {
+			return Null, Log(level, s.Value, argv[1:]...)
+		}
+		return Null, Log(level, msg.String(), argv[1:]...)
+	}
+}
+
+// ellLogConfig - change the settings given, of level:, timestamps:, json:, and port:, and return all of them.
+// A port: of false goes back to logging to the value of *stderr*.
+func ellLogConfig(argv []Value) (Value, error) {
+	var level LogLevel
+	if argv[0] != Null {
+		l, err := logLevelFromKey(argv[0])
+		if err != nil {
+			return nil, err
+		}
+		level = l
+	}
+	var port *Port
+	if argv[3] != Null && argv[3] != False {
+		p, err := outputPort(argv[3], false)
+		if err != nil {
+			return nil, err
+		}
+		port = p
+	}
+	logMutex.Lock()
+	if argv[0] != Null {
+		logLevel = level
+	}
+	if argv[1] != Null {
+		logTimestamps = argv[1] == True
+	}
+	if argv[2] != Null {
+		logJSON = argv[2] == True
+	}
+	if port != nil {
+		logPort = port
+	} else if argv[3] == False {
+		logPort = nil
+	}
+	logMutex.Unlock()
+	return logConfig(), nil
+}
@@ -18,6 +18,9 @@ package ell
 
 import (
 	"fmt"
+	"unicode"
+	"unicode/utf8"
+
 	. "github.com/boynton/ell/data"
 )
 
@@ -42,6 +45,17 @@ func Macroexpand(expr Value) (Value, error) {
 	return macroexpandObject(expr)
 }
 
+// Macroexpand1 - expand the expression once if it is a macro call, without expanding the result further.
+// The result is the expression itself if it is not a macro call.
+func Macroexpand1(expr Value) (Value, error) {
+	if lst, ok := expr.(*List); ok && lst != EmptyList {
+		if mac := GetMacro(lst.Car); mac != nil {
+			return mac.expandOnce(lst)
+		}
+	}
+	return expr, nil
+}
+
 func macroexpandObject(expr Value) (Value, error) {
 	if lst, ok := expr.(*List); ok {
 		if lst != EmptyList {
@@ -51,7 +65,18 @@ func macroexpandObject(expr Value) (Value, error) {
 	return expr, nil
 }
 
+// macroexpandList - expand the macros in the form. The expansion keeps the source location of the form, as
+// does an error in expanding it.
 func macroexpandList(expr *List) (Value, error) {
+	expanded, err := expandList(expr)
+	if err != nil {
+		return nil, locateError(err, expr)
+	}
+	inheritLocation(expanded, expr)
+	return expanded, nil
+}
+
+func expandList(expr *List) (Value, error) {
 	if expr == nil {
 		panic("whoops")
 	}
@@ -82,30 +107,76 @@ func macroexpandList(expr *List) (Value, error) {
 	if err != nil {
 		return nil, err
 	}
+	for args := tail; args != EmptyList; args = args.Cdr {
+		if Car(args.Car) == SpliceSymbol {
+			return expandSplice(head, tail)
+		}
+	}
 	return Cons(head, tail), nil
 }
 
-func (mac *macro) expand(expr Value) (Value, error) {
-	if mac.expander.code != nil {
-		if mac.expander.code.argc == 1 {
-			expanded, err := execCompileTime(mac.expander.code, expr)
-			if err == nil {
-				if IsList(expanded) {
-					return macroexpandObject(expanded)
-				}
-				return expanded, err
-			}
-			return nil, err
+// expandSplice - a call with spliced arguments, (f a @xs b), applies the function to the arguments before the
+// first splice, followed by the list of the rest of them: (apply f a (concat xs (list b)))
+func expandSplice(fn Value, args *List) (Value, error) {
+	result := []Value{Intern("apply"), fn}
+	for ; args != EmptyList && Car(args.Car) != SpliceSymbol; args = args.Cdr {
+		result = append(result, args.Car)
+	}
+	var pieces, run []Value
+	for ; args != EmptyList; args = args.Cdr {
+		arg := args.Car
+		if Car(arg) != SpliceSymbol {
+			run = append(run, arg)
+			continue
 		}
-	} else if mac.expander.primitive != nil {
-		args := []Value{expr}
-		expanded, err := mac.expander.primitive.fun(args)
-		if err == nil {
-			return macroexpandObject(expanded)
+		if ListLength(arg) != 2 {
+			return nil, NewError(SyntaxErrorKey, arg)
+		}
+		if run != nil {
+			pieces = append(pieces, Cons(Intern("list"), ListFromValues(run)))
+			run = nil
 		}
+		pieces = append(pieces, Cadr(arg))
+	}
+	if run != nil {
+		pieces = append(pieces, Cons(Intern("list"), ListFromValues(run)))
+	}
+	if len(pieces) == 1 {
+		return ListFromValues(append(result, pieces[0])), nil
+	}
+	return ListFromValues(append(result, Cons(Intern("concat"), ListFromValues(pieces)))), nil
+}
+
+// traceMacrosSymbol - when the global *trace-macros* is true, each macro expansion is printed
+var traceMacrosSymbol = Intern("*trace-macros*")
+
+func (mac *macro) expand(expr Value) (Value, error) {
+	expanded, err := mac.expandOnce(expr)
+	if err != nil {
 		return nil, err
 	}
-	return nil, NewError(MacroErrorKey, "Bad macro expander function: ", mac.expander)
+	return macroexpandObject(expanded)
+}
+
+// expandOnce - call the expander of the macro, without expanding macros in the result
+func (mac *macro) expandOnce(expr Value) (Value, error) {
+	var expanded Value
+	var err error
+	if mac.expander.code != nil && mac.expander.code.argc == 1 {
+		expanded, err = execCompileTime(mac.expander.code, expr)
+	} else if mac.expander.primitive != nil {
+		expanded, err = mac.expander.primitive.fun([]Value{expr})
+	} else {
+		return nil, NewError(MacroErrorKey, "Bad macro expander function: ", mac.expander)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if GetGlobal(traceMacrosSymbol) == True {
+		Println("[macro ", mac.name, ": ", expr, " => ", expanded, "]")
+	}
+	inheritLocation(expanded, expr)
+	return expanded, nil
 }
 
 func expandSequence(seq Value) (*List, error) {
@@ -171,11 +242,15 @@ func expandDefn(expr Value) (Value, error) {
 	if exprLen >= 4 {
 		name := Cadr(expr)
 		if IsSymbol(name) {
-			args := Caddr(expr)
-			body, err := expandSequence(Cdddr(expr))
+			doc, rest := docString(Cddr(expr))
+			args := Car(rest)
+			body, err := expandSequence(Cdr(rest))
 			if err != nil {
 				return nil, err
 			}
+			if doc != nil {
+				body = Cons(doc, body)
+			}
 			tmp, err := expandFn(Cons(Intern("fn"), Cons(args, body)))
 			if err != nil {
 				return nil, err
@@ -191,8 +266,9 @@ func expandDefmacro(expr Value) (Value, error) {
 	if exprLen >= 4 {
 		name := Cadr(expr)
 		if IsSymbol(name) {
-			args := Caddr(expr)
-			body, err := expandSequence(Cdddr(expr))
+			doc, rest := docString(Cddr(expr))
+			args := Car(rest)
+			body, err := expandSequence(Cdr(rest))
 			if err != nil {
 				return nil, err
 			}
@@ -202,7 +278,11 @@ func expandDefmacro(expr Value) (Value, error) {
 				return nil, err
 			}
 			sym := Intern("expr")
-			tmp, err = expandFn(NewList(Intern("fn"), NewList(sym), NewList(Intern("apply"), tmp, NewList(Intern("cdr"), sym))))
+			expander := NewList(NewList(Intern("apply"), tmp, NewList(Intern("cdr"), sym)))
+			if doc != nil {
+				expander = Cons(doc, expander) //the documentation is the macro's, so it goes on the outer function
+			}
+			tmp, err = expandFn(Cons(Intern("fn"), Cons(NewList(sym), expander)))
 			if err != nil {
 				return nil, err
 			}
@@ -217,14 +297,23 @@ func expandDefmacro(expr Value) (Value, error) {
 
 func expandDef(expr Value) (Value, error) {
 	exprLen := ListLength(expr)
-	if exprLen != 3 {
-		return nil, NewError(SyntaxErrorKey, expr)
-	}
 	name := Cadr(expr)
+	if isPattern(name) {
+		return expandDestructuringDef(expr)
+	}
 	if !IsSymbol(name) {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
-	if exprLen > 3 {
+	if exprLen == 4 {
+		//(def name "doc" (fn args body...)) documents the function: (def name (fn args "doc" body...))
+		doc, ok := Caddr(expr).(*String)
+		fn, isList := Cadddr(expr).(*List)
+		if !ok || !isList || fn.Car != Intern("fn") || ListLength(fn) < 3 {
+			return nil, NewError(SyntaxErrorKey, expr)
+		}
+		return expandDef(NewList(Car(expr), name, Cons(fn.Car, Cons(Cadr(fn), Cons(doc, Cddr(fn))))))
+	}
+	if exprLen != 3 {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
 	body := Caddr(expr)
@@ -247,6 +336,7 @@ func expandFn(expr Value) (Value, error) {
 	if err != nil {
 		return nil, err
 	}
+	doc, body := docString(body)
 	bodyLen := ListLength(body)
 	if bodyLen > 0 {
 		tmp := body
@@ -256,6 +346,17 @@ func expandFn(expr Value) (Value, error) {
 				if Caar(tmp) == Intern("defmacro") {
 					return nil, NewError(MacroErrorKey, "macros can only be defined at top level")
 				}
+				if isPattern(Cadar(tmp)) {
+					defs, err := destructuringDefBindings(Car(tmp))
+					if err != nil {
+						return nil, err
+					}
+					for _, binding := range defs {
+						bindings = Cons(binding, bindings)
+					}
+					tmp = Cdr(tmp)
+					continue
+				}
 				def, err := expandDef(Car(tmp))
 				if err != nil {
 					return nil, err
@@ -266,13 +367,54 @@ func expandFn(expr Value) (Value, error) {
 			bindings = Reverse(bindings)
 			tmp = Cons(Intern("letrec"), Cons(bindings, tmp)) //scheme specifies letrec*
 			tmp2, err := macroexpandList(tmp)
-			return NewList(Car(expr), Cadr(expr), tmp2), err
+			body = NewList(tmp2)
+			if doc != nil {
+				body = Cons(doc, body)
+			}
+			return Cons(Car(expr), Cons(Cadr(expr), body)), err
 		}
 	}
+	if doc != nil {
+		body = Cons(doc, body)
+	}
 	args := Cadr(expr)
 	return Cons(Car(expr), Cons(args, body)), nil
 }
 
+// docString - the documentation string that starts a function body of more than one expression, if there is
+// one, and the rest of the body
+func docString(body *List) (*String, *List) {
+	if s, ok := Car(body).(*String); ok && Cdr(body) != EmptyList {
+		return s, Cdr(body)
+	}
+	return nil, body
+}
+
+// (handler-case expr (kind (sym) body ...) ...)
+// only the expression and the clause bodies are expanded, the clause heads are left alone.
+func expandHandlerCase(expr Value) (Value, error) {
+	if ListLength(expr) < 2 {
+		return nil, NewError(SyntaxErrorKey, expr)
+	}
+	protected, err := macroexpandObject(Cadr(expr))
+	if err != nil {
+		return nil, err
+	}
+	var clauses []Value
+	for lst := Cddr(expr); lst != EmptyList; lst = Cdr(lst) {
+		clause := Car(lst)
+		if ListLength(clause) < 3 {
+			return nil, NewError(SyntaxErrorKey, expr)
+		}
+		body, err := expandSequence(Cddr(clause))
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, Cons(Car(clause), Cons(Cadr(clause), body)))
+	}
+	return Cons(Car(expr), Cons(protected, ListFromValues(clauses))), nil
+}
+
 func expandSetBang(expr Value) (Value, error) {
 	exprLen := ListLength(expr)
 	if exprLen != 3 {
@@ -289,12 +431,42 @@ func expandSetBang(expr Value) (Value, error) {
 	return NewList(Car(expr), Cadr(expr), val), nil
 }
 
+// expandCase - expand the key and the bodies of the clauses, but not the datums, which are not evaluated
+func expandCase(expr Value) (Value, error) {
+	if ListLength(expr) < 3 {
+		return nil, NewError(SyntaxErrorKey, expr)
+	}
+	key, err := macroexpandObject(Cadr(expr))
+	if err != nil {
+		return nil, err
+	}
+	result := NewList(Car(expr), key)
+	tail := result.Cdr
+	for clauses := Cddr(expr); clauses != EmptyList; clauses = Cdr(clauses) {
+		clause, ok := Car(clauses).(*List)
+		if !ok || clause == EmptyList {
+			return nil, NewError(SyntaxErrorKey, expr)
+		}
+		body, err := expandSequence(clause.Cdr)
+		if err != nil {
+			return nil, err
+		}
+		tail.Cdr = NewList(Cons(clause.Car, body))
+		tail = tail.Cdr
+	}
+	return result, nil
+}
+
 func expandPrimitive(fn Value, expr Value) (Value, error) {
 	switch fn {
 	case Intern("quote"):
 		return expr, nil
 	case Intern("do"):
 		return expandSequence(expr)
+	case Intern("catch"):
+		return expandSequence(expr)
+	case Intern("handler-case"):
+		return expandHandlerCase(expr)
 	case Intern("if"):
 		return expandIf(expr)
 	case Intern("def"):
@@ -309,77 +481,80 @@ func expandPrimitive(fn Value, expr Value) (Value, error) {
 		return expandFn(expr)
 	case Intern("set!"):
 		return expandSetBang(expr)
-	case Intern("lap"):
+	case Intern("case"):
+		return expandCase(expr)
+	case Intern("code"):
 		return expr, nil
 	case Intern("use"):
 		return expr, nil
+	case Intern("declare"):
+		return expr, nil
+	case Intern("named-let"), Intern("letrec*"):
+		return expr, nil //already expanded
 	default:
 		macro := GetMacro(fn)
 		if macro != nil {
 			tmp, err := macro.expand(expr)
 			return tmp, err
 		}
+		if sym, ok := fn.(*Symbol); ok && isMemberName(sym.Text) {
+			return expandMemberAccess(sym.Text[1:], expr)
+		}
 		return nil, nil
 	}
 }
 
-func crackLetrecBindings(bindings Value, tail *List) (*List, *List, bool) {
-	var names []Value
-	inits := EmptyList
-	for bindings != EmptyList {
-		if IsList(bindings) {
-			tmp := Car(bindings)
-			if lst, ok := tmp.(*List); ok {
-				name := lst.Car
-				if IsSymbol(name) {
-					names = append(names, name)
-				} else {
-					return nil, nil, false
-				}
-				if IsList(lst.Cdr) {
-					inits = Cons(Cons(Intern("set!"), lst), inits)
-				} else {
-					return nil, nil, false
-				}
-			} else {
-				return nil, nil, false
-			}
-
-		} else {
-			return nil, nil, false
-		}
-		bindings = Cdr(bindings)
+// isMemberName - true if the symbol is a member access, i.e. .Name
+func isMemberName(name string) bool {
+	if len(name) < 2 || name[0] != '.' {
+		return false
 	}
-	inits = Reverse(inits)
-	head := inits
-	for inits.Cdr != EmptyList {
-		inits = inits.Cdr
+	r, _ := utf8.DecodeRuneInString(name[1:])
+	return unicode.IsLetter(r)
+}
+
+// expandMemberAccess - (.Name obj args...) => (invoke obj "Name" args...)
+func expandMemberAccess(name string, expr Value) (Value, error) {
+	args := Cdr(expr)
+	if args == EmptyList {
+		return nil, NewError(SyntaxErrorKey, expr)
 	}
-	inits.Cdr = tail
-	return ListFromValues(names), head, true
+	return macroexpandObject(Cons(Intern("invoke"), Cons(args.Car, Cons(NewString(name), args.Cdr))))
 }
 
 func expandLetrec(expr Value) (Value, error) {
 	// (letrec () expr ...) -> (do expr ...)
-	// (letrec ((x 1) (y 2)) expr ...) -> ((fn (x y) (set! x 1) (set! y 2) expr ...) nil nil)
+	// (letrec ((x 1) (y 2)) expr ...) -> (letrec* ((x 1) (y 2)) expr ...), with the values and body expanded
 	body := Cddr(expr)
 	if body == EmptyList {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
-	bindings := Cadr(expr)
-	if !IsList(bindings) {
-		return nil, NewError(SyntaxErrorKey, expr)
-	}
-	names, body, ok := crackLetrecBindings(bindings, body)
+	bindings, ok := Cadr(expr).(*List)
 	if !ok {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
-	code, err := macroexpandList(Cons(Intern("fn"), Cons(names, body)))
+	if bindings == EmptyList {
+		return macroexpandList(Cons(Intern("do"), body))
+	}
+	var expanded []Value
+	for ; bindings != EmptyList; bindings = bindings.Cdr {
+		binding, ok := bindings.Car.(*List)
+		if !ok || ListLength(binding) != 2 || !IsSymbol(binding.Car) {
+			return nil, NewError(SyntaxErrorKey, expr)
+		}
+		val, err := macroexpandObject(Cadr(binding))
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, NewList(binding.Car, val))
+	}
+	//the body is expanded as that of a function, so that its own internal defines become a nested letrec
+	fn, err := macroexpandList(Cons(Intern("fn"), Cons(EmptyList, body)))
 	if err != nil {
 		return nil, err
 	}
-	values := MakeList(ListLength(names), Null)
-	return Cons(code, values), nil
+	//letrec* is left for the compiler, which initializes the variables in order in a frame of their own
+	return Cons(Intern("letrec*"), Cons(ListFromValues(expanded), Cddr(fn))), nil
 }
 
 func crackLetBindings(bindings Value) (*List, *List, bool) {
@@ -407,6 +582,173 @@ func crackLetBindings(bindings Value) (*List, *List, bool) {
 	return ListFromValues(names), ListFromValues(values), true
 }
 
+// isPattern - true if the target of a binding is a pattern to destructure its value with, rather than a symbol:
+// a list of targets, whose last may follow a . or & to get the rest of the list, or a struct of keys and the
+// targets of their values, as in (let (((a b . rest) lst) ({x: x y: y} point)) ...). Patterns may be nested.
+func isPattern(target Value) bool {
+	switch p := target.(type) {
+	case *List:
+		return p != EmptyList
+	case *Struct:
+		return p.Length() > 0
+	}
+	return false
+}
+
+func isRestMarker(val Value) bool {
+	return val == Intern(".") || val == Intern("&")
+}
+
+// destructure - the bindings of the variables of the pattern to accessor calls on the value of sym, by level.
+// The part of the value a nested pattern takes apart is bound to a gensym first, so the bindings of its own
+// variables go in the level after that, and each part is only accessed once.
+func destructure(pattern Value, sym Value, levels [][]Value, depth int) ([][]Value, error) {
+	var targets, accessors []Value
+	switch p := pattern.(type) {
+	case *List:
+		part := sym
+		for lst := p; lst != EmptyList; lst = lst.Cdr {
+			if isRestMarker(lst.Car) {
+				if lst.Cdr == EmptyList || lst.Cdr.Cdr != EmptyList {
+					return nil, NewError(SyntaxErrorKey, "Bad rest in destructuring pattern: ", pattern)
+				}
+				targets = append(targets, lst.Cdr.Car)
+				accessors = append(accessors, part)
+				break
+			}
+			targets = append(targets, lst.Car)
+			accessors = append(accessors, NewList(Intern("car"), part))
+			part = NewList(Intern("cdr"), part)
+		}
+	case *Struct:
+		for _, entry := range p.Entries() {
+			targets = append(targets, entry.Value)
+			if _, ok := entry.Key.(*Keyword); ok {
+				accessors = append(accessors, NewList(entry.Key, sym))
+			} else {
+				accessors = append(accessors, NewList(Intern("get"), sym, NewList(Intern("quote"), entry.Key)))
+			}
+		}
+	default:
+		return nil, NewError(SyntaxErrorKey, "Bad destructuring pattern: ", pattern)
+	}
+	if len(levels) == depth {
+		levels = append(levels, nil)
+	}
+	for i, target := range targets {
+		if isPattern(target) {
+			tmp := Gensym("part")
+			levels[depth] = append(levels[depth], NewList(tmp, accessors[i]))
+			var err error
+			levels, err = destructure(target, tmp, levels, depth+1)
+			if err != nil {
+				return nil, err
+			}
+		} else if IsSymbol(target) && !isRestMarker(target) {
+			levels[depth] = append(levels[depth], NewList(target, accessors[i]))
+		} else {
+			return nil, NewError(SyntaxErrorKey, "Bad destructuring pattern: ", pattern)
+		}
+	}
+	return levels, nil
+}
+
+// expandDestructuringLet - a let with patterns binds a gensym to the value of each, then the variables of the
+// patterns in nested lets, one for each level of nesting:
+//
+//	(let (((a b) lst) (c 3)) body...) -> (let ((tmp lst) (c 3)) (let ((a (car tmp)) (b (car (cdr tmp)))) body...))
+func expandDestructuringLet(expr Value) (Value, error) {
+	var outer []Value
+	var levels [][]Value
+	for bindings := Cadr(expr); bindings != EmptyList; bindings = Cdr(bindings) {
+		binding := Car(bindings)
+		if !IsList(binding) || ListLength(binding) != 2 || !isPattern(Car(binding)) {
+			outer = append(outer, binding)
+			continue
+		}
+		tmp := Gensym("val")
+		outer = append(outer, NewList(tmp, Cadr(binding)))
+		var err error
+		levels, err = destructure(Car(binding), tmp, levels, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	body := Cddr(expr)
+	for i := len(levels) - 1; i >= 0; i-- {
+		body = NewList(Cons(Intern("let"), Cons(ListFromValues(levels[i]), body)))
+	}
+	return macroexpandList(Cons(Intern("let"), Cons(ListFromValues(outer), body)))
+}
+
+func hasPatterns(bindings Value) bool {
+	for ; IsList(bindings) && bindings != EmptyList; bindings = Cdr(bindings) {
+		if IsList(Car(bindings)) && isPattern(Caar(bindings)) {
+			return true
+		}
+	}
+	return false
+}
+
+// destructuringDefBindings - the bindings of an internal (def pattern val), in the order the letrec of the
+// function body initializes them
+func destructuringDefBindings(def Value) ([]Value, error) {
+	if ListLength(def) != 3 {
+		return nil, NewError(SyntaxErrorKey, def)
+	}
+	val, err := macroexpandObject(Caddr(def))
+	if err != nil {
+		return nil, err
+	}
+	tmp := Gensym("val")
+	levels, err := destructure(Cadr(def), tmp, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	bindings := []Value{NewList(tmp, val)}
+	for _, level := range levels {
+		bindings = append(bindings, level...)
+	}
+	return bindings, nil
+}
+
+// expandDestructuringDef - (def pattern val) at top level defines a global for each variable of the pattern,
+// from a let that destructures the value, and returns the value:
+//
+//	(def (a b) lst) -> (let ((tmp lst)) (let (((a b) tmp)) (do (def a a) (def b b))) tmp)
+func expandDestructuringDef(expr Value) (Value, error) {
+	if ListLength(expr) != 3 {
+		return nil, NewError(SyntaxErrorKey, expr)
+	}
+	pattern := Cadr(expr)
+	defs := []Value{Intern("do")}
+	for _, name := range patternVariables(pattern, nil) {
+		defs = append(defs, NewList(Intern("def"), name, name))
+	}
+	tmp := Gensym("val")
+	inner := NewList(Intern("let"), NewList(NewList(pattern, tmp)), ListFromValues(defs))
+	return macroexpandList(NewList(Intern("let"), NewList(NewList(tmp, Caddr(expr))), inner, tmp))
+}
+
+// patternVariables - the variables a pattern binds, in order
+func patternVariables(pattern Value, vars []Value) []Value {
+	switch p := pattern.(type) {
+	case *List:
+		for ; p != EmptyList; p = p.Cdr {
+			if !isRestMarker(p.Car) {
+				vars = patternVariables(p.Car, vars)
+			}
+		}
+	case *Struct:
+		for _, entry := range p.Entries() {
+			vars = patternVariables(entry.Value, vars)
+		}
+	default:
+		vars = append(vars, pattern)
+	}
+	return vars
+}
+
 func expandLet(expr Value) (Value, error) {
 	// (let () expr ...) -> (do expr ...)
 	// (let ((x 1) (y 2)) expr ...) -> ((fn (x y) expr ...) 1 2)
@@ -419,6 +761,9 @@ func expandLet(expr Value) (Value, error) {
 	if !IsList(bindings) {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
+	if hasPatterns(bindings) {
+		return expandDestructuringLet(expr)
+	}
 	names, values, ok := crackLetBindings(bindings)
 	if !ok {
 		return nil, NewError(SyntaxErrorKey, expr)
@@ -445,10 +790,111 @@ func expandNamedLet(expr Value) (Value, error) {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
 	body := Cdddr(expr)
-	tmp := NewList(Intern("letrec"), NewList(NewList(name, Cons(Intern("fn"), Cons(names, body)))), Cons(name, values))
+	fn, err := macroexpandList(Cons(Intern("fn"), Cons(names, body)))
+	if err != nil {
+		return nil, err
+	}
+	if !ListContains(names, name) && isLoopBody(name, ListLength(names), Cddr(fn), true) {
+		//(named-let name ((sym val) ...) expr ...) is left for the compiler, which turns the calls of name into jumps
+		var loopBindings []Value
+		for ; names != EmptyList; names, values = names.Cdr, values.Cdr {
+			loopBindings = append(loopBindings, NewList(names.Car, values.Car))
+		}
+		return Cons(Intern("named-let"), Cons(name, Cons(ListFromValues(loopBindings), Cddr(fn)))), nil
+	}
+	tmp := NewList(Intern("letrec"), NewList(NewList(name, fn)), Cons(name, values))
 	return macroexpandList(tmp)
 }
 
+// isLoopBody - true if a named let can be compiled as a loop that assigns its variables in place: the name is
+// only used for calls in tail position of the body with the right number of arguments, and the body creates no
+// function that could outlive an iteration, only those that are called immediately, as let expands to.
+func isLoopBody(name Value, argc int, body *List, isTail bool) bool {
+	for ; body != EmptyList; body = body.Cdr {
+		if !isLoopExpr(name, argc, body.Car, isTail && body.Cdr == EmptyList) {
+			return false
+		}
+	}
+	return true
+}
+
+func isLoopExpr(name Value, argc int, expr Value, isTail bool) bool {
+	switch p := expr.(type) {
+	case *List:
+		if p == EmptyList {
+			return true
+		}
+		switch p.Car {
+		case Intern("quote"):
+			return true
+		case Intern("if"):
+			if !isLoopExpr(name, argc, Cadr(p), false) {
+				return false
+			}
+			for branches := Cddr(p); branches != EmptyList; branches = Cdr(branches) {
+				if !isLoopExpr(name, argc, Car(branches), isTail) {
+					return false
+				}
+			}
+			return true
+		case Intern("do"), Intern("and"), Intern("or"):
+			return isLoopBody(name, argc, p.Cdr, isTail)
+		case Intern("when"), Intern("unless"):
+			return isLoopExpr(name, argc, Cadr(p), false) && isLoopBody(name, argc, Cddr(p), isTail)
+		case Intern("case"):
+			if !isLoopExpr(name, argc, Cadr(p), false) {
+				return false
+			}
+			for clauses := Cddr(p); clauses != EmptyList; clauses = Cdr(clauses) {
+				if !isLoopBody(name, argc, Cdr(Car(clauses)), isTail) {
+					return false
+				}
+			}
+			return true
+		case Intern("set!"):
+			return Cadr(p) != name && isLoopExpr(name, argc, Caddr(p), false)
+		case Intern("catch"):
+			return isLoopBody(name, argc, p.Cdr, false)
+		case Intern("named-let"):
+			//a nested loop, whose body was checked when it was expanded. Its init expressions are in the outer
+			//scope, but a binding or loop of the same name shadows the name in its body.
+			shadowed := Cadr(p) == name
+			for bindings := Caddr(p); bindings != EmptyList; bindings = Cdr(bindings) {
+				if Caar(bindings) == name {
+					shadowed = true
+				}
+				if !isLoopExpr(name, argc, Cadar(bindings), false) {
+					return false
+				}
+			}
+			return shadowed || isLoopBody(name, argc, Cdddr(p), false)
+		case Intern("fn"), Intern("letrec*"), Intern("def"), Intern("undef"), Intern("defmacro"), Intern("code"), Intern("use"), Intern("handler-case"), Intern("declare"):
+			return false
+		case name:
+			return isTail && ListLength(p.Cdr) == argc && isLoopBody(name, argc, p.Cdr, false)
+		}
+		if fn, ok := p.Car.(*List); ok && fn != EmptyList && fn.Car == Intern("fn") {
+			return isLoopBody(name, argc, Cddr(fn), false) && isLoopBody(name, argc, p.Cdr, false)
+		}
+		return isLoopBody(name, argc, p, false)
+	case *Vector:
+		for _, el := range p.Elements {
+			if !isLoopExpr(name, argc, el, false) {
+				return false
+			}
+		}
+		return true
+	case *Struct:
+		for _, e := range p.Entries() {
+			if !isLoopExpr(name, argc, e.Key, false) || !isLoopExpr(name, argc, e.Value, false) {
+				return false
+			}
+		}
+		return true
+	}
+	return expr != name
+}
+
 func nextCondClause(expr Value, clauses Value, count int) (Value, error) {
 	var result Value
 	var err error
@@ -532,10 +978,28 @@ func expandQuasiquote(expr Value) (Value, error) {
 	if ListLength(expr) != 2 {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
-	return expandQQ(Cadr(expr))
+	return expandQQ(Cadr(expr), 1, make(map[*Symbol]*Symbol))
+}
+
+// autoGensym - the symbol to use for one in a quasiquote template. A name ending in '#', like tmp#, is replaced
+// with a gensym, the same one for every occurrence in the template.
+func autoGensym(sym *Symbol, gensyms map[*Symbol]*Symbol) *Symbol {
+	n := len(sym.Text)
+	if n < 2 || sym.Text[n-1] != '#' {
+		return sym
+	}
+	g, ok := gensyms[sym]
+	if !ok {
+		g = Gensym(sym.Text[:n-1])
+		gensyms[sym] = g
+	}
+	return g
 }
 
-func expandQQ(expr Value) (Value, error) {
+// expandQQ - expand a quasiquote template. The depth is the number of quasiquotes the expression is nested in:
+// an unquote is only evaluated at depth 1, deeper ones are kept in the result like any other list, with the
+// depth reduced for the expression they contain, as in Scheme.
+func expandQQ(expr Value, depth int, gensyms map[*Symbol]*Symbol) (Value, error) {
 	switch p := expr.(type) {
 	case *List:
 		if p == EmptyList {
@@ -546,34 +1010,49 @@ func expandQQ(expr Value) (Value, error) {
 				if p.Cdr.Cdr != EmptyList {
 					return nil, NewError(SyntaxErrorKey, expr)
 				}
-				return macroexpandObject(p.Cdr.Car)
+				if depth == 1 {
+					return macroexpandObject(p.Cdr.Car)
+				}
+				return expandQQForm(UnquoteSymbol, p.Cdr.Car, depth-1, gensyms)
 			} else if p.Car == UnquoteSymbolSplicing {
-				return nil, NewError(MacroErrorKey, "unquote-splicing can only occur in the context of a list ")
+				if depth == 1 {
+					return nil, NewError(MacroErrorKey, "unquote-splicing can only occur in the context of a list ")
+				}
+				return expandQQForm(UnquoteSymbolSplicing, p.Cdr.Car, depth-1, gensyms)
+			} else if p.Car == QuasiquoteSymbol && p.Cdr.Cdr == EmptyList {
+				return expandQQForm(QuasiquoteSymbol, p.Cdr.Car, depth+1, gensyms)
 			}
 		}
-		tmp, err := expandQQList(p)
+		tmp, err := expandQQList(p, depth, gensyms)
 		if err != nil {
 			return nil, err
 		}
 		return macroexpandObject(tmp)
 	case *Symbol:
-		return NewList(Intern("quote"), expr), nil
+		return NewList(Intern("quote"), autoGensym(p, gensyms)), nil
 	default: //all other objects evaluate to themselves
 		return expr, nil
 	}
 }
 
-func expandQQList(lst *List) (*List, error) {
+// expandQQForm - the expansion of a nested (quasiquote x), (unquote x), or (unquote-splicing x) in a template,
+// which builds the same form around the expansion of x
+func expandQQForm(op Value, expr Value, depth int, gensyms map[*Symbol]*Symbol) (Value, error) {
+	tmp, err := expandQQ(expr, depth, gensyms)
+	if err != nil {
+		return nil, err
+	}
+	return NewList(Intern("list"), NewList(Intern("quote"), op), tmp), nil
+}
+
+func expandQQList(lst *List, depth int, gensyms map[*Symbol]*Symbol) (*List, error) {
 	var tmp Value
 	var err error
 	result := NewList(Intern("concat"))
 	tail := result
 	for lst != EmptyList {
 		if item, ok := Car(lst).(*List); ok && item != EmptyList {
-			if item.Car == QuasiquoteSymbol {
-				return nil, NewError(MacroErrorKey, "nested quasiquote not supported")
-			}
-			if item.Car == UnquoteSymbol && item.Length() == 2 {
+			if depth == 1 && item.Car == UnquoteSymbol && item.Length() == 2 {
 				tmp, err = macroexpandObject(Cadr(item))
 				tmp = NewList(Intern("list"), tmp)
 				if err != nil {
@@ -581,15 +1060,29 @@ func expandQQList(lst *List) (*List, error) {
 				}
 				tail.Cdr = NewList(tmp)
 				tail = tail.Cdr
-			} else if item.Car == UnquoteSymbolSplicing && item.Length() == 2 {
+			} else if depth == 1 && item.Car == UnquoteSymbolSplicing && item.Length() == 2 {
 				tmp, err = macroexpandObject(Cadr(item))
 				if err != nil {
 					return nil, err
 				}
 				tail.Cdr = NewList(tmp)
 				tail = tail.Cdr
+			} else if (item.Car == UnquoteSymbol || item.Car == UnquoteSymbolSplicing) && item.Length() == 2 {
+				tmp, err = expandQQForm(item.Car, Cadr(item), depth-1, gensyms)
+				if err != nil {
+					return nil, err
+				}
+				tail.Cdr = NewList(NewList(Intern("list"), tmp))
+				tail = tail.Cdr
+			} else if item.Car == QuasiquoteSymbol && item.Length() == 2 {
+				tmp, err = expandQQForm(QuasiquoteSymbol, Cadr(item), depth+1, gensyms)
+				if err != nil {
+					return nil, err
+				}
+				tail.Cdr = NewList(NewList(Intern("list"), tmp))
+				tail = tail.Cdr
 			} else {
-				tmp, err = expandQQList(item)
+				tmp, err = expandQQList(item, depth, gensyms)
 				if err != nil {
 					return nil, err
 				}
@@ -597,7 +1090,11 @@ func expandQQList(lst *List) (*List, error) {
 				tail = tail.Cdr
 			}
 		} else {
-			tail.Cdr = NewList(NewList(Intern("quote"), NewList(Car(lst))))
+			item := Car(lst)
+			if sym, ok := item.(*Symbol); ok {
+				item = autoGensym(sym, gensyms)
+			}
+			tail.Cdr = NewList(NewList(Intern("quote"), NewList(item)))
 			tail = tail.Cdr
 		}
 		lst = lst.Cdr
@@ -17,13 +17,17 @@ limitations under the License.
 package ell
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"runtime/pprof"
 	"strings"
+	"sync"
 
-	"github.com/boynton/cli"
 	. "github.com/boynton/ell/data"
 )
 
@@ -38,13 +42,17 @@ func SetFlags(o bool, v bool, d bool, t bool, i bool) {
 	debug = d
 	trace = t
 	interactive = i
+	if v || d || t {
+		SetLogLevel(LogDebug) //their output is logged at the debug level
+	}
+	if v {
+		CountAllocations() //to show what each expression allocates
+	}
 }
 
 // Version - this version of ell
 var Version = "(development version)"
 
-var constantsMap = make(map[Value]int, 0)
-var constants = make([]Value, 0, 1000)
 var macroMap = make(map[Value]*macro, 0)
 var primitives = make([]*Primitive, 0, 1000)
 
@@ -61,7 +69,7 @@ func DefineGlobal(name string, obj Value) {
 func definePrimitive(name string, prim *Function) {
 	sym := Intern(name)
 	if GetGlobal(sym) != nil {
-		println("*** Warning: redefining ", name, " with a primitive")
+		logMessage(LogWarn, "redefining ", name, " with a primitive")
 	}
 	if p, ok := sym.(*Symbol); ok {
 		defGlobal(p, prim)
@@ -94,11 +102,22 @@ func DefineFunctionKeyArgs(name string, fun PrimitiveFunction, result Value, arg
 	definePrimitive(name, prim)
 }
 
+// defineCallback - make the primitive defined as the name, with a nil function, call fun with the VM that calls
+// it. It is for primitives that call the functions they are passed, with CallFunction. Go code that calls the
+// primitive's function directly runs them on a VM of its own.
+func defineCallback(name string, fun vmPrimitiveFunction) {
+	prim := GetGlobal(Intern(name)).(*Function).primitive
+	prim.vmfun = fun
+	prim.fun = func(argv []Value) (Value, error) {
+		return fun(VM(defaultStackSize), argv)
+	}
+}
+
 // Register a primitive macro with the specified name.
 func DefineMacro(name string, fun PrimitiveFunction) {
 	sym := Intern(name)
 	if GetMacro(sym) != nil {
-		println("*** Warning: redefining macro ", name, " -> ", GetMacro(sym))
+		logMessage(LogWarn, "redefining macro ", name, " -> ", GetMacro(sym))
 	}
 	prim := NewPrimitive(name, fun, AnyType, []Value{AnyType}, nil, nil, nil)
 	defMacro(sym, prim)
@@ -118,6 +137,7 @@ func GetKeywords() []Value {
 		Intern("set!"),
 		Intern("code"),
 		Intern("use"),
+		Intern("declare"),
 	}
 	return keywords
 }
@@ -177,20 +197,17 @@ func defMacro(sym Value, val *Function) {
 	macroMap[sym] = NewMacro(sym, val)
 }
 
-// note: unlike java, we cannot use maps or arrays as keys (they are not comparable).
-// so, we will end up with duplicates, unless we do some deep compare, when putting map or array constants
-func putConstant(val Value) int {
-	idx, present := constantsMap[val]
-	if !present {
-		idx = len(constants)
-		constants = append(constants, val)
-		constantsMap[val] = idx
+// Use - load the named module, if it has not already been loaded, and import the names it exports into the
+// current module. The options are keyword/value pairs: only:, rename:, and prefix:, as for the use form.
+func Use(sym *Symbol, options ...Value) error {
+	if verbose {
+		logMessage(LogDebug, "using ", sym.Text)
 	}
-	return idx
-}
-
-func Use(sym *Symbol) error {
-	return Load(sym.Text)
+	mod, err := findModule(sym.Text)
+	if err != nil {
+		return err
+	}
+	return currentModule.importFrom(mod, options)
 }
 
 func importCode(thunk *Code) (Value, error) {
@@ -204,15 +221,61 @@ func importCode(thunk *Code) (Value, error) {
 
 var loadPathSymbol = Intern("*load-path*")
 
+// LoadPath - the directories searched for modules, in order. They are the value of the *load-path* global, a
+// list of strings that Ell code can change. Initially, it comes from the ELL_PATH environment variable.
+func LoadPath() []string {
+	var dirs []string
+	switch p := GetGlobal(loadPathSymbol).(type) {
+	case *String:
+		dirs = strings.Split(p.Value, ":")
+	case *List:
+		for ; p != EmptyList; p = p.Cdr {
+			if s, ok := p.Car.(*String); ok {
+				dirs = append(dirs, s.Value)
+			}
+		}
+	case *Vector:
+		for _, el := range p.Elements {
+			if s, ok := el.(*String); ok {
+				dirs = append(dirs, s.Value)
+			}
+		}
+	}
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	return dirs
+}
+
+// SetLoadPath - set the directories searched for modules
+func SetLoadPath(dirs ...string) {
+	values := make([]Value, 0, len(dirs))
+	for _, dir := range dirs {
+		values = append(values, NewString(dir))
+	}
+	DefineGlobal(StringValue(loadPathSymbol), ListFromValues(values))
+}
+
+// loadingFile - the file being loaded, if any. Modules are searched for in its directory before the load path.
+var loadingFile string
+
+// loadStack - the absolute paths of the files being loaded, innermost last, so that a file that loads itself is
+// an error rather than a loop
+var loadStack []string
+
+func searchPath() []string {
+	dirs := LoadPath()
+	if loadingFile != "" {
+		dirs = append([]string{filepath.Dir(loadingFile)}, dirs...)
+	}
+	return dirs
+}
+
 func FindModuleByName(moduleName string) (string, error) {
 	if moduleName == "ell" || moduleName == "ell.ell" {
 		return "@/ell.ell", nil
 	}
-	loadPath := GetGlobal(loadPathSymbol)
-	if loadPath == nil {
-		loadPath = NewString(".")
-	}
-	path := strings.Split(StringValue(loadPath), ":")
+	path := searchPath()
 	name := moduleName
 	var lname string
 	if strings.HasSuffix(name, ".ell") {
@@ -222,11 +285,11 @@ func FindModuleByName(moduleName string) (string, error) {
 		name = name + ".ell"
 	}
 	for _, dirname := range path {
-		filename := filepath.Join(dirname, lname)
-		if IsFileReadable(filename) {
-			return filename, nil
+		lfilename := filepath.Join(dirname, lname)
+		filename := filepath.Join(dirname, name)
+		if IsFileReadable(lfilename) && !isNewer(filename, lfilename) {
+			return lfilename, nil
 		}
-		filename = filepath.Join(dirname, name)
 		if IsFileReadable(filename) {
 			return filename, nil
 		}
@@ -236,60 +299,302 @@ func FindModuleByName(moduleName string) (string, error) {
 
 func Load(name string) error {
 	if verbose {
-		fmt.Println("; [loading " + name + "]")
+		logMessage(LogDebug, "loading ", name)
 	}
 	file, err := FindModuleFile(name)
 	if err != nil {
 		return err
 	}
+	if path := sourceFile(file); path != "" && moduleUses != nil {
+		*moduleUses = append(*moduleUses, path) //a module that loads a file depends on it, as on one it uses
+	}
 	return LoadFile(file)
 }
 
+// isNewer - true if file1 exists and was modified after file2
+func isNewer(file1 string, file2 string) bool {
+	info1, err := os.Stat(file1)
+	if err != nil {
+		return false
+	}
+	info2, err := os.Stat(file2)
+	if err != nil {
+		return true
+	}
+	return info1.ModTime().After(info2.ModTime())
+}
+
+// cacheModules - cache the compiled code of modules loaded from source, as --cache does
+var cacheModules bool
+
+// moduleUses - the source files of the modules the module being loaded uses, and of the files it loads
+var moduleUses *[]string
+
+func noteModuleUse(mod *module) {
+	if moduleUses != nil {
+		*moduleUses = append(*moduleUses, mod.files...)
+	}
+}
+
+// sourceFile - the absolute path of the file, as a dependency of the code compiled from it, or "" if it is in
+// the library, which is part of the runtime
+func sourceFile(file string) string {
+	if strings.HasPrefix(file, "@/") {
+		return ""
+	}
+	path, err := filepath.Abs(ExpandFilePath(file))
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// fileSum - a digest of the contents of the file, or "" if it cannot be read
+func fileSum(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+var runtimeSumOnce sync.Once
+var runtimeSumValue string
+
+// runtimeSum - a digest of the running executable, which holds the compiler, the runtime, and the library, so
+// code compiled by another build of ell is not reused. It is "" if the executable cannot be read.
+func runtimeSum() string {
+	runtimeSumOnce.Do(func() {
+		if exe, err := os.Executable(); err == nil {
+			runtimeSumValue = fileSum(exe)
+		}
+	})
+	return runtimeSumValue
+}
+
+// moduleCache - the file the compiled code of a module's source file is cached in, and the header line
+// that identifies the runtime and the source it was compiled from. The file is "" if it cannot be cached.
+// The header is followed by a line for each module the code used, with the digest of its source then, as
+// a macro it used may have changed since.
+func moduleCache(file string) (string, string) {
+	if !cacheModules || !strings.HasSuffix(file, ".ell") || strings.HasPrefix(file, "@/") {
+		return "", ""
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", ""
+	}
+	path, err := filepath.Abs(ExpandFilePath(file))
+	if err != nil {
+		return "", ""
+	}
+	source, exe := fileSum(path), runtimeSum()
+	if source == "" || exe == "" {
+		return "", ""
+	}
+	sum := sha1.Sum([]byte(path))
+	cache := filepath.Join(dir, "ell", hex.EncodeToString(sum[:])+".lvm")
+	header := fmt.Sprintf("; ell %s %s, compiled from %s %s\n", Version, exe, path, source)
+	return cache, header
+}
+
+const moduleUsePrefix = "; uses "
+
+// usesUnchanged - true if the sources of the modules listed after the header of the cached code are the same
+func usesUnchanged(data []byte) bool {
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, moduleUsePrefix) {
+			return true
+		}
+		use := strings.TrimPrefix(line, moduleUsePrefix)
+		i := strings.LastIndex(use, " ")
+		if i < 0 || fileSum(use[:i]) != use[i+1:] {
+			return false
+		}
+	}
+	return true
+}
+
+// loadModule - load the module file, and return the source files its code depends on: the file itself, if it
+// is not in the library, and those of the modules it uses. With --cache, a source file is loaded from the
+// compiled code cached by an earlier load, if neither the runtime, the source, nor the modules it uses have
+// changed since. Otherwise it is compiled and run as usual, and the result is cached for next time.
+func loadModule(file string) ([]string, error) {
+	prev := loadingFile
+	loadingFile = file
+	defer func() { loadingFile = prev }()
+	var uses []string
+	prevUses := moduleUses
+	moduleUses = &uses
+	defer func() { moduleUses = prevUses }()
+	var files []string
+	if path := sourceFile(file); path != "" {
+		files = append(files, path)
+	}
+	cache, header := moduleCache(file)
+	if cache == "" {
+		err := LoadFile(file)
+		return append(files, uses...), err
+	}
+	if data, err := ioutil.ReadFile(cache); err == nil && bytes.HasPrefix(data, []byte(header)) && usesUnchanged(data[len(header):]) {
+		if thunks, err := loadCodeForms(data); err == nil {
+			if verbose {
+				logMessage(LogDebug, "loadFile: ", file, " (cached in ", cache, ")")
+			}
+			//each form is run separately, as when loading the source, so a continuation captured by one
+			//does not include the rest of the module
+			for _, thunk := range thunks {
+				_, err = importCode(thunk)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return append(files, uses...), nil
+		}
+	}
+	var compiled bytes.Buffer
+	err := loadFile(file, &compiled)
+	if err != nil {
+		return nil, err
+	}
+	//the cache is only an optimization, so failing to write it is not an error
+	if os.MkdirAll(filepath.Dir(cache), 0755) == nil {
+		var buf bytes.Buffer
+		buf.WriteString(header)
+		written := map[string]bool{}
+		for _, use := range uses {
+			if !written[use] {
+				written[use] = true
+				buf.WriteString(moduleUsePrefix + use + " " + fileSum(use) + "\n")
+			}
+		}
+		buf.Write(compiled.Bytes())
+		ioutil.WriteFile(cache, buf.Bytes(), 0644)
+	}
+	return append(files, uses...), nil
+}
+
 func LoadFile(file string) error {
+	return loadFile(file, nil)
+}
+
+// loadFile - load the file, writing the compiled code of each top level form to the buffer, if there is one
+func loadFile(file string, compiled *bytes.Buffer) error {
 	if verbose {
-		println("; loadFile: " + file)
+		logMessage(LogDebug, "loadFile: ", file)
 	} else if interactive {
 		println("[loading " + file + "]")
 	}
+	path, err := filepath.Abs(ExpandFilePath(file))
+	if err != nil {
+		return ioError(err)
+	}
+	for _, f := range loadStack {
+		if f == path {
+			return NewError(ErrorKey, "Recursive load of ", file)
+		}
+	}
 	fileText, err := SlurpFile(file)
 	if err != nil {
 		return err
 	}
-	exprs, err := ReadAllFromString(fileText)
+	loadStack = append(loadStack, path)
+	prev := loadingFile
+	loadingFile = file
+	defer func() {
+		loadingFile = prev
+		loadStack = loadStack[:len(loadStack)-1]
+	}()
+	exprs, lines, locations, err := readAllWithLines(file, fileText)
 	if err != nil {
 		return err
 	}
-	for exprs != EmptyList {
-		expr := Car(exprs)
-		_, err = Eval(expr)
+	prevLocations := sourceLocations
+	sourceLocations = locations
+	defer func() { sourceLocations = prevLocations }()
+	currentModule.declareAll(exprs)
+	for i, expr := range exprs {
+		code, err := compileSource(expr, fmt.Sprintf("%s:%d", file, lines[i]))
+		if err != nil {
+			return err
+		}
+		_, err = importCode(code)
 		if err != nil {
 			return err
 		}
-		exprs = Cdr(exprs)
+		if compiled != nil {
+			b, err := WriteCode(code)
+			if err != nil {
+				return err
+			}
+			compiled.Write(b)
+		}
 	}
 	return nil
 }
 
+// LoadPort - read the forms of the input port one at a time, evaluating each before reading the next, until the
+// end of its input
+func LoadPort(port *Port) error {
+	reader := port.reader
+	prev := reader.Incremental
+	reader.Incremental = true
+	defer func() { reader.Incremental = prev }()
+	for {
+		expr, err := reader.ReadValue()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return readError(reader, err)
+		}
+		source := ""
+		if port.name != "" {
+			source = fmt.Sprintf("%s:%d", port.name, reader.StartLine())
+		}
+		if _, err := evalSource(expr, source); err != nil {
+			return err
+		}
+	}
+}
+
 func Eval(expr Value) (Value, error) {
+	return evalSource(expr, "")
+}
+
+// evalSource - evaluate the expression, which was read from the given file:line location
+func evalSource(expr Value, source string) (Value, error) {
+	code, err := compileSource(expr, source)
+	if err != nil {
+		return nil, err
+	}
+	return importCode(code)
+}
+
+// compileSource - compile the expression, which was read from the given file:line location
+func compileSource(expr Value, source string) (*Code, error) {
 	if debug {
-		println("; eval: ", Write(expr))
+		logMessage(LogDebug, "eval: ", Write(expr))
 	}
 	expanded, err := macroexpandObject(expr)
 	if err != nil {
 		return nil, err
 	}
 	if debug {
-		println("; expanded to: ", Write(expanded))
+		logMessage(LogDebug, "expanded to: ", Write(expanded))
 	}
 	code, err := Compile(expanded)
 	if err != nil {
 		return nil, err
 	}
+	if source != "" {
+		code.setSource(source)
+	}
 	if debug {
-		val := strings.Replace(Write(code), "\n", "\n; ", -1)
-		println("; compiled to:\n;  ", val)
+		logMessage(LogDebug, "compiled to:\n", Write(code))
 	}
-	return importCode(code)
+	return code, nil
 }
 
 func FindModuleFile(name string) (string, error) {
@@ -301,61 +606,57 @@ func FindModuleFile(name string) (string, error) {
 		}
 		return file, nil
 	}
+	if loadingFile != "" && !filepath.IsAbs(name) && !strings.HasPrefix(name, "~/") && !strings.HasPrefix(name, "@/") {
+		//relative to the file being loaded, if it is there
+		relative := filepath.Join(filepath.Dir(loadingFile), name)
+		if IsFileReadable(relative) {
+			return relative, nil
+		}
+	}
 	if !IsFileReadable(name) {
 		return "", NewError(IOErrorKey, "Cannot read file: ", name)
 	}
 	return name, nil
 }
 
-func compileValue(expr Value) (string, error) {
-	if debug {
-		println("; compile: ", Write(expr))
-	}
-	expanded, err := macroexpandObject(expr)
-	if err != nil {
-		return "", err
-	}
-	if debug {
-		println("; expanded to: ", Write(expanded))
-	}
-	thunk, err := Compile(expanded)
-	if err != nil {
-		return "", err
-	}
-	if debug {
-		println("; compiled to: ", Write(thunk))
-	}
-	return thunk.decompile(true) + "\n", nil
-}
-
-// caveats: when you compile a file, you actually run it. This is so we can handle imports and macros correctly.
+// CompileFile - the compiled code of the file, in the textual form read by LoadCode. Each form is evaluated after
+// it is compiled, as when the file is loaded, so the macros, functions, and modules it defines or uses are there
+// for the forms after it.
 func CompileFile(name string) (Value, error) {
 	file, err := FindModuleFile(name)
 	if err != nil {
 		return nil, err
 	}
 	if verbose {
-		println("; loadFile: " + file)
+		logMessage(LogDebug, "loadFile: ", file)
 	}
 	fileText, err := SlurpFile(file)
 	if err != nil {
 		return nil, err
 	}
 
-	exprs, err := ReadAllFromString(fileText)
+	exprs, lines, locations, err := readAllWithLines(file, fileText)
 	if err != nil {
 		return nil, err
 	}
+	prevLocations := sourceLocations
+	sourceLocations = locations
+	defer func() { sourceLocations = prevLocations }()
+	//compile it in the namespace of the module, as use would load it
+	prev := currentModule
+	currentModule = newModule(moduleName(file))
+	defer func() { currentModule = prev }()
+	currentModule.declareAll(exprs)
 	result := ";\n; code generated from " + file + "\n;\n"
-	var lvm string
-	for exprs != EmptyList {
-		expr := Car(exprs)
-		lvm, err = compileValue(expr)
+	for i, expr := range exprs {
+		code, err := compileSource(expr, fmt.Sprintf("%s:%d", file, lines[i]))
 		if err != nil {
 			return nil, err
 		}
-		result += lvm
-		exprs = Cdr(exprs)
+		if _, err = importCode(code); err != nil {
+			return nil, err
+		}
+		result += code.decompile(true, true) + "\n"
 	}
 	return NewString(result), nil
 }
@@ -368,13 +669,9 @@ type Extension interface {
 
 var extensions []Extension
 
+// AddEllDirectory - add the directory to the front of the load path
 func AddEllDirectory(dirname string) {
-	loadPath := dirname
-	tmp := GetGlobal(loadPathSymbol)
-	if tmp != nil {
-		loadPath = dirname + ":" + StringValue(tmp)
-	}
-	DefineGlobal(StringValue(loadPathSymbol), NewString(loadPath))
+	SetLoadPath(append([]string{dirname}, LoadPath()...)...)
 }
 
 func Init(extns ...Extension) {
@@ -390,7 +687,7 @@ func Init(extns ...Extension) {
 		}
 	}
 	loadPath += ":@/"
-	DefineGlobal(StringValue(loadPathSymbol), NewString(loadPath))
+	SetLoadPath(strings.Split(loadPath, ":")...)
 	InitPrimitives()
 	for _, ext := range extensions {
 		err := ext.Init()
@@ -398,6 +695,7 @@ func Init(extns ...Extension) {
 			Fatal("*** ", err)
 		}
 	}
+	initialized = true
 }
 
 func Cleanup() {
@@ -410,83 +708,7 @@ func Run(args ...string) {
 	for _, filename := range args {
 		err := Load(filename)
 		if err != nil {
-			Fatal("*** ", err.Error())
+			Fatal("*** ", err.Error(), formatStackTrace(err))
 		}
 	}
 }
-
-func Main(extns ...Extension) {
-	var help, compile, optimize, verbose, debug, trace, noInit bool
-	var path string
-	cmd := cli.New("ell", "The Ell Language compiler, VM, and runtime")
-	cmd.BoolOption(&help, "help", false, "Show help")
-	cmd.BoolOption(&compile, "compile", false, "compile the file and output lap")
-	cmd.BoolOption(&optimize, "optimize", false, "optimize execution speed, should work for correct code, relax some checks")
-	cmd.BoolOption(&verbose, "verbose", false, "verbose mode, print extra information")
-	cmd.BoolOption(&debug, "debug", false, "debug mode, print extra information about compilation")
-	cmd.BoolOption(&trace, "trace", false, "trace VM instructions as they get executed")
-	cmd.BoolOption(&noInit, "noinit", false, "disable initialization from the $HOME/.ell file")
-	var prof string
-	cmd.StringOption(&prof, "profile", "", "profile the code to the specified file")
-	cmd.StringOption(&path, "path", "", "add directories to ell load path")
-	args, _ := cmd.Parse()
-	if help {
-		fmt.Println(cmd.Usage())
-		os.Exit(1)
-	}
-	interactive := len(args) == 0
-	SetFlags(optimize, verbose, debug, trace, interactive)
-	Init(extns...)
-	if path != "" {
-		for _, p := range strings.Split(path, ":") {
-			expandedPath := ExpandFilePath(p)
-			if IsDirectoryReadable(expandedPath) {
-				AddEllDirectory(expandedPath)
-				if debug {
-					Println("[added directory to path: '", expandedPath, "']")
-				}
-			} else if debug {
-				Println("[directory not readable, cannot add to path: '", expandedPath, "']")
-			}
-		}
-	}
-	if len(args) > 0 {
-		if compile {
-			SetFlags(optimize, verbose, debug, trace, interactive)
-			//just compile and print LVM code
-			for _, filename := range args {
-				lap, err := CompileFile(filename)
-				if err != nil {
-					Fatal("*** ", err)
-				}
-				Println(lap)
-			}
-		} else {
-			if prof != "" {
-				f, err := os.Create(prof)
-				if err != nil {
-					Fatal("*** ", err)
-				}
-				pprof.StartCPUProfile(f)
-				defer pprof.StopCPUProfile()
-			}
-			SetFlags(optimize, verbose, debug, trace, interactive)
-			Run(args...)
-		}
-	} else {
-		if !noInit {
-			home := os.Getenv("HOME")
-			ellini := filepath.Join(home, ".ell")
-			_, err := os.Stat(ellini)
-			if err == nil {
-				err := Load(ellini)
-				if err != nil {
-					Fatal("*** ", err)
-				}
-			}
-		}
-		SetFlags(optimize, verbose, debug, trace, interactive)
-		ReadEvalPrintLoop()
-	}
-	Cleanup()
-}
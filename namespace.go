@@ -0,0 +1,307 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"path/filepath"
+	"strings"
+
+	. "github.com/boynton/ell/data"
+)
+
+// module - the namespace of a module loaded by use. The globals a module defines are qualified by its name,
+// so (def x 1) in module foo defines foo:x, and the names it imports are aliases for the qualified globals
+// of other modules. Macros are not qualified: they are global, as is everything defined at the top level.
+type module struct {
+	name     string              //"" for the top level, whose globals are not qualified
+	exports  []*Symbol           //the names exported, or nil if everything the module defines is exported
+	declared map[*Symbol]bool    //the names the module defines, including those not defined yet
+	imports  map[*Symbol]*Symbol //the qualified globals imported from other modules, by local name
+	files    []string            //the source files of the module and of the modules it uses, which its code depends on
+}
+
+func newModule(name string) *module {
+	return &module{
+		name:     name,
+		declared: make(map[*Symbol]bool),
+		imports:  make(map[*Symbol]*Symbol),
+	}
+}
+
+// topModule - the namespace of the repl, the main program, and the files they load
+var topModule = newModule("")
+
+// currentModule - the module being loaded, whose namespace the compiler resolves global names in
+var currentModule = topModule
+
+var modules = make(map[string]*module)
+
+var onlyKeyword = Intern("only:")
+var renameKeyword = Intern("rename:")
+var prefixKeyword = Intern("prefix:")
+
+func isQualified(sym *Symbol) bool {
+	return strings.Contains(sym.Text, ":")
+}
+
+func (mod *module) qualify(sym *Symbol) *Symbol {
+	if mod.name == "" || isQualified(sym) {
+		return sym
+	}
+	return Intern(mod.name + ":" + sym.Text).(*Symbol)
+}
+
+// define - the global bound by a definition of the name in this module. A definition hides an import
+// of the same name.
+func (mod *module) define(sym *Symbol) *Symbol {
+	delete(mod.imports, sym)
+	if mod.name == "" || isQualified(sym) {
+		return sym
+	}
+	mod.declared[sym] = true
+	return mod.qualify(sym)
+}
+
+// resolve - the global referred to by the name in this module: an import, a definition of the module, or
+// else the unqualified global
+func (mod *module) resolve(sym *Symbol) *Symbol {
+	if q, ok := mod.imports[sym]; ok {
+		return q
+	}
+	if mod.declared[sym] {
+		return mod.qualify(sym)
+	}
+	return sym
+}
+
+// declareAll - declare the names defined by the top level forms of a module before they are compiled, so
+// that a function can refer to one defined later in the file. The names defined by the expansions of macros
+// already defined, such as the accessors of a defrecord, are declared too.
+func (mod *module) declareAll(exprs []Value) {
+	if mod.name == "" {
+		return
+	}
+	for _, expr := range exprs {
+		mod.declareForm(expr)
+	}
+}
+
+func (mod *module) declareForm(expr Value) {
+	lst, ok := expr.(*List)
+	if !ok || lst == EmptyList {
+		return
+	}
+	switch lst.Car {
+	case Intern("def"), Intern("defn"):
+		name := Cadr(lst)
+		if sig, ok := name.(*List); ok {
+			name = sig.Car
+		}
+		if sym, ok := name.(*Symbol); ok && !isQualified(sym) {
+			mod.declared[sym] = true
+		}
+	case Intern("do"):
+		for forms := lst.Cdr; forms != EmptyList; forms = Cdr(forms) {
+			mod.declareForm(Car(forms))
+		}
+	default:
+		//a form the macro cannot expand yet is left for the compiler to report
+		if mac := GetMacro(lst.Car); mac != nil {
+			if expanded, err := mac.expandOnce(lst); err == nil {
+				mod.declareForm(expanded)
+			}
+		}
+	}
+}
+
+func (mod *module) export(sym *Symbol) {
+	if mod.exports == nil {
+		mod.exports = make([]*Symbol, 0)
+	}
+	for _, name := range mod.exports {
+		if name == sym {
+			return
+		}
+	}
+	mod.exports = append(mod.exports, sym)
+}
+
+// exported - the names the module exports
+func (mod *module) exported() []*Symbol {
+	if mod.exports != nil {
+		return mod.exports
+	}
+	prefix := mod.name + ":"
+	var names []*Symbol
+	for _, val := range Symbols() {
+		if sym, ok := val.(*Symbol); ok && sym.Value != nil && strings.HasPrefix(sym.Text, prefix) {
+			names = append(names, Intern(sym.Text[len(prefix):]).(*Symbol))
+		}
+	}
+	return names
+}
+
+func (mod *module) isExported(sym *Symbol) bool {
+	for _, name := range mod.exported() {
+		if name == sym {
+			return true
+		}
+	}
+	return false
+}
+
+// importFrom - make the names exported by another module visible in this one. The options are those of use:
+// only: (name ...) imports just those names, rename: ((name new-name) ...) imports names under other names,
+// and prefix: pre- imports all names that are not renamed with the prefix.
+func (mod *module) importFrom(from *module, options []Value) error {
+	if from.name == "" {
+		return nil
+	}
+	var only map[*Symbol]bool
+	renames := make(map[*Symbol]*Symbol)
+	prefix := ""
+	for i := 0; i+1 < len(options); i += 2 {
+		switch options[i] {
+		case onlyKeyword:
+			syms, err := symbolsOf(options[i+1])
+			if err != nil {
+				return err
+			}
+			only = make(map[*Symbol]bool)
+			for _, sym := range syms {
+				if !from.isExported(sym) {
+					return NewError(ArgumentErrorKey, "Module ", from.name, " does not export ", sym)
+				}
+				only[sym] = true
+			}
+		case renameKeyword:
+			pairs, err := elementsOf(options[i+1])
+			if err != nil {
+				return err
+			}
+			for _, pair := range pairs {
+				syms, err := symbolsOf(pair)
+				if err != nil || len(syms) != 2 {
+					return NewError(SyntaxErrorKey, "Bad rename in use, expected (name new-name): ", pair)
+				}
+				if !from.isExported(syms[0]) {
+					return NewError(ArgumentErrorKey, "Module ", from.name, " does not export ", syms[0])
+				}
+				renames[syms[0]] = syms[1]
+			}
+		case prefixKeyword:
+			switch p := options[i+1].(type) {
+			case *Symbol:
+				prefix = p.Text
+			case *String:
+				prefix = p.Value
+			default:
+				return NewError(SyntaxErrorKey, "Bad prefix in use, expected a <symbol>: ", p)
+			}
+		default:
+			return NewError(SyntaxErrorKey, "Unknown option to use: ", options[i])
+		}
+	}
+	for _, name := range from.exported() {
+		if only != nil && !only[name] {
+			continue
+		}
+		as := name
+		if newName, ok := renames[name]; ok {
+			as = newName
+		} else if prefix != "" {
+			as = Intern(prefix + name.Text).(*Symbol)
+		}
+		mod.imports[as] = from.qualify(name)
+	}
+	return nil
+}
+
+func elementsOf(val Value) ([]Value, error) {
+	switch seq := val.(type) {
+	case *List:
+		return ListToVector(seq).Elements, nil
+	case *Vector:
+		return seq.Elements, nil
+	}
+	return nil, NewError(SyntaxErrorKey, "Expected a <list> or <vector>, got ", val)
+}
+
+func symbolsOf(val Value) ([]*Symbol, error) {
+	elements, err := elementsOf(val)
+	if err != nil {
+		return nil, err
+	}
+	syms := make([]*Symbol, 0, len(elements))
+	for _, el := range elements {
+		sym, ok := el.(*Symbol)
+		if !ok {
+			return nil, NewError(SyntaxErrorKey, "Expected a <symbol>, got ", el)
+		}
+		syms = append(syms, sym)
+	}
+	return syms, nil
+}
+
+// moduleName - the name of the module loaded from the file. Files in the embedded library, such as ell.ell,
+// are not modules: their definitions are global.
+func moduleName(file string) string {
+	if strings.HasPrefix(file, "@/") {
+		return ""
+	}
+	base := filepath.Base(file)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// findModule - the named module, loading it if it has not been loaded already
+func findModule(name string) (*module, error) {
+	if mod, ok := modules[name]; ok {
+		noteModuleUse(mod)
+		return mod, nil
+	}
+	file, err := FindModuleFile(name)
+	if err != nil {
+		return nil, err
+	}
+	mod := newModule(moduleName(file))
+	modules[name] = mod //before loading it, so that modules that use each other do not loop
+	prev := currentModule
+	currentModule = mod
+	defer func() { currentModule = prev }()
+	mod.files, err = loadModule(file)
+	if err != nil {
+		delete(modules, name)
+		return nil, err
+	}
+	noteModuleUse(mod)
+	return mod, nil
+}
+
+// useSpec - use the module described by the operand of the use instruction: its name, or a list of its
+// name and import options
+func useSpec(spec Value) (*Symbol, error) {
+	var options []Value
+	if lst, ok := spec.(*List); ok {
+		spec = lst.Car
+		options = ListToVector(lst.Cdr).Elements
+	}
+	sym, ok := spec.(*Symbol)
+	if !ok {
+		return nil, NewError(SyntaxErrorKey, "Bad module name in use: ", spec)
+	}
+	return sym, Use(sym, options...)
+}
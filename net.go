@@ -32,160 +32,157 @@ import (
 
 var HTTPErrorKey = Intern("http-error:")
 
-func httpClientOperation(method string, url string, headers *Struct, data *String) (*Struct, error) {
+// httpClientOperation - make the HTTP request, returning the response as a struct with status:, headers:, and
+// body: fields, the body being a blob. Failing to get a response at all is an http-error:, but the status of a
+// response is left to the caller to check.
+func httpClientOperation(method string, url string, headers *Struct, body []byte) (*Struct, error) {
 	client := &http.Client{}
 	var bodyReader io.Reader
-	bodyLen := 0
-	if data != nil {
-		tmp := []byte(data.Value)
-		bodyLen = len(tmp)
-		if bodyLen > 0 {
-			bodyReader = bytes.NewBuffer(tmp)
-		}
+	if len(body) > 0 {
+		bodyReader = bytes.NewReader(body)
 	}
 	req, err := http.NewRequest(method, url, bodyReader)
 	if err != nil {
-		return nil, err
+		return nil, NewError(HTTPErrorKey, err.Error())
 	}
 	if headers != nil {
-		for k, v := range headers.Bindings {
-			ks := StringValue(k.ToValue())
+		for _, e := range headers.Entries() {
+			ks, v := headerString(e.Key), e.Value
 			if p, ok := v.(*List); ok {
-				vs := p.Car.String()
-				req.Header.Set(ks, vs)
-				for p.Cdr != EmptyList {
-					p = p.Cdr
-					req.Header.Add(ks, p.Car.String())
+				for ; p != EmptyList; p = p.Cdr {
+					req.Header.Add(ks, headerString(p.Car))
 				}
 			} else {
-				req.Header.Set(ks, v.String())
+				req.Header.Set(ks, headerString(v))
 			}
 		}
 	}
-	if bodyLen > 0 {
-		req.Header.Set("Content-Length", fmt.Sprint(bodyLen))
-	}
 	res, err := client.Do(req)
-	if err == nil {
-		bodyBytes, err := ioutil.ReadAll(res.Body)
-		res.Body.Close()
-		if err == nil {
-			s := NewStruct()
-			Put(s, Intern("status:"), Integer(res.StatusCode))
-			bodyLen := len(bodyBytes)
-			if bodyLen > 0 {
-				Put(s, Intern("body:"), NewBlob(bodyBytes))
-			}
-			if len(res.Header) > 0 {
-				headers = NewStruct()
-				for k, v := range res.Header {
-					var values []Value
-					for _, val := range v {
-						values = append(values, NewString(val))
-					}
-					Put(headers, NewString(k), ListFromValues(values))
-				}
-				Put(s, Intern("headers:"), headers)
-			}
-			return s, nil
+	if err != nil {
+		return nil, NewError(HTTPErrorKey, err.Error())
+	}
+	bodyBytes, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, NewError(HTTPErrorKey, err.Error())
+	}
+	resHeaders := NewStruct()
+	for k, v := range res.Header {
+		var values []Value
+		for _, val := range v {
+			values = append(values, NewString(val))
 		}
+		Put(resHeaders, NewString(k), ListFromValues(values))
 	}
-	return nil, err
+	s := NewStruct()
+	Put(s, Intern("status:"), Integer(res.StatusCode))
+	Put(s, Intern("headers:"), resHeaders)
+	Put(s, Intern("body:"), NewBlob(bodyBytes))
+	return s, nil
 }
 
-func httpServer(port int, handler *Function) (Value, error) {
-	glue := func(w http.ResponseWriter, r *http.Request) {
-		headers := NewStruct()
-		for k, v := range r.Header {
-			var values []Value
-			for _, val := range v {
-				values = append(values, NewString(val))
-			}
-			Put(headers, NewString(k), ListFromValues(values))
+// httpHandler - an http.Handler that calls an Ell function with each request, as a struct, and makes its
+// response from the result
+type httpHandler struct {
+	code *Code //calls the handler function with its one argument
+}
+
+func newHTTPHandler(handler *Function) *httpHandler {
+	return &httpHandler{code: trampoline(handler, 1, "http-handler")}
+}
+
+// httpRequest - the request as an Ell struct, with method:, path:, headers:, and body: fields, and query:,
+// host:, and remote: fields if they are known
+func httpRequest(r *http.Request) (*Struct, error) {
+	headers := NewStruct()
+	for k, v := range r.Header {
+		var values []Value
+		for _, val := range v {
+			values = append(values, NewString(val))
 		}
-		var body Value
-		method := strings.ToUpper(r.Method)
-		switch method {
-		case "POST", "PUT":
-			bodyBytes, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				w.WriteHeader(500)
-				w.Write([]byte("Cannot decode body for " + r.Method + " request"))
-				return
+		Put(headers, NewString(k), ListFromValues(values))
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	req := NewStruct()
+	Put(req, Intern("method:"), NewString(strings.ToUpper(r.Method)))
+	Put(req, Intern("path:"), NewString(r.URL.Path))
+	Put(req, Intern("headers:"), headers)
+	Put(req, Intern("body:"), NewBlob(body))
+	if r.URL.RawQuery != "" {
+		Put(req, Intern("query:"), NewString(r.URL.RawQuery))
+	}
+	if r.Host != "" {
+		Put(req, Intern("host:"), NewString(r.Host))
+	}
+	if r.RemoteAddr != "" {
+		Put(req, Intern("remote:"), NewString(r.RemoteAddr))
+	}
+	return req, nil
+}
+
+// ServeHTTP - call the handler on a VM of its own. It may return a struct with status:, headers:, and body:
+// fields, or just the body, a string or a blob. An error, or any other result, is a 500 response.
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := httpRequest(r)
+	if err != nil {
+		http.Error(w, "Cannot read the body of the "+r.Method+" request", 500)
+		return
+	}
+	res, err := VM(defaultStackSize).execArgs(h.code, []Value{req})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	status := 200
+	body := res
+	if p, ok := res.(*Struct); ok {
+		if headers, ok := p.Get(Intern("headers:")).(*Struct); ok {
+			for _, e := range headers.Entries() {
+				ks, v := headerString(e.Key), e.Value
+				if lst, ok := v.(*List); ok {
+					for ; lst != EmptyList; lst = lst.Cdr {
+						w.Header().Add(ks, headerString(lst.Car))
+					}
+				} else {
+					w.Header().Set(ks, headerString(v))
+				}
 			}
-			body = NewBlob(bodyBytes)
-		}
-		req, _ := MakeStruct([]Value{Intern("headers:"), headers})
-		if body != nil {
-			Put(req, Intern("body:"), body)
-		}
-		Put(req, Intern("method:"), NewString(method))
-		Put(req, Intern("path:"), NewString(r.URL.Path))
-		if r.URL.Scheme != "" {
-			Put(req, Intern("scheme:"), NewString(r.URL.Scheme))
-		}
-		if r.URL.User != nil {
-			//this is a *url.Userinfo
 		}
-		if r.URL.Host != "" {
-			Put(req, Intern("host:"), NewString(r.URL.Host))
+		if n, ok := p.Get(Intern("status:")).(*Number); ok {
+			status = n.IntValue()
 		}
-		if r.URL.RawQuery != "" {
-			Put(req, Intern("query:"), NewString(r.URL.RawQuery))
-		}
-		args := []Value{req}
-		res, err := exec(handler.code, args)
-		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
-			return
-		}
-		p, ok := res.(*Struct)
-		if !ok {
-			//		if !IsStruct(res) {
-			w.WriteHeader(500)
-			w.Write([]byte("Handler did not return a struct"))
-			return
-		}
-		headers2 := p.Get(Intern("headers:"))
 		body = p.Get(Intern("body:"))
-		status := p.Get(Intern("status:"))
-		if headers, ok := headers2.(*Struct); ok {
-			//fix: multiple values for a header
-			for k, v := range headers.Bindings {
-				ks := headerString(k.ToValue())
-				vs := v.String()
-				w.Header().Set(ks, vs)
-			}
-		}
-		if s, ok := body.(*String); ok {
-			bodylen := len(s.Value)
-			w.Header().Set("Content-length", fmt.Sprint(bodylen))
-			if status != nil {
-				nstatus, _ := AsIntValue(status)
-				if nstatus != 0 && nstatus != 200 {
-					w.WriteHeader(nstatus)
-				}
-			}
-			if bodylen > 0 {
-				w.Write([]byte(s.Value))
-			}
-		} else {
-			if status != nil {
-				nstatus := IntValue(status)
-				if nstatus != 0 && nstatus != 200 {
-					w.WriteHeader(nstatus)
-				}
-			}
+	}
+	var b []byte
+	switch p := body.(type) {
+	case *String:
+		b = []byte(p.Value)
+	case *Blob:
+		b = p.Value
+	default:
+		if body != nil && body != Null {
+			http.Error(w, "Handler did not return a struct, string, or blob: "+res.String(), 500)
+			return
 		}
 	}
-	http.HandleFunc("/", glue)
-	//if verbose {
+	w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// httpServer - serve HTTP on the port, calling the handler for each request. This does not return unless the
+// server cannot be started.
+func httpServer(port int, handler *Function) (Value, error) {
+	if handler.code != nil && handler.code.argc != 1 {
+		return nil, NewError(ArgumentErrorKey, "Cannot use this function as a handler: ", handler)
+	}
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: newHTTPHandler(handler)}
 	fmt.Printf("[web server running at http://localhost:%d]\n", port)
-	//}
-	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
-	//no way to stop it
-	return Null, nil
+	err := server.ListenAndServe()
+	return nil, NewError(HTTPErrorKey, err.Error())
 }
 
 func headerString(obj Value) string {
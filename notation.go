@@ -24,8 +24,10 @@ import (
 	"io/fs"
 	"io/ioutil"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	. "github.com/boynton/ell/data"
 )
@@ -79,16 +81,18 @@ func ExpandFilePath(path string) string {
 //go:embed lib
 var sysFS embed.FS
 
-// SlurpFile - return the file contents as a string
-func SlurpFile(path string) (string, error) {
+// ReadFileBytes - return the file contents. A path starting with @/ names a file in the built-in library.
+func ReadFileBytes(path string) ([]byte, error) {
 	path = ExpandFilePath(path)
-	var b []byte
-	var err error
 	if strings.HasPrefix(path, "@/") {
-		b, err = fs.ReadFile(sysFS, "lib"+path[1:])
-	} else {
-		b, err = ioutil.ReadFile(path)
+		return fs.ReadFile(sysFS, "lib"+path[1:])
 	}
+	return ioutil.ReadFile(path)
+}
+
+// SlurpFile - return the file contents as a string
+func SlurpFile(path string) (string, error) {
+	b, err := ReadFileBytes(path)
 	if err != nil {
 		return "", err
 	}
@@ -101,6 +105,19 @@ func SpitFile(path string, data string) error {
 	return ioutil.WriteFile(path, []byte(data), 0644)
 }
 
+// AppendFile - add the data to the end of the file, creating it if necessary
+func AppendFile(path string, data []byte) error {
+	f, err := os.OpenFile(ExpandFilePath(path), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
 func ReadFromString(s string) (Value, error) {
 	reader := &Reader{
 		Input:    bufio.NewReader(strings.NewReader(s)),
@@ -110,6 +127,31 @@ func ReadFromString(s string) (Value, error) {
 	return reader.Read()
 }
 
+// NewDataReader - a reader of the notation dialect the options describe. Tagged literals, quotes, and the other
+// reader macros of Ell are read as usual, unless the options ask for strict JSON.
+func NewDataReader(r io.Reader, opts ReaderOptions) *Reader {
+	reader := &Reader{ReaderOptions: opts, Input: bufio.NewReader(r)}
+	reader.Extension = &EllReaderExtension{r: reader}
+	return reader
+}
+
+// Decode - read the first value in the text, like ReadFromString, but in the dialect the options describe
+func Decode(s string, opts ReaderOptions) (Value, error) {
+	return NewDataReader(strings.NewReader(s), opts).Read()
+}
+
+// ReadIncremental - read the first value in the text, like ReadFromString, but if the text ends before the
+// value does, return NeedMoreInput, so that the caller can add more text to it and try again
+func ReadIncremental(s string) (Value, error) {
+	reader := &Reader{
+		Input:       bufio.NewReader(strings.NewReader(s)),
+		Position:    0,
+		Incremental: true,
+	}
+	reader.Extension = &EllReaderExtension{r: reader}
+	return reader.Read()
+}
+
 func ReadAllFromString(s string) (*List, error) {
 	reader := &Reader{
 		Input:    bufio.NewReader(strings.NewReader(s)),
@@ -120,14 +162,56 @@ func ReadAllFromString(s string) (*List, error) {
 	//	return ReadAll(strings.NewReader(s))
 }
 
+// readAllWithLines - read all items in the text, along with the line number each one starts on, and the
+// locations in the file of the lists, vectors, and structs in them
+func readAllWithLines(file string, s string) ([]Value, []int, map[Value]*Location, error) {
+	reader := &Reader{
+		Input:       bufio.NewReader(strings.NewReader(s)),
+		Position:    0,
+		File:        file,
+		Locations:   make(map[Value]*Location),
+		Incremental: true,
+	}
+	reader.Extension = &EllReaderExtension{r: reader}
+	var values []Value
+	var lines []int
+	for {
+		val, err := reader.ReadValue()
+		if err != nil {
+			if err == io.EOF {
+				return values, lines, reader.Locations, nil
+			}
+			return nil, nil, nil, readError(reader, err)
+		}
+		values = append(values, val)
+		lines = append(lines, reader.StartLine())
+	}
+}
+
+// readError - the error from an incremental reader, with where in the input it was found. Input that ends in the
+// middle of a value is a syntax error, found where the value starts.
+func readError(reader *Reader, err error) error {
+	if err == NeedMoreInput {
+		e := NewError(SyntaxErrorKey, "unexpected end of input")
+		e.Location = reader.StartLocation()
+		return e
+	}
+	if e, ok := err.(*Error); ok && e.Location == nil {
+		e.Location = reader.Location()
+	}
+	return err
+}
+
 type EllReaderExtension struct {
-	r *Reader
+	r       *Reader
+	gensyms map[string]*Symbol //the uninterned symbols read so far, so that each #:name is the same one throughout
 }
 
 var QuoteSymbol = Intern("quote")
 var QuasiquoteSymbol = Intern("quasiquote")
 var UnquoteSymbol = Intern("unquote")
 var UnquoteSymbolSplicing = Intern("unquote-splicing")
+var SpliceSymbol = Intern("splice")
 
 func (ext *EllReaderExtension) HandleReaderMacro(c byte) (Value, error, bool) {
 	dr := ext.r
@@ -170,9 +254,51 @@ func (ext *EllReaderExtension) HandleReaderMacro(c byte) (Value, error, bool) {
 			dr.UngetChar()
 		}
 		return NewCharacter(rune(c)), nil, true
-	case '!': //to handle shell scripts, handle #! as a comment
-		err := dr.DecodeComment()
-		return Null, err, true
+	case 'u': //a blob literal, i.e. #u8(1 2 3), unless it is a tagged literal, i.e. #uuid "..."
+		next, err := dr.Input.Peek(2)
+		if len(next) > 0 && next[0] != '8' && next[0] != '(' {
+			return Null, nil, false
+		}
+		if err != nil {
+			return nil, err, true
+		}
+		if string(next) != "8(" {
+			return nil, NewError(SyntaxErrorKey, "Bad blob literal, expected #u8("), true
+		}
+		dr.GetChar()
+		dr.GetChar()
+		items, err := dr.DecodeSequence(')')
+		if err != nil {
+			return nil, err, true
+		}
+		blob, err := valuesToBlob(items)
+		if err != nil {
+			return nil, NewError(SyntaxErrorKey, "Bad blob literal: ", err), true
+		}
+		return blob, nil, true
+	case '{': //a set literal, i.e. #{1 2 3}
+		items, err := dr.DecodeSequence('}')
+		if err != nil {
+			return nil, err, true
+		}
+		return NewSet(items...), nil, true
+	case ':': //an uninterned symbol, i.e. #:tmp__12, as a gensym is written
+		name, err := dr.DecodeAtomString(0)
+		if err != nil {
+			return nil, err, true
+		}
+		if !IsValidSymbolName(name) || IsValidKeywordName(name) || IsValidTypeName(name) {
+			return nil, NewError(SyntaxErrorKey, "Bad uninterned symbol: #:", name), true
+		}
+		if ext.gensyms == nil {
+			ext.gensyms = make(map[string]*Symbol)
+		}
+		sym, ok := ext.gensyms[name]
+		if !ok {
+			sym = &Symbol{Text: name}
+			ext.gensyms[name] = sym
+		}
+		return sym, nil, true
 	}
 	return Null, nil, false
 }
@@ -243,6 +369,12 @@ func (ext *EllReaderExtension) HandleChar(c byte) (Value, error, bool) {
 			return nil, err, true
 		}
 		return NewList(sym, o), nil, true
+	case '@':
+		o, err := ext.r.ReadValue()
+		if err != nil {
+			return nil, err, true
+		}
+		return NewList(SpliceSymbol, o), nil, true
 	}
 	return Null, nil, false
 }
@@ -251,8 +383,32 @@ type EllWriterExtension struct {
 	writer *Writer
 }
 
+// printLengthSymbol, printDepthSymbol - when the global *print-length* or *print-depth* is a positive number,
+// what is written is abbreviated with ... beyond that many elements of a list, vector, or struct, or beyond
+// that many levels of them
+var printLengthSymbol = Intern("*print-length*")
+var printDepthSymbol = Intern("*print-depth*")
+
+// printSortedSymbol - when the global *print-sorted* is true, the fields of structs and hashmaps, and the members
+// of sets, are written in the order of their keys, so that the text of equal values is the same however they were
+// built. JSON is always written that way, unless JsonEmit is asked not to.
+var printSortedSymbol = Intern("*print-sorted*")
+
+// printLimit - the value of the limit's global, or zero if it is not a positive number
+func printLimit(sym Value) int {
+	if n, ok := GetGlobal(sym).(*Number); ok && n.IsExactInteger() && n.Int64Value() > 0 {
+		return int(n.Int64Value())
+	}
+	return 0
+}
+
 func newWriter(indent string, json bool) *EllWriterExtension {
-	writer := &Writer{Indent: indent, Json: json}
+	writer := &Writer{Indent: indent, Json: json, SortKeys: json}
+	if !json {
+		writer.MaxLength = printLimit(printLengthSymbol)
+		writer.MaxDepth = printLimit(printDepthSymbol)
+		writer.SortKeys = GetGlobal(printSortedSymbol) == True
+	}
 	ext := &EllWriterExtension{writer: writer}
 	writer.Extension = ext
 	return ext
@@ -274,19 +430,53 @@ func (ext *EllWriterExtension) writeAll(lst *List) string {
 	return s
 }
 
+// quotePrefix - the reader syntax for the list, if it is a quote form, i.e. ' for (quote x)
+func quotePrefix(lst *List) string {
+	if lst == EmptyList || lst.Cdr == EmptyList {
+		return ""
+	}
+	switch lst.Car {
+	case QuoteSymbol:
+		return "'"
+	case QuasiquoteSymbol:
+		return "`"
+	case UnquoteSymbol:
+		return "~"
+	case UnquoteSymbolSplicing:
+		return "~@"
+	case SpliceSymbol:
+		return "@"
+	}
+	return ""
+}
+
 func (ext *EllWriterExtension) HandleValue(val Value) (string, error, bool) {
 	switch p := val.(type) {
+	case *Symbol: //a gensym is written so that reading it back does not intern it
+		if !ext.writer.Json && !IsInterned(p) {
+			return "#:" + p.Text, nil, true
+		}
+		return "", nil, false
 	case *List:
-		if p.Cdr != EmptyList {
-			if p.Car == QuoteSymbol {
-				return "'" + Cadr(val).String(), nil, true
-			} else if p.Car == QuasiquoteSymbol {
-				return "`" + Cadr(val).String(), nil, true
-			} else if p.Car == UnquoteSymbol {
-				return "~" + Cadr(val).String(), nil, true
-			} else if p.Car == UnquoteSymbolSplicing {
-				return "~@" + Cadr(val).String(), nil, true
-			}
+		if prefix := quotePrefix(p); prefix != "" {
+			s, err := ext.writer.WriteData(Cadr(val), false, "", "")
+			return prefix + s, err, true
+		}
+		return "", nil, false
+	case *Set: //written like a vector of its members, which is what JSON gets
+		members := p.Members()
+		if ext.writer.SortKeys {
+			sort.SliceStable(members, func(i, j int) bool { return members[i].String() < members[j].String() })
+		}
+		s, err := ext.writer.WriteVector(NewVector(members...), ext.writer.Json, "", "")
+		if err != nil || ext.writer.Json {
+			return s, err, true
+		}
+		return "#{" + s[1:len(s)-1] + "}", nil, true
+	case *HashMap: //written as a tagged literal, except in JSON, which gets just its entries
+		if ext.writer.Json {
+			s, err := ext.writer.WriteStruct(p.table, true, "", "")
+			return s, err, true
 		}
 		return "", nil, false
 	case *Character: //move this out of here
@@ -320,20 +510,159 @@ func (ext *EllWriterExtension) HandleValue(val Value) (string, error, bool) {
 	return "", nil, false
 }
 
-const defaultIndentSize = "    "
-
 func Write(val Value) string {
 	return newWriter("", false).write(val)
 }
 
-func Pretty(val Value) string {
-	return newWriter(defaultIndentSize, false).write(val)
+// Pretty - the value as Write writes it, but with the lists, vectors, and structs that do not fit in the width
+// broken across lines and indented, and the fields of structs in the order of their keys
+func Pretty(val Value, width int) string {
+	ext := newWriter("", false)
+	ext.writer.SortKeys = true
+	p := &prettyPrinter{ext: ext, width: width, maxLength: ext.writer.MaxLength, maxDepth: ext.writer.MaxDepth}
+	p.print(val, 0, 0)
+	return p.buf.String()
+}
+
+type prettyPrinter struct {
+	ext       *EllWriterExtension
+	width     int
+	maxLength int //the *print-length* and *print-depth* limits, as in the Writer
+	maxDepth  int
+	headArgs  func(lst *List) int //if not nil, the number of arguments after the first to keep on the first line of a call
+	buf       strings.Builder
+}
+
+// column - the column the next character printed is in
+func (p *prettyPrinter) column() int {
+	s := p.buf.String()
+	return utf8.RuneCountInString(s[strings.LastIndex(s, "\n")+1:])
+}
+
+// newline - start a new line, indented to the column
+func (p *prettyPrinter) newline(column int) {
+	p.buf.WriteString("\n")
+	p.buf.WriteString(strings.Repeat(" ", column))
+}
+
+// elided - true if the element at the index is beyond the print length, in which case ... is written for it
+// and the rest of the elements
+func (p *prettyPrinter) elided(i int) bool {
+	if p.maxLength > 0 && i >= p.maxLength {
+		p.buf.WriteString("...")
+		return true
+	}
+	return false
+}
+
+// print - write the value, which starts at the column and is nested in depth lists, vectors, and structs, on one
+// line if it fits, otherwise across lines. The arguments of a call-like list are indented under its operator,
+// the elements of a vector are aligned, and each field of a struct is on its own line.
+func (p *prettyPrinter) print(val Value, column int, depth int) {
+	if p.maxDepth > 0 {
+		switch val.(type) {
+		case *List, *Vector, *Struct:
+			if depth >= p.maxDepth {
+				p.buf.WriteString("...")
+				return
+			}
+		}
+		p.ext.writer.MaxDepth = p.maxDepth - depth
+	}
+	if s, ok := PrintWithMethod(val); ok {
+		p.buf.WriteString(s)
+		return
+	}
+	s := p.ext.write(val)
+	if column+utf8.RuneCountInString(s) <= p.width {
+		p.buf.WriteString(s)
+		return
+	}
+	switch v := val.(type) {
+	case *List:
+		if prefix := quotePrefix(v); prefix != "" {
+			p.buf.WriteString(prefix)
+			p.print(Cadr(v), column+len(prefix), depth)
+			return
+		}
+		p.buf.WriteString("(")
+		items := v
+		indent := column + 1
+		i := 0
+		if sym, ok := v.Car.(*Symbol); ok && v.Cdr != EmptyList && p.maxLength != 1 {
+			p.buf.WriteString(sym.Text + " ")
+			p.print(Cadr(v), column+len(sym.Text)+2, depth+1)
+			items = Cddr(v)
+			indent = column + 2
+			i = 2
+			if p.headArgs != nil {
+				for n := p.headArgs(v); i <= n+1 && items != EmptyList; i++ {
+					p.buf.WriteString(" ")
+					p.print(items.Car, p.column(), depth+1)
+					items = items.Cdr
+				}
+			}
+		}
+		for ; items != EmptyList; items = items.Cdr {
+			if i > 0 {
+				p.newline(indent)
+			}
+			if p.elided(i) {
+				break
+			}
+			p.print(items.Car, indent, depth+1)
+			i++
+		}
+		p.buf.WriteString(")")
+	case *Vector:
+		p.buf.WriteString("[")
+		for i, el := range v.Elements {
+			if i > 0 {
+				p.newline(column + 1)
+			}
+			if p.elided(i) {
+				break
+			}
+			p.print(el, column+1, depth+1)
+		}
+		p.buf.WriteString("]")
+	case *Struct:
+		p.buf.WriteString("{")
+		entries := v.Entries()
+		if p.ext.writer.SortKeys {
+			entries = SortedEntries(v)
+		}
+		for i, e := range entries {
+			if i > 0 {
+				p.newline(column + 1)
+			}
+			if p.elided(i) {
+				break
+			}
+			key := p.ext.write(e.Key)
+			p.buf.WriteString(key + " ")
+			p.print(e.Value, column+1+utf8.RuneCountInString(key)+1, depth+1)
+		}
+		p.buf.WriteString("}")
+	case *Instance:
+		tag := "#" + v.TypeTag.String()
+		p.buf.WriteString(tag)
+		p.print(v.Value, column+len(tag), depth)
+	default:
+		p.buf.WriteString(s)
+	}
 }
 
 func WriteIndent(val Value, indent string) string {
 	return newWriter(indent, false).write(val)
 }
 
+// WriteTo - write the value to w as Write would return it, but as it is encoded, rather than building the whole
+// text first
+func WriteTo(w io.Writer, val Value) error {
+	return newWriter("", false).writer.WriteStream(w, val)
+}
+
 func WriteAll(lst *List) string {
 	return newWriter("", false).writeAll(lst)
 }
@@ -342,7 +671,38 @@ func WriteAllIndent(lst *List, indent string) string {
 	return newWriter(indent, false).writeAll(lst)
 }
 
+// Json - the value in JSON, with the fields of structs in the order of their keys
 func Json(val Value, indent string) (string, error) {
 	ext := newWriter(indent, true)
 	return ext.writer.Write(val)
 }
+
+// JsonTo - write the value to w as Json would return it, but as it is encoded, rather than building the whole text
+// first
+func JsonTo(w io.Writer, val Value, indent string) error {
+	return newWriter(indent, true).writer.WriteStream(w, val)
+}
+
+// JsonOptions - how JsonEmit and JsonEmitTo describe a value in JSON
+type JsonOptions struct {
+	Indent         string // if not empty, pretty print, indenting each level by this
+	SortKeys       bool   // write the fields of structs in the order of their keys, rather than in the order they were put
+	EscapeNonASCII bool   // write the characters outside of ASCII as \u escapes
+}
+
+func newJsonWriter(opts JsonOptions) *Writer {
+	ext := newWriter(opts.Indent, true)
+	ext.writer.SortKeys = opts.SortKeys
+	ext.writer.EscapeNonASCII = opts.EscapeNonASCII
+	return ext.writer
+}
+
+// JsonEmit - the value in JSON, like Json, but as specified by the options
+func JsonEmit(val Value, opts JsonOptions) (string, error) {
+	return newJsonWriter(opts).Write(val)
+}
+
+// JsonEmitTo - write the value in JSON to w as it is encoded, rather than building the whole text first
+func JsonEmitTo(w io.Writer, val Value, opts JsonOptions) error {
+	return newJsonWriter(opts).WriteStream(w, val)
+}
@@ -17,9 +17,12 @@ limitations under the License.
 package ell
 
 import (
+	crand "crypto/rand"
 	"math"
+	"math/big"
+	"math/bits"
 	"math/rand"
-	"strconv"
+	"sync"
 
 	. "github.com/boynton/ell/data"
 )
@@ -34,7 +37,7 @@ var One = Integer(1)
 var MinusOne = Integer(-1)
 
 func Int(n int64) *Number {
-	return Integer(int(n))
+	return Int64(n)
 }
 
 // Round - return the closest integer value to the float value
@@ -58,9 +61,8 @@ func ToNumber(o Value) (*Number, error) {
 		}
 		return Zero, nil
 	case *String:
-		f, err := strconv.ParseFloat(p.Value, 64)
-		if err == nil {
-			return Float(f), nil
+		if n, ok := ParseNumber(p.Value); ok {
+			return n, nil
 		}
 	}
 	return nil, NewError(ArgumentErrorKey, "cannot convert to an number: ", o)
@@ -70,7 +72,10 @@ func ToNumber(o Value) (*Number, error) {
 func ToInt(o Value) (*Number, error) {
 	switch p := o.(type) {
 	case *Number:
-		return Float(Round(p.Value)), nil
+		if p.IsExact() {
+			return roundRational(p.Rat()), nil
+		}
+		return ToExact(Float(Round(p.Value)))
 	case *Character:
 		return Integer(int(p.Value)), nil
 	case *Boolean:
@@ -79,16 +84,329 @@ func ToInt(o Value) (*Number, error) {
 		}
 		return Zero, nil
 	case *String:
-		n, err := strconv.ParseInt(p.Value, 10, 64)
-		if err == nil {
-			return Integer(int(n)), nil
+		if n, ok := ParseNumber(p.Value); ok && n.IsExactInteger() {
+			return n, nil
 		}
 	}
 	return nil, NewError(ArgumentErrorKey, "cannot convert to an integer: ", o)
 }
 
+// roundRational - the exact integer closest to the rational, rounding halves away from zero like Round
+func roundRational(r *big.Rat) *Number {
+	half := big.NewRat(1, 2)
+	if r.Sign() < 0 {
+		half.Neg(half)
+	}
+	r = new(big.Rat).Add(r, half)
+	return BigInteger(new(big.Int).Quo(r.Num(), r.Denom()))
+}
+
+// ToExact - the exact number with the same value as the number. Infinities and NaN have none.
+func ToExact(n *Number) (*Number, error) {
+	if n.IsExact() {
+		return n, nil
+	}
+	if f := n.Value; f >= math.MinInt64 && f < math.MaxInt64 && math.Trunc(f) == f {
+		return Int64(int64(f)), nil
+	}
+	r := new(big.Rat)
+	if r.SetFloat64(n.Value) == nil {
+		return nil, NewError(ArgumentErrorKey, "No exact representation of ", n)
+	}
+	return Rational(r), nil
+}
+
+// ToInexact - the float closest to the value of the number
+func ToInexact(n *Number) *Number {
+	if n.IsExact() {
+		return Float(n.Value)
+	}
+	return n
+}
+
+// Floor - the largest integer not greater than the number, exact if the number is
+func Floor(n *Number) *Number {
+	if n.IsExactInteger() {
+		return n
+	}
+	if n.IsExact() {
+		r := n.Rat()
+		return BigInteger(new(big.Int).Div(r.Num(), r.Denom())) //the denominator is positive, so this is the floor
+	}
+	return Float(math.Floor(n.Value))
+}
+
+// Ceiling - the smallest integer not less than the number, exact if the number is
+func Ceiling(n *Number) *Number {
+	if n.IsExact() {
+		return NumberSub(Zero, Floor(NumberSub(Zero, n)))
+	}
+	return Float(math.Ceil(n.Value))
+}
+
+// Truncate - the integer nearest the number that is not larger in magnitude, exact if the number is
+func Truncate(n *Number) *Number {
+	if n.IsExactInteger() {
+		return n
+	}
+	if n.IsExact() {
+		r := n.Rat()
+		return BigInteger(new(big.Int).Quo(r.Num(), r.Denom()))
+	}
+	return Float(math.Trunc(n.Value))
+}
+
+// RoundNumber - the integer closest to the number, with halves rounded away from zero, exact if the number is
+func RoundNumber(n *Number) *Number {
+	if n.IsExactInteger() {
+		return n
+	}
+	if n.IsExact() {
+		return roundRational(n.Rat())
+	}
+	return Float(Round(n.Value))
+}
+
+// exactSqrt - the exact square root of the non-negative integer, if it has one
+func exactSqrt(i *big.Int) (*big.Int, bool) {
+	root := new(big.Int).Sqrt(i)
+	return root, new(big.Int).Mul(root, root).Cmp(i) == 0
+}
+
+// Sqrt - the square root of the number, which is exact if the number is exact and the root is
+func Sqrt(n *Number) (*Number, error) {
+	if NumberCompare(n, Zero) < 0 {
+		return nil, NewError(ArgumentErrorKey, "sqrt of a negative number: ", n)
+	}
+	if n.IsExact() {
+		r := n.Rat()
+		if num, ok := exactSqrt(r.Num()); ok {
+			if denom, ok := exactSqrt(r.Denom()); ok {
+				return Rational(new(big.Rat).SetFrac(num, denom)), nil
+			}
+		}
+	}
+	return Float(math.Sqrt(n.Value)), nil
+}
+
+// maxExactExptBits - exact powers whose results would have more bits than this are computed inexactly instead
+const maxExactExptBits = 1 << 20
+
+// Expt - the base raised to the power, exact if the base is exact and the power is an exact integer
+func Expt(base *Number, power *Number) (*Number, error) {
+	if base.IsExact() && power.IsExactInteger() {
+		r := base.Rat()
+		p := power.Rat().Num()
+		if r.Sign() == 0 {
+			switch p.Sign() {
+			case 0:
+				return One, nil
+			case 1:
+				return Zero, nil
+			default:
+				return nil, NewError(ArgumentErrorKey, "Division by zero")
+			}
+		}
+		bits := int64(r.Num().BitLen() + r.Denom().BitLen())
+		if p.IsInt64() && bits*abs64(p.Int64()) <= maxExactExptBits {
+			e := new(big.Int).Abs(p)
+			num := new(big.Int).Exp(r.Num(), e, nil)
+			denom := new(big.Int).Exp(r.Denom(), e, nil)
+			if p.Sign() < 0 {
+				num, denom = denom, num
+				if denom.Sign() < 0 {
+					num.Neg(num)
+					denom.Neg(denom)
+				}
+			}
+			return Rational(new(big.Rat).SetFrac(num, denom)), nil
+		}
+	}
+	return Float(math.Pow(base.Value, power.Value)), nil
+}
+
+func abs64(i int64) int64 {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+// NumberMin, NumberMax - the smallest or largest of the numbers, which is inexact if any of them are
+func NumberMin(nums []Value) *Number {
+	return extreme(nums, -1)
+}
+
+func NumberMax(nums []Value) *Number {
+	return extreme(nums, 1)
+}
+
+func extreme(nums []Value, sign int) *Number {
+	result := nums[0].(*Number)
+	exact := result.IsExact()
+	for _, v := range nums[1:] {
+		n := v.(*Number)
+		if !n.IsExact() {
+			exact = false
+		}
+		if NumberCompare(n, result) == sign {
+			result = n
+		}
+	}
+	if !exact {
+		return ToInexact(result)
+	}
+	return result
+}
+
+// integerArgs - the numbers as big integers, which they must all be, and whether they are all exact
+func integerArgs(name string, nums []Value) ([]*big.Int, bool, error) {
+	ints := make([]*big.Int, len(nums))
+	exact := true
+	for i, v := range nums {
+		n := v.(*Number)
+		if !IsInt(n) {
+			return nil, false, NewError(ArgumentErrorKey, name, " expected integers, got ", n)
+		}
+		if !n.IsExact() {
+			exact = false
+			n, _ = ToExact(n)
+		}
+		ints[i] = new(big.Int).Abs(n.Rat().Num())
+	}
+	return ints, exact, nil
+}
+
+// integerResult - the integer as a number, inexact if any of the arguments it was computed from were
+func integerResult(i *big.Int, exact bool) *Number {
+	n := BigInteger(i)
+	if !exact {
+		return ToInexact(n)
+	}
+	return n
+}
+
+// GCD - the greatest common divisor of the integers, which is 0 if there are none
+func GCD(nums []Value) (*Number, error) {
+	ints, exact, err := integerArgs("gcd", nums)
+	if err != nil {
+		return nil, err
+	}
+	result := new(big.Int)
+	for _, i := range ints {
+		result.GCD(nil, nil, result, i)
+	}
+	return integerResult(result, exact), nil
+}
+
+// LCM - the least common multiple of the integers, which is 1 if there are none
+func LCM(nums []Value) (*Number, error) {
+	ints, exact, err := integerArgs("lcm", nums)
+	if err != nil {
+		return nil, err
+	}
+	result := big.NewInt(1)
+	for _, i := range ints {
+		if i.Sign() == 0 {
+			return integerResult(i, exact), nil
+		}
+		gcd := new(big.Int).GCD(nil, nil, result, i)
+		result.Mul(result, new(big.Int).Quo(i, gcd))
+	}
+	return integerResult(result, exact), nil
+}
+
+// exactInteger - the number as a big integer, which it must be an exact one
+func exactInteger(name string, v Value) (*big.Int, error) {
+	if n, ok := v.(*Number); ok && n.IsExactInteger() {
+		return n.Rat().Num(), nil
+	}
+	return nil, NewError(ArgumentErrorKey, name, " expected an exact integer, got ", v)
+}
+
+// BitOp - the bitwise and, or, or xor of the exact integers, with negative numbers treated as two's complement of
+// unlimited width. With no arguments it is the identity of the operation.
+func BitOp(name string, op func(z, x, y *big.Int) *big.Int, identity int64, nums []Value) (*Number, error) {
+	result := big.NewInt(identity)
+	for _, v := range nums {
+		i, err := exactInteger(name, v)
+		if err != nil {
+			return nil, err
+		}
+		op(result, result, i)
+	}
+	return BigInteger(result), nil
+}
+
+// BitNot - the bitwise complement of the exact integer, which is -n-1
+func BitNot(n Value) (*Number, error) {
+	i, err := exactInteger("bit-not", n)
+	if err != nil {
+		return nil, err
+	}
+	return BigInteger(new(big.Int).Not(i)), nil
+}
+
+// ArithmeticShift - the exact integer shifted left by the count of bits, or right if it is negative, keeping its
+// sign, so a right shift is a division rounded down
+func ArithmeticShift(n Value, count Value) (*Number, error) {
+	i, err := exactInteger("arithmetic-shift", n)
+	if err != nil {
+		return nil, err
+	}
+	c := IntValue(count)
+	if c > maxExactExptBits {
+		return nil, NewError(ArgumentErrorKey, "arithmetic-shift count is too large: ", c)
+	}
+	if c >= 0 {
+		return BigInteger(new(big.Int).Lsh(i, uint(c))), nil
+	}
+	return BigInteger(new(big.Int).Rsh(i, uint(-c))), nil
+}
+
+// LogicalShiftRight - the 64 bit integer shifted right by the count of bits, with zeros shifted into the top
+// bits, so a negative number is shifted as the unsigned number with the same bits
+func LogicalShiftRight(n Value, count Value) (*Number, error) {
+	i, err := exactInteger("logical-shift-right", n)
+	if err != nil {
+		return nil, err
+	}
+	if !i.IsInt64() {
+		return nil, NewError(ArgumentErrorKey, "logical-shift-right expected a 64 bit integer, got ", n)
+	}
+	c := IntValue(count)
+	if c < 0 {
+		return nil, NewError(ArgumentErrorKey, "logical-shift-right expected a non-negative count, got ", count)
+	}
+	if c >= 64 {
+		return Zero, nil
+	}
+	u := uint64(i.Int64()) >> uint(c)
+	return BigInteger(new(big.Int).SetUint64(u)), nil
+}
+
+// BitCount - the number of 1 bits in the exact integer, or of 0 bits if it is negative
+func BitCount(n Value) (*Number, error) {
+	i, err := exactInteger("bit-count", n)
+	if err != nil {
+		return nil, err
+	}
+	if i.Sign() < 0 {
+		i = new(big.Int).Not(i)
+	}
+	count := 0
+	for _, w := range i.Bits() {
+		count += bits.OnesCount(uint(w))
+	}
+	return Integer(count), nil
+}
+
+// IsInt - true if the number is an integer, exact or not
 func IsInt(obj Value) bool {
 	if p, ok := obj.(*Number); ok {
+		if p.IsExact() {
+			return p.IsExactInteger()
+		}
 		f := p.Value
 		if math.Trunc(f) == f {
 			return true
@@ -97,9 +415,18 @@ func IsInt(obj Value) bool {
 	return false
 }
 
+// IsFloat - true if the number is inexact
 func IsFloat(obj Value) bool {
-	if obj.Type() == NumberType {
-		return !IsInt(obj)
+	if p, ok := obj.(*Number); ok {
+		return !p.IsExact()
+	}
+	return false
+}
+
+// IsExact - true if the number is an exact integer or rational
+func IsExact(obj Value) bool {
+	if p, ok := obj.(*Number); ok {
+		return p.IsExact()
 	}
 	return false
 }
@@ -113,33 +440,114 @@ func AsFloat64Value(obj Value) (float64, error) {
 
 func AsInt64Value(obj Value) (int64, error) {
 	if p, ok := obj.(*Number); ok {
-		return int64(p.Value), nil
+		return p.Int64Value(), nil
 	}
 	return 0, NewError(ArgumentErrorKey, "Expected a <number>, got a ", obj.Type())
 }
 
 func AsIntValue(obj Value) (int, error) {
 	if p, ok := obj.(*Number); ok {
-		return int(p.Value), nil
+		return p.IntValue(), nil
 	}
 	return 0, NewError(ArgumentErrorKey, "Expected a <number>, got a ", obj.Type())
 }
 
 func AsByteValue(obj Value) (byte, error) {
 	if p, ok := obj.(*Number); ok {
+		if p.Value < 0 || p.Value > 255 || p.Value != float64(int(p.Value)) {
+			return 0, NewError(ArgumentErrorKey, "Expected a byte from 0 to 255, got ", p)
+		}
 		return byte(p.Value), nil
 	}
 	return 0, NewError(ArgumentErrorKey, "Expected a <number>, got a ", obj.Type())
 }
 
-var randomGenerator = rand.New(rand.NewSource(1))
+// RandomGeneratorType - the type of the seedable generators of random numbers
+var RandomGeneratorType Value = Intern("<random-generator>")
+
+// RandomGenerator - a source of pseudo-random numbers, which produces the same numbers whenever it has the same
+// seed, so that a program using it can be reproduced. It is safe to use from more than one goroutine.
+type RandomGenerator struct {
+	mutex sync.Mutex
+	rng   *rand.Rand
+}
+
+func (gen *RandomGenerator) Type() Value {
+	return RandomGeneratorType
+}
+
+func (gen *RandomGenerator) String() string {
+	return "#[random-generator]"
+}
+
+func (gen *RandomGenerator) Equals(another Value) bool {
+	return gen == another
+}
+
+// NewRandomGenerator - a generator seeded with the seed
+func NewRandomGenerator(seed int64) *RandomGenerator {
+	return &RandomGenerator{rng: rand.New(rand.NewSource(seed))}
+}
 
+// Seed - start the generator over from the seed
+func (gen *RandomGenerator) Seed(seed int64) {
+	gen.mutex.Lock()
+	defer gen.mutex.Unlock()
+	gen.rng.Seed(seed)
+}
+
+// Float - a random float at least min and less than max
+func (gen *RandomGenerator) Float(min float64, max float64) *Number {
+	gen.mutex.Lock()
+	defer gen.mutex.Unlock()
+	return Float(min + (gen.rng.Float64() * (max - min)))
+}
+
+// Integer - a random integer at least min and less than max
+func (gen *RandomGenerator) Integer(min int64, max int64) (*Number, error) {
+	if max <= min || max-min <= 0 {
+		return nil, NewError(ArgumentErrorKey, "random expected a range of at least one 64 bit integer, got ", min, " to ", max)
+	}
+	gen.mutex.Lock()
+	defer gen.mutex.Unlock()
+	return Int64(min + gen.rng.Int63n(max-min)), nil
+}
+
+// Random - a random number at least min and less than max, from the generator. It is an exact integer if both
+// of the bounds are, otherwise a float.
+func (gen *RandomGenerator) Random(min *Number, max *Number) (*Number, error) {
+	if min.IsExactInteger() && max.IsExactInteger() {
+		lo, hi := min.Rat().Num(), max.Rat().Num()
+		if !lo.IsInt64() || !hi.IsInt64() {
+			return nil, NewError(ArgumentErrorKey, "random expected 64 bit integer bounds, got ", min, " and ", max)
+		}
+		return gen.Integer(lo.Int64(), hi.Int64())
+	}
+	return gen.Float(min.Value, max.Value), nil
+}
+
+var randomGenerator = NewRandomGenerator(1)
+
+// RandomSeed - seed the default generator
 func RandomSeed(n int64) {
-	randomGenerator = rand.New(rand.NewSource(n))
+	randomGenerator.Seed(n)
 }
 
+// Random - a random float from the default generator, at least min and less than max
 func Random(min float64, max float64) *Number {
-	return Float(min + (randomGenerator.Float64() * (max - min)))
+	return randomGenerator.Float(min, max)
+}
+
+// RandomBytes - a blob of cryptographically secure random bytes, which no seed reproduces
+func RandomBytes(count int) (*Blob, error) {
+	if count < 0 {
+		return nil, NewError(ArgumentErrorKey, "random-bytes expected a non-negative count, got ", count)
+	}
+	b := make([]byte, count)
+	if _, err := crand.Read(b); err != nil {
+		return nil, NewError(IOErrorKey, err.Error())
+	}
+	return NewBlob(b), nil
 }
 
 func RandomList(size int, min float64, max float64) *List {
@@ -162,7 +570,7 @@ func RandomList(size int, min float64, max float64) *List {
 // IntValue - return native int value of the object
 func IntValue(obj Value) int {
 	if p, ok := obj.(*Number); ok {
-		return int(p.Value)
+		return p.IntValue()
 	}
 	return 0
 }
@@ -170,7 +578,7 @@ func IntValue(obj Value) int {
 // Int64Value - return native int64 value of the object
 func Int64Value(obj Value) int64 {
 	if p, ok := obj.(*Number); ok {
-		return int64(p.Value)
+		return p.Int64Value()
 	}
 	return 0
 }
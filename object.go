@@ -24,3 +24,36 @@ import (
 func Identical(o1 Value, o2 Value) bool {
 	return o1 == o2
 }
+
+// recordFields - the fields of the record, an instance of the type with a vector value, as defrecord makes
+func recordFields(obj Value, typ Value, idx int) ([]Value, error) {
+	if p, ok := obj.(*Instance); ok && p.TypeTag == typ {
+		if vec, ok := p.Value.(*Vector); ok && idx >= 0 && idx < len(vec.Elements) {
+			return vec.Elements, nil
+		}
+		return nil, NewError(ArgumentErrorKey, "Record field index out of range for ", typ, ": ", idx)
+	}
+	return nil, NewError(ArgumentErrorKey, "Expected a ", typ, ", got a ", obj.Type())
+}
+
+// RecordRef - the value of the field at the index of the record of the type
+func RecordRef(obj Value, typ Value, idx int) (Value, error) {
+	fields, err := recordFields(obj, typ, idx)
+	if err != nil {
+		return nil, err
+	}
+	return fields[idx], nil
+}
+
+// RecordSet - set the field at the index of the record of the type to the value
+func RecordSet(obj Value, typ Value, idx int, val Value) error {
+	fields, err := recordFields(obj, typ, idx)
+	if err != nil {
+		return err
+	}
+	if err := checkMutable(obj, "record-set!"); err != nil {
+		return err
+	}
+	fields[idx] = val
+	return nil
+}
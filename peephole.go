@@ -0,0 +1,222 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	. "github.com/boynton/ell/data"
+)
+
+// peephole - whether the compiler optimizes the code it emits. It is turned off by --nopeephole, to see the
+// code exactly as it was compiled when debugging.
+var peephole = true
+
+// instruction - a decoded instruction. The target of a jump is the index of the instruction it jumps to, so
+// that instructions can be removed and the offsets recomputed.
+type instruction struct {
+	op      int
+	args    []int
+	target  int
+	label   bool //the target of some jump, so the instruction cannot be merged with the one before it
+	deleted bool
+	loc     *Location //the source location of a call
+}
+
+func opSize(op int) int {
+	if isPrimop(op) {
+		return 1
+	}
+	switch op {
+	case opcodePop, opcodeReturn, opcodeUncatch, opcodeDup:
+		return 1
+	case opcodeLocal, opcodeSetLocal, opcodeCallGlobal, opcodeTailCallGlobal, opcodeCallLiteral, opcodeTailCallLiteral:
+		return 3
+	default:
+		return 2
+	}
+}
+
+func isJump(op int) bool {
+	return op == opcodeJump || op == opcodeJumpFalse || op == opcodeCatch
+}
+
+// optimize - a peephole pass over the code:
+//   - a jump to a jump goes directly to the final target, and a jump to a return is a return
+//   - a jump to the next instruction is removed
+//   - a value that is pushed and immediately popped is not pushed at all
+//   - a global or literal followed by a call is a single callglobal or callliteral instruction
+func (code *Code) optimize() {
+	instrs := decodeInstructions(code.ops, code.locations)
+	for changed := true; changed; {
+		changed = false
+		for i := range instrs {
+			if !instrs[i].deleted && optimizeInstruction(instrs, i) {
+				markLabels(instrs)
+				changed = true
+			}
+		}
+	}
+	code.ops, code.locations = encodeInstructions(instrs)
+}
+
+func optimizeInstruction(instrs []instruction, i int) bool {
+	instr := &instrs[i]
+	next := nextInstruction(instrs, i+1)
+	switch instr.op {
+	case opcodeJump, opcodeJumpFalse:
+		changed := false
+		if target := threadJump(instrs, i); target != instr.target {
+			instr.target = target
+			changed = true
+		}
+		if instr.op == opcodeJump {
+			if instr.target < len(instrs) && instrs[instr.target].op == opcodeReturn {
+				instr.op, instr.args = opcodeReturn, nil
+				return true
+			} else if instr.target == next {
+				instr.deleted = true
+				return true
+			}
+		}
+		return changed
+	}
+	if next == len(instrs) || instrs[next].label {
+		return false
+	}
+	switch instr.op {
+	case opcodeLiteral, opcodeLocal, opcodeDup, opcodeClosure:
+		if instrs[next].op == opcodePop {
+			instr.deleted = true
+			instrs[next].deleted = true
+			return true
+		}
+		if instr.op == opcodeLiteral {
+			return fuseCall(instr, &instrs[next], opcodeCallLiteral, opcodeTailCallLiteral)
+		}
+	case opcodeGlobal:
+		return fuseCall(instr, &instrs[next], opcodeCallGlobal, opcodeTailCallGlobal)
+	}
+	return false
+}
+
+func decodeInstructions(ops []int, locations []pcLocation) []instruction {
+	var instrs []instruction
+	index := make(map[int]int) //pc to instruction index
+	for pc := 0; pc < len(ops); {
+		op := ops[pc]
+		size := opSize(op)
+		index[pc] = len(instrs)
+		instr := instruction{op: op, args: append([]int(nil), ops[pc+1:pc+size]...)}
+		for len(locations) > 0 && locations[0].pc <= pc+size {
+			if locations[0].pc == pc+size {
+				instr.loc = locations[0].loc
+			}
+			locations = locations[1:]
+		}
+		if isJump(op) {
+			instr.target = pc + ops[pc+1] //the pc for now, converted to an index below
+		}
+		instrs = append(instrs, instr)
+		pc += size
+	}
+	index[len(ops)] = len(instrs)
+	for i := range instrs {
+		if isJump(instrs[i].op) {
+			instrs[i].target = index[instrs[i].target]
+		}
+	}
+	markLabels(instrs)
+	return instrs
+}
+
+func markLabels(instrs []instruction) {
+	for i := range instrs {
+		instrs[i].label = false
+	}
+	for i := range instrs {
+		if !instrs[i].deleted && isJump(instrs[i].op) {
+			if target := nextInstruction(instrs, instrs[i].target); target < len(instrs) {
+				instrs[target].label = true
+			}
+		}
+	}
+}
+
+// nextInstruction - the index of the first instruction at or after i that has not been deleted
+func nextInstruction(instrs []instruction, i int) int {
+	for i < len(instrs) && instrs[i].deleted {
+		i++
+	}
+	return i
+}
+
+// threadJump - the final target of a jump that lands on other jumps. A conditional jump is not threaded
+// backwards, since only an unconditional jump back checks for interrupts.
+func threadJump(instrs []instruction, i int) int {
+	target := nextInstruction(instrs, instrs[i].target)
+	for n := 0; n < len(instrs) && target < len(instrs) && instrs[target].op == opcodeJump; n++ {
+		next := nextInstruction(instrs, instrs[target].target)
+		if instrs[i].op == opcodeJumpFalse && next <= i {
+			break
+		}
+		target = next
+	}
+	return target
+}
+
+// fuseCall - turn a global or literal followed by a call into a single instruction
+func fuseCall(instr *instruction, next *instruction, callOp int, tailCallOp int) bool {
+	switch next.op {
+	case opcodeCall:
+		next.op = callOp
+	case opcodeTailCall:
+		next.op = tailCallOp
+	default:
+		return false
+	}
+	next.args = []int{next.args[0], instr.args[0]}
+	instr.deleted = true
+	return true
+}
+
+func encodeInstructions(instrs []instruction) ([]int, []pcLocation) {
+	pcs := make([]int, len(instrs)+1)
+	pc := 0
+	for i, instr := range instrs {
+		pcs[i] = pc
+		if !instr.deleted {
+			pc += opSize(instr.op)
+		}
+	}
+	pcs[len(instrs)] = pc
+	ops := make([]int, 0, pc)
+	var locations []pcLocation
+	for i, instr := range instrs {
+		if instr.deleted {
+			continue
+		}
+		ops = append(ops, instr.op)
+		if isJump(instr.op) {
+			ops = append(ops, pcs[nextInstruction(instrs, instr.target)]-pcs[i])
+		} else {
+			ops = append(ops, instr.args...)
+		}
+		if instr.loc != nil {
+			locations = append(locations, pcLocation{pc: len(ops), loc: instr.loc})
+		}
+	}
+	return ops, locations
+}
@@ -0,0 +1,362 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	. "github.com/boynton/ell/data"
+)
+
+// PortType - the type of Ell's port object, which characters or bytes are read from or written to
+var PortType Value = Intern("<port>")
+
+// Port - an input or an output port, either textual or binary. A string or blob output port collects what
+// is written to it in memory.
+type Port struct {
+	name   string
+	reader *Reader       // non-nil for input ports
+	writer io.Writer     // non-nil for output ports
+	buf    *bytes.Buffer // non-nil for string and blob output ports
+	binary bool          // true if the port reads or writes bytes rather than characters
+	closer io.Closer     // non-nil if closing the port closes the file it reads or writes
+	closed bool
+}
+
+func (port *Port) Type() Value {
+	return PortType
+}
+
+func (port *Port) String() string {
+	s := "#[output-port"
+	if port.reader != nil {
+		s = "#[input-port"
+	}
+	if port.binary {
+		s = "#[binary-" + s[2:]
+	}
+	if port.name != "" {
+		s += " " + port.name
+	}
+	if port.closed {
+		s += " CLOSED"
+	}
+	return s + "]"
+}
+
+func (port1 *Port) Equals(another Value) bool {
+	if port2, ok := another.(*Port); ok {
+		return port1 == port2
+	}
+	return false
+}
+
+// NewInputPort - create a port that reads from the reader
+func NewInputPort(r io.Reader, name string) *Port {
+	reader := &Reader{
+		Input:    bufio.NewReader(r),
+		Position: 0,
+		File:     name,
+	}
+	reader.Extension = &EllReaderExtension{r: reader}
+	return &Port{name: name, reader: reader}
+}
+
+// NewOutputPort - create a port that writes to the writer
+func NewOutputPort(w io.Writer, name string) *Port {
+	return &Port{name: name, writer: w}
+}
+
+// NewBinaryInputPort - create a port that reads bytes from the reader
+func NewBinaryInputPort(r io.Reader, name string) *Port {
+	port := NewInputPort(r, name)
+	port.binary = true
+	return port
+}
+
+// NewBinaryOutputPort - create a port that writes bytes to the writer
+func NewBinaryOutputPort(w io.Writer, name string) *Port {
+	return &Port{name: name, writer: w, binary: true}
+}
+
+// NewStringInputPort - create a port that reads the characters of the string
+func NewStringInputPort(s string) *Port {
+	return NewInputPort(strings.NewReader(s), "")
+}
+
+// NewStringOutputPort - create a port that collects what is written to it, for OutputString
+func NewStringOutputPort() *Port {
+	buf := new(bytes.Buffer)
+	return &Port{writer: buf, buf: buf}
+}
+
+// NewBlobInputPort - create a port that reads the bytes of the blob
+func NewBlobInputPort(b *Blob) *Port {
+	return NewBinaryInputPort(bytes.NewReader(b.Value), "")
+}
+
+// NewBlobOutputPort - create a port that collects the bytes written to it, for OutputBlob
+func NewBlobOutputPort() *Port {
+	buf := new(bytes.Buffer)
+	return &Port{writer: buf, buf: buf, binary: true}
+}
+
+// IsBinary - return true if the port reads or writes bytes rather than characters
+func (port *Port) IsBinary() bool {
+	return port.binary
+}
+
+// IsInputPort - return true if the object is an input port
+func IsInputPort(obj Value) bool {
+	port, ok := obj.(*Port)
+	return ok && port.reader != nil
+}
+
+// IsOutputPort - return true if the object is an output port
+func IsOutputPort(obj Value) bool {
+	port, ok := obj.(*Port)
+	return ok && port.writer != nil
+}
+
+// stdinSymbol, stdoutSymbol, stderrSymbol - the globals *stdin*, *stdout*, and *stderr*, which are bound to
+// ports on the standard input, output, and error of the process. Text written without a port goes to the value
+// of *stdout*, so setting it redirects the output of print, display, and the like.
+var stdinSymbol = Intern("*stdin*")
+var stdoutSymbol = Intern("*stdout*")
+var stderrSymbol = Intern("*stderr*")
+
+// the standard input port shares its buffer with the debugger and the plain REPL
+var stdinPort = NewInputPort(stdinReader, "stdin")
+var stdoutPort = NewOutputPort(os.Stdout, "stdout")
+var stderrPort = NewOutputPort(os.Stderr, "stderr")
+
+// inputPort - the argument as an open input port, binary or textual as specified
+func inputPort(obj Value, binary bool) (*Port, error) {
+	if port, ok := obj.(*Port); ok && port.reader != nil && port.binary == binary {
+		if port.closed {
+			return nil, NewError(IOErrorKey, "Port is closed: ", port)
+		}
+		return port, nil
+	}
+	if binary {
+		return nil, NewError(ArgumentErrorKey, "Expected a binary input <port>, got ", obj)
+	}
+	return nil, NewError(ArgumentErrorKey, "Expected a textual input <port>, got ", obj)
+}
+
+// outputPort - the argument as an open output port, binary or textual as specified, with null meaning the
+// value of *stdout* for text, and standard output for bytes
+func outputPort(obj Value, binary bool) (*Port, error) {
+	if obj == Null && !binary {
+		if port := GetGlobal(stdoutSymbol); port != nil {
+			obj = port
+		}
+	}
+	if obj == Null {
+		return &Port{name: "stdout", writer: os.Stdout, binary: binary}, nil
+	}
+	if port, ok := obj.(*Port); ok && port.writer != nil && port.binary == binary {
+		if port.closed {
+			return nil, NewError(IOErrorKey, "Port is closed: ", port)
+		}
+		return port, nil
+	}
+	if binary {
+		return nil, NewError(ArgumentErrorKey, "Expected a binary output <port>, got ", obj)
+	}
+	return nil, NewError(ArgumentErrorKey, "Expected a textual output <port>, got ", obj)
+}
+
+// WriteString - write the string to the output port
+func (port *Port) WriteString(s string) error {
+	_, err := io.WriteString(port.writer, s)
+	if err != nil {
+		return NewError(IOErrorKey, err.Error())
+	}
+	return nil
+}
+
+// WriteBytes - write the bytes to the output port
+func (port *Port) WriteBytes(b []byte) error {
+	_, err := port.writer.Write(b)
+	if err != nil {
+		return NewError(IOErrorKey, err.Error())
+	}
+	return nil
+}
+
+// OutputString - the contents of a string output port so far
+func (port *Port) OutputString() (string, error) {
+	if port.buf == nil || port.binary {
+		return "", NewError(ArgumentErrorKey, "Not a string output port: ", port)
+	}
+	return port.buf.String(), nil
+}
+
+// OutputBlob - a copy of the contents of a blob output port so far
+func (port *Port) OutputBlob() (*Blob, error) {
+	if port.buf == nil || !port.binary {
+		return nil, NewError(ArgumentErrorKey, "Not a blob output port: ", port)
+	}
+	return NewBlob(append([]byte{}, port.buf.Bytes()...)), nil
+}
+
+// ReadChar - read the next character from the input port, returning null at the end of the input.
+// If peek is true, the character is left to be read again.
+func (port *Port) ReadChar(peek bool) (Value, error) {
+	r, _, err := port.reader.Input.ReadRune()
+	if err != nil {
+		if err == io.EOF {
+			return Null, nil
+		}
+		return nil, NewError(IOErrorKey, err.Error())
+	}
+	if peek {
+		port.reader.Input.UnreadRune()
+	}
+	return NewCharacter(r), nil
+}
+
+// ReadByteValue - read the next byte from the input port, returning null at the end of the input. If peek
+// is true, the byte is left to be read again.
+func (port *Port) ReadByteValue(peek bool) (Value, error) {
+	b, err := port.reader.Input.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			return Null, nil
+		}
+		return nil, NewError(IOErrorKey, err.Error())
+	}
+	if peek {
+		port.reader.Input.UnreadByte()
+	}
+	return Integer(int(b)), nil
+}
+
+// ReadBytes - read up to n bytes from the input port into a blob, which is shorter than n only at the end
+// of the input. Null is returned if the input is already at its end.
+func (port *Port) ReadBytes(n int) (Value, error) {
+	b := make([]byte, n)
+	count, err := io.ReadFull(port.reader.Input, b)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF && n > 0 {
+			return Null, nil
+		}
+		if err != io.EOF {
+			return nil, NewError(IOErrorKey, err.Error())
+		}
+	}
+	return NewBlob(b[:count]), nil
+}
+
+// ReadString - read up to n characters from the input port into a string, which is shorter than n only at the
+// end of the input. Null is returned if the input is already at its end.
+func (port *Port) ReadString(n int) (Value, error) {
+	var buf strings.Builder
+	for i := 0; i < n; i++ {
+		r, _, err := port.reader.Input.ReadRune()
+		if err != nil {
+			if err != io.EOF {
+				return nil, NewError(IOErrorKey, err.Error())
+			}
+			if i == 0 {
+				return Null, nil
+			}
+			break
+		}
+		buf.WriteRune(r)
+	}
+	return NewString(buf.String()), nil
+}
+
+// ReadLine - read the rest of the current line from the input port, without its newline, returning null at
+// the end of the input
+func (port *Port) ReadLine() (Value, error) {
+	s, err := port.reader.Input.ReadString('\n')
+	if err != nil {
+		if err != io.EOF {
+			return nil, NewError(IOErrorKey, err.Error())
+		}
+		if s == "" {
+			return Null, nil
+		}
+	}
+	return NewString(strings.TrimSuffix(s, "\n")), nil
+}
+
+// Read - read the next value from the input port, returning null at the end of the input
+func (port *Port) Read() (Value, error) {
+	return port.reader.Read()
+}
+
+// OpenInputFile - open a port that reads the file, as bytes if binary is true, otherwise as characters
+func OpenInputFile(path string, binary bool) (*Port, error) {
+	f, err := os.Open(ExpandFilePath(path))
+	if err != nil {
+		return nil, NewError(IOErrorKey, err.Error())
+	}
+	port := NewInputPort(f, path)
+	port.binary = binary
+	port.closer = f
+	closeWhenCollected(port)
+	return port, nil
+}
+
+// OpenOutputFile - open a port that writes the file, as bytes if binary is true, otherwise as characters.
+// The file is created if necessary, and is truncated unless append is true.
+func OpenOutputFile(path string, binary bool, append bool) (*Port, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if append {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(ExpandFilePath(path), flags, 0644)
+	if err != nil {
+		return nil, NewError(IOErrorKey, err.Error())
+	}
+	port := &Port{name: path, writer: f, binary: binary, closer: f}
+	closeWhenCollected(port)
+	return port, nil
+}
+
+// closeWhenCollected - close the port when it is garbage collected, if it has not been closed, so that a port
+// that is dropped without being closed does not hold on to its file
+func closeWhenCollected(port *Port) {
+	runtime.SetFinalizer(port, func(port *Port) {
+		ClosePort(port)
+	})
+}
+
+// ClosePort - close the port, and the file it reads or writes, if any. Reading from or writing to it
+// afterwards is an error.
+func ClosePort(port *Port) error {
+	if port.closed {
+		return nil
+	}
+	port.closed = true
+	runtime.SetFinalizer(port, nil)
+	if port.closer != nil {
+		if err := port.closer.Close(); err != nil {
+			return NewError(IOErrorKey, err.Error())
+		}
+	}
+	return nil
+}
@@ -18,14 +18,20 @@ package ell
 
 // the primitive functions for the languages
 import (
+	"bytes"
 	"fmt"
-	"github.com/pborman/uuid"
+	"io/ioutil"
 	"math"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
+	osexec "os/exec"
+	"reflect"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	. "github.com/boynton/ell/data"
 )
@@ -36,14 +42,27 @@ func InitPrimitives() {
 	DefineMacro("letrec", ellLetrec)
 	DefineMacro("cond", ellCond)
 	DefineMacro("quasiquote", ellQuasiquote)
+	DefineMacro("export", ellExport)
+	DefineMacro("delay", ellDelay)
+	DefineMacro("future", ellFuture)
 
 	DefineGlobal("null", Null)
 	DefineGlobal("true", True)
 	DefineGlobal("false", False)
 
-	DefineGlobal("apply", Apply)
 	DefineGlobal("callcc", CallCC)
 	DefineGlobal("spawn", Spawn)
+	DefineGlobal("wind", Wind)
+	DefineGlobal("unwind", Unwind)
+
+	DefineGlobal(StringValue(traceMacrosSymbol), False)
+	DefineGlobal(StringValue(checkTypesSymbol), False)
+	DefineGlobal(StringValue(printLengthSymbol), Null)
+	DefineGlobal(StringValue(printDepthSymbol), Null)
+	DefineGlobal(StringValue(printSortedSymbol), False)
+	DefineGlobal(StringValue(stdinSymbol), stdinPort)
+	DefineGlobal(StringValue(stdoutSymbol), stdoutPort)
+	DefineGlobal(StringValue(stderrSymbol), stderrPort)
 
 	DefineFunction("version", ellVersion, StringType)
 	DefineFunction("boolean?", ellBooleanP, BooleanType, AnyType)
@@ -56,38 +75,78 @@ func InitPrimitives() {
 	DefineFunction("type", ellType, TypeType, AnyType)
 	DefineFunction("value", ellValue, AnyType, AnyType)
 	DefineFunction("instance", ellInstance, AnyType, TypeType, AnyType)
+	DefineFunction("record-ref", ellRecordRef, AnyType, AnyType, TypeType, NumberType)
+	DefineFunction("record-set!", ellRecordSetBang, NullType, AnyType, TypeType, NumberType, AnyType)
 
 	DefineFunction("type?", ellTypeP, BooleanType, AnyType)
 	DefineFunction("type-name", ellTypeName, SymbolType, TypeType)
 	DefineFunction("keyword?", ellKeywordP, BooleanType, AnyType)
 	DefineFunction("keyword-name", ellKeywordName, SymbolType, KeywordType)
 	DefineFunction("to-keyword", ellToKeyword, KeywordType, AnyType)
+	DefineFunction("keyword->symbol", ellKeywordName, SymbolType, KeywordType)
+	DefineFunction("string->keyword", ellStringToKeyword, KeywordType, StringType)
 	DefineFunction("symbol?", ellSymbolP, BooleanType, AnyType)
 	DefineFunctionRestArgs("symbol", ellSymbol, SymbolType, AnyType, AnyType) //"(<any> <any>*) <symbol>")
+	DefineFunctionOptionalArgs("gensym", ellGensym, SymbolType, []Value{AnyType}, NewString("g"))
 
 	DefineFunctionRestArgs("string?", ellStringP, BooleanType, AnyType)
 	DefineFunctionRestArgs("string", ellString, StringType, AnyType) //"(<any>*) <string>")
 	DefineFunction("to-string", ellToString, StringType, AnyType)
 	DefineFunction("string-length", ellStringLength, NumberType, StringType)
+	DefineFunctionRestArgs("string-builder", ellStringBuilder, StringBuilderType, AnyType)
+	DefineFunction("string-builder?", ellStringBuilderP, BooleanType, AnyType)
+	DefineFunctionRestArgs("append!", ellAppendBang, StringBuilderType, AnyType, StringBuilderType)
+	DefineFunction("string-builder->string", ellStringBuilderToString, StringType, StringBuilderType)
+	DefineFunctionRestArgs("format", ellFormat, StringType, AnyType, StringType)
 	DefineFunction("split", ellSplit, ListType, StringType, StringType)
 	DefineFunction("join", ellJoin, ListType, ListType, StringType) // <list|vector> for both arg1 and result could work
 	DefineFunction("character?", ellCharacterP, BooleanType, AnyType)
 	DefineFunction("to-character", ellToCharacter, CharacterType, AnyType)
-	DefineFunction("substring", ellSubstring, StringType, StringType, NumberType, NumberType)
+	DefineFunction("char-alphabetic?", ellCharAlphabeticP, BooleanType, CharacterType)
+	DefineFunction("char-numeric?", ellCharNumericP, BooleanType, CharacterType)
+	DefineFunction("char-whitespace?", ellCharWhitespaceP, BooleanType, CharacterType)
+	DefineFunction("char-upper-case?", ellCharUpperCaseP, BooleanType, CharacterType)
+	DefineFunction("char-lower-case?", ellCharLowerCaseP, BooleanType, CharacterType)
+	DefineFunction("char-upcase", ellCharUpcase, CharacterType, CharacterType)
+	DefineFunction("char-downcase", ellCharDowncase, CharacterType, CharacterType)
+	DefineFunction("char->integer", ellCharToInteger, NumberType, CharacterType)
+	DefineFunction("integer->char", ellIntegerToChar, CharacterType, NumberType)
+	DefineFunctionOptionalArgs("substring", ellSubstring, StringType, []Value{StringType, NumberType, NumberType}, MinusOne)
+	DefineFunction("string-ref", ellStringRef, CharacterType, StringType, NumberType)
+	DefineFunctionOptionalArgs("string-index", ellStringIndex, NumberType, []Value{StringType, StringType, NumberType}, Zero)
+	DefineFunction("string-contains?", ellStringContainsP, BooleanType, StringType, StringType)
+	DefineFunction("string-starts-with?", ellStringStartsWithP, BooleanType, StringType, StringType)
+	DefineFunction("string-ends-with?", ellStringEndsWithP, BooleanType, StringType, StringType)
+	DefineFunctionOptionalArgs("string-replace", ellStringReplace, StringType, []Value{StringType, StringType, StringType, NumberType}, MinusOne)
+	DefineFunctionOptionalArgs("string-trim", ellStringTrim, StringType, []Value{StringType, AnyType}, Null)
+	DefineFunctionOptionalArgs("string-trim-left", ellStringTrimLeft, StringType, []Value{StringType, AnyType}, Null)
+	DefineFunctionOptionalArgs("string-trim-right", ellStringTrimRight, StringType, []Value{StringType, AnyType}, Null)
+	DefineFunction("string-upcase", ellStringUpcase, StringType, StringType)
+	DefineFunction("string-downcase", ellStringDowncase, StringType, StringType)
 
 	DefineFunction("blob?", ellBlobP, BooleanType, AnyType)
 	DefineFunction("to-blob", ellToBlob, BlobType, AnyType)
-	DefineFunction("make-blob", ellMakeBlob, BlobType, NumberType)
+	DefineFunctionOptionalArgs("make-blob", ellMakeBlob, BlobType, []Value{NumberType, NumberType}, Zero)
 	DefineFunction("blob-length", ellBlobLength, NumberType, BlobType)
 	DefineFunction("blob-ref", ellBlobRef, NumberType, BlobType, NumberType)
+	DefineFunction("blob-set!", ellBlobSetBang, NullType, BlobType, NumberType, NumberType)
+	DefineFunction("blob->string", ellBlobToString, StringType, BlobType)
+	DefineFunction("string->blob", ellStringToBlob, BlobType, StringType)
+	DefineFunction("subblob", ellSubblob, BlobType, BlobType, NumberType, NumberType)
 
 	DefineFunction("number?", ellNumberP, BooleanType, AnyType)
 	DefineFunction("int?", ellIntP, BooleanType, AnyType)
 	DefineFunction("float?", ellFloatP, BooleanType, AnyType)
+	DefineFunction("exact?", ellExactP, BooleanType, NumberType)
+	DefineFunction("inexact?", ellInexactP, BooleanType, NumberType)
 	DefineFunction("to-number", ellToNumber, NumberType, AnyType)
 	DefineFunction("int", ellInt, NumberType, AnyType)
+	DefineFunction("exact", ellExact, NumberType, NumberType)
+	DefineFunction("inexact", ellInexact, NumberType, NumberType)
 	DefineFunction("floor", ellFloor, NumberType, NumberType)
 	DefineFunction("ceiling", ellCeiling, NumberType, NumberType)
+	DefineFunction("truncate", ellTruncate, NumberType, NumberType)
+	DefineFunction("round", ellRound, NumberType, NumberType)
 	DefineFunction("inc", ellInc, NumberType, NumberType)
 	DefineFunction("dec", ellDec, NumberType, NumberType)
 	DefineFunction("+", ellAdd, NumberType, NumberType, NumberType)
@@ -96,7 +155,7 @@ func InitPrimitives() {
 	DefineFunction("/", ellDiv, NumberType, NumberType, NumberType)
 	DefineFunction("quotient", ellQuotient, NumberType, NumberType, NumberType)
 	DefineFunction("remainder", ellRemainder, NumberType, NumberType, NumberType)
-	DefineFunction("modulo", ellRemainder, NumberType, NumberType, NumberType) //fix
+	DefineFunction("modulo", ellModulo, NumberType, NumberType, NumberType)
 	DefineFunction("=", ellNumEqual, BooleanType, NumberType, NumberType)
 	DefineFunction("<=", ellNumLessEqual, BooleanType, NumberType, NumberType)
 	DefineFunction(">=", ellNumGreaterEqual, BooleanType, NumberType, NumberType)
@@ -105,7 +164,20 @@ func InitPrimitives() {
 	DefineFunction("zero?", ellZeroP, BooleanType, NumberType)
 	DefineFunction("abs", ellAbs, NumberType, NumberType)
 	DefineFunction("exp", ellExp, NumberType, NumberType)
+	DefineFunction("sqrt", ellSqrt, NumberType, NumberType)
+	DefineFunction("expt", ellExpt, NumberType, NumberType, NumberType)
+	DefineFunctionRestArgs("min", ellMin, NumberType, NumberType, NumberType)
+	DefineFunctionRestArgs("max", ellMax, NumberType, NumberType, NumberType)
+	DefineFunctionRestArgs("gcd", ellGCD, NumberType, NumberType)
+	DefineFunctionRestArgs("lcm", ellLCM, NumberType, NumberType)
 	DefineFunction("log", ellLog, NumberType, NumberType)
+	DefineFunctionRestArgs("bit-and", ellBitAnd, NumberType, NumberType)
+	DefineFunctionRestArgs("bit-or", ellBitOr, NumberType, NumberType)
+	DefineFunctionRestArgs("bit-xor", ellBitXor, NumberType, NumberType)
+	DefineFunction("bit-not", ellBitNot, NumberType, NumberType)
+	DefineFunction("arithmetic-shift", ellArithmeticShift, NumberType, NumberType, NumberType)
+	DefineFunction("logical-shift-right", ellLogicalShiftRight, NumberType, NumberType, NumberType)
+	DefineFunction("bit-count", ellBitCount, NumberType, NumberType)
 	DefineFunction("sin", ellSin, NumberType, NumberType)
 	DefineFunction("cos", ellCos, NumberType, NumberType)
 	DefineFunction("tan", ellTan, NumberType, NumberType)
@@ -124,9 +196,22 @@ func InitPrimitives() {
 	DefineFunction("set-cdr!", ellSetCdrBang, NullType, ListType, ListType)
 	DefineFunction("list-length", ellListLength, NumberType, ListType)
 	DefineFunction("reverse", ellReverse, ListType, ListType)
+	DefineFunction("reverse!", ellReverseBang, ListType, ListType)
 	DefineFunctionRestArgs("list", ellList, ListType, AnyType)
 	DefineFunctionRestArgs("concat", ellConcat, ListType, ListType)
-	DefineFunctionRestArgs("flatten", ellFlatten, ListType, ListType)
+	DefineFunctionRestArgs("append", ellConcat, ListType, ListType)
+	DefineFunction("flatten", ellFlatten, ListType, ListType)
+	DefineFunction("last", ellLast, AnyType, ListType)
+	DefineFunction("member", ellMember, AnyType, AnyType, ListType)
+	DefineFunction("memq", ellMemq, AnyType, AnyType, ListType)
+	DefineFunction("assq", ellAssq, AnyType, AnyType, ListType)
+	DefineFunction("take", nil, AnyType, NumberType, AnyType)
+	defineCallback("take", ellTake)
+	DefineFunction("drop", nil, AnyType, NumberType, AnyType)
+	defineCallback("drop", ellDrop)
+	DefineFunctionRestArgs("range", ellRange, ListType, NumberType, NumberType)
+	DefineFunction("list-tabulate", nil, ListType, NumberType, FunctionType)
+	defineCallback("list-tabulate", ellListTabulate)
 
 	DefineFunction("vector?", ellVectorP, BooleanType, AnyType)
 	DefineFunction("to-vector", ellToVector, VectorType, AnyType)
@@ -136,41 +221,207 @@ func InitPrimitives() {
 	DefineFunction("vector-length", ellVectorLength, NumberType, VectorType)
 	DefineFunction("vector-ref", ellVectorRef, AnyType, VectorType, NumberType)
 	DefineFunction("vector-set!", ellVectorSetBang, NullType, VectorType, NumberType, AnyType)
+	DefineFunction("vector-assoc", ellVectorAssoc, VectorType, VectorType, NumberType, AnyType)
+	DefineFunctionOptionalArgs("subvector", ellSubvector, VectorType, []Value{VectorType, NumberType, NumberType}, MinusOne)
+	DefineFunctionOptionalArgs("vector-fill!", ellVectorFillBang, NullType, []Value{VectorType, AnyType, NumberType, NumberType}, Zero, MinusOne)
+	DefineFunctionRestArgs("vector-append", ellVectorAppend, VectorType, VectorType)
+	DefineFunctionRestArgs("vector-map", nil, VectorType, VectorType, FunctionType, VectorType)
+	defineCallback("vector-map", ellVectorMap)
+	DefineFunctionOptionalArgs("vector-copy!", ellVectorCopyBang, NullType, []Value{VectorType, NumberType, VectorType, NumberType, NumberType}, Zero, MinusOne)
+
+	DefineFunction("copy", ellCopy, AnyType, AnyType)
+	DefineFunction("deep-copy", ellDeepCopy, AnyType, AnyType)
+	DefineFunction("freeze!", ellFreezeBang, AnyType, AnyType)
+	DefineFunction("frozen?", ellFrozenP, BooleanType, AnyType)
 
 	DefineFunction("struct?", ellStructP, BooleanType, AnyType)
 	DefineFunction("to-struct", ellToStruct, StructType, AnyType)
 	DefineFunctionRestArgs("struct", ellStruct, StructType, AnyType)
 	DefineFunction("make-struct", ellMakeStruct, StructType, NumberType)
 	DefineFunction("struct-length", ellStructLength, NumberType, StructType)
-	DefineFunction("has?", ellHasP, BooleanType, StructType, AnyType) // key is <symbol|keyword|type|string>
-	DefineFunction("get", ellGet, AnyType, StructType, AnyType)
-	DefineFunction("put!", ellPutBang, NullType, StructType, AnyType, AnyType)
+	DefineFunction("has?", ellHasP, BooleanType, AnyType, AnyType)          // <struct|instance|hashmap|vector|string|set|object>
+	DefineFunction("has-key?", ellHasKeyP, BooleanType, AnyType, AnyType)   // <struct|instance>
+	DefineFunction("get", ellGet, AnyType, AnyType, AnyType)                // <struct|instance|hashmap|vector|string|object>
+	DefineFunction("put!", ellPutBang, NullType, AnyType, AnyType, AnyType) // <struct|instance|hashmap|vector|object>
+	DefineFunction("length", ellLength, NumberType, AnyType)
 	DefineFunction("unput!", ellUnputBang, NullType, StructType, AnyType)
-	DefineFunction("keys", ellKeys, ListType, AnyType)     // <struct|instance>
-	DefineFunction("values", ellValues, ListType, AnyType) // <struct|instance>
-
+	DefineFunctionRestArgs("assoc", ellAssoc, AnyType, AnyType, AnyType)            // <struct|instance> key val ..., or key alist
+	DefineFunction("dissoc", ellDissoc, AnyType, AnyType, AnyType)                  // <struct|instance>
+	DefineFunction("keys", ellKeys, ListType, AnyType)                              // <struct|instance>
+	DefineFunction("values", ellValues, ListType, AnyType)                          // <struct|instance>
+	DefineFunctionRestArgs("invoke", ellInvoke, AnyType, AnyType, AnyType, AnyType) // <object> name args ...
+
+	DefineFunction("set?", ellSetP, BooleanType, AnyType)
+	DefineFunction("to-set", ellToSet, SetType, AnyType)
+	DefineFunctionRestArgs("set", ellSet, SetType, AnyType)
+	DefineFunction("set-length", ellSetLength, NumberType, SetType)
+	DefineFunction("set-contains?", ellSetContainsP, BooleanType, SetType, AnyType)
+	DefineFunction("set-add!", ellSetAddBang, NullType, SetType, AnyType)
+	DefineFunction("set-remove!", ellSetRemoveBang, NullType, SetType, AnyType)
+	DefineFunctionRestArgs("set-union", ellSetUnion, SetType, SetType)
+	DefineFunctionRestArgs("set-intersection", ellSetIntersection, SetType, SetType, SetType)
+	DefineFunctionRestArgs("set-difference", ellSetDifference, SetType, SetType, SetType)
+
+	DefineFunction("hash", ellHash, NumberType, AnyType)
+	defineHashMapTag()
+	DefineFunction("hashmap?", ellHashMapP, BooleanType, AnyType)
+	DefineFunction("to-hashmap", ellToHashMap, HashMapType, AnyType)
+	DefineFunctionRestArgs("hashmap", ellHashMap, HashMapType, AnyType)
+	DefineFunction("hashmap-length", ellHashMapLength, NumberType, HashMapType)
+	DefineFunctionOptionalArgs("hashmap-get", ellHashMapGet, AnyType, []Value{HashMapType, AnyType, AnyType}, Null)
+	DefineFunction("hashmap-has?", ellHashMapHasP, BooleanType, HashMapType, AnyType)
+	DefineFunction("hashmap-put!", ellHashMapPutBang, NullType, HashMapType, AnyType, AnyType)
+	DefineFunction("hashmap-remove!", ellHashMapRemoveBang, NullType, HashMapType, AnyType)
+	DefineFunction("hashmap-keys", ellHashMapKeys, ListType, HashMapType)
+	DefineFunction("hashmap-values", ellHashMapValues, ListType, HashMapType)
+
+	DefineFunction("promise?", ellPromiseP, BooleanType, AnyType)
+	DefineFunctionOptionalArgs("promise", ellPromise, PromiseType, []Value{AnyType}, Null)
+	DefineFunction("make-promise", ellMakePromise, PromiseType, AnyType)
+	DefineFunction("force", nil, AnyType, AnyType)
+	defineCallback("force", ellForce)
+	DefineFunction("deliver", ellDeliver, BooleanType, PromiseType, AnyType)
+	DefineFunction("future-call", nil, PromiseType, FunctionType)
+	defineCallback("future-call", ellFutureCall)
+	DefineFunction("lazy-seq?", ellLazySeqP, BooleanType, AnyType)
+	DefineFunction("make-lazy-seq", ellMakeLazySeq, LazySeqType, AnyType, AnyType)
+	DefineFunction("lazy-first", ellLazyFirst, AnyType, LazySeqType)
+	DefineFunction("lazy-rest", nil, AnyType, LazySeqType)
+	defineCallback("lazy-rest", ellLazyRest)
+
+	DefineFunctionRestArgs("map", nil, AnyType, AnyType, FunctionType, AnyType)
+	defineCallback("map", ellMap)
+	DefineFunctionRestArgs("for-each", nil, NullType, AnyType, FunctionType, AnyType)
+	defineCallback("for-each", ellForEach)
+	DefineFunction("filter", nil, AnyType, FunctionType, AnyType)
+	defineCallback("filter", ellFilter)
+	DefineFunction("reduce", nil, AnyType, FunctionType, AnyType, AnyType)
+	defineCallback("reduce", ellReduce)
+	DefineFunction("every?", nil, BooleanType, FunctionType, AnyType)
+	defineCallback("every?", ellEveryP)
+	DefineFunction("any?", nil, BooleanType, FunctionType, AnyType)
+	defineCallback("any?", ellAnyP)
+	DefineFunctionRestArgs("zip", ellZip, ListType, AnyType, AnyType)
+
+	DefineFunctionOptionalArgs("sort", nil, AnyType, []Value{AnyType, AnyType}, Null) // <list|vector> [less?]
+	defineCallback("sort", ellSort)
+	DefineFunctionOptionalArgs("sort!", nil, NullType, []Value{AnyType, AnyType}, Null) // <list|vector> [less?]
+	defineCallback("sort!", ellSortBang)
+	DefineFunctionOptionalArgs("sort-by", nil, AnyType, []Value{AnyType, FunctionType, AnyType}, Null)
+	defineCallback("sort-by", ellSortBy)
+
+	DefineFunctionRestArgs("apply", ellApply, AnyType, AnyType, AnyType, AnyType) // <function> <any>* <list>
+	DefineFunctionRestArgs("funcall", ellFuncall, AnyType, AnyType, AnyType)      // <function> <any>*
+	DefineFunction("identity", ellIdentity, AnyType, AnyType)
 	DefineFunction("function?", ellFunctionP, BooleanType, AnyType)
 	DefineFunction("function-signature", ellFunctionSignature, StringType, FunctionType)
+	DefineFunction("function-name", ellFunctionName, AnyType, FunctionType)
+	DefineFunction("function-arity", ellFunctionArity, ListType, FunctionType)
+	DefineFunction("function-defaults", ellFunctionDefaults, ListType, FunctionType)
+	DefineFunction("function-keys", ellFunctionKeys, ListType, FunctionType)
+	DefineFunction("doc", ellDoc, AnyType, AnyType)
+	DefineFunction("apropos", ellApropos, ListType, StringType)
 	DefineFunctionRestArgs("validate-keyword-arg-list", ellValidateKeywordArgList, ListType, KeywordType, ListType)
 	DefineFunction("slurp", ellSlurp, StringType, StringType)
-	DefineFunction("read", ellRead, AnyType, StringType)
+	DefineFunction("read", ellRead, AnyType, AnyType) // <string|port>
 	DefineFunction("read-all", ellReadAll, AnyType, StringType)
 	DefineFunction("spit", ellSpit, NullType, StringType, StringType)
-	DefineFunctionKeyArgs("write", ellWrite, NullType, []Value{AnyType, StringType}, []Value{EmptyString}, []Value{Intern("indent:")})
-	DefineFunctionKeyArgs("write-all", ellWriteAll, NullType, []Value{AnyType, StringType}, []Value{EmptyString}, []Value{Intern("indent:")})
+	DefineFunctionKeyArgs("read-file", ellReadFile, AnyType, []Value{StringType, BooleanType}, []Value{False}, []Value{Intern("binary:")})
+	DefineFunction("write-file", ellWriteFile, NullType, StringType, AnyType)   // <string|blob>
+	DefineFunction("append-file", ellAppendFile, NullType, StringType, AnyType) // <string|blob>
+	DefineFunction("delete-file", ellDeleteFile, NullType, StringType)
+	DefineFunction("rename-file", ellRenameFile, NullType, StringType, StringType)
+	DefineFunction("file-exists?", ellFileExistsP, BooleanType, StringType)
+	DefineFunction("file-info", ellFileInfo, StructType, StringType)
+	DefineFunction("list-directory", ellListDirectory, ListType, StringType)
+	DefineFunction("make-directory", ellMakeDirectory, NullType, StringType)
+	DefineFunction("gzip", ellGzip, BlobType, AnyType) // <blob|string>
+	DefineFunction("gunzip", ellGunzip, BlobType, BlobType)
+	DefineFunction("zip-entries", ellZipEntries, ListType, StringType)
+	DefineFunction("zip-extract", ellZipExtract, ListType, StringType, StringType)
+	DefineFunctionKeyArgs("write", ellWrite, NullType, []Value{AnyType, StringType, AnyType}, []Value{EmptyString, Null}, []Value{Intern("indent:"), Intern("port:")})
+	DefineFunctionKeyArgs("pprint", ellPprint, NullType, []Value{AnyType, NumberType, AnyType}, []Value{Integer(80), Null}, []Value{Intern("width:"), Intern("port:")})
+	DefineFunctionKeyArgs("write-all", ellWriteAll, NullType, []Value{ListType, StringType}, []Value{EmptyString}, []Value{Intern("indent:")})
 	DefineFunctionRestArgs("print", ellPrint, NullType, AnyType)
 	DefineFunctionRestArgs("println", ellPrintln, NullType, AnyType)
+	DefineFunctionRestArgs("printf", ellPrintf, NullType, AnyType) // [<port>] <string> <any>*
+	DefineFunctionOptionalArgs("display", ellDisplay, NullType, []Value{AnyType, AnyType}, Null)
+	DefineFunctionOptionalArgs("newline", ellNewline, NullType, []Value{AnyType}, Null)
+
+	DefineFunction("port?", ellPortP, BooleanType, AnyType)
+	DefineFunction("input-port?", ellInputPortP, BooleanType, AnyType)
+	DefineFunction("output-port?", ellOutputPortP, BooleanType, AnyType)
+	DefineFunction("open-input-string", ellOpenInputString, PortType, StringType)
+	DefineFunction("open-output-string", ellOpenOutputString, PortType)
+	DefineFunction("get-output-string", ellGetOutputString, StringType, PortType)
+	DefineFunction("read-char", ellReadChar, AnyType, PortType)
+	DefineFunction("peek-char", ellPeekChar, AnyType, PortType)
+	DefineFunction("read-line", ellReadLine, AnyType, PortType)
+	DefineFunction("read-string", ellReadString, AnyType, NumberType, PortType)
+	DefineFunction("eof-object?", ellEOFObjectP, BooleanType, AnyType)
+	DefineFunction("binary-port?", ellBinaryPortP, BooleanType, AnyType)
+	DefineFunctionKeyArgs("open-input-file", ellOpenInputFile, PortType, []Value{StringType, BooleanType, BooleanType}, []Value{False, False}, []Value{Intern("binary:"), Intern("gzip:")})
+	DefineFunctionKeyArgs("open-output-file", ellOpenOutputFile, PortType, []Value{StringType, BooleanType, BooleanType, BooleanType}, []Value{False, False, False}, []Value{Intern("binary:"), Intern("append:"), Intern("gzip:")})
+	DefineFunction("open-input-blob", ellOpenInputBlob, PortType, BlobType)
+	DefineFunction("open-output-blob", ellOpenOutputBlob, PortType)
+	DefineFunction("get-output-blob", ellGetOutputBlob, BlobType, PortType)
+	DefineFunction("read-byte", ellReadByte, AnyType, PortType)
+	DefineFunction("peek-byte", ellPeekByte, AnyType, PortType)
+	DefineFunction("read-bytes", ellReadBytes, AnyType, NumberType, PortType)
+	DefineFunctionOptionalArgs("write-byte", ellWriteByte, NullType, []Value{NumberType, AnyType}, Null)
+	DefineFunctionOptionalArgs("write-bytes", ellWriteBytes, NullType, []Value{BlobType, AnyType}, Null)
 	DefineFunction("macroexpand", ellMacroexpand, AnyType, AnyType)
+	DefineFunction("macroexpand-1", ellMacroexpand1, AnyType, AnyType)
+	DefineFunction("macroexpand-all", ellMacroexpand, AnyType, AnyType)
 	DefineFunction("compile", ellCompile, CodeType, AnyType)
+	DefineFunction("eval", ellEval, AnyType, AnyType)
 
 	DefineFunctionRestArgs("make-error", ellMakeError, ErrorType, AnyType)
 	DefineFunction("error?", ellErrorP, BooleanType, AnyType)
 	DefineFunction("error-data", ellErrorData, AnyType, ErrorType)
+	DefineFunction("error-kind", ellErrorKind, KeywordType, ErrorType)
+	DefineFunction("stack-trace", ellStackTrace, ListType, ErrorType)
+	DefineFunctionRestArgs("raise", ellRaise, NullType, AnyType, AnyType)   //doesn't return
 	DefineFunction("uncaught-error", ellUncaughtError, NullType, ErrorType) //doesn't return
 
 	DefineFunctionKeyArgs("json", ellJSON, StringType, []Value{AnyType, StringType}, []Value{EmptyString}, []Value{Intern("indent:")})
+	DefineFunction("json-parse", ellJSONParse, AnyType, StringType)
+	DefineFunction("yaml-parse", ellYAMLParse, AnyType, StringType)
+	DefineFunction("toml-parse", ellTOMLParse, StructType, StringType)
+	DefineFunction("xml-parse", ellXMLParse, StructType, StringType)
+	DefineFunctionKeyArgs("xml-emit", ellXMLEmit, StringType, []Value{StructType, StringType}, []Value{EmptyString}, []Value{Intern("indent:")})
+	DefineFunction("define-print-method", ellDefinePrintMethod, NullType, TypeType, AnyType)
+	DefineFunctionKeyArgs("define-tag", ellDefineTag, NullType, []Value{SymbolType, AnyType, AnyType, AnyType}, []Value{Null, Null}, []Value{Intern("type:"), Intern("writer:")})
+	DefineFunctionKeyArgs("json-emit", ellJSONEmit, AnyType, []Value{AnyType, StringType, BooleanType, BooleanType, AnyType}, []Value{EmptyString, True, False, Null}, []Value{Intern("indent:"), Intern("sort-keys:"), Intern("escape-unicode:"), Intern("port:")})
 
 	DefineFunctionRestArgs("getfn", ellGetFn, FunctionType, AnyType, SymbolType)
+	DefineFunction("break", ellBreak, NullType)
+	DefineFunction("break-on", ellBreakOn, NullType, AnyType)        // <symbol|function>
+	DefineFunctionRestArgs("unbreak", ellUnbreak, NullType, AnyType) // <symbol|function>*
+	DefineFunction("breakpoints", ellBreakpoints, ListType)
+	DefineFunctionRestArgs("trace", ellTrace, AnyType, AnyType)      // <symbol|function>*
+	DefineFunctionRestArgs("untrace", ellUntrace, NullType, AnyType) // <symbol|function>*
+	DefineFunctionRestArgs("log-debug", logFunction(LogDebug), NullType, AnyType, AnyType)
+	DefineFunctionRestArgs("log-info", logFunction(LogInfo), NullType, AnyType, AnyType)
+	DefineFunctionRestArgs("log-warn", logFunction(LogWarn), NullType, AnyType, AnyType)
+	DefineFunctionRestArgs("log-error", logFunction(LogError), NullType, AnyType, AnyType)
+	DefineFunctionKeyArgs("log-config", ellLogConfig, StructType, []Value{AnyType, AnyType, AnyType, AnyType}, []Value{Null, Null, Null, Null}, []Value{Intern("level:"), Intern("timestamps:"), Intern("json:"), Intern("port:")})
+	DefineFunction("profile-start", ellProfileStart, NullType)
+	DefineFunction("profile-stop", ellProfileStop, NullType)
+	DefineFunction("profile-reset", ellProfileReset, NullType)
+	DefineFunction("profile-report", ellProfileReport, NullType)
+	DefineFunction("profile-write", ellProfileWrite, NullType, StringType)
+	DefineFunctionOptionalArgs("vm-stats", ellVMStats, StructType, []Value{AnyType}, Null)
+	DefineFunction("time-function", nil, AnyType, FunctionType)
+	defineCallback("time-function", ellTimeFunction)
+	DefineFunctionKeyArgs("bench-function", nil, NullType, []Value{FunctionType, NumberType}, []Value{Zero}, []Value{Intern("iterations:")})
+	defineCallback("bench-function", ellBenchFunction)
+	DefineFunction("define-test", ellDefineTest, SymbolType, SymbolType, FunctionType)
+	DefineFunctionRestArgs("assert-equal", ellAssertEqual, BooleanType, AnyType, AnyType, AnyType)
+	DefineFunctionOptionalArgs("assert-error-function", nil, BooleanType, []Value{FunctionType, AnyType}, Null)
+	defineCallback("assert-error-function", ellAssertErrorFunction)
+	DefineFunctionOptionalArgs("run-tests", nil, BooleanType, []Value{StringType}, EmptyString)
+	defineCallback("run-tests", ellRunTests)
 	DefineFunction("method-signature", ellMethodSignature, TypeType, ListType)
 
 	DefineFunction("now", ellNow, NumberType)
@@ -180,26 +431,66 @@ func InitPrimitives() {
 	DefineFunctionKeyArgs("channel", ellChannel, ChannelType, []Value{StringType, NumberType}, []Value{EmptyString, Zero}, []Value{Intern("name:"), Intern("bufsize:")})
 	DefineFunctionOptionalArgs("send", ellSend, NullType, []Value{ChannelType, AnyType, NumberType}, MinusOne)
 	DefineFunctionOptionalArgs("recv", ellReceive, AnyType, []Value{ChannelType, NumberType}, MinusOne)
+	DefineFunctionOptionalArgs("chan", ellChan, ChannelType, []Value{NumberType}, Zero)
+	DefineFunctionOptionalArgs("select", ellSelect, AnyType, []Value{AnyType, NumberType}, MinusOne)
 	DefineFunction("close", ellClose, NullType, AnyType)
 
-	DefineFunction("set-random-seed!", ellSetRandomSeedBang, NullType, NumberType)
-	DefineFunctionRestArgs("random", ellRandom, NumberType, NumberType)
+	DefineFunction("mutex", ellMutex, MutexType)
+	DefineFunction("mutex?", ellMutexP, BooleanType, AnyType)
+	DefineFunction("lock", ellLock, NullType, MutexType)
+	DefineFunction("unlock", ellUnlock, NullType, MutexType)
+	DefineFunction("atom", ellAtom, AtomType, AnyType)
+	DefineFunction("atom?", ellAtomP, BooleanType, AnyType)
+	DefineFunctionOptionalArgs("deref", nil, AnyType, []Value{AnyType, NumberType, AnyType}, MinusOne, Null)
+	defineCallback("deref", ellDeref)
+	DefineFunction("reset!", ellResetBang, AnyType, AtomType, AnyType)
+	DefineFunction("compare-and-set!", ellCompareAndSetBang, BooleanType, AtomType, AnyType, AnyType)
+	DefineFunctionRestArgs("swap!", nil, AnyType, AnyType, AtomType, FunctionType)
+	defineCallback("swap!", ellSwapBang)
+
+	DefineFunctionRestArgs("set-random-seed!", ellSetRandomSeedBang, NullType, AnyType)
+	DefineFunctionRestArgs("random-seed!", ellSetRandomSeedBang, NullType, AnyType) // [<random-generator>] <number>
+	DefineFunction("make-random-generator", ellMakeRandomGenerator, RandomGeneratorType, NumberType)
+	DefineFunctionRestArgs("random", ellRandom, NumberType, AnyType) // [<random-generator>] <number>*
+	DefineFunction("random-bytes", ellRandomBytes, BlobType, NumberType)
 	DefineFunctionRestArgs("random-list", ellRandomList, ListType, NumberType)
 
-	DefineFunctionRestArgs("uuid", ellUUIDFromTime, StringType, StringType)
+	defineUUIDTag()
+	DefineFunctionRestArgs("uuid", ellUUID, UUIDType, AnyType) // [<uuid|string>] [<string>]
+	DefineFunction("uuid?", ellUUIDP, BooleanType, AnyType)
+	DefineFunction("string->uuid", ellStringToUUID, UUIDType, StringType)
+	DefineFunction("uuid->string", ellUUIDToString, StringType, UUIDType)
 	DefineFunction("timestamp", ellTimestamp, StringType)
 
+	DefineFunction("db-open", ellDBOpen, DBType, StringType, StringType)
+	DefineFunction("db?", ellDBP, BooleanType, AnyType)
+	DefineFunctionRestArgs("db-query", ellDBQuery, VectorType, AnyType, DBType, StringType)
+	DefineFunctionRestArgs("db-exec", ellDBExec, StructType, AnyType, DBType, StringType)
+
 	DefineFunction("listen", ellListen, ChannelType, NumberType)
 	DefineFunction("connect", ellConnect, AnyType, StringType, NumberType)
 
 	DefineFunction("serve", ellHTTPServer, AnyType, NumberType, FunctionType)
+	DefineFunction("http-serve", ellHTTPServer, AnyType, NumberType, FunctionType)
 	DefineFunctionKeyArgs("http", ellHTTPClient, StructType,
-		[]Value{StringType, StringType, StructType, BlobType}, //(http "url" method: "PUT" headers: {} body: #[blob])
+		[]Value{StringType, StringType, StructType, AnyType}, //(http "url" method: "PUT" headers: {} body: <string|blob>)
 		[]Value{NewString("GET"), EmptyStruct, EmptyBlob},
 		[]Value{Intern("method:"), Intern("headers:"), Intern("body:")})
+	DefineFunctionKeyArgs("http-get", ellHTTPGet, StructType, []Value{StringType, StructType}, []Value{EmptyStruct}, []Value{Intern("headers:")})
+	DefineFunctionKeyArgs("http-post", ellHTTPPost, StructType, []Value{StringType, AnyType, StructType}, []Value{EmptyStruct}, []Value{Intern("headers:")})
 
 	DefineFunction("getenv", ellGetenv, StringType, StringType)
-	DefineFunction("load", ellLoad, StringType, AnyType)
+	DefineFunction("setenv", ellSetenv, NullType, StringType, StringType)
+	DefineFunction("current-directory", ellCurrentDirectory, StringType)
+	DefineFunction("chdir", ellChdir, NullType, StringType)
+	DefineFunction("process-id", ellProcessID, NumberType)
+	DefineFunctionKeyArgs("system", ellSystem, StructType, []Value{StringType, StringType, StringType}, []Value{EmptyString, EmptyString}, []Value{Intern("input:"), Intern("dir:")})
+	DefineFunctionKeyArgs("exec-command", ellExecCommand, StructType, []Value{StringType, ListType, StringType, StringType}, []Value{EmptyString, EmptyString}, []Value{Intern("input:"), Intern("dir:")})
+	DefineGlobal(StringValue(argsSymbol), EmptyList)
+	DefineFunctionOptionalArgs("exit", ellExit, NullType, []Value{NumberType}, Zero)
+	DefineFunction("load", ellLoad, AnyType, AnyType) // <string|port>
+	DefineFunctionRestArgs("module-export", ellModuleExport, NullType, SymbolType)
+	initPrimops()
 
 	if true {
 		err := Load("ell")
@@ -221,6 +512,14 @@ func ellLet(argv []Value) (Value, error) {
 	return expandLet(argv[0])
 }
 
+func ellDelay(argv []Value) (Value, error) {
+	return expandDelay(argv[0])
+}
+
+func ellFuture(argv []Value) (Value, error) {
+	return expandFuture(argv[0])
+}
+
 func ellCond(argv []Value) (Value, error) {
 	return expandCond(argv[0])
 }
@@ -229,6 +528,18 @@ func ellQuasiquote(argv []Value) (Value, error) {
 	return expandQuasiquote(argv[0])
 }
 
+// (export name ...) => (module-export 'name ...)
+func ellExport(argv []Value) (Value, error) {
+	var args []Value
+	for names := Cdr(argv[0]); names != EmptyList; names = Cdr(names) {
+		if !IsSymbol(Car(names)) {
+			return nil, NewError(SyntaxErrorKey, argv[0])
+		}
+		args = append(args, NewList(QuoteSymbol, Car(names)))
+	}
+	return Cons(Intern("module-export"), ListFromValues(args)), nil
+}
+
 // functions
 
 func ellVersion(_ []Value) (Value, error) {
@@ -286,8 +597,118 @@ func ellSpit(argv []Value) (Value, error) {
 	return Null, nil
 }
 
+// bytesOf - the bytes of a string or blob, argument i of the named primitive, to write to a file or send in a
+// request
+func bytesOf(name string, i int, obj Value) ([]byte, error) {
+	switch p := obj.(type) {
+	case *String:
+		return []byte(p.Value), nil
+	case *Blob:
+		return p.Value, nil
+	}
+	return nil, argTypeError(name, "<string> or <blob>", i, obj)
+}
+
+// ioError - the Go error from a file operation, as an Ell error
+func ioError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return NewError(IOErrorKey, err.Error())
+}
+
+func ellReadFile(argv []Value) (Value, error) {
+	b, err := ReadFileBytes(StringValue(argv[0]))
+	if err != nil {
+		return nil, ioError(err)
+	}
+	if argv[1] == True {
+		return NewBlob(b), nil
+	}
+	return NewString(string(b)), nil
+}
+
+func ellWriteFile(argv []Value) (Value, error) {
+	data, err := bytesOf("write-file", 2, argv[1])
+	if err != nil {
+		return nil, err
+	}
+	return Null, ioError(ioutil.WriteFile(ExpandFilePath(StringValue(argv[0])), data, 0644))
+}
+
+func ellAppendFile(argv []Value) (Value, error) {
+	data, err := bytesOf("append-file", 2, argv[1])
+	if err != nil {
+		return nil, err
+	}
+	return Null, ioError(AppendFile(StringValue(argv[0]), data))
+}
+
+func ellDeleteFile(argv []Value) (Value, error) {
+	return Null, ioError(os.Remove(ExpandFilePath(StringValue(argv[0]))))
+}
+
+func ellRenameFile(argv []Value) (Value, error) {
+	return Null, ioError(os.Rename(ExpandFilePath(StringValue(argv[0])), ExpandFilePath(StringValue(argv[1]))))
+}
+
+func ellFileExistsP(argv []Value) (Value, error) {
+	path := StringValue(argv[0])
+	if IsFileReadable(path) || IsDirectoryReadable(path) {
+		return True, nil
+	}
+	if _, err := os.Stat(ExpandFilePath(path)); err == nil {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellFileInfo(argv []Value) (Value, error) {
+	info, err := os.Stat(ExpandFilePath(StringValue(argv[0])))
+	if err != nil {
+		return nil, ioError(err)
+	}
+	result := NewStruct()
+	result.Put(Intern("name:"), NewString(info.Name()))
+	result.Put(Intern("size:"), Int(info.Size()))
+	result.Put(Intern("mtime:"), Float(float64(info.ModTime().UnixNano())/float64(time.Second)))
+	result.Put(Intern("mode:"), Integer(int(info.Mode().Perm())))
+	result.Put(Intern("directory:"), False)
+	if info.IsDir() {
+		result.Put(Intern("directory:"), True)
+	}
+	return result, nil
+}
+
+func ellListDirectory(argv []Value) (Value, error) {
+	entries, err := os.ReadDir(ExpandFilePath(StringValue(argv[0])))
+	if err != nil {
+		return nil, ioError(err)
+	}
+	names := make([]Value, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, NewString(entry.Name()))
+	}
+	return ListFromValues(names), nil
+}
+
+func ellMakeDirectory(argv []Value) (Value, error) {
+	return Null, ioError(os.MkdirAll(ExpandFilePath(StringValue(argv[0])), 0755))
+}
+
 func ellRead(argv []Value) (Value, error) {
-	return ReadFromString(StringValue(argv[0]))
+	if port, ok := argv[0].(*Port); ok {
+		port, err := inputPort(port, false)
+		if err != nil {
+			return nil, err
+		}
+		return port.Read()
+	}
+	s, err := AsStringValue(argv[0])
+	if err != nil {
+		return nil, err
+	}
+	return ReadFromString(s)
 }
 
 func ellReadAll(argv []Value) (Value, error) {
@@ -298,6 +719,11 @@ func ellMacroexpand(argv []Value) (Value, error) {
 	return Macroexpand(argv[0])
 }
 
+func ellMacroexpand1(argv []Value) (Value, error) {
+	return Macroexpand1(argv[0])
+}
+
+// ellCompile - the expression compiled to code, which is called as a function of no arguments to evaluate it
 func ellCompile(argv []Value) (Value, error) {
 	expanded, err := Macroexpand(argv[0])
 	if err != nil {
@@ -306,9 +732,35 @@ func ellCompile(argv []Value) (Value, error) {
 	return Compile(expanded)
 }
 
+// ellEval - evaluate the expression at the top level. It is compiled, then called on the current VM, so errors
+// in it can be caught, and continuations captured in it work as usual.
+func ellEval(argv []Value) (Value, error) {
+	code, err := compileSource(argv[0], "")
+	if err != nil {
+		return nil, err
+	}
+	return TailCallFunction(Closure(code, nil), nil)
+}
+
 func ellLoad(argv []Value) (Value, error) {
-	err := Load(StringValue(argv[0]))
-	return argv[0], err
+	if port, ok := argv[0].(*Port); ok {
+		port, err := inputPort(port, false)
+		if err != nil {
+			return nil, err
+		}
+		return port, LoadPort(port)
+	}
+	if _, ok := argv[0].(*String); !ok {
+		return nil, argTypeError("load", "<string> or <port>", 1, argv[0])
+	}
+	return argv[0], Load(StringValue(argv[0]))
+}
+
+func ellModuleExport(argv []Value) (Value, error) {
+	for _, name := range argv {
+		currentModule.export(name.(*Symbol))
+	}
+	return Null, nil
 }
 
 func ellType(argv []Value) (Value, error) {
@@ -316,13 +768,28 @@ func ellType(argv []Value) (Value, error) {
 }
 
 func ellValue(argv []Value) (Value, error) {
-	return Value(argv[0]), nil
+	if p, ok := argv[0].(*Instance); ok {
+		return p.Value, nil
+	}
+	return argv[0], nil
 }
 
 func ellInstance(argv []Value) (Value, error) {
 	return NewInstance(argv[0], argv[1])
 }
 
+func ellRecordRef(argv []Value) (Value, error) {
+	return RecordRef(argv[0], argv[1], IntValue(argv[2]))
+}
+
+func ellRecordSetBang(argv []Value) (Value, error) {
+	err := RecordSet(argv[0], argv[1], IntValue(argv[2]), argv[3])
+	if err != nil {
+		return nil, err
+	}
+	return Null, nil
+}
+
 func ellValidateKeywordArgList(argv []Value) (Value, error) {
 	//(validate-keyword-arg-list '(x: 23) x: y:) -> (x:)
 	//(validate-keyword-arg-list '(x: 23 z: 100) x: y:) -> error("bad keyword z: in argument list")
@@ -330,11 +797,19 @@ func ellValidateKeywordArgList(argv []Value) (Value, error) {
 }
 
 func ellKeys(argv []Value) (Value, error) {
-	return structKeyList(argv[0].(*Struct)), nil
+	strct, err := structArg(argv[0])
+	if err != nil {
+		return nil, err
+	}
+	return structKeyList(strct), nil
 }
 
 func ellValues(argv []Value) (Value, error) {
-	return structValueList(argv[0].(*Struct)), nil
+	strct, err := structArg(argv[0])
+	if err != nil {
+		return nil, err
+	}
+	return structValueList(strct), nil
 }
 
 func ellStruct(argv []Value) (Value, error) {
@@ -365,9 +840,7 @@ func ellEqualP(argv []Value) (Value, error) {
 
 func numeq(n1 Value, n2 Value) bool {
 	if f1, ok := n1.(*Number); ok {
-		if f2, ok := n2.(*Number); ok {
-			return NumberEqual(f1.Value, f2.Value)
-		}
+		return f1.Equals(n2)
 	}
 	return false
 }
@@ -387,64 +860,62 @@ func numericPair(argv []Value) (float64, float64, error) {
 }
 
 func ellNumEqual(argv []Value) (Value, error) {
-	f1, f2, err := numericPair(argv)
-	if err == nil {
-		if NumberEqual(f1, f2) {
-			return True, nil
-		}
+	if numeq(argv[0], argv[1]) {
+		return True, nil
 	}
-	return False, err
+	return False, nil
 }
 
 func ellNumLess(argv []Value) (Value, error) {
-	f1, f2, err := numericPair(argv)
-	if err == nil {
-		if f1 < f2 {
-			return True, nil
-		}
+	if NumberCompare(argv[0].(*Number), argv[1].(*Number)) < 0 {
+		return True, nil
 	}
-	return False, err
+	return False, nil
 }
 
 func ellNumLessEqual(argv []Value) (Value, error) {
-	f1, f2, err := numericPair(argv)
-	if err == nil {
-		if f1 <= f2 {
-			return True, nil
-		}
+	if NumberCompare(argv[0].(*Number), argv[1].(*Number)) <= 0 {
+		return True, nil
 	}
-	return False, err
+	return False, nil
 }
 
 func ellNumGreater(argv []Value) (Value, error) {
-	f1, f2, err := numericPair(argv)
-	if err == nil {
-		if f1 > f2 {
-			return True, nil
-		}
+	if NumberCompare(argv[0].(*Number), argv[1].(*Number)) > 0 {
+		return True, nil
 	}
-	return False, err
+	return False, nil
 }
 
 func ellNumGreaterEqual(argv []Value) (Value, error) {
-	f1, f2, err := numericPair(argv)
-	if err == nil {
-		if f1 >= f2 {
-			return True, nil
-		}
+	if NumberCompare(argv[0].(*Number), argv[1].(*Number)) >= 0 {
+		return True, nil
 	}
-	return False, err
+	return False, nil
 }
 
 func ellWrite(argv []Value) (Value, error) {
-	return NewString(WriteIndent(argv[0], StringValue(argv[1]))), nil
+	if argv[2] == Null {
+		return NewString(WriteIndent(argv[0], StringValue(argv[1]))), nil
+	}
+	port, err := outputPort(argv[2], false)
+	if err != nil {
+		return nil, err
+	}
+	return Null, newWriter(StringValue(argv[1]), false).writer.WriteStream(port.writer, argv[0])
 }
 
-func ellWriteAll(argv []Value) (Value, error) {
-	if lst, ok := argv[0].(*List); ok {
-		return NewString(WriteAllIndent(lst, StringValue(argv[1]))), nil
+// ellPprint - write the value to the port, or standard output, broken across lines to fit in the width
+func ellPprint(argv []Value) (Value, error) {
+	port, err := outputPort(argv[2], false)
+	if err != nil {
+		return nil, err
 	}
-	return nil, NewError(ArgumentErrorKey, "Expected a <list>, but got a ", argv[0].Type())
+	return Null, port.WriteString(Pretty(argv[0], IntValue(argv[1])) + "\n")
+}
+
+func ellWriteAll(argv []Value) (Value, error) {
+	return NewString(WriteAllIndent(argv[0].(*List), StringValue(argv[1]))), nil
 }
 
 func ellMakeError(argv []Value) (Value, error) {
@@ -459,10 +930,29 @@ func ellErrorP(argv []Value) (Value, error) {
 }
 
 func ellErrorData(argv []Value) (Value, error) {
-	if p, ok := argv[0].(*Error); ok {
-		return p.Data, nil
+	return argv[0].(*Error).Data, nil
+}
+
+func ellErrorKind(argv []Value) (Value, error) {
+	return argv[0].(*Error).Kind(), nil
+}
+
+func ellStackTrace(argv []Value) (Value, error) {
+	if trace := argv[0].(*Error).Trace; trace != nil {
+		return trace, nil
+	}
+	return EmptyList, nil
+}
+
+// (raise err) raises the error object, (raise kind: data ...) makes one first
+func ellRaise(argv []Value) (Value, error) {
+	if p, ok := argv[0].(*Error); ok && len(argv) == 1 {
+		return nil, p
 	}
-	return nil, NewError(ArgumentErrorKey, "Expected an <error>, but got a ", argv[0].Type())
+	if argv[0].Type() != KeywordType {
+		return nil, argTypeError("raise", "<error> or <keyword>", 1, argv[0])
+	}
+	return nil, MakeError(argv...)
 }
 
 func ellUncaughtError(argv []Value) (Value, error) {
@@ -476,148 +966,524 @@ func ellToString(argv []Value) (Value, error) {
 	return ToString(argv[0])
 }
 
-func ellPrint(argv []Value) (Value, error) {
-	for _, o := range argv {
-		fmt.Printf("%v", o)
+// printArgs - the port to print to, which is null, for the value of *stdout*, unless the first argument is an
+// output port, and the values to print
+func printArgs(argv []Value) (Value, []Value) {
+	if len(argv) > 0 && IsOutputPort(argv[0]) {
+		return argv[0], argv[1:]
 	}
-	return Null, nil
-}
-
-func ellPrintln(argv []Value) (Value, error) {
-	ellPrint(argv)
-	fmt.Println("")
-	return Null, nil
+	return Null, argv
 }
 
-func ellConcat(argv []Value) (Value, error) {
-	result := EmptyList
-	tail := result
-	for _, obj := range argv {
-		lst, _ := obj.(*List)
-		for lst != EmptyList {
-			if tail == EmptyList {
-				result = NewList(lst.Car)
-				tail = result
-			} else {
-				tail.Cdr = NewList(lst.Car)
-				tail = tail.Cdr
-			}
-			lst = lst.Cdr
+func ellPrint(argv []Value) (Value, error) {
+	dest, args := printArgs(argv)
+	port, err := outputPort(dest, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range args {
+		if err := port.WriteString(o.String()); err != nil {
+			return nil, err
 		}
 	}
-	return result, nil
-}
-
-func AsList(obj Value) *List {
-	lst, _ := obj.(*List)
-	return lst
-}
-
-func ellReverse(argv []Value) (Value, error) {
-	return Reverse(AsList(argv[0])), nil
+	return Null, nil
 }
 
-func ellFlatten(argv []Value) (Value, error) {
-	return Flatten(AsList(argv[0])), nil
+func ellPrintln(argv []Value) (Value, error) {
+	_, err := ellPrint(argv)
+	if err != nil {
+		return nil, err
+	}
+	dest, _ := printArgs(argv)
+	port, err := outputPort(dest, false)
+	if err != nil {
+		return nil, err
+	}
+	return Null, port.WriteString("\n")
 }
 
-func ellList(argv []Value) (Value, error) {
-	argc := len(argv)
-	p := EmptyList
-	for i := argc - 1; i >= 0; i-- {
-		p = Cons(argv[i], p)
+// ellPrintf - print the arguments formatted by the format string, like format does, to the port if the first
+// argument is one
+func ellPrintf(argv []Value) (Value, error) {
+	dest, args := printArgs(argv)
+	if len(args) == 0 {
+		return nil, argcError("printf", len(argv)+1, -1, len(argv))
 	}
-	return p, nil
+	format, ok := args[0].(*String)
+	if !ok {
+		return nil, argTypeError("printf", StringType.String(), len(argv)-len(args)+1, args[0])
+	}
+	s, err := Format(format.Value, args[1:])
+	if err != nil {
+		return nil, err
+	}
+	port, err := outputPort(dest, false)
+	if err != nil {
+		return nil, err
+	}
+	return Null, port.WriteString(s)
 }
 
-func ellListLength(argv []Value) (Value, error) {
-	return Integer(ListLength(argv[0])), nil
+func ellDisplay(argv []Value) (Value, error) {
+	port, err := outputPort(argv[1], false)
+	if err != nil {
+		return nil, err
+	}
+	return Null, port.WriteString(argv[0].String())
 }
 
-func IsNumber(val Value) bool {
-	return val.Type() == NumberType
+func ellNewline(argv []Value) (Value, error) {
+	port, err := outputPort(argv[0], false)
+	if err != nil {
+		return nil, err
+	}
+	return Null, port.WriteString("\n")
 }
 
-func ellNumberP(argv []Value) (Value, error) {
-	if IsNumber(argv[0]) {
+func ellPortP(argv []Value) (Value, error) {
+	if _, ok := argv[0].(*Port); ok {
 		return True, nil
 	}
 	return False, nil
 }
 
-func ellToNumber(argv []Value) (Value, error) {
-	return ToNumber(argv[0])
-}
-
-func ellIntP(argv []Value) (Value, error) {
-	if IsInt(argv[0]) {
+func ellInputPortP(argv []Value) (Value, error) {
+	if IsInputPort(argv[0]) {
 		return True, nil
 	}
 	return False, nil
 }
 
-func ellFloatP(argv []Value) (Value, error) {
-	if IsFloat(argv[0]) {
+func ellOutputPortP(argv []Value) (Value, error) {
+	if IsOutputPort(argv[0]) {
 		return True, nil
 	}
 	return False, nil
 }
 
-func ellInt(argv []Value) (Value, error) {
-	return ToInt(argv[0])
+func ellOpenInputString(argv []Value) (Value, error) {
+	return NewStringInputPort(StringValue(argv[0])), nil
 }
 
-func ellFloor(argv []Value) (Value, error) {
-	return Float(math.Floor(Float64Value(argv[0]))), nil
+func ellOpenOutputString(argv []Value) (Value, error) {
+	return NewStringOutputPort(), nil
 }
 
-func ellCeiling(argv []Value) (Value, error) {
-	return Float(math.Ceil(Float64Value(argv[0]))), nil
+func ellGetOutputString(argv []Value) (Value, error) {
+	s, err := argv[0].(*Port).OutputString()
+	if err != nil {
+		return nil, err
+	}
+	return NewString(s), nil
 }
 
-func ellInc(argv []Value) (Value, error) {
-	return Integer(IntValue(argv[0]) + 1), nil
+func ellReadChar(argv []Value) (Value, error) {
+	port, err := inputPort(argv[0], false)
+	if err != nil {
+		return nil, err
+	}
+	return port.ReadChar(false)
 }
 
-func ellDec(argv []Value) (Value, error) {
-	return Integer(IntValue(argv[0]) - 1), nil
+func ellPeekChar(argv []Value) (Value, error) {
+	port, err := inputPort(argv[0], false)
+	if err != nil {
+		return nil, err
+	}
+	return port.ReadChar(true)
 }
 
-func ellAdd(argv []Value) (Value, error) {
-	//f1, f2, _ := numericPair(argv) //
-	return Float((argv[0].(*Number)).Value + (argv[1].(*Number)).Value), nil //interesting: inlining like this instead of numericPair is no faster
+func ellReadLine(argv []Value) (Value, error) {
+	port, err := inputPort(argv[0], false)
+	if err != nil {
+		return nil, err
+	}
+	return port.ReadLine()
 }
 
-func ellSub(argv []Value) (Value, error) {
-	return Float((argv[0].(*Number)).Value - (argv[1].(*Number)).Value), nil
+func ellReadString(argv []Value) (Value, error) {
+	n, err := AsIntValue(argv[0])
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, NewError(ArgumentErrorKey, "read-string count is negative: ", n)
+	}
+	port, err := inputPort(argv[1], false)
+	if err != nil {
+		return nil, err
+	}
+	return port.ReadString(n)
 }
 
-func ellMul(argv []Value) (Value, error) {
-	return Float((argv[0].(*Number)).Value * (argv[1].(*Number)).Value), nil
+// the reading primitives return null at the end of the input
+func ellEOFObjectP(argv []Value) (Value, error) {
+	if argv[0] == Null {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellOpenInputFile(argv []Value) (Value, error) {
+	if argv[2] == True {
+		return OpenGzipInputFile(StringValue(argv[0]), argv[1] == True)
+	}
+	return OpenInputFile(StringValue(argv[0]), argv[1] == True)
+}
+
+func ellOpenOutputFile(argv []Value) (Value, error) {
+	if argv[3] == True {
+		return OpenGzipOutputFile(StringValue(argv[0]), argv[1] == True, argv[2] == True)
+	}
+	return OpenOutputFile(StringValue(argv[0]), argv[1] == True, argv[2] == True)
+}
+
+func ellBinaryPortP(argv []Value) (Value, error) {
+	if port, ok := argv[0].(*Port); ok && port.IsBinary() {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellOpenInputBlob(argv []Value) (Value, error) {
+	return NewBlobInputPort(argv[0].(*Blob)), nil
+}
+
+func ellOpenOutputBlob(argv []Value) (Value, error) {
+	return NewBlobOutputPort(), nil
+}
+
+func ellGetOutputBlob(argv []Value) (Value, error) {
+	return argv[0].(*Port).OutputBlob()
+}
+
+func ellReadByte(argv []Value) (Value, error) {
+	port, err := inputPort(argv[0], true)
+	if err != nil {
+		return nil, err
+	}
+	return port.ReadByteValue(false)
+}
+
+func ellPeekByte(argv []Value) (Value, error) {
+	port, err := inputPort(argv[0], true)
+	if err != nil {
+		return nil, err
+	}
+	return port.ReadByteValue(true)
+}
+
+func ellReadBytes(argv []Value) (Value, error) {
+	n, err := AsIntValue(argv[0])
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, NewError(ArgumentErrorKey, "read-bytes count is negative: ", n)
+	}
+	port, err := inputPort(argv[1], true)
+	if err != nil {
+		return nil, err
+	}
+	return port.ReadBytes(n)
+}
+
+func ellWriteByte(argv []Value) (Value, error) {
+	b, err := AsByteValue(argv[0])
+	if err != nil {
+		return nil, err
+	}
+	port, err := outputPort(argv[1], true)
+	if err != nil {
+		return nil, err
+	}
+	return Null, port.WriteBytes([]byte{b})
+}
+
+func ellWriteBytes(argv []Value) (Value, error) {
+	port, err := outputPort(argv[1], true)
+	if err != nil {
+		return nil, err
+	}
+	return Null, port.WriteBytes(argv[0].(*Blob).Value)
+}
+
+func ellConcat(argv []Value) (Value, error) {
+	result := EmptyList
+	tail := result
+	for _, obj := range argv {
+		lst, _ := obj.(*List)
+		for lst != EmptyList {
+			if tail == EmptyList {
+				result = NewList(lst.Car)
+				tail = result
+			} else {
+				tail.Cdr = NewList(lst.Car)
+				tail = tail.Cdr
+			}
+			lst = lst.Cdr
+		}
+	}
+	return result, nil
+}
+
+func AsList(obj Value) *List {
+	lst, _ := obj.(*List)
+	return lst
+}
+
+func ellReverse(argv []Value) (Value, error) {
+	return Reverse(AsList(argv[0])), nil
+}
+
+func ellReverseBang(argv []Value) (Value, error) {
+	return ReverseBang(argv[0].(*List)), nil
+}
+
+func ellFlatten(argv []Value) (Value, error) {
+	return Flatten(AsList(argv[0])), nil
+}
+
+func ellLast(argv []Value) (Value, error) {
+	return Last(argv[0].(*List))
+}
+
+func memberResult(lst *List) Value {
+	if lst == nil {
+		return False
+	}
+	return lst
+}
+
+func ellMember(argv []Value) (Value, error) {
+	return memberResult(Member(argv[0], argv[1].(*List), false)), nil
+}
+
+func ellMemq(argv []Value) (Value, error) {
+	return memberResult(Member(argv[0], argv[1].(*List), true)), nil
+}
+
+func ellAssq(argv []Value) (Value, error) {
+	entry, err := AssocList(argv[0], argv[1].(*List), true, "assq")
+	if err != nil {
+		return nil, err
+	}
+	return memberResult(entry), nil
+}
+
+func ellTake(vm *vm, argv []Value) (Value, error) {
+	return Take(vm, IntValue(argv[0]), argv[1])
+}
+
+func ellDrop(vm *vm, argv []Value) (Value, error) {
+	return Drop(vm, IntValue(argv[0]), argv[1])
+}
+
+func ellRange(argv []Value) (Value, error) {
+	start, end, step := Zero, argv[0].(*Number), One
+	switch len(argv) {
+	case 1:
+	case 2:
+		start, end = argv[0].(*Number), argv[1].(*Number)
+	case 3:
+		start, end, step = argv[0].(*Number), argv[1].(*Number), argv[2].(*Number)
+	default:
+		return nil, argcError("range", 1, 3, len(argv))
+	}
+	return Range(start, end, step)
+}
+
+func ellListTabulate(vm *vm, argv []Value) (Value, error) {
+	return ListTabulate(vm, IntValue(argv[0]), argv[1].(*Function))
+}
+
+func ellList(argv []Value) (Value, error) {
+	argc := len(argv)
+	p := EmptyList
+	for i := argc - 1; i >= 0; i-- {
+		p = Cons(argv[i], p)
+	}
+	return p, nil
+}
+
+func ellListLength(argv []Value) (Value, error) {
+	return Integer(ListLength(argv[0])), nil
+}
+
+func IsNumber(val Value) bool {
+	return val.Type() == NumberType
+}
+
+func ellNumberP(argv []Value) (Value, error) {
+	if IsNumber(argv[0]) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellToNumber(argv []Value) (Value, error) {
+	return ToNumber(argv[0])
+}
+
+func ellIntP(argv []Value) (Value, error) {
+	if IsInt(argv[0]) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellFloatP(argv []Value) (Value, error) {
+	if IsFloat(argv[0]) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellExactP(argv []Value) (Value, error) {
+	if IsExact(argv[0]) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellInexactP(argv []Value) (Value, error) {
+	if IsExact(argv[0]) {
+		return False, nil
+	}
+	return True, nil
+}
+
+func ellExact(argv []Value) (Value, error) {
+	return ToExact(argv[0].(*Number))
+}
+
+func ellInexact(argv []Value) (Value, error) {
+	return ToInexact(argv[0].(*Number)), nil
+}
+
+func ellInt(argv []Value) (Value, error) {
+	return ToInt(argv[0])
+}
+
+func ellFloor(argv []Value) (Value, error) {
+	return Floor(argv[0].(*Number)), nil
+}
+
+func ellCeiling(argv []Value) (Value, error) {
+	return Ceiling(argv[0].(*Number)), nil
+}
+
+func ellTruncate(argv []Value) (Value, error) {
+	return Truncate(argv[0].(*Number)), nil
+}
+
+func ellRound(argv []Value) (Value, error) {
+	return RoundNumber(argv[0].(*Number)), nil
+}
+
+func ellInc(argv []Value) (Value, error) {
+	return NumberAdd(argv[0].(*Number), One), nil
+}
+
+func ellDec(argv []Value) (Value, error) {
+	return NumberSub(argv[0].(*Number), One), nil
+}
+
+func ellAdd(argv []Value) (Value, error) {
+	return NumberAdd(argv[0].(*Number), argv[1].(*Number)), nil
+}
+
+func ellSub(argv []Value) (Value, error) {
+	return NumberSub(argv[0].(*Number), argv[1].(*Number)), nil
+}
+
+func ellMul(argv []Value) (Value, error) {
+	return NumberMul(argv[0].(*Number), argv[1].(*Number)), nil
 }
 
 func ellDiv(argv []Value) (Value, error) {
-	return Float((argv[0].(*Number)).Value / (argv[1].(*Number)).Value), nil
+	return NumberDiv(argv[0].(*Number), argv[1].(*Number))
 }
 
 func ellQuotient(argv []Value) (Value, error) {
-	f1 := (argv[0].(*Number)).Value
-	f2 := (argv[1].(*Number)).Value
-	return Float(math.Floor(f1 / f2)), nil
+	return NumberQuotient(argv[0].(*Number), argv[1].(*Number))
 }
 
 func ellRemainder(argv []Value) (Value, error) {
-	return Integer(int((argv[0].(*Number)).Value) % int((argv[1].(*Number)).Value)), nil
+	return NumberRemainder(argv[0].(*Number), argv[1].(*Number))
+}
+
+func ellModulo(argv []Value) (Value, error) {
+	return NumberModulo(argv[0].(*Number), argv[1].(*Number))
 }
 
 func ellAbs(argv []Value) (Value, error) {
-	return Float(math.Abs((argv[0].(*Number)).Value)), nil
+	n := argv[0].(*Number)
+	if !n.IsExact() {
+		return Float(math.Abs(n.Value)), nil
+	}
+	if NumberCompare(n, Zero) < 0 {
+		return NumberSub(Zero, n), nil
+	}
+	return n, nil
 }
 
 func ellExp(argv []Value) (Value, error) {
 	return Float(math.Exp((argv[0].(*Number)).Value)), nil
 }
 
+func ellSqrt(argv []Value) (Value, error) {
+	return Sqrt(argv[0].(*Number))
+}
+
+func ellExpt(argv []Value) (Value, error) {
+	return Expt(argv[0].(*Number), argv[1].(*Number))
+}
+
+func ellMin(argv []Value) (Value, error) {
+	return NumberMin(argv), nil
+}
+
+func ellMax(argv []Value) (Value, error) {
+	return NumberMax(argv), nil
+}
+
+func ellGCD(argv []Value) (Value, error) {
+	return GCD(argv)
+}
+
+func ellLCM(argv []Value) (Value, error) {
+	return LCM(argv)
+}
+
+func ellBitAnd(argv []Value) (Value, error) {
+	return BitOp("bit-and", (*big.Int).And, -1, argv)
+}
+
+func ellBitOr(argv []Value) (Value, error) {
+	return BitOp("bit-or", (*big.Int).Or, 0, argv)
+}
+
+func ellBitXor(argv []Value) (Value, error) {
+	return BitOp("bit-xor", (*big.Int).Xor, 0, argv)
+}
+
+func ellBitNot(argv []Value) (Value, error) {
+	return BitNot(argv[0])
+}
+
+func ellArithmeticShift(argv []Value) (Value, error) {
+	return ArithmeticShift(argv[0], argv[1])
+}
+
+func ellLogicalShiftRight(argv []Value) (Value, error) {
+	return LogicalShiftRight(argv[0], argv[1])
+}
+
+func ellBitCount(argv []Value) (Value, error) {
+	return BitCount(argv[0])
+}
+
 func ellLog(argv []Value) (Value, error) {
 	return Float(math.Log(Float64Value(argv[0]))), nil
 }
@@ -687,19 +1553,73 @@ func ellVectorRef(argv []Value) (Value, error) {
 	return el[idx], nil
 }
 
+func ellVectorAssoc(argv []Value) (Value, error) {
+	return VectorAssoc(argv[0].(*Vector), IntValue(argv[1]), argv[2])
+}
+
 func ellVectorSetBang(argv []Value) (Value, error) {
 	vec, _ := argv[0].(*Vector)
+	if err := checkMutable(vec, "vector-set!"); err != nil {
+		return nil, err
+	}
 	el := vec.Elements
 	idx := IntValue(argv[1])
-	if idx < 0 || idx > len(el) {
+	if idx < 0 || idx >= len(el) {
 		return nil, NewError(ArgumentErrorKey, "Vector index out of range")
 	}
 	el[idx] = argv[2]
 	return Null, nil
 }
 
+func ellCopy(argv []Value) (Value, error) {
+	return Copy(argv[0]), nil
+}
+
+func ellDeepCopy(argv []Value) (Value, error) {
+	return DeepCopy(argv[0]), nil
+}
+
+func ellFreezeBang(argv []Value) (Value, error) {
+	return Freeze(argv[0]), nil
+}
+
+func ellFrozenP(argv []Value) (Value, error) {
+	if IsFrozen(argv[0]) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellSubvector(argv []Value) (Value, error) {
+	return Subvector(argv[0].(*Vector), IntValue(argv[1]), IntValue(argv[2]))
+}
+
+func ellVectorFillBang(argv []Value) (Value, error) {
+	return Null, VectorFill(argv[0].(*Vector), argv[1], IntValue(argv[2]), IntValue(argv[3]))
+}
+
+func ellVectorAppend(argv []Value) (Value, error) {
+	vecs := make([]*Vector, len(argv))
+	for i, v := range argv {
+		vecs[i] = v.(*Vector)
+	}
+	return VectorAppend(vecs...), nil
+}
+
+func ellVectorMap(vm *vm, argv []Value) (Value, error) {
+	results, err := eachArgs(vm, argv[0].(*Function), argv[1:], "vector-map")
+	if err != nil {
+		return nil, err
+	}
+	return VectorFromElementsNoCopy(results), nil
+}
+
+func ellVectorCopyBang(argv []Value) (Value, error) {
+	return Null, VectorCopy(argv[0].(*Vector), IntValue(argv[1]), argv[2].(*Vector), IntValue(argv[3]), IntValue(argv[4]))
+}
+
 func ellZeroP(argv []Value) (Value, error) {
-	if NumberEqual(Float64Value(argv[0]), 0.0) {
+	if numeq(argv[0], Zero) {
 		return True, nil
 	}
 	return False, nil
@@ -734,13 +1654,21 @@ func ellSymbolP(argv []Value) (Value, error) {
 }
 
 func ellSymbol(argv []Value) (Value, error) {
-	if len(argv) < 1 {
-		return nil, NewError(ArgumentErrorKey, "symbol expected at least 1 argument, got none")
-	}
 	return NewSymbol(argv)
 }
 
-func ellKeywordP(argv []Value) (Value, error) {
+// (gensym) or (gensym prefix) - a new uninterned symbol
+func ellGensym(argv []Value) (Value, error) {
+	switch p := argv[0].(type) {
+	case *String:
+		return Gensym(p.Value), nil
+	case *Symbol:
+		return Gensym(p.Text), nil
+	}
+	return nil, argTypeError("gensym", "<string> or <symbol>", 1, argv[0])
+}
+
+func ellKeywordP(argv []Value) (Value, error) {
 	if argv[0].Type() == KeywordType {
 		return True, nil
 	}
@@ -755,6 +1683,18 @@ func ellToKeyword(argv []Value) (Value, error) {
 	return ToKeyword(argv[0])
 }
 
+// ellStringToKeyword - the keyword with the name, which may be written with or without its final colon
+func ellStringToKeyword(argv []Value) (Value, error) {
+	name := StringValue(argv[0])
+	if !strings.HasSuffix(name, ":") {
+		name += ":"
+	}
+	if !IsValidKeywordName(name) {
+		return nil, NewError(ArgumentErrorKey, "string->keyword cannot make a <keyword> named ", argv[0])
+	}
+	return Intern(name), nil
+}
+
 func ellTypeP(argv []Value) (Value, error) {
 	if IsType(argv[0]) {
 		return True, nil
@@ -784,118 +1724,554 @@ func ellToCharacter(argv []Value) (Value, error) {
 	return ToCharacter(argv[0])
 }
 
+// ellSubstring - the characters from the start index to the end index, or to the end of the string if the end
+// index is negative
+// charTest - true if the character passes the Unicode test
+func charTest(c Value, test func(rune) bool) Value {
+	if test(RuneValue(c)) {
+		return True
+	}
+	return False
+}
+
+func ellCharAlphabeticP(argv []Value) (Value, error) {
+	return charTest(argv[0], unicode.IsLetter), nil
+}
+
+func ellCharNumericP(argv []Value) (Value, error) {
+	return charTest(argv[0], unicode.IsDigit), nil
+}
+
+func ellCharWhitespaceP(argv []Value) (Value, error) {
+	return charTest(argv[0], unicode.IsSpace), nil
+}
+
+func ellCharUpperCaseP(argv []Value) (Value, error) {
+	return charTest(argv[0], unicode.IsUpper), nil
+}
+
+func ellCharLowerCaseP(argv []Value) (Value, error) {
+	return charTest(argv[0], unicode.IsLower), nil
+}
+
+func ellCharUpcase(argv []Value) (Value, error) {
+	return NewCharacter(unicode.ToUpper(RuneValue(argv[0]))), nil
+}
+
+func ellCharDowncase(argv []Value) (Value, error) {
+	return NewCharacter(unicode.ToLower(RuneValue(argv[0]))), nil
+}
+
+func ellCharToInteger(argv []Value) (Value, error) {
+	return Integer(int(RuneValue(argv[0]))), nil
+}
+
+// ellIntegerToChar - the character with the Unicode code point, which must be a valid one, i.e. not a surrogate
+func ellIntegerToChar(argv []Value) (Value, error) {
+	n := argv[0].(*Number)
+	if !n.IsExactInteger() || n.Value < 0 || n.Value > unicode.MaxRune || !utf8.ValidRune(rune(n.IntValue())) {
+		return nil, NewError(ArgumentErrorKey, "integer->char expected a Unicode code point, got ", n)
+	}
+	return NewCharacter(rune(n.IntValue())), nil
+}
+
 func ellSubstring(argv []Value) (Value, error) {
-	s := StringValue(argv[0])
-	start := IntValue(argv[1])
+	s := argv[0].(*String)
 	end := IntValue(argv[2])
-	if start < 0 {
-		start = 0
-	} else if start > len(s) {
-		return EmptyString, nil
+	if end < 0 {
+		end = StringLength(s)
 	}
-	if end < start {
-		return EmptyString, nil
-	} else if end > len(s) {
-		end = len(s)
+	return Substring(s, IntValue(argv[1]), end), nil
+}
+
+func ellStringRef(argv []Value) (Value, error) {
+	return StringRef(argv[0].(*String), IntValue(argv[1]))
+}
+
+func ellStringIndex(argv []Value) (Value, error) {
+	return Integer(StringIndex(argv[0].(*String), argv[1].(*String), IntValue(argv[2]))), nil
+}
+
+func ellStringContainsP(argv []Value) (Value, error) {
+	if strings.Contains(StringValue(argv[0]), StringValue(argv[1])) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellStringStartsWithP(argv []Value) (Value, error) {
+	if strings.HasPrefix(StringValue(argv[0]), StringValue(argv[1])) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellStringEndsWithP(argv []Value) (Value, error) {
+	if strings.HasSuffix(StringValue(argv[0]), StringValue(argv[1])) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellStringReplace(argv []Value) (Value, error) {
+	return StringReplace(argv[0].(*String), argv[1].(*String), argv[2].(*String), IntValue(argv[3])), nil
+}
+
+func ellStringTrim(argv []Value) (Value, error) {
+	return StringTrim(argv[0].(*String), argv[1], true, true), nil
+}
+
+func ellStringTrimLeft(argv []Value) (Value, error) {
+	return StringTrim(argv[0].(*String), argv[1], true, false), nil
+}
+
+func ellStringTrimRight(argv []Value) (Value, error) {
+	return StringTrim(argv[0].(*String), argv[1], false, true), nil
+}
+
+func ellStringUpcase(argv []Value) (Value, error) {
+	return NewString(strings.ToUpper(StringValue(argv[0]))), nil
+}
+
+func ellStringDowncase(argv []Value) (Value, error) {
+	return NewString(strings.ToLower(StringValue(argv[0]))), nil
+}
+
+// isCallable - true if the value can be called like a function: a function, a keyword, or compiled code
+func isCallable(val Value) bool {
+	switch val.(type) {
+	case *Function, *Keyword, *Code:
+		return true
+	}
+	return false
+}
+
+// ellApply - call the function with the arguments, the last of which is a list of more of them. Like funcall,
+// the VM makes the call in place of apply's, so neither the Go stack nor the VM stack grows.
+func ellApply(argv []Value) (Value, error) {
+	if !isCallable(argv[0]) {
+		return nil, argTypeError("apply", FunctionType.String(), 1, argv[0])
+	}
+	last := len(argv) - 1
+	lst, ok := argv[last].(*List)
+	if !ok {
+		return nil, argTypeError("apply", ListType.String(), last+1, argv[last])
+	}
+	args := make([]Value, 0, last-1+lst.Length())
+	args = append(args, argv[1:last]...)
+	for ; lst != EmptyList; lst = lst.Cdr {
+		args = append(args, lst.Car)
+	}
+	return TailCallFunction(argv[0], args)
+}
+
+func ellFuncall(argv []Value) (Value, error) {
+	if !isCallable(argv[0]) {
+		return nil, argTypeError("funcall", FunctionType.String(), 1, argv[0])
+	}
+	return TailCallFunction(argv[0], argv[1:])
+}
+
+func ellIdentity(argv []Value) (Value, error) {
+	return argv[0], nil
+}
+
+func ellFunctionP(argv []Value) (Value, error) {
+	if argv[0].Type() == FunctionType {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellFunctionSignature(argv []Value) (Value, error) {
+	fun, _ := argv[0].(*Function)
+	return NewString(functionSignature(fun)), nil
+}
+
+func ellFunctionName(argv []Value) (Value, error) {
+	if name := functionName(argv[0].(*Function)); name != "" {
+		return NewString(name), nil
+	}
+	return Null, nil
+}
+
+func ellFunctionArity(argv []Value) (Value, error) {
+	min, max := functionArity(argv[0].(*Function))
+	if max < 0 {
+		return NewList(Integer(min), Null), nil
+	}
+	return NewList(Integer(min), Integer(max)), nil
+}
+
+func ellFunctionDefaults(argv []Value) (Value, error) {
+	defaults, _ := functionDefaults(argv[0].(*Function))
+	return ListFromValues(defaults), nil
+}
+
+func ellFunctionKeys(argv []Value) (Value, error) {
+	_, keys := functionDefaults(argv[0].(*Function))
+	return ListFromValues(keys), nil
+}
+
+func ellDoc(argv []Value) (Value, error) {
+	if doc := Doc(argv[0]); doc != "" {
+		return NewString(doc), nil
+	}
+	return Null, nil
+}
+
+func ellApropos(argv []Value) (Value, error) {
+	return ListFromValues(Apropos(StringValue(argv[0]))), nil
+}
+
+func ellListP(argv []Value) (Value, error) {
+	if argv[0].Type() == ListType {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellEmptyP(argv []Value) (Value, error) {
+	if argv[0] == EmptyList {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellString(argv []Value) (Value, error) {
+	var buf strings.Builder
+	for _, val := range argv {
+		appendText(&buf, val)
+	}
+	return NewString(buf.String()), nil
+}
+
+func ellFormat(argv []Value) (Value, error) {
+	s, err := Format(StringValue(argv[0]), argv[1:])
+	if err != nil {
+		return nil, err
+	}
+	return NewString(s), nil
+}
+
+func ellStringLength(argv []Value) (Value, error) {
+	return Integer(StringLength(argv[0].(*String))), nil
+}
+
+func ellCar(argv []Value) (Value, error) {
+	lst := argv[0].(*List)
+	if lst == EmptyList {
+		return Null, nil
+	}
+	return lst.Car, nil
+}
+
+func ellCdr(argv []Value) (Value, error) {
+	lst := argv[0].(*List)
+	if lst == EmptyList {
+		return lst, nil
+	}
+	return lst.Cdr, nil
+}
+
+func ellSetCarBang(argv []Value) (Value, error) {
+	lst := argv[0].(*List)
+	if lst == EmptyList {
+		return nil, NewError(ArgumentErrorKey, "set-car! expected a non-empty <list>")
+	}
+	lst.Car = argv[1]
+	return Null, nil
+}
+
+func ellSetCdrBang(argv []Value) (Value, error) {
+	lst := argv[0].(*List)
+	if lst == EmptyList {
+		return nil, NewError(ArgumentErrorKey, "set-cdr! expected a non-empty <list>")
+	}
+	lst.Cdr = argv[1].(*List)
+	return Null, nil
+}
+
+func ellCons(argv []Value) (Value, error) {
+	return Cons(argv[0], argv[1].(*List)), nil
+}
+
+func ellStructP(argv []Value) (Value, error) {
+	if IsStruct(argv[0]) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellGet(argv []Value) (Value, error) {
+	return Get(argv[0], argv[1])
+}
+
+func ellLength(argv []Value) (Value, error) {
+	n, err := Length(argv[0])
+	if err != nil {
+		return nil, err
+	}
+	return Integer(n), nil
+}
+
+func ellStructLength(argv []Value) (Value, error) {
+	s := argv[0].(*Struct)
+	return Integer(s.Length()), nil
+}
+
+func ellHasP(argv []Value) (Value, error) {
+	b, err := Has(argv[0], argv[1])
+	if err != nil {
+		return nil, err
 	}
-	return NewString(s[start:end]), nil
+	if b {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellHasKeyP(argv []Value) (Value, error) {
+	b, err := HasKey(argv[0], argv[1])
+	if err != nil {
+		return nil, err
+	}
+	if b {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellAssoc(argv []Value) (Value, error) {
+	if len(argv) == 2 {
+		if alist, ok := argv[1].(*List); ok {
+			entry, err := AssocList(argv[0], alist, false, "assoc")
+			if err != nil {
+				return nil, err
+			}
+			return memberResult(entry), nil
+		}
+	}
+	return Assoc(argv[0], argv[1:])
+}
+
+func ellDissoc(argv []Value) (Value, error) {
+	return Dissoc(argv[0], argv[1])
+}
+
+func ellPutBang(argv []Value) (Value, error) {
+	if err := Put(argv[0], argv[1], argv[2]); err != nil {
+		return nil, err
+	}
+	return Null, nil
+}
+
+func ellInvoke(argv []Value) (Value, error) {
+	return Invoke(argv[0], argv[1], argv[2:])
+}
+
+func ellUnputBang(argv []Value) (Value, error) {
+	if err := Unput(argv[0], argv[1]); err != nil {
+		return nil, err
+	}
+	return Null, nil
+}
+
+func ellSetP(argv []Value) (Value, error) {
+	if IsSet(argv[0]) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellToSet(argv []Value) (Value, error) {
+	return ToSet(argv[0])
+}
+
+func ellSet(argv []Value) (Value, error) {
+	return NewSet(argv...), nil
+}
+
+func ellSetLength(argv []Value) (Value, error) {
+	return Integer(argv[0].(*Set).Length()), nil
+}
+
+func ellSetContainsP(argv []Value) (Value, error) {
+	if argv[0].(*Set).Contains(argv[1]) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellSetAddBang(argv []Value) (Value, error) {
+	argv[0].(*Set).Add(argv[1])
+	return Null, nil
+}
+
+func ellSetRemoveBang(argv []Value) (Value, error) {
+	argv[0].(*Set).Remove(argv[1])
+	return Null, nil
+}
+
+// sets - the arguments, which the signature has checked are all sets
+func sets(argv []Value) []*Set {
+	result := make([]*Set, len(argv))
+	for i, v := range argv {
+		result[i] = v.(*Set)
+	}
+	return result
+}
+
+func ellSetUnion(argv []Value) (Value, error) {
+	return SetUnion(sets(argv)...), nil
+}
+
+func ellSetIntersection(argv []Value) (Value, error) {
+	return SetIntersection(argv[0].(*Set), sets(argv[1:])...), nil
+}
+
+func ellSetDifference(argv []Value) (Value, error) {
+	return SetDifference(argv[0].(*Set), sets(argv[1:])...), nil
+}
+
+// ellHash - the hash of the value, which is the same for values that are equal. It is kept to 53 bits, so that
+// it is an exact integer <number>.
+func ellHash(argv []Value) (Value, error) {
+	return Int64(int64(Hash(argv[0]) & (1<<53 - 1))), nil
 }
 
-func ellFunctionP(argv []Value) (Value, error) {
-	if argv[0].Type() == FunctionType {
+func ellHashMapP(argv []Value) (Value, error) {
+	if IsHashMap(argv[0]) {
 		return True, nil
 	}
 	return False, nil
 }
 
-func ellFunctionSignature(argv []Value) (Value, error) {
-	fun, _ := argv[0].(*Function)
-	return NewString(functionSignature(fun)), nil
+func ellToHashMap(argv []Value) (Value, error) {
+	return ToHashMap(argv[0])
 }
 
-func ellListP(argv []Value) (Value, error) {
-	if argv[0].Type() == ListType {
-		return True, nil
+func ellHashMap(argv []Value) (Value, error) {
+	return NewHashMap(argv)
+}
+
+func ellHashMapLength(argv []Value) (Value, error) {
+	return Integer(argv[0].(*HashMap).Length()), nil
+}
+
+// ellHashMapGet - the value for the key, or the default if the hashmap has no entry for it
+func ellHashMapGet(argv []Value) (Value, error) {
+	h := argv[0].(*HashMap)
+	if h.Has(argv[1]) {
+		return h.Get(argv[1]), nil
 	}
-	return False, nil
+	return argv[2], nil
 }
 
-func ellEmptyP(argv []Value) (Value, error) {
-	if argv[0] == EmptyList {
+func ellHashMapHasP(argv []Value) (Value, error) {
+	if argv[0].(*HashMap).Has(argv[1]) {
 		return True, nil
 	}
 	return False, nil
 }
 
-func ellString(argv []Value) (Value, error) {
-	s := ""
-	for _, ss := range argv {
-		s += ss.String()
-	}
-	return NewString(s), nil
+func ellHashMapPutBang(argv []Value) (Value, error) {
+	argv[0].(*HashMap).Put(argv[1], argv[2])
+	return Null, nil
 }
 
-func ellStringLength(argv []Value) (Value, error) {
-	s, _ := argv[0].(*String)
-	return Integer(len(s.Value)), nil
+func ellHashMapRemoveBang(argv []Value) (Value, error) {
+	argv[0].(*HashMap).Remove(argv[1])
+	return Null, nil
 }
 
-func ellCar(argv []Value) (Value, error) {
-	lst := argv[0].(*List)
-	if lst == EmptyList {
-		return Null, nil
-	}
-	return lst.Car, nil
+func ellHashMapKeys(argv []Value) (Value, error) {
+	return ListFromValues(argv[0].(*HashMap).Keys()), nil
 }
 
-func ellCdr(argv []Value) (Value, error) {
-	lst := argv[0].(*List)
-	if lst == EmptyList {
-		return lst, nil
+func ellHashMapValues(argv []Value) (Value, error) {
+	return ListFromValues(argv[0].(*HashMap).Values()), nil
+}
+
+func ellPromiseP(argv []Value) (Value, error) {
+	if IsPromise(argv[0]) {
+		return True, nil
 	}
-	return lst.Cdr, nil
+	return False, nil
 }
 
-func ellSetCarBang(argv []Value) (Value, error) {
-	lst := argv[0].(*List)
-	if lst == EmptyList {
-		return nil, NewError(ArgumentErrorKey, "set-car! expected a non-empty <list>")
+// ellPromise - a promise of the value of the thunk, which is what (delay expr) expands into, or without one, a
+// promise that is delivered its value
+func ellPromise(argv []Value) (Value, error) {
+	if argv[0] == Null {
+		return NewDeliveredPromise(), nil
 	}
-	lst.Car = argv[1]
-	return Null, nil
+	thunk, ok := argv[0].(*Function)
+	if !ok {
+		return nil, argTypeError("promise", FunctionType.String(), 1, argv[0])
+	}
+	return NewPromise(thunk), nil
 }
 
-func ellSetCdrBang(argv []Value) (Value, error) {
-	lst := argv[0].(*List)
-	if lst == EmptyList {
-		return nil, NewError(ArgumentErrorKey, "set-cdr! expected a non-empty <list>")
+func ellDeliver(argv []Value) (Value, error) {
+	ok, err := argv[0].(*Promise).Deliver(argv[1])
+	if err != nil || !ok {
+		return False, err
 	}
-	lst.Cdr = argv[1].(*List)
-	return Null, nil
+	return True, nil
 }
 
-func ellCons(argv []Value) (Value, error) {
-	return Cons(argv[0], argv[1].(*List)), nil
+func ellFutureCall(vm *vm, argv []Value) (Value, error) {
+	return NewFuture(vm, argv[0].(*Function)), nil
 }
 
-func ellStructP(argv []Value) (Value, error) {
-	if IsStruct(argv[0]) {
+func ellMakePromise(argv []Value) (Value, error) {
+	return MakePromise(argv[0]), nil
+}
+
+func ellForce(vm *vm, argv []Value) (Value, error) {
+	return Force(vm, argv[0])
+}
+
+func ellLazySeqP(argv []Value) (Value, error) {
+	if IsLazySeq(argv[0]) {
 		return True, nil
 	}
 	return False, nil
 }
 
-func ellGet(argv []Value) (Value, error) {
-	return Get(argv[0], argv[1])
+// ellMakeLazySeq - a lazy sequence of the first element followed by the rest, which is what (lazy-cons first
+// rest) expands into, with the rest delayed
+func ellMakeLazySeq(argv []Value) (Value, error) {
+	return NewLazySeq(argv[0], argv[1]), nil
 }
 
-func ellStructLength(argv []Value) (Value, error) {
-	s := argv[0].(*Struct)
-	return Integer(len(s.Bindings)), nil
+func ellLazyFirst(argv []Value) (Value, error) {
+	return argv[0].(*LazySeq).first, nil
 }
 
-func ellHasP(argv []Value) (Value, error) {
-	b, err := Has(argv[0], argv[1])
+func ellLazyRest(vm *vm, argv []Value) (Value, error) {
+	return argv[0].(*LazySeq).LazyRest(vm)
+}
+
+func ellMap(vm *vm, argv []Value) (Value, error) {
+	return Map(vm, argv[0].(*Function), argv[1:])
+}
+
+func ellForEach(vm *vm, argv []Value) (Value, error) {
+	return Null, ForEach(vm, argv[0].(*Function), argv[1:])
+}
+
+func ellFilter(vm *vm, argv []Value) (Value, error) {
+	return Filter(vm, argv[0].(*Function), argv[1])
+}
+
+func ellReduce(vm *vm, argv []Value) (Value, error) {
+	return Reduce(vm, argv[0].(*Function), argv[1], argv[2])
+}
+
+func ellEveryP(vm *vm, argv []Value) (Value, error) {
+	b, err := Every(vm, argv[0].(*Function), argv[1], true, "every?")
 	if err != nil {
 		return nil, err
 	}
@@ -905,22 +2281,32 @@ func ellHasP(argv []Value) (Value, error) {
 	return False, nil
 }
 
-func ellPutBang(argv []Value) (Value, error) {
-	key := argv[1]
-	if !IsValidStructKey(key) {
-		return nil, NewError(ArgumentErrorKey, "Bad struct key: ", key)
+func ellAnyP(vm *vm, argv []Value) (Value, error) {
+	b, err := Every(vm, argv[0].(*Function), argv[1], false, "any?")
+	if err != nil {
+		return nil, err
 	}
-	Put(argv[0], key, argv[2])
-	return Null, nil
+	if b {
+		return True, nil
+	}
+	return False, nil
 }
 
-func ellUnputBang(argv []Value) (Value, error) {
-	key := argv[1]
-	if !IsValidStructKey(key) {
-		return nil, NewError(ArgumentErrorKey, "Bad struct key: ", key)
-	}
-	Unput(argv[0], key)
-	return Null, nil
+func ellZip(argv []Value) (Value, error) {
+	return Zip(argv)
+}
+
+func ellSort(vm *vm, argv []Value) (Value, error) {
+	return Sort(vm, argv[0], argv[1], Null, "sort")
+}
+
+func ellSortBang(vm *vm, argv []Value) (Value, error) {
+	return Null, SortBang(vm, argv[0], argv[1], Null)
+}
+
+// ellSortBy - the sequence sorted by the values the key function returns for its elements
+func ellSortBy(vm *vm, argv []Value) (Value, error) {
+	return Sort(vm, argv[0], argv[2], argv[1], "sort-by")
 }
 
 func ellToList(argv []Value) (Value, error) {
@@ -943,15 +2329,106 @@ func ellJSON(argv []Value) (Value, error) {
 	return NewString(s), nil
 }
 
-func ellGetFn(argv []Value) (Value, error) {
-	if len(argv) < 1 {
-		return nil, NewError(ArgumentErrorKey, "getfn expected at least 1 argument, got none")
+func ellJSONParse(argv []Value) (Value, error) {
+	return ParseJSON(StringValue(argv[0]))
+}
+
+func ellYAMLParse(argv []Value) (Value, error) {
+	return ParseYAML(StringValue(argv[0]))
+}
+
+func ellTOMLParse(argv []Value) (Value, error) {
+	return ParseTOML(StringValue(argv[0]))
+}
+
+func ellXMLParse(argv []Value) (Value, error) {
+	return ParseXML(StringValue(argv[0]))
+}
+
+func ellXMLEmit(argv []Value) (Value, error) {
+	s, err := EmitXML(argv[0], StringValue(argv[1]))
+	if err != nil {
+		return nil, err
+	}
+	return NewString(s), nil
+}
+
+func ellJSONEmit(argv []Value) (Value, error) {
+	opts := JsonOptions{Indent: StringValue(argv[1]), SortKeys: argv[2] == True, EscapeNonASCII: argv[3] == True}
+	if argv[4] != Null {
+		port, err := outputPort(argv[4], false)
+		if err != nil {
+			return nil, err
+		}
+		return Null, JsonEmitTo(port.writer, argv[0], opts)
+	}
+	s, err := JsonEmit(argv[0], opts)
+	if err != nil {
+		return nil, err
 	}
-	sym := argv[0]
-	if sym.Type() != SymbolType {
-		return nil, NewError(ArgumentErrorKey, "getfn expected a <symbol> for argument 1, got ", sym)
+	return NewString(s), nil
+}
+
+// ellDefineTag - read the literals with the tag by calling the constructor, if it is not null, with the value
+// after the tag. If a type and writer are given, values of the type are written with the tag, followed by what
+// the writer returns for them.
+func ellDefineTag(argv []Value) (Value, error) {
+	tag := argv[0].(*Symbol)
+	switch fn := argv[1].(type) {
+	case *Function:
+		code := trampoline(fn, 1, "tag-constructor")
+		DefineTagConstructor(tag, func(val Value) (Value, error) {
+			return exec(code, []Value{val})
+		})
+	default:
+		if fn != Null {
+			return nil, argTypeError("define-tag", "<function> or <null>", 2, fn)
+		}
+		DefineTagConstructor(tag, nil)
+	}
+	if argv[3] != Null {
+		fn, ok := argv[3].(*Function)
+		if !ok {
+			return nil, argTypeError("define-tag", "<function>", 4, argv[3])
+		}
+		if !IsType(argv[2]) {
+			return nil, argTypeError("define-tag", "<type>", 3, argv[2])
+		}
+		code := trampoline(fn, 1, "tag-writer")
+		DefineTagWriter(argv[2], tag, func(val Value) (Value, error) {
+			return exec(code, []Value{val})
+		})
 	}
-	return getfn(sym, argv[1:])
+	return Null, nil
+}
+
+// ellDefinePrintMethod - write the values of the type with the function, which returns their textual form as a
+// string. A null function removes the type's print method.
+func ellDefinePrintMethod(argv []Value) (Value, error) {
+	if argv[1] == Null {
+		DefinePrintMethod(argv[0], nil)
+		return Null, nil
+	}
+	fn, ok := argv[1].(*Function)
+	if !ok {
+		return nil, argTypeError("define-print-method", "<function> or <null>", 2, argv[1])
+	}
+	code := trampoline(fn, 1, "print-method")
+	DefinePrintMethod(argv[0], func(val Value) (string, error) {
+		s, err := exec(code, []Value{val})
+		if err != nil {
+			return "", err
+		}
+		if _, ok := s.(*String); !ok {
+			return "", NewError(ArgumentErrorKey, "print method for ", argv[0], " returned a ", s.Type())
+		}
+		return StringValue(s), nil
+	})
+	return Null, nil
+}
+
+func ellGetFn(argv []Value) (Value, error) {
+	return getfn(argv[0], argv[1:])
 }
 
 func ellMethodSignature(argv []Value) (Value, error) {
@@ -970,8 +2447,12 @@ func ellClose(argv []Value) (Value, error) {
 		CloseChannel(p)
 	case *Connection:
 		closeConnection(p)
+	case *Port:
+		return Null, ClosePort(p)
+	case *DB:
+		return Null, CloseDB(p)
 	default:
-		return nil, NewError(ArgumentErrorKey, "close expected a channel or connection")
+		return nil, argTypeError("close", "<channel>, <connection>, <port>, or <db>", 1, argv[0])
 	}
 	return Null, nil
 }
@@ -1033,65 +2514,149 @@ func ellReceive(argv []Value) (Value, error) {
 	return Null, nil
 }
 
+// (chan) or (chan bufsize) - the short form of the channel function, for an anonymous channel
+func ellChan(argv []Value) (Value, error) {
+	return NewChannel(IntValue(argv[0]), ""), nil
+}
+
+// (select cases timeout) waits for the first of several channel operations to proceed. Each case is either
+// a channel to receive from, or a [channel value] pair to send the value on. The result is the list
+// (channel value) for the case that proceeded, or null if the timeout, in seconds, expired first. Like
+// recv, receiving from a closed channel proceeds immediately, with a null value.
+func ellSelect(argv []Value) (Value, error) {
+	var cases []Value
+	switch p := argv[0].(type) {
+	case *Vector:
+		cases = p.Elements
+	case *List:
+		cases = ListToVector(p).Elements
+	default:
+		return nil, argTypeError("select", "<vector> or <list>", 1, argv[0])
+	}
+	var channels []Value
+	var values []Value
+	var selectCases []reflect.SelectCase
+	for _, c := range cases {
+		if ch, ok := c.(*Channel); ok {
+			if ch.channel == nil {
+				return NewList(ch, Null), nil
+			}
+			channels = append(channels, ch)
+			values = append(values, nil)
+			selectCases = append(selectCases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch.channel)})
+			continue
+		}
+		if v, ok := c.(*Vector); ok && len(v.Elements) == 2 {
+			if ch, ok := v.Elements[0].(*Channel); ok {
+				if ch.channel != nil { //sending on a closed channel never proceeds
+					channels = append(channels, ch)
+					values = append(values, v.Elements[1])
+					selectCases = append(selectCases, reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(ch.channel), Send: reflect.ValueOf(v.Elements[1])})
+				}
+				continue
+			}
+		}
+		return nil, NewError(ArgumentErrorKey, "select expected a <channel> or [<channel> <any>] case, got ", c)
+	}
+	timeout := Float64Value(argv[1])
+	if NumberEqual(timeout, 0.0) { //non-blocking
+		selectCases = append(selectCases, reflect.SelectCase{Dir: reflect.SelectDefault})
+	} else if timeout > 0 {
+		dur := time.Millisecond * time.Duration(timeout*1000.0)
+		selectCases = append(selectCases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(time.After(dur))})
+	} else if len(selectCases) == 0 {
+		return nil, NewError(ArgumentErrorKey, "select with no cases would block forever")
+	}
+	chosen, received, ok := reflect.Select(selectCases)
+	if chosen >= len(channels) {
+		return Null, nil
+	}
+	if values[chosen] != nil {
+		return NewList(channels[chosen], values[chosen]), nil
+	}
+	if ok && !received.IsNil() {
+		return NewList(channels[chosen], received.Interface().(Value)), nil
+	}
+	return NewList(channels[chosen], Null), nil
+}
+
+// randomArgs - the generator to use, which is the first argument if it is one, otherwise the default one, and
+// the rest of the arguments
+func randomArgs(argv []Value) (*RandomGenerator, []Value) {
+	if len(argv) > 0 {
+		if gen, ok := argv[0].(*RandomGenerator); ok {
+			return gen, argv[1:]
+		}
+	}
+	return randomGenerator, argv
+}
+
+// ellSetRandomSeedBang - seed the generator, if the first argument is one, otherwise the default one
 func ellSetRandomSeedBang(argv []Value) (Value, error) {
-	RandomSeed(int64(IntValue(argv[0])))
+	gen, args := randomArgs(argv)
+	if len(args) != 1 {
+		return nil, argcError("random-seed!", len(argv)-len(args)+1, len(argv)-len(args)+1, len(argv))
+	}
+	if _, ok := args[0].(*Number); !ok {
+		return nil, argTypeError("random-seed!", NumberType.String(), len(argv), args[0])
+	}
+	if !IsInt(args[0]) {
+		return nil, NewError(ArgumentErrorKey, "random-seed! expected an integer seed, got ", args[0])
+	}
+	gen.Seed(Int64Value(args[0]))
 	return Null, nil
 }
 
-func ellRandom(argv []Value) (Value, error) {
-	min := 0.0
-	max := 1.0
-	argc := len(argv)
-	switch argc {
-	case 0:
-	case 1:
-		max = Float64Value(argv[0])
-	case 2:
-		min = Float64Value(argv[0])
-		max = Float64Value(argv[1])
-	default:
-		return nil, NewError(ArgumentErrorKey, "random expected 0 to 2 arguments, got ", argc)
+func ellMakeRandomGenerator(argv []Value) (Value, error) {
+	if !IsInt(argv[0]) {
+		return nil, NewError(ArgumentErrorKey, "make-random-generator expected an integer seed, got ", argv[0])
 	}
-	return Random(min, max), nil
+	return NewRandomGenerator(Int64Value(argv[0])), nil
 }
 
-func ellRandomList(argv []Value) (Value, error) {
-	count := IntValue(argv[0])
-	min := 0.0
-	max := 1.0
-	argc := len(argv)
-	switch argc {
+// ellRandom - a random number from the generator, if the first argument is one, otherwise the default one. With
+// no bounds it is a float at least 0 and less than 1. With one, it is at least 0 and less than it, and with two,
+// at least the first and less than the second. It is an integer if the bounds are exact integers.
+func ellRandom(argv []Value) (Value, error) {
+	gen, args := randomArgs(argv)
+	bounds := []*Number{Zero}
+	for i, arg := range args {
+		n, ok := arg.(*Number)
+		if !ok {
+			return nil, argTypeError("random", NumberType.String(), len(argv)-len(args)+i+1, arg)
+		}
+		bounds = append(bounds, n)
+	}
+	switch len(bounds) {
 	case 1:
+		return gen.Float(0, 1), nil
 	case 2:
-		max = Float64Value(argv[0])
+		return gen.Random(bounds[0], bounds[1])
 	case 3:
-		min = Float64Value(argv[0])
-		max = Float64Value(argv[1])
-	default:
-		return nil, NewError(ArgumentErrorKey, "random-list expected 1 to 3 arguments, got ", argc)
+		return gen.Random(bounds[1], bounds[2])
 	}
-	return RandomList(count, min, max), nil
+	return nil, argcError("random", len(argv)-len(args), len(argv)-len(args)+2, len(argv))
+}
+
+func ellRandomBytes(argv []Value) (Value, error) {
+	return RandomBytes(IntValue(argv[0]))
 }
 
-func ellUUIDFromTime(argv []Value) (Value, error) {
-	var u uuid.UUID
+func ellRandomList(argv []Value) (Value, error) {
 	argc := len(argv)
+	if argc < 1 || argc > 3 {
+		return nil, argcError("random-list", 1, 3, argc)
+	}
+	min := 0.0
+	max := 1.0
 	switch argc {
-	case 0:
-		u = uuid.NewUUID()
-	case 1:
-		u = uuid.NewMD5(uuid.NameSpace_URL, []byte(StringValue(argv[0])))
 	case 2:
-		ns := uuid.Parse(StringValue(argv[0]))
-		if ns == nil {
-			ns = uuid.NewMD5(uuid.NameSpace_URL, []byte(StringValue(argv[0])))
-		}
-		u = uuid.NewMD5(ns, []byte(StringValue(argv[1])))
-	}
-	if u == nil {
-		return nil, NewError(ArgumentErrorKey, "Expected 0-2 arguments, got: ", argc)
+		max = Float64Value(argv[1])
+	case 3:
+		min = Float64Value(argv[1])
+		max = Float64Value(argv[2])
 	}
-	return NewString(u.String()), nil
+	return RandomList(IntValue(argv[0]), min, max), nil
 }
 
 func CurrentTimestamp(t time.Time) Value {
@@ -1116,7 +2681,20 @@ func ellToBlob(argv []Value) (Value, error) {
 
 func ellMakeBlob(argv []Value) (Value, error) {
 	size := IntValue(argv[0])
-	return MakeBlob(size), nil
+	if size < 0 {
+		return nil, NewError(ArgumentErrorKey, "make-blob expected a non-negative size, got ", argv[0])
+	}
+	fill, err := AsByteValue(argv[1])
+	if err != nil {
+		return nil, err
+	}
+	blob := MakeBlob(size)
+	if fill != 0 {
+		for i := range blob.Value {
+			blob.Value[i] = fill
+		}
+	}
+	return blob, nil
 }
 
 func ellBlobLength(argv []Value) (Value, error) {
@@ -1134,6 +2712,48 @@ func ellBlobRef(argv []Value) (Value, error) {
 	return Integer(int(el[idx])), nil
 }
 
+func ellBlobSetBang(argv []Value) (Value, error) {
+	blob := argv[0].(*Blob)
+	el := blob.Value
+	idx := IntValue(argv[1])
+	if idx < 0 || idx >= len(el) {
+		return nil, NewError(ArgumentErrorKey, "Blob index out of range")
+	}
+	b, err := AsByteValue(argv[2])
+	if err != nil {
+		return nil, err
+	}
+	el[idx] = b
+	return Null, nil
+}
+
+func ellBlobToString(argv []Value) (Value, error) {
+	blob := argv[0].(*Blob)
+	return NewString(string(blob.Value)), nil
+}
+
+func ellStringToBlob(argv []Value) (Value, error) {
+	return NewBlob([]byte(StringValue(argv[0]))), nil
+}
+
+// ellSubblob - a copy of the bytes from start up to end, which are clamped to the blob like those of substring
+func ellSubblob(argv []Value) (Value, error) {
+	el := argv[0].(*Blob).Value
+	start := IntValue(argv[1])
+	end := IntValue(argv[2])
+	if start < 0 {
+		start = 0
+	} else if start > len(el) {
+		return EmptyBlob, nil
+	}
+	if end < start {
+		return EmptyBlob, nil
+	} else if end > len(el) {
+		end = len(el)
+	}
+	return NewBlob(append([]byte(nil), el[start:end]...)), nil
+}
+
 func ellListen(argv []Value) (Value, error) {
 	port := fmt.Sprintf(":%d", IntValue(argv[0]))
 	listener, err := net.Listen("tcp", port)
@@ -1159,9 +2779,6 @@ func ellConnect(argv []Value) (Value, error) {
 func ellHTTPServer(argv []Value) (Value, error) {
 	port := IntValue(argv[0])
 	handler := argv[1].(*Function) // a function of one <struct> argument
-	if handler.code == nil || handler.code.argc != 1 {
-		return nil, NewError(ArgumentErrorKey, "Cannot use this function as a handler: ", handler)
-	}
 	return httpServer(port, handler)
 }
 
@@ -1169,14 +2786,28 @@ func ellHTTPClient(argv []Value) (Value, error) {
 	url := StringValue(argv[0])
 	method := strings.ToUpper(StringValue(argv[1]))
 	headers := argv[2].(*Struct)
-	body := argv[3].(*String)
-	println("http ", method, " of ", url, ", headers: ", headers, ", body: ", body)
+	body, err := bytesOf("http", 4, argv[3])
+	if err != nil {
+		return nil, err
+	}
 	switch method {
 	case "GET", "PUT", "POST", "DELETE", "HEAD", "OPTIONS", "PATCH":
 		return httpClientOperation(method, url, headers, body)
 	default:
-		return nil, NewError(ErrorKey, "HTTP method not support: ", method)
+		return nil, NewError(ArgumentErrorKey, "HTTP method not supported: ", method)
+	}
+}
+
+func ellHTTPGet(argv []Value) (Value, error) {
+	return httpClientOperation("GET", StringValue(argv[0]), argv[1].(*Struct), nil)
+}
+
+func ellHTTPPost(argv []Value) (Value, error) {
+	body, err := bytesOf("http-post", 2, argv[1])
+	if err != nil {
+		return nil, err
 	}
+	return httpClientOperation("POST", StringValue(argv[0]), argv[2].(*Struct), body)
 }
 
 func Now() float64 {
@@ -1211,3 +2842,72 @@ func ellGetenv(argv []Value) (Value, error) {
 	}
 	return NewString(s), nil
 }
+
+func ellSetenv(argv []Value) (Value, error) {
+	return Null, ioError(os.Setenv(StringValue(argv[0]), StringValue(argv[1])))
+}
+
+func ellCurrentDirectory(_ []Value) (Value, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, ioError(err)
+	}
+	return NewString(dir), nil
+}
+
+func ellChdir(argv []Value) (Value, error) {
+	return Null, ioError(os.Chdir(ExpandFilePath(StringValue(argv[0]))))
+}
+
+func ellProcessID(_ []Value) (Value, error) {
+	return Integer(os.Getpid()), nil
+}
+
+// runCommand - run the command to completion, with the input as its standard input, and in the directory, if they
+// are not empty. The result is a struct of its output and exit code, i.e. {stdout: "hi\n" stderr: "" exit-code: 0}.
+// A command that exits with a nonzero code is not an error, but one that cannot be run at all is.
+func runCommand(cmd *osexec.Cmd, input string, dir string) (Value, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if input != "" {
+		cmd.Stdin = strings.NewReader(input)
+	}
+	if dir != "" {
+		cmd.Dir = ExpandFilePath(dir)
+	}
+	code := 0
+	if err := cmd.Run(); err != nil {
+		exitErr, ok := err.(*osexec.ExitError)
+		if !ok {
+			return nil, ioError(err)
+		}
+		code = exitErr.ExitCode()
+	}
+	result := NewStruct()
+	result.Put(Intern("stdout:"), NewString(stdout.String()))
+	result.Put(Intern("stderr:"), NewString(stderr.String()))
+	result.Put(Intern("exit-code:"), Integer(code))
+	return result, nil
+}
+
+func ellSystem(argv []Value) (Value, error) {
+	return runCommand(osexec.Command("/bin/sh", "-c", StringValue(argv[0])), StringValue(argv[1]), StringValue(argv[2]))
+}
+
+func ellExecCommand(argv []Value) (Value, error) {
+	var args []string
+	for lst := argv[1].(*List); lst != EmptyList; lst = lst.Cdr {
+		arg, err := AsStringValue(lst.Car)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return runCommand(osexec.Command(StringValue(argv[0]), args...), StringValue(argv[2]), StringValue(argv[3]))
+}
+
+func ellExit(argv []Value) (Value, error) {
+	exit(IntValue(argv[0]))
+	return Null, nil
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	. "github.com/boynton/ell/data"
+)
+
+// primop - a primitive that the compiler applies with its own instruction when optimizing, rather than
+// looking up the global and calling it. In a tight loop the call overhead dominates the work these do.
+type primop struct {
+	name      string
+	argc      int
+	primitive *Primitive //the builtin, which handles the cases the VM does not do inline, such as type errors
+}
+
+// primops - indexed by opcode, from opcodeCar
+var primops = []*primop{
+	{name: "car", argc: 1},
+	{name: "cdr", argc: 1},
+	{name: "null?", argc: 1},
+	{name: "not", argc: 1},
+	{name: "identical?", argc: 2},
+	{name: "cons", argc: 2},
+	{name: "+", argc: 2},
+	{name: "-", argc: 2},
+	{name: "*", argc: 2},
+	{name: "inc", argc: 1},
+	{name: "dec", argc: 1},
+	{name: "<", argc: 2},
+	{name: "vector-ref", argc: 2},
+	{name: "vector-set!", argc: 3},
+	{name: "get", argc: 2},
+}
+
+var primopsBySymbol = initPrimopsBySymbol()
+
+func initPrimopsBySymbol() map[Value]int {
+	m := make(map[Value]int)
+	for i, p := range primops {
+		m[Intern(p.name)] = opcodeCar + i
+	}
+	return m
+}
+
+func isPrimop(op int) bool {
+	return op >= opcodeCar && op < opcodeCount
+}
+
+// initPrimops - bind the primops to the builtins. Called once the primitives are defined.
+func initPrimops() {
+	for _, p := range primops {
+		if f, ok := GetGlobal(Intern(p.name)).(*Function); ok {
+			p.primitive = f.primitive
+		}
+	}
+}
+
+// primopFor - the opcode for a call of the function with argc arguments, if the call can be a primop: the
+// name must refer to the builtin, not to a local variable, a module's definition, or a redefinition.
+func primopFor(fn Value, env *List, argc int) (int, bool) {
+	op, ok := primopsBySymbol[fn]
+	if !ok || primops[op-opcodeCar].argc != argc {
+		return 0, false
+	}
+	sym := fn.(*Symbol)
+	if _, _, local := calculateLocation(sym, env); local || currentModule.resolve(sym) != sym {
+		return 0, false
+	}
+	if f, ok := sym.Value.(*Function); !ok || f.primitive == nil || f.primitive != primops[op-opcodeCar].primitive {
+		return 0, false
+	}
+	return op, true
+}
+
+// primop - apply the primop to the arguments on the stack, leaving the result in their place. The common
+// cases are done inline, the rest by calling the builtin.
+func (vm *vm) primop(op int, stack []Value, sp int) (int, error) {
+	var result Value
+	switch op {
+	case opcodeCar:
+		if lst, ok := stack[sp].(*List); ok {
+			result = Null
+			if lst != EmptyList {
+				result = lst.Car
+			}
+		}
+	case opcodeCdr:
+		if lst, ok := stack[sp].(*List); ok {
+			result = lst
+			if lst != EmptyList {
+				result = lst.Cdr
+			}
+		}
+	case opcodeNullP:
+		result = False
+		if stack[sp] == Null {
+			result = True
+		}
+	case opcodeNot:
+		result = False
+		if stack[sp] == False {
+			result = True
+		}
+	case opcodeIdenticalP:
+		result = False
+		if stack[sp] == stack[sp+1] {
+			result = True
+		}
+	case opcodeCons:
+		if lst, ok := stack[sp+1].(*List); ok {
+			result = Cons(stack[sp], lst)
+		}
+	case opcodeAdd, opcodeSub, opcodeMul, opcodeNumLess:
+		n1, ok1 := stack[sp].(*Number)
+		n2, ok2 := stack[sp+1].(*Number)
+		if ok1 && ok2 {
+			switch op {
+			case opcodeAdd:
+				result = NumberAdd(n1, n2)
+			case opcodeSub:
+				result = NumberSub(n1, n2)
+			case opcodeMul:
+				result = NumberMul(n1, n2)
+			default:
+				result = False
+				if NumberCompare(n1, n2) < 0 {
+					result = True
+				}
+			}
+		}
+	case opcodeInc, opcodeDec:
+		if n, ok := stack[sp].(*Number); ok {
+			if op == opcodeInc {
+				result = NumberAdd(n, One)
+			} else {
+				result = NumberSub(n, One)
+			}
+		}
+	case opcodeVectorRef:
+		vec, ok1 := stack[sp].(*Vector)
+		n, ok2 := stack[sp+1].(*Number)
+		if ok1 && ok2 {
+			if idx := int(n.Value); idx >= 0 && idx < len(vec.Elements) {
+				result = vec.Elements[idx]
+			}
+		}
+	case opcodeVectorSetBang:
+		vec, ok1 := stack[sp].(*Vector)
+		n, ok2 := stack[sp+1].(*Number)
+		if ok1 && ok2 && !vec.IsFrozen() {
+			if idx := int(n.Value); idx >= 0 && idx < len(vec.Elements) {
+				vec.Elements[idx] = stack[sp+2]
+				result = Null
+			}
+		}
+	case opcodeGet:
+		if strct, ok := stack[sp].(*Struct); ok {
+			val, err := Get(strct, stack[sp+1])
+			if err != nil {
+				return sp, err
+			}
+			result = val
+		}
+	}
+	p := primops[op-opcodeCar]
+	if result == nil {
+		val, err := vm.callPrimitive(p.primitive, stack[sp:sp+p.argc])
+		if err != nil {
+			return sp, err
+		}
+		result = val
+	}
+	sp += p.argc - 1
+	stack[sp] = result
+	return sp, nil
+}
@@ -0,0 +1,344 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/boynton/ell/data"
+)
+
+// The profiler counts the calls of each function, and samples the VM as it runs: every so many instructions, and
+// after each primitive call, the time since the last sample is charged, in whole periods of profilePeriod, to the
+// function running (its self time) and to every function on the stack for it (its cumulative time). The time in a
+// primitive is charged to it, since it is sampled as soon as it returns. Like the debugger, the profiler runs in the
+// instrumented VM. Calls of primops compiled inline, and self tail calls, which are loops, are not counted.
+
+const profilePeriod = time.Millisecond
+
+// profileInterval - the number of instructions between checks of the time
+const profileInterval = 256
+
+var profiling bool
+var profileMutex sync.Mutex
+var profileStart time.Time
+var profileDuration time.Duration
+
+// profileEntry - the calls and samples of a function, compiled or primitive
+type profileEntry struct {
+	id    int
+	name  string
+	file  string
+	calls int
+	self  int
+	cum   int
+}
+
+var profileCodes = map[*Code]*profileEntry{}
+var profilePrims = map[*Primitive]*profileEntry{}
+var profileEntries []*profileEntry
+
+// profileStacks - the number of samples of each stack, keyed by the ids of its entries, innermost first
+var profileStacks = map[string]int{}
+
+// StartProfiling - start counting calls and sampling the VM
+func StartProfiling() {
+	profileMutex.Lock()
+	defer profileMutex.Unlock()
+	if !profiling {
+		profiling = true
+		profileStart = time.Now()
+	}
+}
+
+// StopProfiling - stop profiling, keeping what has been recorded
+func StopProfiling() {
+	profileMutex.Lock()
+	defer profileMutex.Unlock()
+	if profiling {
+		profiling = false
+		profileDuration += time.Since(profileStart)
+	}
+}
+
+// ResetProfile - discard what has been recorded
+func ResetProfile() {
+	profileMutex.Lock()
+	defer profileMutex.Unlock()
+	profileCodes = map[*Code]*profileEntry{}
+	profilePrims = map[*Primitive]*profileEntry{}
+	profileEntries = nil
+	profileStacks = map[string]int{}
+	profileDuration = 0
+	profileStart = time.Now()
+}
+
+func newProfileEntry(name string, file string) *profileEntry {
+	if name == "" {
+		name = "(anonymous)"
+	}
+	entry := &profileEntry{id: len(profileEntries) + 1, name: name, file: file}
+	profileEntries = append(profileEntries, entry)
+	return entry
+}
+
+func codeProfile(code *Code) *profileEntry {
+	entry, ok := profileCodes[code]
+	if !ok {
+		file := code.source
+		if i := strings.LastIndex(file, ":"); i > 0 {
+			file = file[:i]
+		}
+		entry = newProfileEntry(code.name, file)
+		profileCodes[code] = entry
+	}
+	return entry
+}
+
+func primitiveProfile(prim *Primitive) *profileEntry {
+	entry, ok := profilePrims[prim]
+	if !ok {
+		entry = newProfileEntry(prim.name, "")
+		profilePrims[prim] = entry
+	}
+	return entry
+}
+
+// profileCall - count the call of the primitive, which is charged for a sample due when it returns
+func (vm *vm) profileCall(prim *Primitive) {
+	profileMutex.Lock()
+	primitiveProfile(prim).calls++
+	profileMutex.Unlock()
+	vm.profPrim = prim
+}
+
+// profileStep - count the call of the function whose code is starting, and take a sample if one is due
+func (vm *vm) profileStep(env *Frame, pc int) {
+	if pc == 0 && env != vm.profEnv {
+		profileMutex.Lock()
+		codeProfile(env.code).calls++
+		profileMutex.Unlock()
+	}
+	vm.profEnv = env
+	prim := vm.profPrim
+	vm.profPrim = nil
+	vm.profSteps++
+	if prim == nil && vm.profSteps < profileInterval {
+		return
+	}
+	vm.profSteps = 0
+	now := time.Now()
+	if vm.profLast.IsZero() {
+		vm.profLast = now
+		return
+	}
+	periods := int(now.Sub(vm.profLast) / profilePeriod)
+	if periods == 0 {
+		return
+	}
+	vm.profLast = vm.profLast.Add(time.Duration(periods) * profilePeriod)
+	profileMutex.Lock()
+	defer profileMutex.Unlock()
+	var stack []*profileEntry
+	if prim != nil {
+		stack = append(stack, primitiveProfile(prim))
+	}
+	for f := env; f != nil; f = f.previous {
+		if f.code != nil {
+			stack = append(stack, codeProfile(f.code))
+		}
+	}
+	if len(stack) == 0 {
+		return
+	}
+	stack[0].self += periods
+	seen := map[*profileEntry]bool{}
+	ids := make([]string, len(stack))
+	for i, entry := range stack {
+		if !seen[entry] {
+			seen[entry] = true
+			entry.cum += periods
+		}
+		ids[i] = strconv.Itoa(entry.id)
+	}
+	profileStacks[strings.Join(ids, ",")] += periods
+}
+
+// ProfileReport - the calls, self time, and cumulative time of each function profiled, most time first
+func ProfileReport() string {
+	profileMutex.Lock()
+	defer profileMutex.Unlock()
+	entries := append([]*profileEntry(nil), profileEntries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].cum != entries[j].cum {
+			return entries[i].cum > entries[j].cum
+		}
+		return entries[i].calls > entries[j].calls
+	})
+	ms := func(samples int) float64 {
+		return float64(time.Duration(samples)*profilePeriod) / float64(time.Millisecond)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%10s %10s %10s  %s\n", "calls", "self ms", "cum ms", "function")
+	for _, entry := range entries {
+		fmt.Fprintf(&buf, "%10d %10.0f %10.0f  %s\n", entry.calls, ms(entry.self), ms(entry.cum), entry.name)
+	}
+	return buf.String()
+}
+
+// WriteProfile - write the samples in the gzipped protocol buffer format of pprof, so `go tool pprof` can
+// show them
+func WriteProfile(w io.Writer) error {
+	profileMutex.Lock()
+	defer profileMutex.Unlock()
+	strs := map[string]int{"": 0}
+	table := []string{""}
+	str := func(s string) uint64 {
+		i, ok := strs[s]
+		if !ok {
+			i = len(table)
+			strs[s] = i
+			table = append(table, s)
+		}
+		return uint64(i)
+	}
+	valueType := func(typ string, unit string) []byte {
+		var m protoBuffer
+		m.varintField(1, str(typ))
+		m.varintField(2, str(unit))
+		return m.Bytes()
+	}
+	var p protoBuffer
+	p.bytesField(1, valueType("samples", "count"))
+	p.bytesField(1, valueType("cpu", "nanoseconds"))
+	keys := make([]string, 0, len(profileStacks))
+	for key := range profileStacks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		count := profileStacks[key]
+		var ids, values protoBuffer
+		for _, id := range strings.Split(key, ",") {
+			n, _ := strconv.ParseUint(id, 10, 64)
+			ids.varint(n)
+		}
+		values.varint(uint64(count))
+		values.varint(uint64(int64(count) * int64(profilePeriod)))
+		var sample protoBuffer
+		sample.bytesField(1, ids.Bytes())
+		sample.bytesField(2, values.Bytes())
+		p.bytesField(2, sample.Bytes())
+	}
+	for _, entry := range profileEntries {
+		var line, loc protoBuffer
+		line.varintField(1, uint64(entry.id))
+		loc.varintField(1, uint64(entry.id))
+		loc.bytesField(4, line.Bytes())
+		p.bytesField(4, loc.Bytes())
+	}
+	for _, entry := range profileEntries {
+		var fn protoBuffer
+		fn.varintField(1, uint64(entry.id))
+		fn.varintField(2, str(entry.name))
+		fn.varintField(3, str(entry.name))
+		fn.varintField(4, str(entry.file))
+		p.bytesField(5, fn.Bytes())
+	}
+	duration := profileDuration
+	if profiling {
+		duration += time.Since(profileStart)
+	}
+	periodType := valueType("cpu", "nanoseconds")
+	for _, s := range table {
+		p.bytesField(6, []byte(s))
+	}
+	p.varintField(9, uint64(profileStart.UnixNano()))
+	p.varintField(10, uint64(duration))
+	p.bytesField(11, periodType)
+	p.varintField(12, uint64(profilePeriod))
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(p.Bytes()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// protoBuffer - the encoding of a protocol buffer message, with just what a pprof profile needs
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) varint(n uint64) {
+	for n >= 0x80 {
+		b.WriteByte(byte(n) | 0x80)
+		n >>= 7
+	}
+	b.WriteByte(byte(n))
+}
+
+func (b *protoBuffer) varintField(field int, n uint64) {
+	b.varint(uint64(field) << 3)
+	b.varint(n)
+}
+
+func (b *protoBuffer) bytesField(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	b.Write(data)
+}
+
+func ellProfileStart(argv []Value) (Value, error) {
+	StartProfiling()
+	return Null, nil
+}
+
+func ellProfileStop(argv []Value) (Value, error) {
+	StopProfiling()
+	return Null, nil
+}
+
+func ellProfileReset(argv []Value) (Value, error) {
+	ResetProfile()
+	return Null, nil
+}
+
+func ellProfileReport(argv []Value) (Value, error) {
+	fmt.Print(ProfileReport())
+	return Null, nil
+}
+
+func ellProfileWrite(argv []Value) (Value, error) {
+	f, err := os.Create(StringValue(argv[0]))
+	if err != nil {
+		return nil, NewError(IOErrorKey, err.Error())
+	}
+	defer f.Close()
+	if err := WriteProfile(f); err != nil {
+		return nil, NewError(IOErrorKey, err.Error())
+	}
+	return Null, nil
+}
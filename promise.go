@@ -0,0 +1,238 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/boynton/ell/data"
+)
+
+// PromiseType - the type of the promises that delay, make-promise, promise, and future return
+var PromiseType Value = Intern("<promise>")
+
+// Promise - a value that is computed by calling its thunk the first time it is forced, and remembered after that.
+// A promise made without a thunk is delivered its value instead, by deliver, or by the thread computing a future,
+// and forcing it waits until then.
+type Promise struct {
+	thunk     *Function //null once the promise is forced
+	value     Value
+	err       error //the error the thunk of a future raised, which forcing it raises again
+	forced    bool
+	mutex     sync.Mutex
+	delivered chan bool //for a promise that is delivered, closed once it has been
+}
+
+func (p *Promise) Type() Value {
+	return PromiseType
+}
+
+func (p *Promise) String() string {
+	if p.delivered != nil {
+		select {
+		case <-p.delivered:
+		default:
+			return "#[promise]"
+		}
+	}
+	p.mutex.Lock()
+	forced, val, err := p.forced, p.value, p.err
+	p.mutex.Unlock()
+	if forced && err == nil {
+		return "#[promise " + val.String() + "]"
+	}
+	return "#[promise]"
+}
+
+func (p1 *Promise) Equals(another Value) bool {
+	if p2, ok := another.(*Promise); ok {
+		return p1 == p2
+	}
+	return false
+}
+
+// NewPromise - a promise of the value the thunk, a function of no arguments, returns
+func NewPromise(thunk *Function) *Promise {
+	return &Promise{thunk: thunk}
+}
+
+// MakePromise - a promise that is already forced to the value
+func MakePromise(val Value) *Promise {
+	if p, ok := val.(*Promise); ok {
+		return p
+	}
+	return &Promise{value: val, forced: true}
+}
+
+// NewDeliveredPromise - a promise whose value is delivered later, by Deliver
+func NewDeliveredPromise() *Promise {
+	return &Promise{delivered: make(chan bool)}
+}
+
+// NewFuture - a promise of the value the thunk returns, which is computed at once, by another thread. The thread
+// runs under the context and limits of the VM, as one that VM spawns does.
+func NewFuture(vm *vm, thunk *Function) *Promise {
+	p := NewDeliveredPromise()
+	child := vm.thread()
+	go func() {
+		val, err := child.execArgs(trampoline(thunk, 0, "future"), nil)
+		p.deliver(val, err)
+	}()
+	return p
+}
+
+func IsPromise(obj Value) bool {
+	_, ok := obj.(*Promise)
+	return ok
+}
+
+// Deliver - give the promise its value, and wake the threads waiting for it. The result is false if the promise
+// already had one, which it keeps.
+func (p *Promise) Deliver(val Value) (bool, error) {
+	if p.delivered == nil {
+		return false, NewError(ErrorKey, "deliver: the promise is not one that is delivered: ", p)
+	}
+	return p.deliver(val, nil), nil
+}
+
+func (p *Promise) deliver(val Value, err error) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.forced {
+		return false
+	}
+	p.value, p.err, p.forced = val, err, true
+	close(p.delivered)
+	return true
+}
+
+// Await - the value of the promise, waiting up to the timeout, in seconds, for it to be delivered, or forever if
+// the timeout is negative. If it is not delivered in time, the result is false.
+func (p *Promise) Await(vm *vm, timeout float64) (Value, bool, error) {
+	if p.delivered == nil {
+		val, err := Force(vm, p)
+		return val, err == nil, err
+	}
+	if timeout < 0 {
+		<-p.delivered
+	} else {
+		select {
+		case <-p.delivered:
+		case <-time.After(time.Duration(timeout * float64(time.Second))):
+			return nil, false, nil
+		}
+	}
+	return p.value, true, p.err
+}
+
+// Force - the value of the promise, calling its thunk if it has not been forced yet, or waiting for it to be
+// delivered. Anything other than a promise is its own value. The thunk is called with CallFunction, under the
+// context and limits of the VM. If forcing the promise forces it again, or another thread forces it meanwhile,
+// the value of the force that finishes first is kept.
+func Force(vm *vm, obj Value) (Value, error) {
+	p, ok := obj.(*Promise)
+	if !ok {
+		return obj, nil
+	}
+	if p.delivered != nil {
+		val, _, err := p.Await(vm, -1)
+		return val, err
+	}
+	p.mutex.Lock()
+	if p.forced {
+		defer p.mutex.Unlock()
+		return p.value, nil
+	}
+	thunk := p.thunk
+	p.mutex.Unlock() //the thunk may force the promise itself
+	val, err := CallFunction(vm, thunk, nil)
+	if err != nil {
+		return nil, err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.forced {
+		p.value = val
+		p.forced = true
+		p.thunk = nil
+	}
+	return p.value, nil
+}
+
+// expandDelay - (delay expr) => (promise (fn () expr))
+func expandDelay(expr Value) (Value, error) {
+	if ListLength(expr) != 2 {
+		return nil, NewError(SyntaxErrorKey, expr)
+	}
+	thunk := NewList(Intern("fn"), EmptyList, Cadr(expr))
+	return NewList(Intern("promise"), thunk), nil
+}
+
+// expandFuture - (future expr) => (future-call (fn () expr))
+func expandFuture(expr Value) (Value, error) {
+	if ListLength(expr) != 2 {
+		return nil, NewError(SyntaxErrorKey, expr)
+	}
+	thunk := NewList(Intern("fn"), EmptyList, Cadr(expr))
+	return NewList(Intern("future-call"), thunk), nil
+}
+
+// LazySeqType - the type of the non-empty lazy sequences that lazy-cons makes. The empty list ends them.
+var LazySeqType Value = Intern("<lazy-seq>")
+
+// LazySeq - a sequence whose first element is known, and whose rest is a promise of another sequence, so that
+// it is only computed when it is needed, and a sequence can be infinite
+type LazySeq struct {
+	first Value
+	rest  Value //a promise of the rest, or the rest once it is forced
+}
+
+func (seq *LazySeq) Type() Value {
+	return LazySeqType
+}
+
+func (seq *LazySeq) String() string {
+	return "#[lazy-seq " + seq.first.String() + " ...]"
+}
+
+func (seq1 *LazySeq) Equals(another Value) bool {
+	if seq2, ok := another.(*LazySeq); ok {
+		return seq1 == seq2
+	}
+	return false
+}
+
+// NewLazySeq - a sequence of the first element followed by the rest, which is usually a promise of a sequence
+func NewLazySeq(first Value, rest Value) *LazySeq {
+	return &LazySeq{first: first, rest: rest}
+}
+
+func IsLazySeq(obj Value) bool {
+	_, ok := obj.(*LazySeq)
+	return ok
+}
+
+// LazyRest - the rest of the sequence, forcing it if it is not yet known
+func (seq *LazySeq) LazyRest(vm *vm) (Value, error) {
+	rest, err := Force(vm, seq.rest)
+	if err != nil {
+		return nil, err
+	}
+	seq.rest = rest
+	return rest, nil
+}
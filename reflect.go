@@ -0,0 +1,455 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"unicode"
+	"unicode/utf8"
+
+	. "github.com/boynton/ell/data"
+)
+
+// The exported fields and methods of the Go values wrapped by objects (see NewObject) are available to Ell code:
+// `(get obj name:)` and `(put! obj name: val)` get and set fields, `(invoke obj "Method" args...)` calls methods,
+// and `(.Name obj args...)` calls the method Name, or gets the field Name if there is no such method. Ell values
+// are converted to the Go types the fields and methods expect, and Go results that have no Ell equivalent, such as
+// structs, are wrapped as <go-object> objects.
+
+// GoObjectType - the type of the Go values returned by methods and fields that are wrapped as objects
+var GoObjectType Value = Intern("<go-object>")
+
+var errorInterface = reflect.TypeOf((*error)(nil)).Elem()
+
+// goName - the Go name of a field or method named by the keyword, symbol, or string
+func goName(key Value, name string) (string, error) {
+	switch p := key.(type) {
+	case *Keyword:
+		return p.Name(), nil
+	case *Symbol:
+		return p.Text, nil
+	case *String:
+		return p.Value, nil
+	}
+	return "", NewError(ArgumentErrorKey, name, " expected a <keyword>, <symbol>, or <string> name, got a ", key.Type())
+}
+
+// exportedName - the name with its first letter capitalized, as Go requires for exported names. Ell names
+// are usually lowercase, i.e. the keyword name: names the field Name.
+func exportedName(name string) string {
+	r, n := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(r)) + name[n:]
+}
+
+// goStruct - the struct the Go value is, or points to
+func goStruct(obj *Object) (reflect.Value, bool) {
+	v := reflect.ValueOf(obj.Value)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return v, false
+		}
+		v = v.Elem()
+	}
+	return v, v.Kind() == reflect.Struct
+}
+
+// goField - the exported field of the struct with the name, or the exported name for it
+func goField(v reflect.Value, name string) (reflect.Value, bool) {
+	for _, n := range []string{name, exportedName(name)} {
+		if sf, ok := v.Type().FieldByName(n); ok && sf.PkgPath == "" {
+			return v.FieldByIndex(sf.Index), true
+		}
+	}
+	return v, false
+}
+
+// goMethod - the exported method of the Go value with the name, or the exported name for it
+func goMethod(v reflect.Value, name string) (reflect.Value, bool) {
+	if !v.IsValid() {
+		return v, false
+	}
+	for _, n := range []string{name, exportedName(name)} {
+		if m := v.MethodByName(n); m.IsValid() {
+			return m, true
+		}
+	}
+	return v, false
+}
+
+// goCollection - the map, slice, or array the Go value is, or points to
+func goCollection(obj *Object) (reflect.Value, bool) {
+	v := reflect.ValueOf(obj.Value)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return v, false
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Map:
+		return v, !v.IsNil()
+	case reflect.Slice, reflect.Array:
+		return v, true
+	}
+	return v, false
+}
+
+// goMapKey - the Go key of the map for the key. Keywords and symbols name string keys, as they name fields.
+func goMapKey(m reflect.Value, key Value, name string) (reflect.Value, error) {
+	if m.Type().Key().Kind() == reflect.String {
+		switch key.(type) {
+		case *Keyword, *Symbol:
+			n, _ := goName(key, name)
+			return reflect.ValueOf(n).Convert(m.Type().Key()), nil
+		}
+	}
+	return toGo(key, m.Type().Key(), name, 2)
+}
+
+// ObjectField - the value of the field of the Go struct wrapped by the object, or of the key or index of the
+// wrapped map or slice
+func ObjectField(obj *Object, key Value) (Value, error) {
+	if v, ok := goCollection(obj); ok {
+		if v.Kind() == reflect.Map {
+			k, err := goMapKey(v, key, "get")
+			if err != nil {
+				return nil, err
+			}
+			return fromGo(v.MapIndex(k)), nil
+		}
+		i, err := elementIndex(key, v.Len(), "get")
+		if err != nil {
+			return nil, err
+		}
+		return fromGo(v.Index(i)), nil
+	}
+	name, err := goName(key, "get")
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := goStruct(obj); ok {
+		if f, ok := goField(v, name); ok {
+			return fromGo(f), nil
+		}
+	}
+	return nil, NewError(ArgumentErrorKey, "No field ", name, " in ", obj)
+}
+
+// SetObjectField - set the field of the Go struct wrapped by the object, which must be a pointer to the struct, or
+// the key or index of the wrapped map or slice
+func SetObjectField(obj *Object, key Value, val Value) error {
+	if v, ok := goCollection(obj); ok {
+		gv, err := toGo(val, v.Type().Elem(), "put!", 3)
+		if err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Map {
+			k, err := goMapKey(v, key, "put!")
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(k, gv)
+			return nil
+		}
+		i, err := elementIndex(key, v.Len(), "put!")
+		if err != nil {
+			return err
+		}
+		if !v.Index(i).CanSet() {
+			return NewError(ArgumentErrorKey, "put! cannot set element ", i, " of ", obj, ", it is not a pointer")
+		}
+		v.Index(i).Set(gv)
+		return nil
+	}
+	name, err := goName(key, "put!")
+	if err != nil {
+		return err
+	}
+	if v, ok := goStruct(obj); ok {
+		if f, ok := goField(v, name); ok {
+			if !f.CanSet() {
+				return NewError(ArgumentErrorKey, "put! cannot set field ", name, " of ", obj, ", it is not a pointer")
+			}
+			gv, err := toGo(val, f.Type(), "put!", 3)
+			if err != nil {
+				return err
+			}
+			f.Set(gv)
+			return nil
+		}
+	}
+	return NewError(ArgumentErrorKey, "No field ", name, " in ", obj)
+}
+
+// ObjectLength - the number of entries or elements of the Go map, slice, array, or string wrapped by the object
+func ObjectLength(obj *Object) (int, error) {
+	if v, ok := goCollection(obj); ok {
+		return v.Len(), nil
+	}
+	if s, ok := obj.Value.(string); ok {
+		return utf8.RuneCountInString(s), nil
+	}
+	return 0, accessorTypeError("length", obj)
+}
+
+// Invoke - call the method of the Go value wrapped by the object with the arguments. If the value has no such
+// method, and there are no arguments, the value of the field with the name is returned.
+func Invoke(obj Value, key Value, args []Value) (Value, error) {
+	o, ok := obj.(*Object)
+	if !ok {
+		return nil, NewError(ArgumentErrorKey, "invoke expected a Go object for argument 1, got a ", obj.Type())
+	}
+	name, err := goName(key, "invoke")
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := goMethod(reflect.ValueOf(o.Value), name); ok {
+		return callGo(m, args, name)
+	}
+	if len(args) == 0 {
+		if v, ok := goStruct(o); ok {
+			if f, ok := goField(v, name); ok {
+				return fromGo(f), nil
+			}
+		}
+	}
+	return nil, NewError(ArgumentErrorKey, "No method ", name, " for ", obj)
+}
+
+// callGo - call the Go function with the arguments. A final error result is returned as the error, the other
+// results are the value: null if there are none, a list if there are several. A panic in the function is
+// returned as an error.
+func callGo(fn reflect.Value, args []Value, name string) (result Value, err error) {
+	t := fn.Type()
+	nin := t.NumIn()
+	if t.IsVariadic() {
+		if len(args) < nin-1 {
+			return nil, argcError(name, nin-1, -1, len(args))
+		}
+	} else if len(args) != nin {
+		return nil, argcError(name, nin, nin, len(args))
+	}
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		var at reflect.Type
+		if t.IsVariadic() && i >= nin-1 {
+			at = t.In(nin - 1).Elem()
+		} else {
+			at = t.In(i)
+		}
+		in[i], err = toGo(arg, at, name, i+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, NewError(ErrorKey, name, ": ", fmt.Sprint(r))
+		}
+	}()
+	out := fn.Call(in)
+	if n := len(out); n > 0 && t.Out(n-1) == errorInterface {
+		if e := out[n-1]; !e.IsNil() {
+			if ellErr, ok := e.Interface().(*Error); ok {
+				return nil, ellErr
+			}
+			return nil, NewError(ErrorKey, e.Interface().(error).Error())
+		}
+		out = out[:n-1]
+	}
+	switch len(out) {
+	case 0:
+		return Null, nil
+	case 1:
+		return fromGo(out[0]), nil
+	}
+	values := make([]Value, len(out))
+	for i, v := range out {
+		values[i] = fromGo(v)
+	}
+	return ListFromValues(values), nil
+}
+
+// fromGo - the Ell value for the Go value. Go values that are already Ell values are returned as is, and those
+// with no Ell equivalent are wrapped as <go-object> objects.
+func fromGo(v reflect.Value) Value {
+	if !v.IsValid() {
+		return Null
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		if v.IsNil() {
+			return Null
+		}
+	}
+	if !v.CanInterface() {
+		return Null
+	}
+	if val, ok := v.Interface().(Value); ok {
+		return val
+	}
+	switch v.Kind() {
+	case reflect.Interface:
+		return fromGo(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return True
+		}
+		return False
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Int64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n := v.Uint(); n > math.MaxInt64 {
+			return BigInteger(new(big.Int).SetUint64(n))
+		}
+		return Int64(int64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		return Float(v.Float())
+	case reflect.String:
+		return NewString(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return NewBlob(b)
+		}
+		elements := make([]Value, v.Len())
+		for i := range elements {
+			elements[i] = fromGo(v.Index(i))
+		}
+		return NewVector(elements...)
+	case reflect.Map:
+		strct := NewStruct()
+		iter := v.MapRange()
+		for iter.Next() {
+			strct.Put(fromGo(iter.Key()), fromGo(iter.Value()))
+		}
+		return strct
+	}
+	return &Object{TypeTag: GoObjectType, Value: v.Interface()}
+}
+
+// toGo - the Go value of the type for the Ell value, which is argument i of the named function or method
+func toGo(val Value, t reflect.Type, name string, i int) (reflect.Value, error) {
+	if obj, ok := val.(*Object); ok {
+		if v := reflect.ValueOf(obj.Value); v.IsValid() && v.Type().AssignableTo(t) {
+			return v, nil
+		}
+	}
+	if t.Kind() == reflect.Interface && t.NumMethod() == 0 {
+		if gv := goValue(val); gv != nil {
+			return reflect.ValueOf(gv), nil
+		}
+		return reflect.Zero(t), nil
+	}
+	if reflect.TypeOf(val).AssignableTo(t) {
+		return reflect.ValueOf(val), nil
+	}
+	result := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		if val == Null {
+			return result, nil
+		}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		if b, ok := val.(*Boolean); ok {
+			result.SetBool(b == True)
+			return result, nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := val.(*Number); ok && n.IsExactInteger() && !result.OverflowInt(n.Int64Value()) {
+			result.SetInt(n.Int64Value())
+			return result, nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n, ok := val.(*Number); ok && n.IsExactInteger() && n.Int64Value() >= 0 && !result.OverflowUint(uint64(n.Int64Value())) {
+			result.SetUint(uint64(n.Int64Value()))
+			return result, nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if n, ok := val.(*Number); ok {
+			result.SetFloat(n.Float64Value())
+			return result, nil
+		}
+	case reflect.String:
+		if s, ok := val.(*String); ok {
+			result.SetString(s.Value)
+			return result, nil
+		}
+	case reflect.Slice:
+		if b, ok := val.(*Blob); ok && t.Elem().Kind() == reflect.Uint8 {
+			return reflect.ValueOf(append([]byte(nil), b.Value...)).Convert(t), nil
+		}
+		switch val.(type) {
+		case *List, *Vector:
+			elements, _ := sequenceElements(val, name)
+			result = reflect.MakeSlice(t, len(elements), len(elements))
+			for j, el := range elements {
+				gv, err := toGo(el, t.Elem(), name, i)
+				if err != nil {
+					return result, err
+				}
+				result.Index(j).Set(gv)
+			}
+			return result, nil
+		}
+	case reflect.Map:
+		if strct, ok := val.(*Struct); ok {
+			result = reflect.MakeMap(t)
+			for _, e := range strct.Entries() {
+				k, err := toGo(e.Key, t.Key(), name, i)
+				if err != nil {
+					return result, err
+				}
+				v, err := toGo(e.Value, t.Elem(), name, i)
+				if err != nil {
+					return result, err
+				}
+				result.SetMapIndex(k, v)
+			}
+			return result, nil
+		}
+	}
+	return result, NewError(ArgumentErrorKey, fmt.Sprintf("%s expected a Go %s for argument %d, got a %s", name, t, i, val.Type()))
+}
+
+// goValue - the natural Go value for the Ell value, for arguments of type interface{}
+func goValue(val Value) interface{} {
+	switch p := val.(type) {
+	case *NullValue:
+		return nil
+	case *Boolean:
+		return p == True
+	case *Number:
+		if p.IsExactInteger() {
+			return p.IntValue()
+		}
+		return p.Float64Value()
+	case *String:
+		return p.Value
+	case *Blob:
+		return p.Value
+	case *Object:
+		return p.Value
+	}
+	return val
+}
@@ -17,10 +17,10 @@ limitations under the License.
 package ell
 
 import (
-	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
-	"os/signal"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -29,86 +29,206 @@ import (
 	"github.com/boynton/repl"
 )
 
+// replWidth - the width results are pretty printed to, after the "= " before them
+const replWidth = 78
+
 type ellHandler struct {
-	buf string
+	buf   string
+	theme *colorTheme //the colors to write results and errors in, which replace those of the line editor
+}
+
+// replError - an error, written in the color of the theme's errors
+type replError struct {
+	err   error
+	color string
+}
+
+func (e *replError) Error() string {
+	return e.color + e.err.Error()
 }
 
 func (ell *ellHandler) Eval(expr string) (string, bool, error) {
 	//return result, needMore, error
 	for checkInterrupt() {
 	} //to clear out any that happened while sitting in getc
-	interrupted = false
+	awaitingInput.Store(false)
+	defer awaitInput()
 	whole := strings.Trim(ell.buf+expr, " ")
-	opens := len(strings.Split(whole, "("))
-	closes := len(strings.Split(whole, ")"))
-	if opens > closes {
-		ell.buf = whole + " "
+	if whole == "" {
+		return "", false, nil
+	}
+	if ell.buf == "" && strings.HasPrefix(whole, ",") {
+		return replCommand(whole[1:])
+	}
+	lexpr, err := ReadIncremental(whole)
+	if err == NeedMoreInput {
+		ell.buf = whole + "\n"
 		return "", true, nil
-	} else if closes > opens {
-		ell.buf = ""
-		return "", false, errors.New("unbalanced ')' encountered")
-	} else {
-		//this is the normal case
-		if whole == "" {
-			return "", false, nil
-		}
-		lexpr, err := ReadFromString(whole)
-		ell.buf = ""
-		if err == nil {
-			val, err := Eval(lexpr)
-			if err == nil {
-				result := ""
-				if val == nil {
-					result = " !!! whoops, result is nil, that isn't right"
-					panic("here")
-				} else {
-					result = "= " + Write(val)
-				}
-				return result, false, nil
-			}
-			return "", false, err
+	}
+	ell.buf = ""
+	if err != nil {
+		return "", false, ell.colorError(err)
+	}
+	if ell.theme != nil {
+		fmt.Print(ell.theme.output)
+	}
+	val, err := Eval(lexpr)
+	if err != nil {
+		recordError(err)
+		return "", false, ell.colorError(err)
+	}
+	if val == nil {
+		panic("here")
+	}
+	recordResult(val)
+	result := "= " + Pretty(val, replWidth)
+	if ell.theme != nil {
+		result = ell.theme.result + result
+	}
+	return result, false, nil
+}
+
+func (ell *ellHandler) colorError(err error) error {
+	if ell.theme != nil && ell.theme.err != "" {
+		return &replError{err: err, color: ell.theme.err}
+	}
+	return err
+}
+
+// The REPL binds *1, *2, and *3 to the last three results, most recent first, and *e* to the last error
+var resultSymbols = []Value{Intern("*1"), Intern("*2"), Intern("*3")}
+var lastErrorSymbol = Intern("*e*")
+
+func initReplVariables() {
+	for _, sym := range resultSymbols {
+		defGlobal(sym.(*Symbol), Null)
+	}
+	defGlobal(lastErrorSymbol.(*Symbol), Null)
+}
+
+// recordResult - remember the result, as *1, moving the previous ones along
+func recordResult(val Value) {
+	for i := len(resultSymbols) - 1; i > 0; i-- {
+		defGlobal(resultSymbols[i].(*Symbol), GetGlobal(resultSymbols[i-1]))
+	}
+	defGlobal(resultSymbols[0].(*Symbol), val)
+}
+
+// recordError - remember the error, as *e*
+func recordError(err error) {
+	e, ok := err.(*Error)
+	if !ok {
+		e = NewError(ErrorKey, err.Error())
+	}
+	defGlobal(lastErrorSymbol.(*Symbol), e)
+}
+
+// replCommand - perform a REPL command, entered after a comma, i.e. ",doc map"
+func replCommand(line string) (string, bool, error) {
+	words := strings.Fields(line)
+	if len(words) == 2 && words[0] == "doc" {
+		if sym, ok := Intern(words[1]).(*Symbol); ok {
+			return describe(sym), false, nil
 		}
-		return "", false, err
 	}
+	return "", false, NewError(ArgumentErrorKey, "unknown REPL command: ,", line)
 }
 
 func (ell *ellHandler) Reset() {
 	ell.buf = ""
 }
 
-func greatestCommonPrefixLength(s1 string, s2 string) int {
-	max := len(s1)
-	l2 := len(s2)
-	if l2 < max {
-		max = l2
+// greatestCommonPrefix - the longest prefix all of the strings share
+func greatestCommonPrefix(matches []string) string {
+	if len(matches) == 0 {
+		return ""
 	}
-	for i := 0; i < max; i++ {
-		if s1[i] != s2[i] {
-			return i - 1
+	s := matches[0]
+	for _, m := range matches[1:] {
+		n := 0
+		for n < len(s) && n < len(m) && s[n] == m[n] {
+			n++
 		}
+		s = s[:n]
 	}
-	return max
+	return s
 }
 
-func greatestCommonPrefix(matches []string) string {
-	switch len(matches) {
-	case 0:
-		return ""
-	case 1:
-		return matches[0]
-	default:
-		s := matches[0]
-		max := len(matches)
-		greatest := len(s)
-		for i := 1; i < max; i++ {
-			n := greatestCommonPrefixLength(s, matches[i])
-			if n < greatest {
-				greatest = n
-				s = s[:n+1]
+// completion - the sorted matches for the prefix, and what can be added to the prefix because all of them
+// start with it
+func completion(prefix string, matches []string) (string, []string) {
+	sort.Strings(matches)
+	if gcp := greatestCommonPrefix(matches); len(gcp) > len(prefix) {
+		return gcp[len(prefix):], matches
+	}
+	return "", matches
+}
+
+// openForms - the positions of the opening brackets of the forms not yet closed at the end of the expression,
+// innermost last, and the position of the quote that starts an unterminated string at its end, or -1
+func openForms(expr string) ([]int, int) {
+	var open []int
+	str := -1
+	comment := false
+	for i := 0; i < len(expr); i++ {
+		ch := expr[i]
+		switch {
+		case comment:
+			comment = ch != '\n'
+		case str >= 0:
+			if ch == '\\' {
+				i++
+			} else if ch == '"' {
+				str = -1
+			}
+		case ch == '"':
+			str = i
+		case ch == ';':
+			comment = true
+		case ch == '(' || ch == '[' || ch == '{':
+			open = append(open, i)
+		case ch == ')' || ch == ']' || ch == '}':
+			if len(open) > 0 {
+				open = open[:len(open)-1]
 			}
 		}
-		return s
 	}
+	return open, str
+}
+
+// formHead - the first token of the form that starts at the position in the expression
+func formHead(expr string, pos int) string {
+	rest := strings.TrimLeft(expr[pos+1:], " \t\r\n,")
+	for i := 0; i < len(rest); i++ {
+		if IsWhitespace(rest[i]) || IsDelimiter(rest[i]) {
+			return rest[:i]
+		}
+	}
+	return rest
+}
+
+// completeFile - complete the file path, for the strings passed to load and use. Hidden files are only
+// matched if the name being completed starts with a dot.
+func completeFile(path string) (string, []string) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", nil
+	}
+	var matches []string
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, base) && (strings.HasPrefix(base, ".") || !strings.HasPrefix(name, ".")) {
+			if e.IsDir() {
+				name += "/"
+			}
+			matches = append(matches, name)
+		}
+	}
+	return completion(base, matches)
 }
 
 func (ell *ellHandler) completePrefix(expr string) (string, bool) {
@@ -142,57 +262,52 @@ func (ell *ellHandler) completePrefix(expr string) (string, bool) {
 	return prefix, funPosition
 }
 
+// Complete - the completions of the token at the end of the expression. Inside a string passed to load or use, file
+// paths are completed. Otherwise keywords and macros are completed in function position, and defined functions.
+// Elsewhere, any global and keyword, such as a struct key, is completed.
 func (ell *ellHandler) Complete(expr string) (string, []string) {
-	var matches []string
-	addendum := ""
+	open, str := openForms(ell.buf + expr)
+	if str >= 0 {
+		whole := ell.buf + expr
+		if n := len(open); n > 0 {
+			if head := formHead(whole, open[n-1]); head == "load" || head == "use" {
+				return completeFile(whole[str+1:])
+			}
+		}
+		return "", nil
+	}
 	prefix, funPosition := ell.completePrefix(expr)
 	candidates := map[string]bool{}
 	if funPosition {
 		for _, sym := range GetKeywords() {
-			str := sym.String()
-			if strings.HasPrefix(str, prefix) {
-				candidates[sym.String()] = true
+			if str := sym.String(); strings.HasPrefix(str, prefix) {
+				candidates[str] = true
 			}
 		}
 		for _, sym := range Macros() {
-			_, ok := candidates[sym.String()]
-			if !ok {
-				str := sym.String()
-				if strings.HasPrefix(str, prefix) {
-					candidates[sym.String()] = true
-				}
+			if str := sym.String(); strings.HasPrefix(str, prefix) {
+				candidates[str] = true
+			}
+		}
+	} else {
+		for _, sym := range Symbols() {
+			if kw, ok := sym.(*Keyword); ok && strings.HasPrefix(kw.Text, prefix) {
+				candidates[kw.Text] = true
 			}
 		}
 	}
 	for _, sym := range Globals() {
-		str := sym.String()
-		_, ok := candidates[str]
-		if !ok {
-			_, ok := candidates[str]
-			if !ok {
-				if strings.HasPrefix(str, prefix) {
-					if funPosition {
-						val := GetGlobal(sym)
-						if IsFunction(val) {
-							candidates[str] = true
-						}
-					} else {
-						candidates[str] = true
-					}
-				}
+		if str := sym.String(); strings.HasPrefix(str, prefix) {
+			if !funPosition || IsFunction(GetGlobal(sym)) {
+				candidates[str] = true
 			}
 		}
 	}
+	var matches []string
 	for str := range candidates {
 		matches = append(matches, str)
-
-	}
-	sort.Strings(matches)
-	gcp := greatestCommonPrefix(matches)
-	if len(gcp) > len(prefix) {
-		addendum = gcp[len(prefix):]
 	}
-	return addendum, matches
+	return completion(prefix, matches)
 }
 
 func (ell *ellHandler) Prompt() string {
@@ -233,18 +348,87 @@ func (ell *ellHandler) Stop(history []string) {
 	}
 }
 
+// lineEditing - true while the line editor has the terminal
+var lineEditing bool
+
+// awaitInput - clear the interrupts left by the last input, before waiting for the next. Until it is read, there is
+// no code running to notice an interrupt, so a second one does not end the process.
+func awaitInput() {
+	for checkInterrupt() {
+	}
+	awaitingInput.Store(true)
+}
+
 func ReadEvalPrintLoop() {
-	interrupts = make(chan os.Signal, 1)
-	signal.Notify(interrupts, os.Interrupt)
-	defer signal.Stop(interrupts)
-	handler := ellHandler{""}
+	defer EnableInterrupts()()
+	awaitInput()
+	defer awaitingInput.Store(false)
+	initReplVariables()
+	theme := currentColors()
+	if *theme == (colorTheme{}) {
+		plainREPL(&ellHandler{})
+		return
+	}
+	handler := ellHandler{theme: theme}
+	debugReadLine = editorReadLine
+	lineEditing = true
 	err := repl.REPL(&handler)
+	lineEditing = false
 	if err != nil {
 		println("REPL error: ", err)
 	}
 }
 
+// editorReadLine - read a line from the line editor's input, which is in cbreak mode, echoing it
+func editorReadLine() (string, error) {
+	var line []byte
+	for {
+		ch := repl.GetChar()
+		switch {
+		case ch == '\r' || ch == '\n':
+			repl.PutChar('\n')
+			return string(line), nil
+		case ch == 4 && len(line) == 0: //CTRL-D
+			return "", io.EOF
+		case ch == 127:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				repl.PutString("\b \b")
+			}
+		case ch >= ' ' && ch < 127:
+			line = append(line, ch)
+			repl.PutChar(ch)
+		}
+	}
+}
+
+// plainREPL - a REPL that reads lines from standard input without editing them, and writes no colors. The line
+// editor always writes some, so this is the REPL when there are to be none.
+func plainREPL(handler *ellHandler) {
+	fmt.Print(handler.Prompt())
+	for {
+		line, err := stdinReader.ReadString('\n')
+		if err != nil && line == "" {
+			break
+		}
+		result, more, err := handler.Eval(strings.TrimRight(line, "\r\n"))
+		if err != nil {
+			fmt.Println("***", err)
+		} else if result != "" {
+			fmt.Println(result)
+		}
+		if !more {
+			fmt.Print(handler.Prompt())
+		}
+	}
+	fmt.Println()
+}
+
 func exit(code int) {
 	Cleanup()
-	repl.Exit(code)
+	if lineEditing {
+		//restore the terminal. The line editor always exits with a status of 1.
+		repl.Exit(code)
+	}
+	os.Exit(code)
 }
@@ -18,8 +18,14 @@ package ell
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net"
 	"os"
+	"os/signal"
+	"sync/atomic"
 	"time"
 
 	. "github.com/boynton/ell/data"
@@ -28,21 +34,49 @@ import (
 var trace bool
 var optimize bool
 
-var interrupted = false
-var interrupts chan os.Signal
+// interrupts - the interrupt not yet noticed by the running code, if there is one. It is made once, and read by
+// the VMs of all threads.
+var interrupts = make(chan os.Signal, 1)
 var InterruptKey = Intern("interrupt:")
 
-func checkInterrupt() bool {
-	if interrupts != nil {
-		select {
-		case msg := <-interrupts:
-			if msg != nil {
-				interrupted = true
-				return true
-			}
-		default:
-			return false
+// awaitingInput - true while the REPL waits for its next input, when no code is running to notice an interrupt
+var awaitingInput atomic.Bool
+
+// EnableInterrupts - make SIGINT, i.e. Ctrl-C, raise an interrupt: error in the code that is running. Unlike the
+// errors of the limits, it can be caught, and the dynamic extents it leaves are unwound. A second SIGINT before
+// the first is noticed, as when the code is blocked in a primitive, ends the process. The result stops it.
+func EnableInterrupts() func() {
+	signals := make(chan os.Signal, 1)
+	done := make(chan bool)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				select {
+				case interrupts <- sig:
+				default:
+					if !awaitingInput.Load() {
+						exit(130)
+					}
+				}
+			case <-done:
+				return
+			}
 		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// checkInterrupt - true if there has been an interrupt since the last check
+func checkInterrupt() bool {
+	select {
+	case <-interrupts:
+		return true
+	default:
 	}
 	return false
 }
@@ -76,26 +110,36 @@ func Fatal(args ...interface{}) {
 	exit(1)
 }
 
-// Continuation -
+// Continuation - a captured point of execution. The ops and pc to resume at are recorded, along
+// with a copy of the stack below the callcc call. The frame chain is shared rather than copied, since
+// frames are never reused once captured (see tailcall), which keeps set! on captured locals visible.
 type Continuation struct {
-	ops   []int
-	stack []Value
-	pc    int
+	ops      []int
+	stack    []Value
+	pc       int
+	winders  *winder
+	handlers *handler
 }
 
 func Closure(code *Code, frame *Frame) *Function {
+	functionAllocs.Add(0)
 	return &Function{
 		code:  code,
 		frame: frame,
 	}
 }
 
-func NewContinuation(frame *Frame, ops []int, pc int, stack []Value) *Function {
+func NewContinuation(frame *Frame, ops []int, pc int, stack []Value, winders *winder, handlers *handler) *Function {
+	for f := frame; f != nil && !f.captured; f = f.previous {
+		f.captured = true
+	}
 	cont := new(Continuation)
 	cont.ops = ops
 	cont.stack = make([]Value, len(stack))
 	copy(cont.stack, stack)
 	cont.pc = pc
+	cont.winders = winders
+	cont.handlers = handlers
 	return &Function{
 		frame:        frame,
 		continuation: cont,
@@ -104,13 +148,43 @@ func NewContinuation(frame *Frame, ops []int, pc int, stack []Value) *Function {
 
 const defaultStackSize = 1000
 
+// winder - an active dynamic extent, entered by dynamic-wind. The before and after thunks are called
+// whenever control enters or leaves the extent.
+type winder struct {
+	before *Function
+	after  *Function
+	next   *winder
+}
+
+// handler - an active catch form. When an error is raised, the stack and frame are restored to what they
+// were when the catch began, the error is pushed, and execution continues at the handler's pc.
+type handler struct {
+	ops     []int
+	pc      int
+	depth   int //the stack depth when the catch began, so it can be restored on another stack of the same size
+	env     *Frame
+	winders *winder
+	next    *handler
+}
+
 // VM - the Ell VM
 type vm struct {
 	stackSize int
+	winders   *winder
+	handlers  *handler
+	acct      *accounting     //nil if there are no limits
+	ctx       context.Context //nil if execution cannot be cancelled
+	stack     []Value         //the stack of the last call run to completion, reused by the next one
+	instrEnv  *Frame          //the frame executing the last instruction that could raise an error
+	instrPc   int             //the pc at the end of that instruction, to locate the error in the source
+	profEnv   *Frame          //the frame of the last instruction profiled
+	profPrim  *Primitive      //the primitive called since then, if any
+	profSteps int             //the instructions profiled since the time was last checked
+	profLast  time.Time       //when the last sample was taken
 }
 
 func VM(stackSize int) *vm {
-	return &vm{stackSize}
+	return &vm{stackSize: stackSize}
 }
 
 var FunctionType Value = Intern("<function>")
@@ -149,27 +223,33 @@ func (f *Function) String() string {
 	if f.continuation != nil {
 		return "#[continuation]"
 	}
-	if f == Apply {
-		return "#[function apply]"
-	}
 	if f == CallCC {
 		return "#[function callcc]"
 	}
 	if f == Spawn {
 		return "#[function spawn]"
 	}
+	if f == Wind {
+		return "#[function wind]"
+	}
+	if f == Unwind {
+		return "#[function unwind]"
+	}
 	panic("Bad function")
 }
 
-// Apply is a primitive instruction to apply a function to a list of arguments
-var Apply = &Function{}
-
 // CallCC is a primitive instruction to executable (restore) a continuation
 var CallCC = &Function{}
 
-// Apply is a primitive instruction to apply a function to a list of arguments
+// Spawn is a primitive instruction to call a function in a new goroutine
 var Spawn = &Function{}
 
+// Wind is a primitive instruction to enter a dynamic extent with the given before and after thunks
+var Wind = &Function{}
+
+// Unwind is a primitive instruction to leave the innermost dynamic extent normally
+var Unwind = &Function{}
+
 func functionSignature(f *Function) string {
 	if f.primitive != nil {
 		return f.primitive.signature
@@ -180,33 +260,103 @@ func functionSignature(f *Function) string {
 	if f.continuation != nil {
 		return "(<function>) <any>"
 	}
-	if f == Apply {
-		return "(<any>*) <list>"
-	}
 	if f == CallCC {
 		return "(<function>) <any>"
 	}
 	if f == Spawn {
 		return "(<function> <any>*) <null>"
 	}
+	if f == Wind {
+		return "(<function> <function>) <null>"
+	}
+	if f == Unwind {
+		return "() <null>"
+	}
 	panic("Bad function")
 }
 
+// functionName - the name the function was defined with, or "" if it is anonymous
+func functionName(f *Function) string {
+	if f.primitive != nil {
+		return f.primitive.name
+	}
+	if f.code != nil {
+		return f.code.name
+	}
+	switch f {
+	case CallCC:
+		return "callcc"
+	case Spawn:
+		return "spawn"
+	case Wind:
+		return "wind"
+	case Unwind:
+		return "unwind"
+	}
+	return ""
+}
+
+// functionArity - the least and the most arguments the function accepts. The most is -1 if it accepts any number
+// beyond the least. Keyword arguments count as two arguments each, the key and the value.
+func functionArity(f *Function) (int, int) {
+	var argc int
+	var defaults, keys []Value
+	switch {
+	case f.primitive != nil:
+		if f.primitive.rest != nil {
+			return f.primitive.argc, -1
+		}
+		argc, defaults, keys = f.primitive.argc, f.primitive.defaults, f.primitive.keys
+	case f.code != nil:
+		if f.code.defaults != nil && len(f.code.defaults) == 0 {
+			return f.code.argc, -1
+		}
+		argc, defaults, keys = f.code.argc, f.code.defaults, f.code.keys
+	case f.continuation != nil, f == CallCC:
+		return 1, 1
+	case f == Spawn:
+		return 1, -1
+	case f == Wind:
+		return 2, 2
+	}
+	if keys != nil {
+		return argc, argc + 2*len(keys)
+	}
+	return argc, argc + len(defaults)
+}
+
+// functionDefaults - the default values of the function's optional or keyword arguments, and the keys of its
+// keyword arguments, if it has them
+func functionDefaults(f *Function) ([]Value, []Value) {
+	if f.primitive != nil {
+		return f.primitive.defaults, f.primitive.keys
+	}
+	if f.code != nil {
+		return f.code.defaults, f.code.keys
+	}
+	return nil, nil
+}
+
 // PrimitiveFunction is the native go function signature for all Ell primitive functions
 type PrimitiveFunction func(argv []Value) (Value, error)
 
+// vmPrimitiveFunction - the signature of a primitive that calls the functions it is passed. It gets the VM that
+// calls it, so it can call them with CallFunction, under the VM's context and limits.
+type vmPrimitiveFunction func(vm *vm, argv []Value) (Value, error)
+
 // Primitive - a primitive function, written in Go, callable by VM
 type Primitive struct { // <function>
 	name      string
 	fun       PrimitiveFunction
 	signature string
 	//	idx       int
-	argc     int     // -1 means the primitive itself checks the args (legacy mode)
-	result   Value   // if set the type of the result
-	args     []Value // if set, the length must be for total args (both required and optional). The type (or <any>) for each
-	rest     Value   // if set, then any number of this type can follow the normal args. Mutually incompatible with defaults/keys
-	defaults []Value // if set, then that many optional args beyond argc have these default values
-	keys     []Value // if set, then it must match the size of defaults, and these are the keys
+	argc     int                 // -1 means the primitive itself checks the args (legacy mode)
+	result   Value               // if set the type of the result
+	args     []Value             // if set, the length must be for total args (both required and optional). The type (or <any>) for each
+	rest     Value               // if set, then any number of this type can follow the normal args. Mutually incompatible with defaults/keys
+	defaults []Value             // if set, then that many optional args beyond argc have these default values
+	keys     []Value             // if set, then it must match the size of defaults, and these are the keys
+	vmfun    vmPrimitiveFunction // if set, it is called in place of fun, with the calling VM
 }
 
 func functionSignatureFromTypes(result Value, args []Value, rest Value) string {
@@ -265,7 +415,7 @@ func NewPrimitive(name string, fun PrimitiveFunction, result Value, args []Value
 		}
 	}
 	signature := functionSignatureFromTypes(result, args, rest)
-	prim := &Primitive{name, fun, signature, argc, result, args, rest, defaults, keys}
+	prim := &Primitive{name, fun, signature, argc, result, args, rest, defaults, keys, nil}
 	primitives = append(primitives, prim)
 	return &Function{primitive: prim}
 }
@@ -278,6 +428,7 @@ type Frame struct {
 	elements  []Value
 	firstfive [5]Value
 	pc        int
+	captured  bool // set when a continuation refers to this frame, so it must not be reused
 }
 
 func (frame *Frame) String() string {
@@ -309,14 +460,21 @@ func buildFrame(env *Frame, pc int, ops []int, fun *Function, argc int, stack []
 	defaults := fun.code.defaults
 	if defaults == nil {
 		if argc != expectedArgc {
-			return nil, NewError(ArgumentErrorKey, "Wrong number of args to ", fun, " (expected ", expectedArgc, ", got ", argc, ")")
+			return nil, argcError(callName(fun), expectedArgc, expectedArgc, argc)
 		}
-		if argc <= 5 {
-			f.elements = f.firstfive[:]
+		if n := fun.code.locals; n <= 5 {
+			f.elements = f.firstfive[:n]
+			frameAllocs.Add(0)
 		} else {
-			f.elements = make([]Value, argc)
+			f.elements = make([]Value, n)
+			frameAllocs.Add(n * int(valueSize))
 		}
 		copy(f.elements, stack[sp:sp+argc])
+		if fun.code.declared != nil && GetGlobal(checkTypesSymbol) == True {
+			if err := fun.code.declared.checkArgs(fun, f.elements); err != nil {
+				return nil, err
+			}
+		}
 		return f, nil
 	}
 	keys := fun.code.keys
@@ -328,12 +486,13 @@ func buildFrame(env *Frame, pc int, ops []int, fun *Function, argc int, stack []
 	}
 	if argc < expectedArgc {
 		if extra > 0 {
-			return nil, NewError(ArgumentErrorKey, "Wrong number of args to ", fun, " (expected at least ", expectedArgc, ", got ", argc, ")")
+			return nil, argcError(callName(fun), expectedArgc, -1, argc)
 		}
-		return nil, NewError(ArgumentErrorKey, "Wrong number of args to ", fun, " (expected ", expectedArgc, ", got ", argc, ")")
+		return nil, argcError(callName(fun), expectedArgc, expectedArgc, argc)
 	}
 	totalArgc := expectedArgc + extra
-	el := make([]Value, totalArgc)
+	el := make([]Value, fun.code.locals)
+	frameAllocs.Add(len(el) * int(valueSize))
 	end := sp + expectedArgc
 	if rest {
 		copy(el, stack[sp:end])
@@ -344,57 +503,131 @@ func buildFrame(env *Frame, pc int, ops []int, fun *Function, argc int, stack []
 		if len(bindings)%2 != 0 {
 			return nil, NewError(ArgumentErrorKey, "Bad keyword argument(s): ", bindings)
 		}
-		copy(el, stack[sp:sp+expectedArgc]) //the required ones
-		for i := expectedArgc; i < totalArgc; i++ {
-			el[i] = defaults[i-expectedArgc]
-		}
-		for i := expectedArgc; i < argc; i += 2 {
-			key, err := ToSymbol(stack[sp+i])
+		copy(el, stack[sp:end]) //the required ones
+		copy(el[expectedArgc:totalArgc], defaults)
+		for i := 0; i < len(bindings); i += 2 {
+			key, err := ToSymbol(bindings[i])
 			if err != nil {
-				return nil, NewError(ArgumentErrorKey, "Bad keyword argument: ", stack[sp+1])
-			}
-			gotit := false
-			for j := 0; j < extra; j++ {
-				if keys[j] == key {
-					el[expectedArgc+j] = stack[sp+i+1]
-					gotit = true
-					break
-				}
+				return nil, NewError(ArgumentErrorKey, "Bad keyword argument: ", bindings[i])
 			}
-			if !gotit {
+			j, ok := fun.code.keyIndex[key]
+			if !ok {
 				return nil, NewError(ArgumentErrorKey, "Undefined keyword argument: ", key)
 			}
+			el[expectedArgc+j] = bindings[i+1]
 		}
 	} else {
-		copy(el, stack[sp:sp+argc])
-		for i := argc; i < totalArgc; i++ {
-			el[i] = defaults[i-expectedArgc]
+		if argc > totalArgc {
+			return nil, argcError(callName(fun), expectedArgc, totalArgc, argc)
 		}
+		copy(el, stack[sp:sp+argc])
+		copy(el[argc:totalArgc], defaults[argc-expectedArgc:])
 	}
 	f.elements = el
+	if fun.code.declared != nil && GetGlobal(checkTypesSymbol) == True {
+		if err := fun.code.declared.checkArgs(fun, el); err != nil {
+			return nil, err
+		}
+	}
 	return f, nil
 }
 
-func addContext(env *Frame, err error) error {
-	if _, ok := err.(*Error); ok {
-		if env.code != nil {
-			if env.code.name != "throw" {
-				//FIX e.Data = append(e.Data, env.code.name)
-			} else if env.previous != nil {
-				if env.previous.code != nil {
-					//FIX e.Data = append(e.Data, env.previous.code.name)
-				}
+// addContext - the error with a stack trace of the active frames, unless it already has one. A caught error
+// that is raised again keeps the trace from where it was first raised. The trace goes on a copy, so an error
+// value raised from several places gets the trace of each, and the value itself is left as it was.
+func addContext(env *Frame, err error) *Error {
+	return addContextAt(env, -1, err)
+}
+
+// addContextAt - like addContext, where the pc is the end of the instruction in the innermost frame that
+// raised the error, or -1 if it is not known
+func addContextAt(env *Frame, pc int, err error) *Error {
+	errobj := errorObject(err)
+	if errobj.Trace == nil {
+		traced := *errobj
+		traced.Trace = stackTrace(env, pc)
+		return &traced
+	}
+	return errobj
+}
+
+// stackTrace - describe the active frames, innermost first. Each frame records the pc to return to in
+// its caller, so the pc is known for every frame but the innermost, for which it is given.
+func stackTrace(env *Frame, pc int) *List {
+	var entries []Value
+	for f := env; f != nil; f = f.previous {
+		if f.code != nil {
+			entries = append(entries, NewString(f.code.location(pc)))
+		}
+		pc = f.pc
+	}
+	return ListFromValues(entries)
+}
+
+// location - describe a point in the code as a stack trace entry, i.e. "foo [pc 12] (tests/foo.ell:3:5)". The
+// source location is that of the call ending at the pc if it is known, otherwise that of the code.
+func (code *Code) location(pc int) string {
+	name := code.name
+	if name == "" {
+		name = "(anonymous)"
+	}
+	if pc >= 0 {
+		name += fmt.Sprintf(" [pc %d]", pc)
+	}
+	if loc := code.sourceLocation(pc); loc != nil {
+		name += " (" + loc.String() + ")"
+	} else if code.source != "" {
+		name += " (" + code.source + ")"
+	}
+	return name
+}
+
+const maxStackTraceLines = 20
+
+// formatStackTrace - the stack trace of the error for display, after the source location of an error found
+// by the compiler, or the empty string if it has neither
+func formatStackTrace(err error) string {
+	var buf bytes.Buffer
+	errobj, ok := err.(*Error)
+	if !ok {
+		return ""
+	}
+	if errobj.Location != nil {
+		buf.WriteString("\n    at " + errobj.Location.String())
+	}
+	if errobj.Trace != nil {
+		count := 0
+		for lst := errobj.Trace; lst != EmptyList; lst = lst.Cdr {
+			if count == maxStackTraceLines {
+				buf.WriteString(fmt.Sprintf("\n    ... %d more", errobj.Trace.Length()-count))
+				break
 			}
+			buf.WriteString("\n    at " + StringValue(lst.Car))
+			count++
 		}
 	}
-	return err
+	return buf.String()
 }
 
-func (vm *vm) keywordCall(fun *Keyword, argc int, pc int, stack []Value, sp int) (int, int, error) {
-	if argc != 1 {
-		return 0, 0, NewError(ArgumentErrorKey, fun.Text, " expected 1 argument, got ", argc)
+// keywordGet - the result of calling the keyword with its arguments on the stack at sp, a struct and optionally a
+// default, which is the result if the struct has no value for the keyword. The stack pointer where the result goes
+// is returned with it.
+func keywordGet(kw *Keyword, argc int, stack []Value, sp int) (Value, int, error) {
+	if argc != 1 && argc != 2 {
+		return nil, 0, argcError(kw.Text, 1, 2, argc)
+	}
+	v, err := Get(stack[sp], kw)
+	if err != nil {
+		return nil, 0, err
+	}
+	if v == Null && argc == 2 {
+		v = stack[sp+1]
 	}
-	v, err := Get(stack[sp], fun)
+	return v, sp + argc - 1, nil
+}
+
+func (vm *vm) keywordCall(fun *Keyword, argc int, pc int, stack []Value, sp int) (int, int, error) {
+	v, sp, err := keywordGet(fun, argc, stack, sp)
 	if err != nil {
 		return 0, 0, err
 	}
@@ -402,6 +635,8 @@ func (vm *vm) keywordCall(fun *Keyword, argc int, pc int, stack []Value, sp int)
 	return pc, sp, nil
 }
 
+// argcError - the error for a call of the named function with the wrong number of arguments. A max of -1 means
+// there is no maximum.
 func argcError(name string, min int, max int, provided int) error {
 	s := "1 argument"
 	if min == max {
@@ -416,47 +651,73 @@ func argcError(name string, min int, max int, provided int) error {
 	return NewError(ArgumentErrorKey, fmt.Sprintf("%s expected %s, got %d", name, s, provided))
 }
 
+// argTypeError - the error for a call of the named function with argument i, counting from 1, of the wrong type.
+// The expected type may describe several, i.e. "<error> or <keyword>".
+func argTypeError(name string, expected string, i int, arg Value) error {
+	return NewError(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", name, expected, i, TypeNameOf(arg)))
+}
+
+// callName - the name of the function for errors in calling it
+func callName(fun *Function) string {
+	if name := functionName(fun); name != "" {
+		return name
+	}
+	return fun.String()
+}
+
+// call - call the primitive's function, passing the VM to one that calls functions back
+func (prim *Primitive) call(vm *vm, argv []Value) (Value, error) {
+	if prim.vmfun != nil {
+		return prim.vmfun(vm, argv)
+	}
+	return prim.fun(argv)
+}
+
+// checkArgs - check the types of the arguments of a call of the primitive against its spec: the types of its
+// arguments, then the type of its rest arguments. Optional and keyword arguments are checked after their
+// defaults are filled in, so there is one argument for each type.
+func (prim *Primitive) checkArgs(argv []Value) error {
+	for i, arg := range argv {
+		t := prim.rest
+		if i < len(prim.args) {
+			t = prim.args[i]
+		}
+		if t != nil && t != AnyType && arg.Type() != t {
+			return argTypeError(prim.name, t.String(), i+1, arg)
+		}
+	}
+	return nil
+}
+
+// callPrimitive - call the primitive after checking the number and types of the arguments, so primitive
+// functions can assume their arguments match the spec they were defined with
 func (vm *vm) callPrimitive(prim *Primitive, argv []Value) (Value, error) {
+	if profiling {
+		vm.profileCall(prim)
+	}
 	if prim.defaults != nil {
 		return vm.callPrimitiveWithDefaults(prim, argv)
 	}
-	argc := len(argv)
-	if argc != prim.argc {
+	if argc := len(argv); argc != prim.argc {
 		return nil, argcError(prim.name, prim.argc, prim.argc, argc)
 	}
-	for i, arg := range argv {
-		t := prim.args[i]
-		if t != AnyType && arg.Type() != t {
-			return nil, NewError(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", prim.name, prim.args[i].String(), i+1, TypeNameOf(argv[i])))
-		}
+	if err := prim.checkArgs(argv); err != nil {
+		return nil, err
 	}
-	return prim.fun(argv)
+	return prim.call(vm, argv)
 }
 
 func (vm *vm) callPrimitiveWithDefaults(prim *Primitive, argv []Value) (Value, error) {
 	provided := len(argv)
 	minargc := prim.argc
 	if len(prim.defaults) == 0 {
-		rest := prim.rest
 		if provided < minargc {
 			return nil, argcError(prim.name, minargc, -1, provided)
 		}
-		for i := 0; i < minargc; i++ {
-			t := prim.args[i]
-			arg := argv[i]
-			if t != AnyType && arg.Type() != t {
-				return nil, NewError(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", prim.name, prim.args[i].String(), i+1, TypeNameOf(argv[i])))
-			}
+		if err := prim.checkArgs(argv); err != nil {
+			return nil, err
 		}
-		if rest != AnyType {
-			for i := minargc; i < provided; i++ {
-				arg := argv[i]
-				if arg.Type() != rest {
-					return nil, NewError(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", prim.name, rest.String(), i+1, TypeNameOf(argv[i])))
-				}
-			}
-		}
-		return prim.fun(argv)
+		return prim.call(vm, argv)
 	}
 	maxargc := len(prim.args)
 	if provided < minargc {
@@ -479,7 +740,7 @@ func (vm *vm) callPrimitiveWithDefaults(prim *Primitive, argv []Value) (Value, e
 				return nil, NewError(ArgumentErrorKey, "mismatched keyword/value pair in argument list")
 			}
 			if k.Type() != KeywordType {
-				return nil, NewError(ArgumentErrorKey, "expected keyword, got a "+TypeNameOf(k))
+				return nil, argTypeError(prim.name, KeywordType.String(), j, k)
 			}
 			gotit := false
 			for i := 0; i < ndefaults; i++ {
@@ -500,28 +761,29 @@ func (vm *vm) callPrimitiveWithDefaults(prim *Primitive, argv []Value) (Value, e
 			return nil, argcError(prim.name, minargc, maxargc, provided)
 		}
 		copy(newargs, argv)
-		j := 0
 		for i := provided; i < maxargc; i++ {
-			newargs[i] = prim.defaults[j]
-			j++
+			newargs[i] = prim.defaults[i-minargc]
 		}
 		argv = newargs
 	}
-	for i, arg := range argv {
-		t := prim.args[i]
-		if t != AnyType && arg.Type() != t {
-			return nil, NewError(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", prim.name, prim.args[i].String(), i+1, TypeNameOf(argv[i])))
-		}
+	if err := prim.checkArgs(argv); err != nil {
+		return nil, err
 	}
-	return prim.fun(argv)
+	return prim.call(vm, argv)
 }
 
 func (vm *vm) funcall(callable Value, argc int, ops []int, savedPc int, stack []Value, sp int, env *Frame) ([]int, int, int, *Frame, error) {
 opcodeCallAgain:
 	if fun, ok := callable.(*Function); ok {
 		if fun.code != nil {
-			if interrupted || checkInterrupt() {
-				return nil, 0, 0, nil, addContext(env, NewError(InterruptKey)) //not catchable
+			if err := vm.check(); err != nil {
+				return nil, 0, 0, nil, addContext(env, err) //not catchable
+			}
+			if checkInterrupt() {
+				return vm.catch(NewError(InterruptKey), stack, env)
+			}
+			if sp+argc < fun.code.maxDepth {
+				return nil, 0, 0, nil, addContext(env, stackOverflow())
 			}
 			if fun.code.defaults == nil {
 				f := new(Frame)
@@ -532,12 +794,15 @@ opcodeCallAgain:
 				f.code = fun.code
 				expectedArgc := fun.code.argc
 				if argc != expectedArgc {
-					return nil, 0, 0, nil, NewError(ArgumentErrorKey, "Wrong number of args to ", fun, " (expected ", expectedArgc, ", got ", argc, ")")
+					err := argcError(callName(fun), expectedArgc, expectedArgc, argc)
+					return vm.catch(err, stack, env)
 				}
-				if argc <= 5 {
-					f.elements = f.firstfive[:argc]
+				if n := fun.code.locals; n <= 5 {
+					f.elements = f.firstfive[:n]
+					frameAllocs.Add(0)
 				} else {
-					f.elements = make([]Value, argc)
+					f.elements = make([]Value, n)
+					frameAllocs.Add(n * int(valueSize))
 				}
 				endSp := sp + argc
 				copy(f.elements, stack[sp:endSp])
@@ -557,57 +822,29 @@ opcodeCallAgain:
 			if err != nil {
 				return vm.catch(err, stack, env)
 			}
+			if call, ok := val.(*functionCall); ok {
+				callable = call.fun
+				argc, sp, err = call.pushArgs(argc, stack, sp)
+				if err != nil {
+					return nil, 0, 0, nil, addContext(env, err)
+				}
+				goto opcodeCallAgain
+			}
 			sp = sp + argc - 1
 			stack[sp] = val
 			return ops, savedPc, sp, env, err
 		}
-		if fun == Apply {
-			if argc < 2 {
-				err := NewError(ArgumentErrorKey, "apply expected at least 2 arguments, got ", argc)
-				return vm.catch(err, stack, env)
-			}
-			callable = stack[sp]
-			args := stack[sp+argc-1]
-			if !IsList(args) {
-				err := NewError(ArgumentErrorKey, "apply expected a <list> as its final argument")
-				return vm.catch(err, stack, env)
-			}
-			arglist := args.(*List)
-			for i := argc - 2; i > 0; i-- {
-				arglist = Cons(stack[sp+i], arglist)
-			}
-			sp += argc
-			argc = ListLength(arglist)
-			i := 0
-			sp -= argc
-			for arglist != EmptyList {
-				stack[sp+i] = arglist.Car
-				i++
-				arglist = arglist.Cdr
-			}
-			goto opcodeCallAgain
-		}
 		if fun == CallCC {
 			if argc != 1 {
-				err := NewError(ArgumentErrorKey, "callcc expected 1 argument, got ", argc)
+				err := argcError("callcc", 1, 1, argc)
 				return vm.catch(err, stack, env)
 			}
 			callable = stack[sp]
-			stack[sp] = NewContinuation(env, ops, savedPc, stack[sp+1:])
+			stack[sp] = NewContinuation(env, ops, savedPc, stack[sp+1:], vm.winders, vm.handlers)
 			goto opcodeCallAgain
 		}
 		if fun.continuation != nil {
-			if argc != 1 {
-				err := NewError(ArgumentErrorKey, "#[continuation] expected 1 argument, got ", argc)
-				return vm.catch(err, stack, env)
-			}
-			arg := stack[sp]
-			sp = len(stack) - len(fun.continuation.stack)
-			segment := stack[sp:]
-			copy(segment, fun.continuation.stack)
-			sp--
-			stack[sp] = arg
-			return fun.continuation.ops, fun.continuation.pc, sp, fun.frame, nil
+			return vm.resume(fun, argc, stack, sp, env)
 		}
 		if fun == Spawn {
 			err := vm.spawn(stack[sp], argc-1, stack, sp+1)
@@ -618,14 +855,24 @@ opcodeCallAgain:
 			stack[sp] = Null
 			return ops, savedPc, sp, env, err
 		}
+		if fun == Wind || fun == Unwind {
+			err := vm.wind(fun, argc, stack, sp)
+			if err != nil {
+				return vm.catch(err, stack, env)
+			}
+			sp = sp + argc - 1
+			stack[sp] = Null
+			return ops, savedPc, sp, env, nil
+		}
 		panic("unsupported instruction")
 	}
+	if code, ok := callable.(*Code); ok {
+		//compiled code, as returned by compile, is called as a function of no arguments
+		callable = Closure(code, nil)
+		goto opcodeCallAgain
+	}
 	if kw, ok := callable.(*Keyword); ok {
-		if argc != 1 {
-			err := NewError(ArgumentErrorKey, kw.Text, " expected 1 argument, got ", argc)
-			return vm.catch(err, stack, env)
-		}
-		v, err := Get(stack[sp], kw)
+		v, sp, err := keywordGet(kw, argc, stack, sp)
 		if err != nil {
 			return vm.catch(err, stack, env)
 		}
@@ -636,14 +883,175 @@ opcodeCallAgain:
 	return vm.catch(err, stack, env)
 }
 
+// resume restores the continuation: the saved stack segment is copied back to the bottom of the
+// stack, and the argument becomes the result of the original callcc call. A nil frame means the
+// continuation was captured in tail position of a top level expression, so the caller must return.
+func (vm *vm) resume(fun *Function, argc int, stack []Value, sp int, env *Frame) ([]int, int, int, *Frame, error) {
+	if argc != 1 {
+		err := argcError("#[continuation]", 1, 1, argc)
+		return vm.catch(err, stack, env)
+	}
+	cont := fun.continuation
+	if len(cont.stack) >= len(stack) {
+		err := NewError(ErrorKey, "Stack overflow resuming continuation")
+		return vm.catch(err, stack, env)
+	}
+	if err := vm.rewind(cont.winders); err != nil {
+		return vm.catch(err, stack, env)
+	}
+	vm.handlers = cont.handlers
+	arg := stack[sp]
+	sp = len(stack) - len(cont.stack)
+	copy(stack[sp:], cont.stack)
+	sp--
+	stack[sp] = arg
+	return cont.ops, cont.pc, sp, fun.frame, nil
+}
+
+// wind implements the Wind and Unwind instructions, which maintain the list of active dynamic extents
+func (vm *vm) wind(fun *Function, argc int, stack []Value, sp int) error {
+	if fun == Unwind {
+		if argc != 0 {
+			return argcError("unwind", 0, 0, argc)
+		}
+		if vm.winders == nil {
+			return NewError(ErrorKey, "unwind: not in a dynamic extent")
+		}
+		vm.winders = vm.winders.next
+		return nil
+	}
+	if argc != 2 {
+		return argcError("wind", 2, 2, argc)
+	}
+	before, ok := stack[sp].(*Function)
+	if !ok {
+		return argTypeError("wind", FunctionType.String(), 1, stack[sp])
+	}
+	after, ok := stack[sp+1].(*Function)
+	if !ok {
+		return argTypeError("wind", FunctionType.String(), 2, stack[sp+1])
+	}
+	vm.winders = &winder{before: before, after: after, next: vm.winders}
+	return nil
+}
+
+// rewind leaves the active dynamic extents that are not shared with the target, innermost first, and
+// then enters the target's extents that are not already active, outermost first.
+func (vm *vm) rewind(target *winder) error {
+	common := commonWinder(vm.winders, target)
+	for vm.winders != common {
+		w := vm.winders
+		vm.winders = w.next
+		if err := vm.callThunk(w.after); err != nil {
+			return err
+		}
+	}
+	var entering []*winder
+	for w := target; w != common; w = w.next {
+		entering = append(entering, w)
+	}
+	for i := len(entering) - 1; i >= 0; i-- {
+		w := entering[i]
+		if err := vm.callThunk(w.before); err != nil {
+			return err
+		}
+		vm.winders = w
+	}
+	return nil
+}
+
+func winderDepth(w *winder) int {
+	depth := 0
+	for ; w != nil; w = w.next {
+		depth++
+	}
+	return depth
+}
+
+func commonWinder(w1 *winder, w2 *winder) *winder {
+	d1 := winderDepth(w1)
+	d2 := winderDepth(w2)
+	for ; d1 > d2; d1-- {
+		w1 = w1.next
+	}
+	for ; d2 > d1; d2-- {
+		w2 = w2.next
+	}
+	for w1 != w2 {
+		w1 = w1.next
+		w2 = w2.next
+	}
+	return w1
+}
+
+// callThunk calls a function of no arguments to completion on a separate VM. It is used to run the
+// before and after thunks of dynamic extents, when the current VM is between instructions.
+func (vm *vm) callThunk(thunk *Function) error {
+	if thunk.primitive != nil {
+		val, err := vm.callPrimitive(thunk.primitive, nil)
+		if call, ok := val.(*functionCall); ok && err == nil {
+			//the thunk's code is just the call the primitive made
+			code := MakeCode(0, nil, nil, "")
+			for i := len(call.args) - 1; i >= 0; i-- {
+				code.emitLiteral(call.args[i])
+			}
+			code.emitLiteral(call.fun)
+			code.emitTailCall(len(call.args))
+			_, err = vm.child().execArgs(code, nil)
+		}
+		return err
+	}
+	if thunk.code == nil {
+		return NewError(ArgumentErrorKey, "Cannot call as a thunk: ", thunk)
+	}
+	env, err := buildFrame(nil, 0, nil, thunk, 0, nil, 0)
+	if err != nil {
+		return err
+	}
+	_, err = vm.child().exec(thunk.code, env)
+	return err
+}
+
+// thread - a VM for a thread the current VM starts. It has the same stack size and context, and a budget of its
+// own under the same limits.
+func (vm *vm) thread() *vm {
+	child := VM(vm.stackSize)
+	child.ctx = vm.ctx
+	if vm.acct != nil {
+		child.acct = newAccounting(vm.acct.limits)
+	}
+	return child
+}
+
+// child - a VM to run a call from Go code to completion on, for the current VM. It has the same stack size,
+// context, and limits, sharing the budget of the current VM.
+func (vm *vm) child() *vm {
+	child := VM(vm.stackSize)
+	child.acct = vm.acct
+	child.ctx = vm.ctx
+	return child
+}
+
 func (vm *vm) tailcall(callable Value, argc int, ops []int, stack []Value, sp int, env *Frame) ([]int, int, int, *Frame, error) {
 opcodeTailCallAgain:
 	if fun, ok := callable.(*Function); ok {
 		if fun.code != nil {
-			if fun.code.defaults == nil && fun.code == env.code { //self-tail-call - we can reuse the frame.
+			if err := vm.check(); err != nil {
+				return nil, 0, 0, nil, addContext(env, err) //not catchable
+			}
+			if checkInterrupt() {
+				return vm.catch(NewError(InterruptKey), stack, env)
+			}
+			if sp+argc < fun.code.maxDepth {
+				return nil, 0, 0, nil, addContext(env, stackOverflow())
+			}
+			//a self tail call can reuse the frame, unless a continuation or a closure made by the code refers to it,
+			//in which case each call must have its own, as each iteration of a loop has its own variables
+			if fun.code.defaults == nil && fun.code == env.code && !env.captured && !fun.code.closes {
 				expectedArgc := fun.code.argc
 				if argc != expectedArgc {
-					return nil, 0, 0, nil, NewError(ArgumentErrorKey, "Wrong number of args to ", fun, " (expected ", expectedArgc, ", got ", argc, ")")
+					err := argcError(callName(fun), expectedArgc, expectedArgc, argc)
+					return vm.catch(err, stack, env)
 				}
 				endSp := sp + argc
 				copy(env.elements, stack[sp:endSp])
@@ -661,56 +1069,28 @@ opcodeTailCallAgain:
 			if err != nil {
 				return vm.catch(err, stack, env)
 			}
+			if call, ok := val.(*functionCall); ok {
+				callable = call.fun
+				argc, sp, err = call.pushArgs(argc, stack, sp)
+				if err != nil {
+					return nil, 0, 0, nil, addContext(env, err)
+				}
+				goto opcodeTailCallAgain
+			}
 			sp = sp + argc - 1
 			stack[sp] = val
 			return env.ops, env.pc, sp, env.previous, nil
 		}
-		if fun == Apply {
-			if argc < 2 {
-				err := NewError(ArgumentErrorKey, "apply expected at least 2 arguments, got ", argc)
-				return vm.catch(err, stack, env)
-			}
-			callable = stack[sp]
-			args := stack[sp+argc-1]
-			if !IsList(args) {
-				err := NewError(ArgumentErrorKey, "apply expected its last argument to be a <list>")
-				return vm.catch(err, stack, env)
-			}
-			arglist := args.(*List)
-			for i := argc - 2; i > 0; i-- {
-				arglist = Cons(stack[sp+i], arglist)
-			}
-			sp += argc
-			argc = ListLength(arglist)
-			i := 0
-			sp -= argc
-			for arglist != EmptyList {
-				stack[sp+i] = arglist.Car
-				i++
-				arglist = arglist.Cdr
-			}
-			goto opcodeTailCallAgain
-		}
 		if fun.continuation != nil {
-			if argc != 1 {
-				err := NewError(ArgumentErrorKey, "#[continuation] expected 1 argument, got ", argc)
-				return vm.catch(err, stack, env)
-			}
-			arg := stack[sp]
-			sp = len(stack) - len(fun.continuation.stack)
-			segment := stack[sp:]
-			copy(segment, fun.continuation.stack)
-			sp--
-			stack[sp] = arg
-			return fun.continuation.ops, fun.continuation.pc, sp, fun.frame, nil
+			return vm.resume(fun, argc, stack, sp, env)
 		}
 		if fun == CallCC {
 			if argc != 1 {
-				err := NewError(ArgumentErrorKey, "callcc expected 1 argument, got ", argc)
+				err := argcError("callcc", 1, 1, argc)
 				return vm.catch(err, stack, env)
 			}
 			callable = stack[sp]
-			stack[sp] = NewContinuation(env.previous, env.ops, env.pc, stack[sp:])
+			stack[sp] = NewContinuation(env.previous, env.ops, env.pc, stack[sp+1:], vm.winders, vm.handlers)
 			goto opcodeTailCallAgain
 		}
 		if fun == Spawn {
@@ -722,14 +1102,23 @@ opcodeTailCallAgain:
 			stack[sp] = Null
 			return env.ops, env.pc, sp, env.previous, nil
 		}
+		if fun == Wind || fun == Unwind {
+			err := vm.wind(fun, argc, stack, sp)
+			if err != nil {
+				return vm.catch(err, stack, env)
+			}
+			sp = sp + argc - 1
+			stack[sp] = Null
+			return env.ops, env.pc, sp, env.previous, nil
+		}
 		panic("Bad function")
 	}
+	if code, ok := callable.(*Code); ok {
+		callable = Closure(code, nil)
+		goto opcodeTailCallAgain
+	}
 	if kw, ok := callable.(*Keyword); ok {
-		if argc != 1 {
-			err := NewError(ArgumentErrorKey, kw.Text, " expected 1 argument, got ", argc)
-			return vm.catch(err, stack, env)
-		}
-		v, err := Get(stack[sp], kw)
+		v, sp, err := keywordGet(kw, argc, stack, sp)
 		if err != nil {
 			return vm.catch(err, stack, env)
 		}
@@ -740,12 +1129,75 @@ opcodeTailCallAgain:
 	return vm.catch(err, stack, env)
 }
 
-func (vm *vm) keywordTailcall(fun *Keyword, argc int, ops []int, stack []Value, sp int, env *Frame) ([]int, int, int, *Frame, error) {
-	if argc != 1 {
-		err := NewError(ArgumentErrorKey, fun.Text, " expected 1 argument, got ", argc)
-		return vm.catch(err, stack, env)
+// functionCall - the value returned by a primitive that calls a function with TailCallFunction
+type functionCall struct {
+	fun  Value
+	args []Value
+}
+
+var functionCallType = Intern("<function-call>")
+
+func (call *functionCall) Type() Value {
+	return functionCallType
+}
+
+func (call *functionCall) String() string {
+	return "#[function-call " + call.fun.String() + "]"
+}
+
+func (call *functionCall) Equals(another Value) bool {
+	return call == another
+}
+
+// TailCallFunction - call a function from a primitive, in place of returning a value:
+//
+//	return TailCallFunction(fun, args)
+//
+// The VM makes the call as a tail call of the primitive, so its result is the result of the primitive. The
+// function may be a closure, a primitive, or a continuation, and is called on the current VM, so neither the
+// Go stack nor the VM stack grows, and a loop that goes through a primitive runs in constant space.
+func TailCallFunction(fun Value, args []Value) (Value, error) {
+	return &functionCall{fun: fun, args: args}, nil
+}
+
+// CallFunction - call a function from a primitive and return its result, for a primitive that goes on to use
+// it, as map does. The call does not run on the current VM: it runs to completion on a child of it, under the
+// same context and limits, so cancelling the context or exceeding the budget stops the function too. Each call
+// nested this way adds a VM to the Go stack, so a loop through a primitive should use TailCallFunction, which
+// does run on the current VM.
+func CallFunction(vm *vm, fun Value, args []Value) (Value, error) {
+	return vm.child().execArgs(trampoline(fun, len(args), "callback"), args)
+}
+
+// pushArgs - replace the arguments of the primitive on the stack with the arguments of its call
+func (call *functionCall) pushArgs(argc int, stack []Value, sp int) (int, int, error) {
+	n := len(call.args)
+	sp += argc - n
+	if sp < 0 {
+		return 0, 0, stackOverflow()
+	}
+	copy(stack[sp:], call.args)
+	return n, sp, nil
+}
+
+func (vm *vm) funcallFrom(call *functionCall, argc int, ops []int, savedPc int, stack []Value, sp int, env *Frame) ([]int, int, int, *Frame, error) {
+	argc, sp, err := call.pushArgs(argc, stack, sp)
+	if err != nil {
+		return nil, 0, 0, nil, addContext(env, err)
+	}
+	return vm.funcall(call.fun, argc, ops, savedPc, stack, sp, env)
+}
+
+func (vm *vm) tailcallFrom(call *functionCall, argc int, ops []int, stack []Value, sp int, env *Frame) ([]int, int, int, *Frame, error) {
+	argc, sp, err := call.pushArgs(argc, stack, sp)
+	if err != nil {
+		return nil, 0, 0, nil, addContext(env, err)
 	}
-	v, err := Get(stack[sp], fun)
+	return vm.tailcall(call.fun, argc, ops, stack, sp, env)
+}
+
+func (vm *vm) keywordTailcall(fun *Keyword, argc int, ops []int, stack []Value, sp int, env *Frame) ([]int, int, int, *Frame, error) {
+	v, sp, err := keywordGet(fun, argc, stack, sp)
 	if err != nil {
 		return vm.catch(err, stack, env)
 	}
@@ -762,24 +1214,42 @@ func execCompileTime(code *Code, arg Value) (Value, error) {
 	return res, err
 }
 
+// catch transfers control to the innermost active handler, with the error object as the value of its
+// catch form. If there is no handler, the error is returned, and the VM exits.
 func (vm *vm) catch(err error, stack []Value, env *Frame) ([]int, int, int, *Frame, error) {
-	errobj, ok := err.(Value)
-	if !ok {
-		errobj = MakeError(ErrorKey, NewString(err.Error()))
-	}
-	ghandler := GetGlobal(Intern("*top-handler*"))
-	if ghandler != nil {
-		if handler, ok := ghandler.(*Function); ok {
-			if handler.code != nil {
-				if handler.code.argc == 1 {
-					sp := len(stack) - 1
-					stack[sp] = errobj
-					return vm.funcall(handler, 1, nil, 0, stack, sp, nil)
-				}
-			}
-		}
+	pc := -1
+	if vm.instrEnv == env {
+		pc = vm.instrPc
+	}
+	errobj := addContextAt(env, pc, err)
+	h := vm.handlers
+	if h == nil {
+		return nil, 0, 0, nil, errobj
+	}
+	vm.handlers = h.next
+	if err := vm.rewind(h.winders); err != nil {
+		return vm.catch(err, stack, env)
+	}
+	sp := len(stack) - h.depth - 1
+	stack[sp] = errobj
+	return h.ops, h.pc, sp, h.env, nil
+}
+
+// errorObject - the error as an Ell value. Errors from the file system and the network are io-error:
+func errorObject(err error) *Error {
+	if errobj, ok := err.(*Error); ok {
+		return errobj
 	}
-	return nil, 0, 0, nil, addContext(env, err)
+	var pathErr *fs.PathError
+	var netErr net.Error
+	if errors.As(err, &pathErr) || errors.As(err, &netErr) {
+		return MakeError(IOErrorKey, NewString(err.Error()))
+	}
+	return MakeError(ErrorKey, NewString(err.Error()))
+}
+
+func (vm *vm) pushHandler(ops []int, pc int, stack []Value, sp int, env *Frame) {
+	vm.handlers = &handler{ops: ops, pc: pc, depth: len(stack) - sp, env: env, winders: vm.winders, next: vm.handlers}
 }
 
 func (vm *vm) spawn(callable Value, argc int, stack []Value, sp int) error {
@@ -789,13 +1259,13 @@ func (vm *vm) spawn(callable Value, argc int, stack []Value, sp int) error {
 			if err != nil {
 				return err
 			}
+			child := vm.thread()
 			go func(code *Code, env *Frame) {
-				vm := VM(defaultStackSize)
-				_, err := vm.exec(code, env)
+				_, err := child.exec(code, env)
 				if err != nil {
-					println("; [*** error in spawned function '", code.name, "': ", err, "]")
+					logMessage(LogError, "error in spawned function '", code.name, "': ", err)
 				} else if verbose {
-					println("; [spawned function '", code.name, "' exited cleanly]")
+					logMessage(LogDebug, "spawned function '", code.name, "' exited cleanly")
 				}
 			}(fun.code, env)
 			return nil
@@ -807,15 +1277,56 @@ func (vm *vm) spawn(callable Value, argc int, stack []Value, sp int) error {
 }
 
 func exec(code *Code, args []Value) (Value, error) {
-	vm := VM(defaultStackSize)
+	return VM(defaultStackSize).execArgs(code, args)
+}
+
+// trampoline - code that calls the function with its arguments, so that Go code can call the function with exec
+func trampoline(fn Value, argc int, name string) *Code {
+	code := MakeCode(argc, nil, nil, name)
+	for i := argc - 1; i >= 0; i-- {
+		code.emitLocal(0, i)
+	}
+	code.emitLiteral(fn)
+	code.emitTailCall(argc)
+	return code
+}
+
+// caller - a Go function that calls the function with argc arguments, for primitives that call the functions
+// they are passed. The code to call it and the child of the VM it runs on, as CallFunction's do, under its
+// context and limits, are made once, and the child reuses its stack, so the function can be called many times
+// cheaply.
+func caller(vm *vm, fn *Function, argc int, name string) func(args ...Value) (Value, error) {
+	code := trampoline(fn, argc, name)
+	child := vm.child()
+	if fn.code != nil {
+		//a closure runs directly in a frame of its own, without the frame of the code that calls it
+		return func(args ...Value) (Value, error) {
+			env, err := buildFrame(nil, 0, nil, fn, len(args), args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return child.exec(fn.code, env)
+		}
+	}
+	return func(args ...Value) (Value, error) {
+		return child.execArgs(code, args)
+	}
+}
+
+func (vm *vm) execArgs(code *Code, args []Value) (Value, error) {
 	if len(args) != code.argc {
-		return nil, NewError(ArgumentErrorKey, "Wrong number of arguments")
+		return nil, argcError(code.name, code.argc, code.argc, len(args))
 	}
 	env := new(Frame)
-	env.elements = make([]Value, len(args))
+	env.elements = make([]Value, code.locals)
+	frameAllocs.Add(code.locals * int(valueSize))
 	copy(env.elements, args)
 	env.code = code
 	startTime := time.Now()
+	var startCount, startBytes int64
+	if verbose {
+		startCount, startBytes = allocTotals()
+	}
 	result, err := vm.exec(code, env)
 	dur := time.Since(startTime)
 	if err != nil {
@@ -825,56 +1336,103 @@ func exec(code *Code, args []Value) (Value, error) {
 		panic("result should never be nil if no error")
 	}
 	if verbose {
-		println("; executed in ", dur)
+		logMessage(LogDebug, "executed in ", dur)
+		count, bytes := allocTotals()
+		logMessage(LogDebug, "allocated ", count-startCount, " values, ", bytes-startBytes, " bytes")
 		if !interactive {
-			println("; => ", result)
+			logMessage(LogDebug, "=> ", result)
 		}
 	}
 	return result, err
 }
 
 func (vm *vm) exec(code *Code, env *Frame) (Value, error) {
-	if !optimize || verbose || trace {
-		return vm.instrumentedExec(code, env)
+	var result Value
+	var err error
+	if code.maxDepth >= vm.stackSize {
+		return nil, addContext(env, stackOverflow())
+	}
+	//a call made while the VM's stack is in use, from a primitive it called, gets a stack of its own
+	stack := vm.stack
+	vm.stack = nil
+	if stack == nil {
+		stack = make([]Value, vm.stackSize)
 	}
-	stack := make([]Value, vm.stackSize)
+	if !optimize || verbose || trace || debugging || profiling {
+		result, err = vm.instrumentedExec(code, env, stack)
+	} else {
+		result, err = vm.optimizedExec(code, env, stack)
+	}
+	vm.stack = stack
+	if err != nil && vm.winders != nil {
+		//the error is leaving any dynamic extents that are still active
+		if err2 := vm.rewind(nil); err2 != nil {
+			return nil, err2
+		}
+	}
+	return result, err
+}
+
+func (vm *vm) optimizedExec(code *Code, env *Frame, stack []Value) (Value, error) {
 	sp := vm.stackSize
 	ops := code.ops
 	pc := 0
 	var val Value
 	var err error
 	for {
+		if vm.acct != nil {
+			if err := vm.acct.step(); err != nil {
+				return nil, addContext(env, err) //not catchable
+			}
+		}
 		op := ops[pc]
-		if op == opcodeCall {
+		if op == opcodeCall || op == opcodeCallGlobal || op == opcodeCallLiteral {
+			vm.instrEnv, vm.instrPc = env, pc+opSize(op)
 			argc := ops[pc+1]
+			next := pc + 2
+			if op != opcodeCall {
+				sp--
+				stack[sp] = callee(op, env.code.constants[ops[pc+2]])
+				next = pc + 3
+			}
 			callable := stack[sp]
 			if fun, ok := callable.(*Function); ok {
 				if fun.primitive != nil {
 					nextSp := sp + argc
 					prim := fun.primitive
 					argv := stack[sp+1 : nextSp+1]
-					if prim.defaults != nil {
-						val, err = vm.callPrimitiveWithDefaults(prim, argv)
-					} else {
-						val, err = prim.fun(argv)
-					}
+					val, err = vm.callPrimitive(prim, argv)
 					if err != nil {
-						ops, pc, _, env, err = vm.catch(err, stack, env)
+						ops, pc, sp, env, err = vm.catch(err, stack, env)
 						if err != nil {
 							return nil, err
 						}
+						continue
+					}
+					if call, ok := val.(*functionCall); ok {
+						ops, pc, sp, env, err = vm.funcallFrom(call, argc, ops, next, stack, sp+1, env)
+						if err != nil {
+							return nil, err
+						}
+						if env == nil {
+							return stack[sp], nil
+						}
+						continue
 					}
 					stack[nextSp] = val
 					sp = nextSp
-					pc += 2
+					pc = next
 				} else {
-					ops, pc, sp, env, err = vm.funcall(fun, argc, ops, pc+2, stack, sp+1, env)
+					ops, pc, sp, env, err = vm.funcall(fun, argc, ops, next, stack, sp+1, env)
 					if err != nil {
 						return nil, err
 					}
+					if env == nil {
+						return stack[sp], nil
+					}
 				}
 			} else if kw, ok := callable.(*Keyword); ok {
-				pc, sp, err = vm.keywordCall(kw, argc, pc+2, stack, sp+1)
+				pc, sp, err = vm.keywordCall(kw, argc, next, stack, sp+1)
 				if err != nil {
 					ops, pc, sp, env, err = vm.catch(err, stack, env)
 					if err != nil {
@@ -882,15 +1440,26 @@ func (vm *vm) exec(code *Code, env *Frame) (Value, error) {
 					}
 				}
 			} else {
-				ops, pc, sp, env, err = vm.catch(NewError(ArgumentErrorKey, "Not callable: ", callable), stack, env)
+				ops, pc, sp, env, err = vm.funcall(callable, argc, ops, next, stack, sp+1, env)
 				if err != nil {
 					return nil, err
 				}
+				if env == nil {
+					return stack[sp], nil
+				}
 			}
 		} else if op == opcodeGlobal {
-			sym := constants[ops[pc+1]]
+			sym := env.code.constants[ops[pc+1]].(*Symbol)
+			if sym.Value == nil {
+				vm.instrEnv, vm.instrPc = env, pc+2
+				ops, pc, sp, env, err = vm.catch(NewError(ErrorKey, "Undefined symbol: ", sym), stack, env)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
 			sp--
-			stack[sp] = (sym.(*Symbol)).Value
+			stack[sp] = sym.Value
 			pc += 2
 		} else if op == opcodeLocal {
 			tmpEnv := env
@@ -915,7 +1484,27 @@ func (vm *vm) exec(code *Code, env *Frame) (Value, error) {
 		} else if op == opcodePop {
 			sp++
 			pc++
-		} else if op == opcodeTailCall {
+		} else if op == opcodeDup {
+			sp--
+			stack[sp] = stack[sp+1]
+			pc++
+		} else if op >= opcodeCar {
+			vm.instrEnv, vm.instrPc = env, pc+1
+			sp, err = vm.primop(op, stack, sp)
+			if err != nil {
+				ops, pc, sp, env, err = vm.catch(err, stack, env)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			pc++
+		} else if op == opcodeTailCall || op == opcodeTailCallGlobal || op == opcodeTailCallLiteral {
+			vm.instrEnv, vm.instrPc = env, pc+opSize(op)
+			if op != opcodeTailCall {
+				sp--
+				stack[sp] = callee(op, env.code.constants[ops[pc+2]])
+			}
 			callable := stack[sp]
 			argc := ops[pc+1]
 			if fun, ok := callable.(*Function); ok {
@@ -923,16 +1512,23 @@ func (vm *vm) exec(code *Code, env *Frame) (Value, error) {
 					nextSp := sp + argc
 					prim := fun.primitive
 					argv := stack[sp+1 : nextSp+1]
-					if prim.defaults != nil {
-						val, err = vm.callPrimitiveWithDefaults(prim, argv)
-					} else {
-						val, err = prim.fun(argv)
-					}
+					val, err = vm.callPrimitive(prim, argv)
 					if err != nil {
-						_, _, _, env, err = vm.catch(err, stack, env)
+						ops, pc, sp, env, err = vm.catch(err, stack, env)
 						if err != nil {
 							return nil, err
 						}
+						continue
+					}
+					if call, ok := val.(*functionCall); ok {
+						ops, pc, sp, env, err = vm.tailcallFrom(call, argc, ops, stack, sp+1, env)
+						if err != nil {
+							return nil, err
+						}
+						if env == nil {
+							return stack[sp], nil
+						}
+						continue
 					}
 					stack[nextSp] = val
 					sp = nextSp
@@ -964,14 +1560,17 @@ func (vm *vm) exec(code *Code, env *Frame) (Value, error) {
 					}
 				}
 			} else {
-				ops, pc, sp, env, err = vm.catch(NewError(ArgumentErrorKey, "Not callable: ", fun), stack, env)
+				ops, pc, sp, env, err = vm.tailcall(callable, argc, ops, stack, sp+1, env)
 				if err != nil {
 					return nil, err
 				}
+				if env == nil {
+					return stack[sp], nil
+				}
 			}
 		} else if op == opcodeLiteral {
 			sp--
-			stack[sp] = constants[ops[pc+1]]
+			stack[sp] = env.code.constants[ops[pc+1]]
 			pc += 2
 		} else if op == opcodeSetLocal {
 			tmpEnv := env
@@ -985,7 +1584,7 @@ func (vm *vm) exec(code *Code, env *Frame) (Value, error) {
 			pc += 3
 		} else if op == opcodeClosure {
 			sp--
-			stack[sp] = Closure(constants[ops[pc+1]].(*Code), env)
+			stack[sp] = Closure(env.code.constants[ops[pc+1]].(*Code), env)
 			pc = pc + 2
 		} else if op == opcodeReturn {
 			if env.previous == nil {
@@ -995,23 +1594,47 @@ func (vm *vm) exec(code *Code, env *Frame) (Value, error) {
 			pc = env.pc
 			env = env.previous
 		} else if op == opcodeJump {
+			if ops[pc+1] <= 0 { //a loop, which is checked like a call
+				if err := vm.check(); err != nil {
+					return nil, addContext(env, err) //not catchable
+				}
+				if checkInterrupt() {
+					ops, pc, sp, env, err = vm.catch(NewError(InterruptKey), stack, env)
+					if err != nil {
+						return nil, err
+					}
+					continue
+				}
+			}
 			pc += ops[pc+1]
 		} else if op == opcodeDefGlobal {
-			sym := constants[ops[pc+1]].(*Symbol)
+			sym := env.code.constants[ops[pc+1]].(*Symbol)
 			defGlobal(sym, stack[sp])
 			pc += 2
+		} else if op == opcodeSetGlobal {
+			sym := env.code.constants[ops[pc+1]].(*Symbol)
+			if sym.Value == nil {
+				vm.instrEnv, vm.instrPc = env, pc+2
+				ops, pc, sp, env, err = vm.catch(NewError(ErrorKey, "Cannot set! undefined symbol: ", sym), stack, env)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				sym.Value = stack[sp]
+				pc += 2
+			}
 		} else if op == opcodeUndefGlobal {
-			sym := constants[ops[pc+1]].(*Symbol)
+			sym := env.code.constants[ops[pc+1]].(*Symbol)
 			undefGlobal(sym)
 			pc += 2
 		} else if op == opcodeDefMacro {
-			sym := constants[ops[pc+1]].(*Symbol)
+			sym := env.code.constants[ops[pc+1]].(*Symbol)
 			defMacro(sym, stack[sp].(*Function))
 			stack[sp] = sym
 			pc += 2
 		} else if op == opcodeUse {
-			sym := constants[ops[pc+1]].(*Symbol)
-			err := Use(sym)
+			vm.instrEnv, vm.instrPc = env, pc+2
+			sym, err := useSpec(env.code.constants[ops[pc+1]])
 			if err != nil {
 				ops, pc, sp, env, err = vm.catch(err, stack, env)
 				if err != nil {
@@ -1030,22 +1653,44 @@ func (vm *vm) exec(code *Code, env *Frame) (Value, error) {
 			pc += 2
 		} else if op == opcodeStruct {
 			vlen := ops[pc+1]
-			v, _ := MakeStruct(stack[sp : sp+vlen])
+			v, _ := StructFromPairs(stack[sp : sp+vlen])
 			sp = sp + vlen - 1
 			stack[sp] = v
 			pc += 2
+		} else if op == opcodeCatch {
+			vm.pushHandler(ops, pc+ops[pc+1], stack, sp, env)
+			pc += 2
+		} else if op == opcodeUncatch {
+			vm.handlers = vm.handlers.next
+			pc++
 		} else {
 			panic("Bad instruction")
 		}
 	}
 }
 
+// callee - the function called by a callglobal or callliteral instruction, given its operand
+func callee(op int, fn Value) Value {
+	if op == opcodeCallGlobal || op == opcodeTailCallGlobal {
+		return fn.(*Symbol).Value
+	}
+	return fn
+}
+
+// callArgs - the operands of a call instruction, for tracing
+func callArgs(op int, ops []int, code *Code) string {
+	if op == opcodeCall || op == opcodeTailCall {
+		return fmt.Sprintf("%d", ops[1])
+	}
+	return fmt.Sprintf("%d %v", ops[1], code.constants[ops[2]])
+}
+
 const stackColumn = 40
 
 func showInstruction(pc int, op int, args string, stack []Value, sp int) {
 	var body string
 	body = leftJustified(fmt.Sprintf("%d ", pc), 8) + leftJustified(opsyms[op].String(), 10) + args
-	println(leftJustified(body, stackColumn), showStack(stack, sp))
+	logMessage(LogDebug, leftJustified(body, stackColumn)+" "+showStack(stack, sp))
 }
 
 func leftJustified(s string, width int) string {
@@ -1112,19 +1757,46 @@ func primopName(v Value) string {
 	return f.primitive.name
 }
 
-func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
-	stack := make([]Value, vm.stackSize)
+func (vm *vm) instrumentedExec(code *Code, env *Frame, stack []Value) (Value, error) {
 	sp := vm.stackSize
 	ops := code.ops
 	pc := 0
 	var err, err2 error
 	for {
+		if vm.acct != nil {
+			if err := vm.acct.step(); err != nil {
+				return nil, addContext(env, err) //not catchable
+			}
+		}
+		if debugging {
+			if err := vm.debugPause(env, pc, stack, sp); err != nil {
+				return nil, addContext(env, err) //not catchable
+			}
+		}
+		if profiling {
+			vm.profileStep(env, pc)
+		}
 		op := ops[pc]
-		if op == opcodeCall { // CALL
+		if op == opcodeCall || op == opcodeCallGlobal || op == opcodeCallLiteral { // CALL
+			vm.instrEnv, vm.instrPc = env, pc+opSize(op)
 			if trace {
-				showInstruction(pc, op, fmt.Sprintf("%d", ops[pc+1]), stack, sp)
+				showInstruction(pc, op, callArgs(op, ops[pc:], env.code), stack, sp)
 			}
 			argc := ops[pc+1]
+			next := pc + 2
+			if op != opcodeCall {
+				fn := env.code.constants[ops[pc+2]]
+				if sym, ok := fn.(*Symbol); ok && op == opcodeCallGlobal && sym.Value == nil {
+					ops, pc, sp, env, err2 = vm.catch(NewError(ErrorKey, "Undefined symbol: ", sym), stack, env)
+					if err2 != nil {
+						return nil, err2
+					}
+					continue
+				}
+				sp--
+				stack[sp] = callee(op, fn)
+				next = pc + 3
+			}
 			callable := stack[sp]
 			if fun, ok := callable.(*Function); ok {
 				if fun.primitive != nil {
@@ -1135,19 +1807,30 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 						if err != nil {
 							return nil, err
 						}
+					} else if call, ok := val.(*functionCall); ok {
+						ops, pc, sp, env, err = vm.funcallFrom(call, argc, ops, next, stack, sp+1, env)
+						if err != nil {
+							return nil, err
+						}
+						if env == nil {
+							return stack[sp], nil
+						}
 					} else {
 						stack[nextSp] = val
 						sp = nextSp
-						pc += 2
+						pc = next
 					}
 				} else {
-					ops, pc, sp, env, err = vm.funcall(fun, argc, ops, pc+2, stack, sp+1, env)
+					ops, pc, sp, env, err = vm.funcall(fun, argc, ops, next, stack, sp+1, env)
 					if err != nil {
 						return nil, err
 					}
+					if env == nil {
+						return stack[sp], nil
+					}
 				}
 			} else if kw, ok := callable.(*Keyword); ok {
-				pc, sp, err = vm.keywordCall(kw, argc, pc+2, stack, sp+1)
+				pc, sp, err = vm.keywordCall(kw, argc, next, stack, sp+1)
 				if err != nil {
 					ops, pc, sp, env, err = vm.catch(err, stack, env)
 					if err != nil {
@@ -1155,16 +1838,19 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 					}
 				}
 			} else {
-				err := NewError(ArgumentErrorKey, "Not callable: ", fun)
-				ops, pc, sp, env, err2 = vm.catch(err, stack, env)
-				if err2 != nil {
-					return nil, err2
+				ops, pc, sp, env, err = vm.funcall(callable, argc, ops, next, stack, sp+1, env)
+				if err != nil {
+					return nil, err
+				}
+				if env == nil {
+					return stack[sp], nil
 				}
 			}
 		} else if op == opcodeGlobal { //GObjectAL
-			sym := constants[ops[pc+1]].(*Symbol)
+			sym := env.code.constants[ops[pc+1]].(*Symbol)
 			if sym.Value == nil {
 				err := NewError(ErrorKey, "Undefined symbol: ", sym)
+				vm.instrEnv, vm.instrPc = env, pc+2
 				ops, pc, sp, env, err2 = vm.catch(err, stack, env)
 				if err2 != nil {
 					return nil, err2
@@ -1209,12 +1895,43 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 			}
 			sp++
 			pc++
-		} else if op == opcodeTailCall {
-			if interrupted || checkInterrupt() {
-				return nil, addContext(env, NewError(InterruptKey)) //not catchable
+		} else if op == opcodeDup {
+			if trace {
+				showInstruction(pc, op, "", stack, sp)
 			}
+			sp--
+			stack[sp] = stack[sp+1]
+			pc++
+		} else if op >= opcodeCar {
 			if trace {
-				showInstruction(pc, op, fmt.Sprintf("%d", ops[pc+1]), stack, sp)
+				showInstruction(pc, op, "", stack, sp)
+			}
+			vm.instrEnv, vm.instrPc = env, pc+1
+			sp, err = vm.primop(op, stack, sp)
+			if err != nil {
+				ops, pc, sp, env, err2 = vm.catch(err, stack, env)
+				if err2 != nil {
+					return nil, err2
+				}
+				continue
+			}
+			pc++
+		} else if op == opcodeTailCall || op == opcodeTailCallGlobal || op == opcodeTailCallLiteral {
+			vm.instrEnv, vm.instrPc = env, pc+opSize(op)
+			if trace {
+				showInstruction(pc, op, callArgs(op, ops[pc:], env.code), stack, sp)
+			}
+			if op != opcodeTailCall {
+				fn := env.code.constants[ops[pc+2]]
+				if sym, ok := fn.(*Symbol); ok && op == opcodeTailCallGlobal && sym.Value == nil {
+					ops, pc, sp, env, err2 = vm.catch(NewError(ErrorKey, "Undefined symbol: ", sym), stack, env)
+					if err2 != nil {
+						return nil, err2
+					}
+					continue
+				}
+				sp--
+				stack[sp] = callee(op, fn)
 			}
 			callable := stack[sp]
 			argc := ops[pc+1]
@@ -1227,6 +1944,14 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 						if err != nil {
 							return nil, err
 						}
+					} else if call, ok := val.(*functionCall); ok {
+						ops, pc, sp, env, err = vm.tailcallFrom(call, argc, ops, stack, sp+1, env)
+						if err != nil {
+							return nil, err
+						}
+						if env == nil {
+							return stack[sp], nil
+						}
 					} else {
 						stack[nextSp] = val
 						sp = nextSp
@@ -1251,18 +1976,24 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 				if err != nil {
 					return nil, err
 				}
-				if env.previous == nil {
+				if env == nil {
 					return stack[sp], nil
 				}
 			} else {
-				return nil, addContext(env, NewError(ArgumentErrorKey, "Not callable: ", fun))
+				ops, pc, sp, env, err = vm.tailcall(callable, argc, ops, stack, sp+1, env)
+				if err != nil {
+					return nil, err
+				}
+				if env == nil {
+					return stack[sp], nil
+				}
 			}
 		} else if op == opcodeLiteral {
 			if trace {
-				showInstruction(pc, op, Write(constants[ops[pc+1]].Type()), stack, sp)
+				showInstruction(pc, op, Write(env.code.constants[ops[pc+1]].Type()), stack, sp)
 			}
 			sp--
-			stack[sp] = constants[ops[pc+1]]
+			stack[sp] = env.code.constants[ops[pc+1]]
 			pc += 2
 		} else if op == opcodeSetLocal {
 			if trace {
@@ -1282,11 +2013,18 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 				showInstruction(pc, op, "", stack, sp)
 			}
 			sp--
-			stack[sp] = Closure((constants[ops[pc+1]].(*Code)), env)
+			stack[sp] = Closure((env.code.constants[ops[pc+1]].(*Code)), env)
 			pc = pc + 2
 		} else if op == opcodeReturn {
-			if interrupted || checkInterrupt() {
-				return nil, addContext(env, NewError(InterruptKey)) //not catchable
+			if err := vm.check(); err != nil {
+				return nil, addContext(env, err) //not catchable
+			}
+			if checkInterrupt() {
+				ops, pc, sp, env, err = vm.catch(NewError(InterruptKey), stack, env)
+				if err != nil {
+					return nil, err
+				}
+				continue
 			}
 			if trace {
 				showInstruction(pc, op, "", stack, sp)
@@ -1301,24 +2039,51 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 			if trace {
 				showInstruction(pc, op, fmt.Sprintf("%d", pc+ops[pc+1]), stack, sp)
 			}
+			if ops[pc+1] <= 0 { //a loop, which is checked like a call
+				if err := vm.check(); err != nil {
+					return nil, addContext(env, err) //not catchable
+				}
+				if checkInterrupt() {
+					ops, pc, sp, env, err = vm.catch(NewError(InterruptKey), stack, env)
+					if err != nil {
+						return nil, err
+					}
+					continue
+				}
+			}
 			pc += ops[pc+1]
 		} else if op == opcodeDefGlobal {
-			sym := constants[ops[pc+1]].(*Symbol)
+			sym := env.code.constants[ops[pc+1]].(*Symbol)
 			if trace {
 				showInstruction(pc, op, sym.Text, stack, sp)
 			}
 			defGlobal(sym, stack[sp])
 			//fmt.Println(";", sym)
 			pc += 2
+		} else if op == opcodeSetGlobal {
+			sym := env.code.constants[ops[pc+1]].(*Symbol)
+			if trace {
+				showInstruction(pc, op, sym.Text, stack, sp)
+			}
+			if sym.Value == nil {
+				vm.instrEnv, vm.instrPc = env, pc+2
+				ops, pc, sp, env, err2 = vm.catch(NewError(ErrorKey, "Cannot set! undefined symbol: ", sym), stack, env)
+				if err2 != nil {
+					return nil, err2
+				}
+			} else {
+				sym.Value = stack[sp]
+				pc += 2
+			}
 		} else if op == opcodeUndefGlobal {
-			sym := constants[ops[pc+1]].(*Symbol)
+			sym := env.code.constants[ops[pc+1]].(*Symbol)
 			if trace {
 				showInstruction(pc, op, sym.Text, stack, sp)
 			}
 			undefGlobal(sym)
 			pc += 2
 		} else if op == opcodeDefMacro {
-			sym := constants[ops[pc+1]].(*Symbol)
+			sym := env.code.constants[ops[pc+1]].(*Symbol)
 			if trace {
 				showInstruction(pc, op, sym.Text, stack, sp)
 			}
@@ -1326,20 +2091,22 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 			stack[sp] = sym
 			pc += 2
 		} else if op == opcodeUse {
-			sym := constants[ops[pc+1]].(*Symbol)
+			spec := env.code.constants[ops[pc+1]]
 			if trace {
-				showInstruction(pc, op, sym.Text, stack, sp)
+				showInstruction(pc, op, Write(spec), stack, sp)
 			}
-			err := Use(sym)
+			vm.instrEnv, vm.instrPc = env, pc+2
+			sym, err := useSpec(spec)
 			if err != nil {
 				ops, pc, sp, env, err = vm.catch(err, stack, env)
 				if err != nil {
 					return nil, err
 				}
+			} else {
+				sp--
+				stack[sp] = sym
+				pc += 2
 			}
-			sp--
-			stack[sp] = sym
-			pc += 2
 		} else if op == opcodeVector {
 			if trace {
 				showInstruction(pc, op, fmt.Sprintf("%d", ops[pc+1]), stack, sp)
@@ -1354,10 +2121,22 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 				showInstruction(pc, op, fmt.Sprintf("%d", ops[pc+1]), stack, sp)
 			}
 			vlen := ops[pc+1]
-			v, _ := MakeStruct(stack[sp : sp+vlen])
+			v, _ := StructFromPairs(stack[sp : sp+vlen])
 			sp = sp + vlen - 1
 			stack[sp] = v
 			pc += 2
+		} else if op == opcodeCatch {
+			if trace {
+				showInstruction(pc, op, fmt.Sprintf("%d", pc+ops[pc+1]), stack, sp)
+			}
+			vm.pushHandler(ops, pc+ops[pc+1], stack, sp, env)
+			pc += 2
+		} else if op == opcodeUncatch {
+			if trace {
+				showInstruction(pc, op, "", stack, sp)
+			}
+			vm.handlers = vm.handlers.next
+			pc++
 		} else {
 			panic("Bad instruction")
 		}
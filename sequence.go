@@ -0,0 +1,243 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	. "github.com/boynton/ell/data"
+)
+
+// The sequence functions work on lists, vectors, and strings, whose elements are characters. Their results are
+// of the same kind as their (first) sequence argument.
+
+// sequenceElements - the elements of the list, vector, or string, in a new slice
+func sequenceElements(seq Value, name string) ([]Value, error) {
+	switch p := seq.(type) {
+	case *List:
+		return ListToVector(p).Elements, nil
+	case *Vector:
+		return append([]Value(nil), p.Elements...), nil
+	case *String:
+		return StringCharacters(p), nil
+	}
+	return nil, NewError(ArgumentErrorKey, name, " expected a <list>, <vector>, or <string>, got a ", seq.Type())
+}
+
+// sameSequence - a sequence of the values of the same kind as the sequence. For a string, the values must be
+// characters.
+func sameSequence(seq Value, values []Value, name string) (Value, error) {
+	switch seq.(type) {
+	case *Vector:
+		return NewVector(values...), nil
+	case *String:
+		s, err := ToString(VectorFromElementsNoCopy(values))
+		if err != nil {
+			return nil, NewError(ArgumentErrorKey, name, " of a <string> expected <character> results: ", err)
+		}
+		return s, nil
+	}
+	return ListFromValues(values), nil
+}
+
+// sequencesElements - the elements of each of the sequences, and the length of the shortest one
+func sequencesElements(seqs []Value, name string) ([][]Value, int, error) {
+	elements := make([][]Value, len(seqs))
+	shortest := -1
+	for i, seq := range seqs {
+		el, err := sequenceElements(seq, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		elements[i] = el
+		if shortest < 0 || len(el) < shortest {
+			shortest = len(el)
+		}
+	}
+	return elements, shortest, nil
+}
+
+// eachArgs - call the function with the elements at each index of the sequences in turn, up to the end of the
+// shortest one, and return the results
+func eachArgs(vm *vm, fn *Function, seqs []Value, name string) ([]Value, error) {
+	elements, n, err := sequencesElements(seqs, name)
+	if err != nil {
+		return nil, err
+	}
+	call := caller(vm, fn, len(seqs), name)
+	results := make([]Value, n)
+	args := make([]Value, len(seqs))
+	for i := 0; i < n; i++ {
+		for j, el := range elements {
+			args[j] = el[i]
+		}
+		if results[i], err = call(args...); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// Map - the results of calling the function with the elements of the sequences, as a sequence of the same kind
+// as the first of them
+func Map(vm *vm, fn *Function, seqs []Value) (Value, error) {
+	results, err := eachArgs(vm, fn, seqs, "map")
+	if err != nil {
+		return nil, err
+	}
+	return sameSequence(seqs[0], results, "map")
+}
+
+// ForEach - call the function with the elements of the sequences, for its effects
+func ForEach(vm *vm, fn *Function, seqs []Value) error {
+	_, err := eachArgs(vm, fn, seqs, "for-each")
+	return err
+}
+
+// Filter - the elements of the sequence for which the predicate is not false
+func Filter(vm *vm, pred *Function, seq Value) (Value, error) {
+	elements, err := sequenceElements(seq, "filter")
+	if err != nil {
+		return nil, err
+	}
+	call := caller(vm, pred, 1, "filter")
+	var results []Value
+	for _, el := range elements {
+		b, err := call(el)
+		if err != nil {
+			return nil, err
+		}
+		if b != False {
+			results = append(results, el)
+		}
+	}
+	return sameSequence(seq, results, "filter")
+}
+
+// Reduce - the result of calling the function with the initial value and the first element, then with that
+// result and the second element, and so on through the sequence
+func Reduce(vm *vm, fn *Function, init Value, seq Value) (Value, error) {
+	elements, err := sequenceElements(seq, "reduce")
+	if err != nil {
+		return nil, err
+	}
+	call := caller(vm, fn, 2, "reduce")
+	result := init
+	for _, el := range elements {
+		if result, err = call(result, el); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Every - if all is true, true if the predicate is not false for every element of the sequence, otherwise true if
+// it is not false for any one of them. The predicate is not called after the answer is known.
+func Every(vm *vm, pred *Function, seq Value, all bool, name string) (bool, error) {
+	elements, err := sequenceElements(seq, name)
+	if err != nil {
+		return false, err
+	}
+	call := caller(vm, pred, 1, name)
+	for _, el := range elements {
+		b, err := call(el)
+		if err != nil {
+			return false, err
+		}
+		if (b != False) != all {
+			return !all, nil
+		}
+	}
+	return all, nil
+}
+
+// Zip - a list of lists of the elements at each index of the sequences, up to the end of the shortest one
+func Zip(seqs []Value) (*List, error) {
+	elements, n, err := sequencesElements(seqs, "zip")
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Value, n)
+	for i := 0; i < n; i++ {
+		tuple := make([]Value, len(seqs))
+		for j, el := range elements {
+			tuple[j] = el[i]
+		}
+		result[i] = ListFromValues(tuple)
+	}
+	return ListFromValues(result), nil
+}
+
+// Take - the first count elements of the sequence, or all of them if there are fewer, as a sequence of the same
+// kind. A lazy sequence is forced only as far as needed, and the result is a list.
+func Take(vm *vm, count int, seq Value) (Value, error) {
+	if p, ok := seq.(*LazySeq); ok {
+		var values []Value
+		for len(values) < count {
+			values = append(values, p.first)
+			if len(values) == count {
+				break
+			}
+			rest, err := p.LazyRest(vm)
+			if err != nil {
+				return nil, err
+			}
+			if p, ok = rest.(*LazySeq); !ok {
+				break
+			}
+		}
+		return ListFromValues(values), nil
+	}
+	elements, err := sequenceElements(seq, "take")
+	if err != nil {
+		return nil, err
+	}
+	if count < 0 {
+		count = 0
+	} else if count > len(elements) {
+		count = len(elements)
+	}
+	return sameSequence(seq, elements[:count], "take")
+}
+
+// Drop - the sequence without its first count elements. The rest of a list or lazy sequence is shared, not copied.
+func Drop(vm *vm, count int, seq Value) (Value, error) {
+	var rest Value = seq
+	for i := 0; i < count; i++ {
+		switch p := rest.(type) {
+		case *List:
+			if p == EmptyList {
+				return p, nil
+			}
+			rest = p.Cdr
+		case *LazySeq:
+			r, err := p.LazyRest(vm)
+			if err != nil {
+				return nil, err
+			}
+			rest = r
+		default:
+			elements, err := sequenceElements(seq, "drop")
+			if err != nil {
+				return nil, err
+			}
+			if count > len(elements) {
+				count = len(elements)
+			}
+			return sameSequence(seq, elements[count:], "drop")
+		}
+	}
+	return rest, nil
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"bytes"
+
+	. "github.com/boynton/ell/data"
+)
+
+var SetType Value = Intern("<set>")
+
+// Set - a collection of distinct values, compared with Equal, i.e. #{1 2 3}. The members are kept in the order
+// they were added.
+type Set struct {
+	members *Struct //the members are the keys, all with the value true
+}
+
+func (s *Set) Type() Value {
+	return SetType
+}
+
+// String - the set in the syntax the reader accepts for it
+func (s *Set) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("#{")
+	for i, e := range s.members.Entries() {
+		if i > 0 {
+			buf.WriteString(" ")
+		}
+		buf.WriteString(e.Key.String())
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
+
+// Equals - sets are equal if they have the same members, in any order
+func (s *Set) Equals(another Value) bool {
+	if s2, ok := another.(*Set); ok {
+		if s.Length() != s2.Length() {
+			return false
+		}
+		for _, e := range s.members.Entries() {
+			if !s2.Contains(e.Key) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Hash - the hash of the set, which does not depend on the order of its members
+func (s *Set) Hash() uint64 {
+	var h uint64
+	for _, e := range s.members.Entries() {
+		h += Hash(e.Key)
+	}
+	return h
+}
+
+// NewSet - create a new set of the values, without duplicates
+func NewSet(values ...Value) *Set {
+	s := &Set{members: NewStruct()}
+	for _, v := range values {
+		s.Add(v)
+	}
+	return s
+}
+
+func IsSet(obj Value) bool {
+	_, ok := obj.(*Set)
+	return ok
+}
+
+// Length - the number of members of the set
+func (s *Set) Length() int {
+	return s.members.Length()
+}
+
+// Contains - true if the value is a member of the set
+func (s *Set) Contains(val Value) bool {
+	return s.members.Has(val)
+}
+
+// Add - add the value to the set, if it is not already a member
+func (s *Set) Add(val Value) {
+	if !s.members.Has(val) {
+		s.members.Put(val, True)
+	}
+}
+
+// Remove - remove the value from the set, if it is a member
+func (s *Set) Remove(val Value) {
+	s.members.Unput(val)
+}
+
+// Members - the members of the set, in the order they were added
+func (s *Set) Members() []Value {
+	return s.members.Keys()
+}
+
+// SetUnion - a new set of the members of any of the sets
+func SetUnion(sets ...*Set) *Set {
+	result := NewSet()
+	for _, s := range sets {
+		for _, e := range s.members.Entries() {
+			result.Add(e.Key)
+		}
+	}
+	return result
+}
+
+// SetIntersection - a new set of the members of the first set that are members of all the others
+func SetIntersection(first *Set, others ...*Set) *Set {
+	result := NewSet()
+	for _, e := range first.members.Entries() {
+		member := true
+		for _, s := range others {
+			if !s.Contains(e.Key) {
+				member = false
+				break
+			}
+		}
+		if member {
+			result.Add(e.Key)
+		}
+	}
+	return result
+}
+
+// SetDifference - a new set of the members of the first set that are not members of any of the others
+func SetDifference(first *Set, others ...*Set) *Set {
+	result := NewSet()
+	for _, e := range first.members.Entries() {
+		member := false
+		for _, s := range others {
+			if s.Contains(e.Key) {
+				member = true
+				break
+			}
+		}
+		if !member {
+			result.Add(e.Key)
+		}
+	}
+	return result
+}
+
+// ToSet - convert the object to a <set>, if possible
+func ToSet(obj Value) (*Set, error) {
+	switch p := obj.(type) {
+	case *Set:
+		return p, nil
+	case *List:
+		s := NewSet()
+		for ; p != EmptyList; p = p.Cdr {
+			s.Add(p.Car)
+		}
+		return s, nil
+	case *Vector:
+		return NewSet(p.Elements...), nil
+	case *String:
+		return NewSet(StringToVector(p).Elements...), nil
+	}
+	return nil, NewError(ArgumentErrorKey, "to-set expected <set>, <list>, <vector>, or <string>, got a ", obj.Type())
+}
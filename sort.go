@@ -0,0 +1,167 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"sort"
+	"strings"
+
+	. "github.com/boynton/ell/data"
+)
+
+// Compare - -1, 0, or 1 as the first value orders before, the same as, or after the second. Numbers, strings,
+// characters, symbols, and keywords have a natural order, but only values of the same kind can be compared.
+func Compare(v1 Value, v2 Value) (int, error) {
+	switch p1 := v1.(type) {
+	case *Number:
+		if p2, ok := v2.(*Number); ok {
+			return NumberCompare(p1, p2), nil
+		}
+	case *String:
+		if p2, ok := v2.(*String); ok {
+			return strings.Compare(p1.Value, p2.Value), nil
+		}
+	case *Character:
+		if p2, ok := v2.(*Character); ok {
+			if p1.Value < p2.Value {
+				return -1, nil
+			} else if p1.Value > p2.Value {
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case *Symbol, *Keyword:
+		if v1.Type() == v2.Type() {
+			return strings.Compare(v1.String(), v2.String()), nil
+		}
+	}
+	return 0, NewError(ArgumentErrorKey, "Cannot compare ", v1, " and ", v2)
+}
+
+// lessFunction - a Go function that returns true if the first value orders before the second, by calling the Ell
+// predicate, or by Compare if it is null
+func lessFunction(vm *vm, pred Value, name string) (func(v1 Value, v2 Value) (bool, error), error) {
+	if pred == Null {
+		return func(v1 Value, v2 Value) (bool, error) {
+			c, err := Compare(v1, v2)
+			return c < 0, err
+		}, nil
+	}
+	fn, ok := pred.(*Function)
+	if !ok {
+		return nil, NewError(ArgumentErrorKey, name, " expected a <function> to compare with, got ", pred)
+	}
+	call := caller(vm, fn, 2, name)
+	return func(v1 Value, v2 Value) (bool, error) {
+		b, err := call(v1, v2)
+		return b == True, err
+	}, nil
+}
+
+// sortValues - sort the values in place, stably, by their keys, which are the values themselves if keys is nil.
+// The first error comparing them stops the comparisons and is returned.
+func sortValues(values []Value, keys []Value, less func(Value, Value) (bool, error)) error {
+	if keys == nil {
+		keys = values
+	}
+	indices := make([]int, len(values))
+	for i := range indices {
+		indices[i] = i
+	}
+	var err error
+	sort.SliceStable(indices, func(i, j int) bool {
+		if err != nil {
+			return false
+		}
+		b, e := less(keys[indices[i]], keys[indices[j]])
+		if e != nil {
+			err = e
+		}
+		return b
+	})
+	if err != nil {
+		return err
+	}
+	sorted := make([]Value, len(values))
+	for i, idx := range indices {
+		sorted[i] = values[idx]
+	}
+	copy(values, sorted)
+	return nil
+}
+
+// Sort - a new list, vector, or string of the elements of the sequence, stably sorted by the predicate, or by
+// Compare if the predicate is null. If key is not null, it is a function of an element that returns what is
+// compared for it.
+func Sort(vm *vm, seq Value, pred Value, key Value, name string) (Value, error) {
+	values, err := sequenceElements(seq, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := sortInPlace(vm, values, pred, key, name); err != nil {
+		return nil, err
+	}
+	return sameSequence(seq, values, name)
+}
+
+// SortBang - sort the elements of the list or vector in place, as Sort does
+func SortBang(vm *vm, seq Value, pred Value, key Value) error {
+	if _, ok := seq.(*String); ok {
+		return NewError(ArgumentErrorKey, "sort! cannot sort a <string> in place")
+	}
+	if err := checkMutable(seq, "sort!"); err != nil {
+		return err
+	}
+	values, err := sequenceElements(seq, "sort!")
+	if err != nil {
+		return err
+	}
+	if err := sortInPlace(vm, values, pred, key, "sort!"); err != nil {
+		return err
+	}
+	switch p := seq.(type) {
+	case *List:
+		for i := 0; p != EmptyList; i, p = i+1, p.Cdr {
+			p.Car = values[i]
+		}
+	case *Vector:
+		copy(p.Elements, values)
+	}
+	return nil
+}
+
+func sortInPlace(vm *vm, values []Value, pred Value, key Value, name string) error {
+	less, err := lessFunction(vm, pred, name)
+	if err != nil {
+		return err
+	}
+	var keys []Value
+	if key != Null {
+		fn, ok := key.(*Function)
+		if !ok {
+			return NewError(ArgumentErrorKey, name, " expected a <function> key, got ", key)
+		}
+		call := caller(vm, fn, 1, name)
+		keys = make([]Value, len(values))
+		for i, v := range values {
+			if keys[i], err = call(v); err != nil {
+				return err
+			}
+		}
+	}
+	return sortValues(values, keys, less)
+}
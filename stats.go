@@ -0,0 +1,165 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"time"
+	"unsafe"
+
+	. "github.com/boynton/ell/data"
+)
+
+const valueSize = unsafe.Sizeof(Value(nil))
+
+// the allocations of the VM's own values are counted along with those of the data package
+var frameAllocs = NewAllocCounter("<frame>", unsafe.Sizeof(Frame{}))
+var functionAllocs = NewAllocCounter("<function>", unsafe.Sizeof(Function{}))
+var blobAllocs = NewAllocCounter("<blob>", unsafe.Sizeof(Blob{}))
+
+var statsCountKey = Intern("count:")
+var statsBytesKey = Intern("bytes:")
+var statsTypesKey = Intern("types:")
+var statsGCsKey = Intern("gcs:")
+
+// allocTotals - the number of values allocated so far, of all types, and the bytes they took
+func allocTotals() (int64, int64) {
+	var count, bytes int64
+	for _, stat := range AllocStats() {
+		count += stat.Count
+		bytes += stat.Bytes
+	}
+	return count, bytes
+}
+
+// VMStats - the allocations so far, as a struct of the number of values allocated, the bytes they took, and the
+// number of garbage collections, with the counts and bytes of each type:
+//
+//	{count: 1234 bytes: 45678 gcs: 2 types: {<list>: {count: 1000 bytes: 32000} ...}}
+//
+// If since is a struct returned earlier, the result is what has been allocated since then. Allocations are
+// counted from the first call, or from when they were first wanted for a time, bench, or limit on conses.
+func VMStats(since *Struct) *Struct {
+	CountAllocations()
+	var memstats runtime.MemStats
+	runtime.ReadMemStats(&memstats)
+	var count, bytes int64
+	types := NewStruct()
+	for _, stat := range AllocStats() {
+		typ := Intern(stat.Type)
+		n := stat.Count - statsValue(since, statsTypesKey, typ, statsCountKey)
+		size := stat.Bytes - statsValue(since, statsTypesKey, typ, statsBytesKey)
+		entry := NewStruct()
+		entry.Put(statsCountKey, Int(n))
+		entry.Put(statsBytesKey, Int(size))
+		types.Put(typ, entry)
+		count += n
+		bytes += size
+	}
+	result := NewStruct()
+	result.Put(statsCountKey, Int(count))
+	result.Put(statsBytesKey, Int(bytes))
+	result.Put(statsGCsKey, Int(int64(memstats.NumGC)-statsValue(since, statsGCsKey)))
+	result.Put(statsTypesKey, types)
+	return result
+}
+
+// statsValue - the number at the path of keys in the stats, or 0 if there is none
+func statsValue(stats *Struct, keys ...Value) int64 {
+	var val Value = stats
+	for _, key := range keys {
+		s, ok := val.(*Struct)
+		if !ok || s == nil {
+			return 0
+		}
+		val = s.Get(key)
+	}
+	if n, ok := val.(*Number); ok {
+		return n.Int64Value()
+	}
+	return 0
+}
+
+func ellVMStats(argv []Value) (Value, error) {
+	if argv[0] == Null {
+		return VMStats(nil), nil
+	}
+	since, ok := argv[0].(*Struct)
+	if !ok {
+		return nil, argTypeError("vm-stats", StructType.String(), 1, argv[0])
+	}
+	return VMStats(since), nil
+}
+
+// timeOut - where time and bench report
+var timeOut io.Writer = os.Stdout
+
+// benchTime - how long bench runs a function for, when the number of iterations is not given
+var benchTime = time.Second
+
+// TimeFunction - call the function of no arguments, reporting how long it took and what it allocated
+func TimeFunction(vm *vm, fn *Function) (Value, error) {
+	call := caller(vm, fn, 0, "time")
+	CountAllocations()
+	count, bytes := allocTotals()
+	start := time.Now()
+	result, err := call()
+	dur := time.Since(start)
+	count2, bytes2 := allocTotals()
+	fmt.Fprintf(timeOut, "; elapsed %v, allocated %d values, %d bytes\n", dur, count2-count, bytes2-bytes)
+	return result, err
+}
+
+// BenchFunction - call the function of no arguments repeatedly, reporting the fastest and average times of the
+// calls, and what each allocated. If iterations is 0, it is called for about benchTime.
+func BenchFunction(vm *vm, fn *Function, iterations int) error {
+	call := caller(vm, fn, 0, "bench")
+	CountAllocations()
+	count, bytes := allocTotals()
+	var fastest, total time.Duration
+	n := 0
+	for iterations <= 0 && (n == 0 || total < benchTime) || n < iterations {
+		start := time.Now()
+		if _, err := call(); err != nil {
+			return err
+		}
+		dur := time.Since(start)
+		if n == 0 || dur < fastest {
+			fastest = dur
+		}
+		total += dur
+		n++
+	}
+	count2, bytes2 := allocTotals()
+	fmt.Fprintf(timeOut, "; %d iterations, min %v, avg %v, allocated %d values, %d bytes per iteration\n",
+		n, fastest, total/time.Duration(n), (count2-count)/int64(n), (bytes2-bytes)/int64(n))
+	return nil
+}
+
+func ellTimeFunction(vm *vm, argv []Value) (Value, error) {
+	return TimeFunction(vm, argv[0].(*Function))
+}
+
+func ellBenchFunction(vm *vm, argv []Value) (Value, error) {
+	if err := BenchFunction(vm, argv[0].(*Function), IntValue(argv[1])); err != nil {
+		return nil, err
+	}
+	return Null, nil
+}
@@ -17,7 +17,10 @@ limitations under the License.
 package ell
 
 import (
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	. "github.com/boynton/ell/data"
 )
@@ -103,15 +106,93 @@ func StringCharacters(s *String) []Value {
 	return chars
 }
 
-// StringRef - return the <character> object at the specified string index
-func StringRef(s *String, idx int) Value {
-	//utf8 requires a scan
-	for i, r := range s.Value {
+// StringLength - the number of characters in the string, which is not the number of bytes in its UTF-8 encoding
+func StringLength(s *String) int {
+	return utf8.RuneCountInString(s.Value)
+}
+
+// StringRef - return the <character> object at the specified character index
+func StringRef(s *String, idx int) (Value, error) {
+	if idx >= 0 {
+		i := 0
+		for _, r := range s.Value {
+			if i == idx {
+				return NewCharacter(r), nil
+			}
+			i++
+		}
+	}
+	return nil, NewError(ArgumentErrorKey, "String index out of range")
+}
+
+// byteOffset - the offset of the byte the character at the index starts at, or the length of the string if the
+// index is beyond its end
+func byteOffset(s string, idx int) int {
+	i := 0
+	for offset := range s {
 		if i == idx {
-			return NewCharacter(r)
+			return offset
 		}
+		i++
 	}
-	return Null
+	return len(s)
+}
+
+// Substring - the characters of the string from the start index up to, but not including, the end index. The
+// indices are limited to the string.
+func Substring(s *String, start int, end int) *String {
+	if start < 0 {
+		start = 0
+	}
+	if end <= start {
+		return NewString("")
+	}
+	from := byteOffset(s.Value, start)
+	to := from + byteOffset(s.Value[from:], end-start)
+	return NewString(s.Value[from:to])
+}
+
+// StringIndex - the character index of the first occurrence of the substring in the string, at or after the
+// start index, or -1 if there is none
+func StringIndex(s *String, sub *String, start int) int {
+	if start < 0 {
+		start = 0
+	}
+	from := byteOffset(s.Value, start)
+	i := strings.Index(s.Value[from:], sub.Value)
+	if i < 0 {
+		return -1
+	}
+	return start + utf8.RuneCountInString(s.Value[from:from+i])
+}
+
+// StringReplace - the string with the first count occurrences of old replaced by new, or all of them if the
+// count is negative
+func StringReplace(s *String, old *String, new *String, count int) *String {
+	return NewString(strings.Replace(s.Value, old.Value, new.Value, count))
+}
+
+// StringTrim - the string without leading and trailing characters that are in the cutset, or whitespace if the
+// cutset is null. The left and right flags choose the ends to trim.
+func StringTrim(s *String, cutset Value, left bool, right bool) *String {
+	str := s.Value
+	if cutset == Null {
+		if left {
+			str = strings.TrimLeftFunc(str, unicode.IsSpace)
+		}
+		if right {
+			str = strings.TrimRightFunc(str, unicode.IsSpace)
+		}
+	} else {
+		cut := StringValue(cutset)
+		if left {
+			str = strings.TrimLeft(str, cut)
+		}
+		if right {
+			str = strings.TrimRight(str, cut)
+		}
+	}
+	return NewString(str)
 }
 
 func StringToVector(s *String) *Vector {
@@ -125,11 +206,11 @@ func StringToList(s *String) *List {
 func StringSplit(obj Value, delims Value) (*List, error) {
 	str, ok := obj.(*String)
 	if !ok {
-		return nil, NewError(ArgumentErrorKey, "split expected a <string> for argument 1, got ", obj)
+		return nil, argTypeError("split", StringType.String(), 1, obj)
 	}
 	del, ok := delims.(*String)
 	if !ok {
-		return nil, NewError(ArgumentErrorKey, "split expected a <string> for argument 2, got ", delims)
+		return nil, argTypeError("split", StringType.String(), 2, delims)
 	}
 	lst := EmptyList
 	tail := EmptyList
@@ -148,7 +229,7 @@ func StringSplit(obj Value, delims Value) (*List, error) {
 func StringJoin(seq Value, delims Value) (*String, error) {
 	del, ok := delims.(*String)
 	if !ok {
-		return nil, NewError(ArgumentErrorKey, "join expected a <string> for argument 2, got ", delims)
+		return nil, argTypeError("join", StringType.String(), 2, delims)
 	}
 	switch p := seq.(type) {
 	case *List:
@@ -183,6 +264,147 @@ func StringJoin(seq Value, delims Value) (*String, error) {
 	}
 }
 
+// Format - the format string, with each directive replaced by the formatted value of the next argument. A
+// directive is a ~, optional flags, width, and precision, and a letter:
+//
+//	~a  the value as display and print show it
+//	~s  the value as write shows it
+//	~d  the number as an integer, truncated
+//	~f  the number, with precision digits after the decimal point if a precision is given
+//	~x, ~o, ~b  the number as an integer in hexadecimal, octal, or binary
+//	~%  a newline, with no argument
+//	~~  a tilde, with no argument
+//
+// The width is the minimum number of characters, padded with spaces on the left, or on the right with the - flag,
+// or with zeros on the left for numbers with the 0 flag. i.e. (format "~-6a|~05.1f" 'x 3.14159) => "x     |003.1"
+func Format(format string, args []Value) (string, error) {
+	var buf strings.Builder
+	argi := 0
+	nextArg := func(directive string) (Value, error) {
+		if argi >= len(args) {
+			return nil, NewError(ArgumentErrorKey, "format has no argument for ", directive)
+		}
+		argi++
+		return args[argi-1], nil
+	}
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '~' {
+			buf.WriteByte(c)
+			continue
+		}
+		start := i
+		left, zeros := false, false
+		for i+1 < len(format) && (format[i+1] == '-' || format[i+1] == '0') {
+			i++
+			if format[i] == '-' {
+				left = true
+			} else {
+				zeros = true
+			}
+		}
+		width, precision := 0, -1
+		for i+1 < len(format) && format[i+1] >= '0' && format[i+1] <= '9' {
+			i++
+			width = width*10 + int(format[i]-'0')
+		}
+		if i+1 < len(format) && format[i+1] == '.' {
+			i++
+			precision = 0
+			for i+1 < len(format) && format[i+1] >= '0' && format[i+1] <= '9' {
+				i++
+				precision = precision*10 + int(format[i]-'0')
+			}
+		}
+		if i+1 >= len(format) {
+			return "", NewError(ArgumentErrorKey, "format directive is incomplete: ", format[start:])
+		}
+		i++
+		directive := format[start : i+1]
+		var s string
+		numeric := false
+		switch format[i] {
+		case '%':
+			s = "\n"
+		case '~':
+			s = "~"
+		case 'a', 's':
+			arg, err := nextArg(directive)
+			if err != nil {
+				return "", err
+			}
+			if format[i] == 'a' {
+				s = arg.String()
+			} else {
+				s = Write(arg)
+			}
+			if precision >= 0 && utf8.RuneCountInString(s) > precision {
+				s = string([]rune(s)[:precision])
+			}
+		case 'd', 'f', 'x', 'o', 'b':
+			arg, err := nextArg(directive)
+			if err != nil {
+				return "", err
+			}
+			n, ok := arg.(*Number)
+			if !ok {
+				return "", NewError(ArgumentErrorKey, "format expected a <number> for ", directive, ", got a ", arg.Type())
+			}
+			numeric = true
+			switch format[i] {
+			case 'd':
+				s = formatInteger(n, 10)
+			case 'f':
+				if precision >= 0 {
+					s = strconv.FormatFloat(n.Float64Value(), 'f', precision, 64)
+				} else {
+					s = n.String()
+				}
+			case 'x':
+				s = formatInteger(n, 16)
+			case 'o':
+				s = formatInteger(n, 8)
+			case 'b':
+				s = formatInteger(n, 2)
+			}
+		default:
+			return "", NewError(ArgumentErrorKey, "format directive is not known: ", directive)
+		}
+		buf.WriteString(pad(s, width, left, zeros && numeric))
+	}
+	if argi < len(args) {
+		return "", NewError(ArgumentErrorKey, "format has more arguments than directives: ", len(args))
+	}
+	return buf.String(), nil
+}
+
+// formatInteger - the number, truncated to an integer, in the base
+func formatInteger(n *Number, base int) string {
+	if n.IsExactInteger() {
+		return n.Rat().Num().Text(base)
+	}
+	return strconv.FormatInt(n.Int64Value(), base)
+}
+
+// pad - the string padded to the width in characters, with spaces on the right if left justified, otherwise on
+// the left, with zeros after the sign of a number if zeros is true
+func pad(s string, width int, left bool, zeros bool) string {
+	n := width - utf8.RuneCountInString(s)
+	if n <= 0 {
+		return s
+	}
+	if left {
+		return s + strings.Repeat(" ", n)
+	}
+	if zeros {
+		if strings.HasPrefix(s, "-") {
+			return "-" + strings.Repeat("0", n) + s[1:]
+		}
+		return strings.Repeat("0", n) + s
+	}
+	return strings.Repeat(" ", n) + s
+}
+
 // RuneValue - return native rune value of the object
 func RuneValue(obj Value) rune {
 	if p, ok := obj.(*Character); ok {
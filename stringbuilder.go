@@ -0,0 +1,94 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"strconv"
+	"strings"
+
+	. "github.com/boynton/ell/data"
+)
+
+// StringBuilderType - the type of Ell's string builder, which accumulates a string in place, without copying
+// what it has so far each time something is appended, as concatenating strings does
+var StringBuilderType Value = Intern("<string-builder>")
+
+// StringBuilder - a strings.Builder as an Ell value. It is not safe to append to one from more than one thread.
+type StringBuilder struct {
+	buf strings.Builder
+}
+
+// NewStringBuilder - a new, empty, string builder
+func NewStringBuilder() *StringBuilder {
+	return &StringBuilder{}
+}
+
+func (sb *StringBuilder) Type() Value {
+	return StringBuilderType
+}
+
+func (sb *StringBuilder) String() string {
+	return "#[string-builder " + strconv.Itoa(sb.buf.Len()) + "]"
+}
+
+func (sb1 *StringBuilder) Equals(another Value) bool {
+	if sb2, ok := another.(*StringBuilder); ok {
+		return sb1 == sb2
+	}
+	return false
+}
+
+// Append - append the text of each of the values, as the string function makes it: strings and characters
+// as themselves, the contents of a string builder, and anything else as it is printed by display
+func (sb *StringBuilder) Append(vals ...Value) *StringBuilder {
+	for _, val := range vals {
+		appendText(&sb.buf, val)
+	}
+	return sb
+}
+
+// ToString - the string accumulated so far. The builder can go on being appended to.
+func (sb *StringBuilder) ToString() *String {
+	return NewString(sb.buf.String())
+}
+
+func appendText(buf *strings.Builder, val Value) {
+	if sb, ok := val.(*StringBuilder); ok {
+		buf.WriteString(sb.buf.String())
+	} else {
+		buf.WriteString(val.String())
+	}
+}
+
+func ellStringBuilder(argv []Value) (Value, error) {
+	return NewStringBuilder().Append(argv...), nil
+}
+
+func ellStringBuilderP(argv []Value) (Value, error) {
+	if _, ok := argv[0].(*StringBuilder); ok {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellAppendBang(argv []Value) (Value, error) {
+	return argv[0].(*StringBuilder).Append(argv[1:]...), nil
+}
+
+func ellStringBuilderToString(argv []Value) (Value, error) {
+	return argv[0].(*StringBuilder).ToString(), nil
+}
@@ -17,46 +17,198 @@ limitations under the License.
 package ell
 
 import (
-	"bytes"
-
 	. "github.com/boynton/ell/data"
 )
 
 // StructLength - return the length (field count) of the <struct> object
 func StructLength(strct *Struct) int {
-	return len(strct.Bindings)
+	return strct.Length()
 }
 
-// Get - return the value for the key of the object. The Value() function is first called to
-// handle typed instances of <struct>.
-// This is called by the VM, when a keyword is used as a function.
+// Get - return the value for the key of the object: the field of a struct, or of a typed instance of one, the value
+// in a hashmap, the element at the index of a vector, or the character at the index of a string. For an object
+// wrapping a Go struct, the key names a field, and for one wrapping a Go map or slice, it is a key or an index.
+// A missing key is null, but an index out of range is an error. This is called by the VM, when a keyword is used
+// as a function.
 func Get(obj Value, key Value) (Value, error) {
 	if pi, ok := obj.(*Instance); ok {
 		obj = pi.Value
 	}
-	if p, ok := obj.(*Struct); ok {
+	switch p := obj.(type) {
+	case *Struct:
 		return p.Get(key), nil
+	case *HashMap:
+		return p.Get(key), nil
+	case *Vector:
+		i, err := elementIndex(key, len(p.Elements), "get")
+		if err != nil {
+			return nil, err
+		}
+		return p.Elements[i], nil
+	case *String:
+		i, err := elementIndex(key, StringLength(p), "get")
+		if err != nil {
+			return nil, err
+		}
+		return StringRef(p, i)
+	case *Object:
+		return ObjectField(p, key)
 	}
-	return nil, NewError(ArgumentErrorKey, "Expected a <struct> argument, got a ", obj.Type())
+	return nil, accessorTypeError("get", obj)
 }
 
+// Has - true if the object has a value for the key that is not null, or for a vector or string, if the key is an
+// index of it, or for a set, if the key is a member of it
 func Has(obj Value, key Value) (bool, error) {
+	if pi, ok := obj.(*Instance); ok {
+		obj = pi.Value
+	}
+	switch p := obj.(type) {
+	case *Vector:
+		_, err := elementIndex(key, len(p.Elements), "has?")
+		return err == nil, nil
+	case *String:
+		_, err := elementIndex(key, StringLength(p), "has?")
+		return err == nil, nil
+	case *Set:
+		return p.Contains(key), nil
+	}
 	tmp, err := Get(obj, key)
-	if err != nil || tmp == Null {
+	if err != nil {
+		if _, ok := obj.(*Object); ok {
+			return false, nil //a Go struct without the field
+		}
 		return false, err
 	}
-	return true, nil
+	return tmp != Null, nil
 }
 
-func Put(obj Value, key Value, val Value) error {
+// Length - the number of elements, characters, fields, entries, or members of the object
+func Length(obj Value) (int, error) {
+	if pi, ok := obj.(*Instance); ok {
+		obj = pi.Value
+	}
+	switch p := obj.(type) {
+	case *List:
+		return ListLength(p), nil
+	case *Vector:
+		return len(p.Elements), nil
+	case *String:
+		return StringLength(p), nil
+	case *Struct:
+		return p.Length(), nil
+	case *HashMap:
+		return p.Length(), nil
+	case *Set:
+		return p.Length(), nil
+	case *Blob:
+		return len(p.Value), nil
+	case *Object:
+		return ObjectLength(p)
+	}
+	return 0, accessorTypeError("length", obj)
+}
+
+// elementIndex - the key as an index of a sequence of the length, for the named function
+func elementIndex(key Value, length int, name string) (int, error) {
+	n, ok := key.(*Number)
+	if !ok || !n.IsExactInteger() {
+		return 0, NewError(ArgumentErrorKey, name, " expected an integer index, got ", key)
+	}
+	if i := n.Int64Value(); i >= 0 && i < int64(length) {
+		return int(i), nil
+	}
+	return 0, NewError(ArgumentErrorKey, name, " index out of range: ", key)
+}
+
+func accessorTypeError(name string, obj Value) error {
+	return NewError(ArgumentErrorKey, name, " expected a <struct>, <hashmap>, <vector>, <string>, or Go object, got a ", obj.Type())
+}
+
+// structArg - the object as a struct, if it is one or is an instance of one
+func structArg(obj Value) (*Struct, error) {
 	if pi, ok := obj.(*Instance); ok {
 		obj = pi.Value
 	}
 	if p, ok := obj.(*Struct); ok {
+		return p, nil
+	}
+	return nil, NewError(ArgumentErrorKey, "Expected a <struct> argument, got a ", obj.Type())
+}
+
+// HasKey - return true if the struct has a field with the key, even if its value is null
+func HasKey(obj Value, key Value) (bool, error) {
+	strct, err := structArg(obj)
+	if err != nil {
+		return false, err
+	}
+	return strct.Has(key), nil
+}
+
+// Assoc - return a copy of the struct with the values for the keys, which alternate with them in the slice.
+// The struct is not changed, and the copy shares its keys and values. A copy of an instance of a struct is an
+// instance of the same type.
+func Assoc(obj Value, kv []Value) (Value, error) {
+	strct, err := structArg(obj)
+	if err != nil {
+		return nil, err
+	}
+	if len(kv)%2 != 0 {
+		return nil, NewError(ArgumentErrorKey, "Mismatched key/value in arguments: ", kv[len(kv)-1])
+	}
+	cp := strct.Copy()
+	for i := 0; i < len(kv); i += 2 {
+		cp.Put(kv[i], kv[i+1])
+	}
+	return sameKind(obj, cp)
+}
+
+// Dissoc - return a copy of the struct without the field with the key. The struct is not changed.
+func Dissoc(obj Value, key Value) (Value, error) {
+	strct, err := structArg(obj)
+	if err != nil {
+		return nil, err
+	}
+	return sameKind(obj, strct.Dissoc(key))
+}
+
+// sameKind - the struct, as an instance of the same type as obj if obj is an instance
+func sameKind(obj Value, strct *Struct) (Value, error) {
+	if pi, ok := obj.(*Instance); ok {
+		return NewInstance(pi.TypeTag, strct)
+	}
+	return strct, nil
+}
+
+// Put - set the value for the key of the object, as Get would get it. Strings cannot be changed.
+func Put(obj Value, key Value, val Value) error {
+	if pi, ok := obj.(*Instance); ok {
+		obj = pi.Value
+	}
+	switch p := obj.(type) {
+	case *Struct:
+		if err := checkMutable(p, "put!"); err != nil {
+			return err
+		}
 		p.Put(key, val)
 		return nil
+	case *HashMap:
+		p.Put(key, val)
+		return nil
+	case *Vector:
+		if err := checkMutable(p, "put!"); err != nil {
+			return err
+		}
+		i, err := elementIndex(key, len(p.Elements), "put!")
+		if err != nil {
+			return err
+		}
+		p.Elements[i] = val
+		return nil
+	case *Object:
+		return SetObjectField(p, key, val)
 	}
-	return NewError(ArgumentErrorKey, "Expected a <struct> argument, got a ", obj.Type())
+	return NewError(ArgumentErrorKey, "put! expected a <struct>, <hashmap>, <vector>, or Go object, got a ", obj.Type())
 }
 
 func Unput(obj Value, key Value) error {
@@ -64,6 +216,9 @@ func Unput(obj Value, key Value) error {
 		obj = pi.Value
 	}
 	if p, ok := obj.(*Struct); ok {
+		if err := checkMutable(p, "unput!"); err != nil {
+			return err
+		}
 		p.Unput(key)
 		return nil
 	}
@@ -124,10 +279,9 @@ func validateKeywordArgBindings(args *List, keys []Value) ([]Value, error) {
 			}
 			bindings = slicePut(bindings, key, Car(args))
 		case *Struct:
-			for k, v := range p.Bindings {
-				sym := Intern(k.Value)
-				if sliceContains(keys, sym) {
-					bindings = slicePut(bindings, sym, v)
+			for _, e := range p.Entries() {
+				if sliceContains(keys, e.Key) {
+					bindings = slicePut(bindings, e.Key, e.Value)
 				}
 			}
 		default:
@@ -140,47 +294,14 @@ func validateKeywordArgBindings(args *List, keys []Value) ([]Value, error) {
 
 // Equal returns true if the object is equal to the argument
 func StructEqual(s1 *Struct, s2 *Struct) bool {
-	bindings1 := s1.Bindings
-	size := len(bindings1)
-	bindings2 := s2.Bindings
-	if size == len(bindings2) {
-		for k, v := range bindings1 {
-			v2, ok := bindings2[k]
-			if !ok {
-				return false
-			}
-			if !Equal(v, v2) {
-				return false
-			}
-		}
-		return true
-	}
-	return false
-}
-
-func structToString(s *Struct) string {
-	var buf bytes.Buffer
-	buf.WriteString("{")
-	first := true
-	for k, v := range s.Bindings {
-		if first {
-			first = false
-		} else {
-			buf.WriteString(" ")
-		}
-		buf.WriteString(k.Value)
-		buf.WriteString(" ")
-		buf.WriteString(v.String())
-	}
-	buf.WriteString("}")
-	return buf.String()
+	return s1.Equals(s2)
 }
 
 func StructToList(s *Struct) (*List, error) {
 	result := EmptyList
 	tail := EmptyList
-	for k, v := range s.Bindings {
-		tmp := NewList(k.ToValue(), v)
+	for _, e := range s.Entries() {
+		tmp := NewList(e.Key, e.Value)
 		if result == EmptyList {
 			result = NewList(tmp)
 			tail = result
@@ -193,12 +314,10 @@ func StructToList(s *Struct) (*List, error) {
 }
 
 func StructToVector(s *Struct) *Vector {
-	size := len(s.Bindings)
+	size := s.Length()
 	el := make([]Value, size)
-	j := 0
-	for k, v := range s.Bindings {
-		el[j] = NewVector(k.ToValue(), v)
-		j++
+	for j, e := range s.Entries() {
+		el[j] = NewVector(e.Key, e.Value)
 	}
 	return VectorFromElements(el, size)
 }
@@ -220,8 +339,8 @@ func StructValues(s Value) Value {
 func structKeyList(s *Struct) *List {
 	result := EmptyList
 	tail := EmptyList
-	for k := range s.Bindings {
-		key := k.ToValue()
+	for _, e := range s.Entries() {
+		key := e.Key
 		if result == EmptyList {
 			result = NewList(key)
 			tail = result
@@ -236,7 +355,8 @@ func structKeyList(s *Struct) *List {
 func structValueList(s *Struct) *List {
 	result := EmptyList
 	tail := EmptyList
-	for _, v := range s.Bindings {
+	for _, e := range s.Entries() {
+		v := e.Value
 		if result == EmptyList {
 			result = NewList(v)
 			tail = result
@@ -259,9 +379,6 @@ func listToStruct(lst *List) (Value, error) {
 			if EmptyList == p || EmptyList == p.Cdr || EmptyList != p.Cdr.Cdr {
 				return nil, NewError(ArgumentErrorKey, "Bad struct binding: ", k)
 			}
-			if !IsValidStructKey(p.Car) {
-				return nil, NewError(ArgumentErrorKey, "Bad struct key: ", p.Car)
-			}
 			strct.Put(p.Car, p.Cdr.Car)
 		case *Vector:
 			elements := p.Elements
@@ -269,14 +386,8 @@ func listToStruct(lst *List) (Value, error) {
 			if n != 2 {
 				return nil, NewError(ArgumentErrorKey, "Bad struct binding: ", k)
 			}
-			if !IsValidStructKey(elements[0]) {
-				return nil, NewError(ArgumentErrorKey, "Bad struct key: ", elements[0])
-			}
 			strct.Put(elements[0], elements[1])
 		default:
-			if !IsValidStructKey(k) {
-				return nil, NewError(ArgumentErrorKey, "Bad struct key: ", k)
-			}
 			if lst == EmptyList {
 				return nil, NewError(ArgumentErrorKey, "Mismatched keyword/value in list: ", k)
 			}
@@ -299,9 +410,6 @@ func vectorToStruct(vec *Vector) (Value, error) {
 			if EmptyList == p || EmptyList == p.Cdr || EmptyList != p.Cdr.Cdr {
 				return nil, NewError(ArgumentErrorKey, "Bad struct binding: ", k)
 			}
-			if !IsValidStructKey(p.Car) {
-				return nil, NewError(ArgumentErrorKey, "Bad struct key: ", p.Car)
-			}
 			strct.Put(p.Car, p.Cdr.Car)
 		case *Vector:
 			elements := p.Elements
@@ -309,15 +417,8 @@ func vectorToStruct(vec *Vector) (Value, error) {
 			if n != 2 {
 				return nil, NewError(ArgumentErrorKey, "Bad struct binding: ", k)
 			}
-			if !IsValidStructKey(elements[0]) {
-				return nil, NewError(ArgumentErrorKey, "Bad struct key: ", elements[0])
-			}
 			strct.Put(elements[0], elements[1])
-		case *String, *Symbol, *Keyword, *Type:
 		default:
-			if !IsValidStructKey(k) {
-				return nil, NewError(ArgumentErrorKey, "Bad struct key: ", k)
-			}
 			if i == count {
 				return nil, NewError(ArgumentErrorKey, "Mismatched keyword/value in vector: ", k)
 			}
@@ -337,6 +438,8 @@ func ToStruct(obj Value) (Value, error) {
 		return listToStruct(p)
 	case *Vector:
 		return vectorToStruct(p)
+	case *HashMap:
+		return p.ToStruct(), nil
 	}
 	return nil, NewError(ArgumentErrorKey, "to-struct cannot accept argument of type ", obj.Type())
 }
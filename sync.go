@@ -0,0 +1,220 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"sync"
+
+	. "github.com/boynton/ell/data"
+)
+
+// Mutexes and atoms let threads made with spawn share state safely. A mutex is held by one thread at a time, and
+// an atom holds a value that is replaced as a whole, so each thread sees either the old value or the new one.
+
+// MutexType - the type of the mutexes that mutex makes
+var MutexType Value = Intern("<mutex>")
+
+// Mutex - a lock that is held by one thread at a time. It is a channel with room for one token, so that unlocking
+// a mutex that is not locked is an error rather than a crash.
+type Mutex struct {
+	token chan bool
+}
+
+func (m *Mutex) Type() Value {
+	return MutexType
+}
+
+func (m *Mutex) String() string {
+	if len(m.token) > 0 {
+		return "#[mutex locked]"
+	}
+	return "#[mutex]"
+}
+
+func (m1 *Mutex) Equals(another Value) bool {
+	if m2, ok := another.(*Mutex); ok {
+		return m1 == m2
+	}
+	return false
+}
+
+// NewMutex - a mutex that is not locked
+func NewMutex() *Mutex {
+	return &Mutex{token: make(chan bool, 1)}
+}
+
+// Lock - wait until the mutex is not locked, then lock it
+func (m *Mutex) Lock() {
+	m.token <- true
+}
+
+// Unlock - unlock the mutex, which any thread can do. It is an error if it is not locked.
+func (m *Mutex) Unlock() error {
+	select {
+	case <-m.token:
+		return nil
+	default:
+		return NewError(ErrorKey, "unlock: the mutex is not locked")
+	}
+}
+
+// AtomType - the type of the atoms that atom makes
+var AtomType Value = Intern("<atom>")
+
+// Atom - a box holding a value, which threads can replace atomically
+type Atom struct {
+	mutex sync.Mutex
+	value Value
+}
+
+func (a *Atom) Type() Value {
+	return AtomType
+}
+
+func (a *Atom) String() string {
+	return "#[atom " + Write(a.Deref()) + "]"
+}
+
+func (a1 *Atom) Equals(another Value) bool {
+	if a2, ok := another.(*Atom); ok {
+		return a1 == a2
+	}
+	return false
+}
+
+// NewAtom - an atom holding the value
+func NewAtom(val Value) *Atom {
+	return &Atom{value: val}
+}
+
+// Deref - the value the atom holds
+func (a *Atom) Deref() Value {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.value
+}
+
+// Reset - replace the value the atom holds
+func (a *Atom) Reset(val Value) {
+	a.mutex.Lock()
+	a.value = val
+	a.mutex.Unlock()
+}
+
+// CompareAndSet - replace the value the atom holds with the new one, if it is the old one. Like Swap, it compares
+// by identity, not equality, so the old value should be the one read from the atom. The result is true if it was
+// replaced.
+func (a *Atom) CompareAndSet(old Value, val Value) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !Identical(a.value, old) {
+		return false
+	}
+	a.value = val
+	return true
+}
+
+// Swap - replace the value the atom holds with the result of calling the function with it, followed by the
+// arguments. If another thread replaces the value while the function is called, it is called again with the new
+// one, so it should have no side effects. The result is the new value.
+func (a *Atom) Swap(vm *vm, fn *Function, args []Value) (Value, error) {
+	call := caller(vm, fn, len(args)+1, "swap!")
+	callArgs := append([]Value{nil}, args...)
+	for {
+		a.mutex.Lock()
+		old := a.value
+		a.mutex.Unlock()
+		callArgs[0] = old
+		val, err := call(callArgs...)
+		if err != nil {
+			return nil, err
+		}
+		a.mutex.Lock()
+		if Identical(a.value, old) {
+			a.value = val
+			a.mutex.Unlock()
+			return val, nil
+		}
+		a.mutex.Unlock()
+	}
+}
+
+func ellMutex(argv []Value) (Value, error) {
+	return NewMutex(), nil
+}
+
+func ellMutexP(argv []Value) (Value, error) {
+	if _, ok := argv[0].(*Mutex); ok {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellLock(argv []Value) (Value, error) {
+	argv[0].(*Mutex).Lock()
+	return Null, nil
+}
+
+func ellUnlock(argv []Value) (Value, error) {
+	return Null, argv[0].(*Mutex).Unlock()
+}
+
+func ellAtom(argv []Value) (Value, error) {
+	return NewAtom(argv[0]), nil
+}
+
+func ellAtomP(argv []Value) (Value, error) {
+	if _, ok := argv[0].(*Atom); ok {
+		return True, nil
+	}
+	return False, nil
+}
+
+// ellDeref - the value of an atom, or of a promise or future, waiting for it up to the timeout, in seconds, if
+// one is given. If it is not delivered in time, the result is the default.
+func ellDeref(vm *vm, argv []Value) (Value, error) {
+	switch p := argv[0].(type) {
+	case *Atom:
+		return p.Deref(), nil
+	case *Promise:
+		val, ok, err := p.Await(vm, Float64Value(argv[1]))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return argv[2], nil
+		}
+		return val, nil
+	}
+	return nil, argTypeError("deref", "<atom> or <promise>", 1, argv[0])
+}
+
+func ellResetBang(argv []Value) (Value, error) {
+	argv[0].(*Atom).Reset(argv[1])
+	return argv[1], nil
+}
+
+func ellCompareAndSetBang(argv []Value) (Value, error) {
+	if argv[0].(*Atom).CompareAndSet(argv[1], argv[2]) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellSwapBang(vm *vm, argv []Value) (Value, error) {
+	return argv[0].(*Atom).Swap(vm, argv[1].(*Function), argv[2:])
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	. "github.com/boynton/ell/data"
+)
+
+// A traced function is replaced, as the value of its global, by a primitive that logs each call and its result,
+// indented by the depth of the traced calls in progress, and calls the original function in a VM of its own.
+// Calls compiled inline, as calls to car and the other primops are, are not traced.
+
+type tracedFunction struct {
+	original *Function
+	tracer   *Function
+}
+
+var traced = map[*Symbol]*tracedFunction{}
+var traceMutex sync.Mutex
+var traceDepth int
+
+// traceOut - where the calls of traced functions are logged
+var traceOut io.Writer = os.Stdout
+
+// globalFunctionSymbol - the global the function is the value of, which may be given as the function itself or
+// as its symbol
+func globalFunctionSymbol(arg Value, name string) (*Symbol, error) {
+	var sym *Symbol
+	switch p := arg.(type) {
+	case *Symbol:
+		sym = p
+	case *Function:
+		if s, ok := Intern(functionName(p)).(*Symbol); ok && GetGlobal(s) == p {
+			sym = s
+		}
+	}
+	if sym == nil {
+		return nil, NewError(ArgumentErrorKey, name, " expected a global function or its <symbol>, got ", arg)
+	}
+	return sym, nil
+}
+
+// Trace - log the calls of the function that is the value of the global
+func Trace(sym *Symbol) error {
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	if t, ok := traced[sym]; ok && GetGlobal(sym) == t.tracer {
+		return nil
+	}
+	fn, ok := GetGlobal(sym).(*Function)
+	if !ok {
+		return NewError(ArgumentErrorKey, "trace expected a global function, but ", sym, " is not one")
+	}
+	t := &tracedFunction{original: fn, tracer: tracer(sym.Text, fn)}
+	traced[sym] = t
+	defGlobal(sym, t.tracer)
+	return nil
+}
+
+// Untrace - stop logging the calls of the function that is the value of the global. If the global has been
+// redefined since it was traced, it keeps its new value.
+func Untrace(sym *Symbol) {
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	if t, ok := traced[sym]; ok {
+		if GetGlobal(sym) == t.tracer {
+			defGlobal(sym, t.original)
+		}
+		delete(traced, sym)
+	}
+}
+
+// Traced - the globals whose functions are traced, sorted by name
+func Traced() []*Symbol {
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	syms := make([]*Symbol, 0, len(traced))
+	for sym := range traced {
+		syms = append(syms, sym)
+	}
+	sort.Slice(syms, func(i, j int) bool { return syms[i].Text < syms[j].Text })
+	return syms
+}
+
+func traceLine(depth int, s string) {
+	fmt.Fprintln(traceOut, colored(currentColors().trace, strings.Repeat("  ", depth)+s))
+}
+
+// tracer - a primitive that logs the call of the function, then calls it and logs its result
+func tracer(name string, fn *Function) *Function {
+	var mutex sync.Mutex
+	callers := map[int]*Code{}
+	return NewPrimitive(name, func(argv []Value) (Value, error) {
+		mutex.Lock()
+		code, ok := callers[len(argv)]
+		if !ok {
+			code = trampoline(fn, len(argv), name)
+			callers[len(argv)] = code
+		}
+		mutex.Unlock()
+		depth := traceDepth
+		traceLine(depth, Write(Cons(Intern(name), ListFromValues(argv))))
+		traceDepth++
+		result, err := exec(code, argv)
+		traceDepth = depth
+		if err != nil {
+			traceLine(depth, name+" raised "+err.Error())
+			return nil, err
+		}
+		traceLine(depth, name+" => "+Write(result))
+		return result, nil
+	}, AnyType, []Value{}, AnyType, []Value{}, nil)
+}
+
+// (trace name ...) traces the functions, (trace) returns the names of the traced ones
+func ellTrace(argv []Value) (Value, error) {
+	if len(argv) == 0 {
+		var names []Value
+		for _, sym := range Traced() {
+			names = append(names, sym)
+		}
+		return ListFromValues(names), nil
+	}
+	for _, arg := range argv {
+		sym, err := globalFunctionSymbol(arg, "trace")
+		if err != nil {
+			return nil, err
+		}
+		if err := Trace(sym); err != nil {
+			return nil, err
+		}
+	}
+	return Null, nil
+}
+
+// (untrace name ...) stops tracing the functions, (untrace) stops tracing all of them
+func ellUntrace(argv []Value) (Value, error) {
+	if len(argv) == 0 {
+		for _, sym := range Traced() {
+			Untrace(sym)
+		}
+		return Null, nil
+	}
+	for _, arg := range argv {
+		if fn, ok := arg.(*Function); ok && fn.primitive != nil {
+			arg = Intern(fn.primitive.name)
+		}
+		sym, err := globalFunctionSymbol(arg, "untrace")
+		if err != nil {
+			return nil, err
+		}
+		Untrace(sym)
+	}
+	return Null, nil
+}
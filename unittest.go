@@ -0,0 +1,257 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	. "github.com/boynton/ell/data"
+)
+
+// Tests are defined with deftest, which names a function of no arguments that fails by raising an error, usually
+// with one of the assertions. run-tests calls them all, in the order they were defined, and reports the failures.
+
+// AssertionErrorKey - the kind of error raised when an assertion fails. The error's data is the message, followed
+// by the expected and actual values, if there are any.
+var AssertionErrorKey = Intern("assertion-error:")
+
+type unitTest struct {
+	name *Symbol
+	fn   *Function
+}
+
+var testMutex sync.Mutex
+var unitTests []*unitTest
+
+// testOut - where the results of tests are reported
+var testOut io.Writer = os.Stdout
+
+// DefineTest - define the test with the name, replacing any test of that name
+func DefineTest(name *Symbol, fn *Function) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	for _, t := range unitTests {
+		if t.name == name {
+			t.fn = fn
+			return
+		}
+	}
+	unitTests = append(unitTests, &unitTest{name: name, fn: fn})
+}
+
+// ClearTests - forget all the tests defined so far
+func ClearTests() {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+	unitTests = nil
+}
+
+// RunTests - run the tests whose names contain the pattern, all of them if it is empty, reporting each failure
+// and a summary of the results. An interrupt stops the run, and is returned.
+func RunTests(vm *vm, pattern string) (int, int, error) {
+	testMutex.Lock()
+	tests := append([]*unitTest(nil), unitTests...)
+	testMutex.Unlock()
+	passed, failed := 0, 0
+	for _, t := range tests {
+		if !strings.Contains(t.name.Text, pattern) {
+			continue
+		}
+		_, err := caller(vm, t.fn, 0, t.name.Text)()
+		if err == nil {
+			passed++
+			continue
+		}
+		if errorKind(err) == InterruptKey {
+			return passed, failed, err
+		}
+		failed++
+		reportFailure(t.name.Text, err)
+	}
+	fmt.Fprintf(testOut, "%d passed, %d failed\n", passed, failed)
+	return passed, failed, nil
+}
+
+// RunTestFiles - load the test files, and the files named *_test.ell in the directories, then run the tests they
+// define. A file that fails to load counts as a failed test.
+func RunTestFiles(paths ...string) (int, int, error) {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	var files []string
+	for _, path := range paths {
+		path = ExpandFilePath(path)
+		if !IsDirectoryReadable(path) {
+			files = append(files, path)
+			continue
+		}
+		AddEllDirectory(path)
+		matches, err := filepath.Glob(filepath.Join(path, "*_test.ell"))
+		if err != nil {
+			return 0, 0, ioError(err)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	loadFailures := 0
+	for _, file := range files {
+		if err := LoadFile(file); err != nil {
+			if errorKind(err) == InterruptKey {
+				return 0, loadFailures, err
+			}
+			loadFailures++
+			reportFailure(file, err)
+		}
+	}
+	passed, failed, err := RunTests(VM(defaultStackSize), "")
+	return passed, failed + loadFailures, err
+}
+
+func errorKind(err error) Value {
+	if e, ok := err.(*Error); ok {
+		return e.Kind()
+	}
+	return ErrorKey
+}
+
+func reportFailure(name string, err error) {
+	fmt.Fprintf(testOut, "--- FAIL: %s\n", name)
+	e, ok := err.(*Error)
+	if !ok {
+		fmt.Fprintf(testOut, "    %v\n", err)
+		return
+	}
+	data, _ := e.Data.(*Vector)
+	if e.Kind() != AssertionErrorKey || data == nil || len(data.Elements) < 2 {
+		fmt.Fprintf(testOut, "    %s%s\n", err.Error(), formatStackTrace(err))
+		return
+	}
+	fmt.Fprintf(testOut, "    %s\n", data.Elements[1])
+	if len(data.Elements) == 4 {
+		expected, actual := data.Elements[2], data.Elements[3]
+		fmt.Fprintf(testOut, "    expected: %s\n      actual: %s\n", Write(expected), Write(actual))
+		if path, e, a := valueDiff("", expected, actual); path != "" {
+			fmt.Fprintf(testOut, "    first difference at %s, expected %s, got %s\n", path, Write(e), Write(a))
+		}
+	}
+}
+
+// valueDiff - the path to the first difference between the values, within lists, vectors, and structs, and the
+// values that differ there. The path is empty if the values themselves differ.
+func valueDiff(path string, expected Value, actual Value) (string, Value, Value) {
+	switch e := expected.(type) {
+	case *List:
+		if a, ok := actual.(*List); ok {
+			return elementsDiff(path, listElements(e), listElements(a), expected, actual)
+		}
+	case *Vector:
+		if a, ok := actual.(*Vector); ok {
+			return elementsDiff(path, e.Elements, a.Elements, expected, actual)
+		}
+	case *Struct:
+		if a, ok := actual.(*Struct); ok {
+			for _, entry := range e.Entries() {
+				if !a.Has(entry.Key) {
+					return path + "." + entry.Key.String(), entry.Value, Null
+				}
+				if v := a.Get(entry.Key); !Equal(entry.Value, v) {
+					return valueDiff(path+"."+entry.Key.String(), entry.Value, v)
+				}
+			}
+			for _, entry := range a.Entries() {
+				if !e.Has(entry.Key) {
+					return path + "." + entry.Key.String(), Null, entry.Value
+				}
+			}
+		}
+	}
+	return path, expected, actual
+}
+
+func elementsDiff(path string, expected []Value, actual []Value, e Value, a Value) (string, Value, Value) {
+	for i := 0; i < len(expected) && i < len(actual); i++ {
+		if !Equal(expected[i], actual[i]) {
+			return valueDiff(fmt.Sprintf("%s[%d]", path, i), expected[i], actual[i])
+		}
+	}
+	return path, e, a
+}
+
+func listElements(lst *List) []Value {
+	var elements []Value
+	for ; lst != EmptyList; lst = lst.Cdr {
+		elements = append(elements, lst.Car)
+	}
+	return elements
+}
+
+func assertionError(msg string, values ...Value) error {
+	return MakeError(append([]Value{AssertionErrorKey, NewString(msg)}, values...)...)
+}
+
+func ellDefineTest(argv []Value) (Value, error) {
+	DefineTest(argv[0].(*Symbol), argv[1].(*Function))
+	return argv[0], nil
+}
+
+// (assert-equal expected actual msg ...) - the message is the rest of the arguments, joined as string joins them
+func ellAssertEqual(argv []Value) (Value, error) {
+	if !Equal(argv[0], argv[1]) {
+		msg := "values are not equal"
+		if len(argv) > 2 {
+			var buf strings.Builder
+			for _, part := range argv[2:] {
+				appendText(&buf, part)
+			}
+			msg = buf.String()
+		}
+		return nil, assertionError(msg, argv[0], argv[1])
+	}
+	return True, nil
+}
+
+func ellAssertErrorFunction(vm *vm, argv []Value) (Value, error) {
+	_, err := caller(vm, argv[0].(*Function), 0, "assert-error")()
+	if err == nil {
+		return nil, assertionError("expected an error")
+	}
+	kind := errorKind(err)
+	if kind == InterruptKey || kind == LimitErrorKey {
+		return nil, err
+	}
+	if argv[1] != Null && kind != argv[1] {
+		return nil, assertionError("expected a different kind of error", argv[1], kind)
+	}
+	return True, nil
+}
+
+func ellRunTests(vm *vm, argv []Value) (Value, error) {
+	_, failed, err := RunTests(vm, StringValue(argv[0]))
+	if err != nil {
+		return nil, err
+	}
+	if failed > 0 {
+		return False, nil
+	}
+	return True, nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"encoding/binary"
+
+	. "github.com/boynton/ell/data"
+	"github.com/pborman/uuid"
+)
+
+var UUIDType Value = Intern("<uuid>")
+
+var uuidTag = Intern("uuid").(*Symbol)
+
+// UUID - a universally unique identifier. It is written as a tagged literal of its canonical text, i.e.
+// #uuid "f47ac10b-58cc-4372-a567-0e02b2c3d479".
+type UUID struct {
+	value uuid.Array
+}
+
+func (u *UUID) Type() Value {
+	return UUIDType
+}
+
+func (u *UUID) String() string {
+	return "#" + uuidTag.Text + " \"" + u.value.String() + "\""
+}
+
+// Equals - UUIDs are equal if they have the same bits
+func (u *UUID) Equals(another Value) bool {
+	if u2, ok := another.(*UUID); ok {
+		return u.value == u2.value
+	}
+	return false
+}
+
+func (u *UUID) Hash() uint64 {
+	return binary.BigEndian.Uint64(u.value[:8]) ^ binary.BigEndian.Uint64(u.value[8:])
+}
+
+// Text - the canonical text of the UUID, i.e. "f47ac10b-58cc-4372-a567-0e02b2c3d479"
+func (u *UUID) Text() string {
+	return u.value.String()
+}
+
+// NewRandomUUID - a new random (version 4) UUID
+func NewRandomUUID() *UUID {
+	return &UUID{value: uuid.NewRandom().Array()}
+}
+
+// NewNameUUID - the name based (version 3) UUID for the name in the namespace
+func NewNameUUID(namespace *UUID, name string) *UUID {
+	return &UUID{value: uuid.NewMD5(namespace.value.UUID(), []byte(name)).Array()}
+}
+
+// ParseUUID - the UUID whose text is the string, in the canonical form or as a urn:uuid: URN
+func ParseUUID(s string) (*UUID, error) {
+	u := uuid.Parse(s)
+	if u == nil {
+		return nil, NewError(ArgumentErrorKey, "Bad UUID: ", NewString(s))
+	}
+	return &UUID{value: u.Array()}, nil
+}
+
+var urlNamespaceUUID = &UUID{value: uuid.NameSpace_URL.Array()}
+
+// defineUUIDTag - read #uuid tagged literals as UUIDs, and write UUIDs as them
+func defineUUIDTag() {
+	DefineTagConstructor(uuidTag, func(val Value) (Value, error) {
+		if s, ok := val.(*String); ok {
+			if u := uuid.Parse(s.Value); u != nil {
+				return &UUID{value: u.Array()}, nil
+			}
+			return nil, NewError(SyntaxErrorKey, "Bad UUID literal: #uuid ", s)
+		}
+		return nil, NewError(SyntaxErrorKey, "#uuid expected a <string>, got a ", val.Type())
+	})
+	DefineTagWriter(UUIDType, uuidTag, func(val Value) (Value, error) {
+		return NewString(val.(*UUID).Text()), nil
+	})
+}
+
+// ellUUID - a new random UUID, or with arguments, the name based UUID for the name, in the namespace if it is
+// given. The namespace is a UUID, or the text of one, or else a name whose UUID is the namespace.
+func ellUUID(argv []Value) (Value, error) {
+	switch len(argv) {
+	case 0:
+		return NewRandomUUID(), nil
+	case 1:
+		name, ok := argv[0].(*String)
+		if !ok {
+			return nil, argTypeError("uuid", StringType.String(), 1, argv[0])
+		}
+		return NewNameUUID(urlNamespaceUUID, name.Value), nil
+	case 2:
+		var ns *UUID
+		switch p := argv[0].(type) {
+		case *UUID:
+			ns = p
+		case *String:
+			if u := uuid.Parse(p.Value); u != nil {
+				ns = &UUID{value: u.Array()}
+			} else {
+				ns = NewNameUUID(urlNamespaceUUID, p.Value)
+			}
+		default:
+			return nil, argTypeError("uuid", "<uuid> or <string>", 1, argv[0])
+		}
+		name, ok := argv[1].(*String)
+		if !ok {
+			return nil, argTypeError("uuid", StringType.String(), 2, argv[1])
+		}
+		return NewNameUUID(ns, name.Value), nil
+	}
+	return nil, argcError("uuid", 0, 2, len(argv))
+}
+
+func ellUUIDP(argv []Value) (Value, error) {
+	if _, ok := argv[0].(*UUID); ok {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellStringToUUID(argv []Value) (Value, error) {
+	return ParseUUID(StringValue(argv[0]))
+}
+
+func ellUUIDToString(argv []Value) (Value, error) {
+	return NewString(argv[0].(*UUID).Text()), nil
+}
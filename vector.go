@@ -31,8 +31,91 @@ func ToVector(obj Value) (*Vector, error) {
 		return StructToVector(p), nil
 	case *String:
 		return StringToVector(p), nil
+	case *Set:
+		return NewVector(p.Members()...), nil
 	}
-	return nil, NewError(ArgumentErrorKey, "to-vector expected <vector>, <list>, <struct>, or <string>, got a ", obj.Type())
+	return nil, NewError(ArgumentErrorKey, "to-vector expected <vector>, <list>, <struct>, <set>, or <string>, got a ", obj.Type())
+}
+
+// VectorAssoc - return a copy of the vector with the value at the index, which may be the length of the vector,
+// to add the value to its end. The vector is not changed, and the copy shares its elements.
+func VectorAssoc(vec *Vector, idx int, val Value) (*Vector, error) {
+	n := len(vec.Elements)
+	if idx < 0 || idx > n {
+		return nil, NewError(ArgumentErrorKey, "Vector index out of range")
+	}
+	el := make([]Value, n, n+1)
+	copy(el, vec.Elements)
+	if idx == n {
+		el = append(el, val)
+	} else {
+		el[idx] = val
+	}
+	return VectorFromElementsNoCopy(el), nil
+}
+
+// vectorRange - check that start and end are a valid range of indices of a vector of length n, where a negative
+// end means the end of the vector
+func vectorRange(name string, n int, start int, end int) (int, error) {
+	if end < 0 {
+		end = n
+	}
+	if start < 0 || start > end || end > n {
+		return 0, NewError(ArgumentErrorKey, name, " index range ", start, " to ", end, " out of range for a <vector> of length ", n)
+	}
+	return end, nil
+}
+
+// Subvector - a new vector of the elements of the vector from start up to, but not including, end. A negative end
+// means the end of the vector.
+func Subvector(vec *Vector, start int, end int) (*Vector, error) {
+	end, err := vectorRange("subvector", len(vec.Elements), start, end)
+	if err != nil {
+		return nil, err
+	}
+	return NewVector(vec.Elements[start:end]...), nil
+}
+
+// VectorFill - set the elements of the vector from start up to, but not including, end to the value. A negative
+// end means the end of the vector.
+func VectorFill(vec *Vector, val Value, start int, end int) error {
+	if err := checkMutable(vec, "vector-fill!"); err != nil {
+		return err
+	}
+	end, err := vectorRange("vector-fill!", len(vec.Elements), start, end)
+	if err != nil {
+		return err
+	}
+	for i := start; i < end; i++ {
+		vec.Elements[i] = val
+	}
+	return nil
+}
+
+// VectorAppend - a new vector of the elements of all the vectors, in order
+func VectorAppend(vecs ...*Vector) *Vector {
+	var el []Value
+	for _, vec := range vecs {
+		el = append(el, vec.Elements...)
+	}
+	return VectorFromElementsNoCopy(el)
+}
+
+// VectorCopy - copy the elements of the source vector from start up to, but not including, end into the target
+// vector, starting at the index at. The ranges may overlap. A negative end means the end of the source vector.
+func VectorCopy(to *Vector, at int, from *Vector, start int, end int) error {
+	if err := checkMutable(to, "vector-copy!"); err != nil {
+		return err
+	}
+	end, err := vectorRange("vector-copy!", len(from.Elements), start, end)
+	if err != nil {
+		return err
+	}
+	if _, err := vectorRange("vector-copy!", len(to.Elements), at, at+end-start); err != nil {
+		return err
+	}
+	copy(to.Elements[at:], from.Elements[start:end])
+	return nil
 }
 
 func IsVector(obj Value) bool {